@@ -3,106 +3,81 @@ package main
 
 import (
 	"fmt"
-	"jcron/modules/cron"
+	"jcron/modules/client"
 	"log"
-	"net"
-	"net/rpc/jsonrpc"
 	"time"
 )
 
 func main() {
 
-	client, err := net.Dial("tcp", "127.0.0.1:1234")
+	c, err := client.Dial("127.0.0.1:1234", &client.Options{Token: ""})
 	if err != nil {
-		log.Printf("dialing:", err)
+		log.Fatalf("dialing: %s", err)
 	}
-	// Synchronous call
-	var reply = 0
+	defer c.Close()
 	name1 := "php1"
 	//name2 := "http1"
-	c := jsonrpc.NewClient(client)
 
 	//获取任务实例列表
-	list := []*cron.RunInfo{}
-	err = c.Call("Calculator.GetJobInstance", name1, &list)
-	if err != nil {
-		log.Printf("arith error:", err)
-	}
-	fmt.Printf("GetJobInstance %s\n", name1)
-	for _, runInfo := range list {
-		fmt.Printf("Date : %s, ObjectId : %s\n", runInfo.Date, runInfo.ObjectId)
+	printInstance := func() {
+		list, err := c.GetJobInstance(name1)
+		if err != nil {
+			log.Printf("GetJobInstance error: %s", err)
+			return
+		}
+		fmt.Printf("GetJobInstance %s\n", name1)
+		for _, runInfo := range list {
+			fmt.Printf("Date : %s, ObjectId : %s\n", runInfo.Date, runInfo.ObjectId)
+		}
 	}
+	printInstance()
 
 	//停止任务
 	<-time.After(10 * time.Second)
 	fmt.Printf("stop job : %s\n", name1)
-	reply = 0
-	err = c.Call("Calculator.StopJob", name1, &reply)
-	if err != nil {
-		log.Printf("arith error:", err)
+	if err = c.StopJob(name1); err != nil {
+		log.Printf("StopJob error: %s", err)
 	}
 
 	//获取任务实例列表
 	<-time.After(10 * time.Second)
-	list = []*cron.RunInfo{}
-	err = c.Call("Calculator.GetJobInstance", name1, &list)
-	if err != nil {
-		log.Printf("arith error:", err)
-	}
-	fmt.Printf("GetJobInstance %s\n", name1)
-	for _, runInfo := range list {
-		fmt.Printf("Date : %s, ObjectId : %s\n", runInfo.Date, runInfo.ObjectId)
-	}
+	printInstance()
 
 	//启动任务，重新生成id
 	<-time.After(10 * time.Second)
-	reply = 0
-	err = c.Call("Calculator.StartJob", name1, &reply)
-	if err != nil {
-		log.Printf("arith error:", err)
+	if err = c.StartJob(name1); err != nil {
+		log.Printf("StartJob error: %s", err)
 	}
 	fmt.Printf("start job : %s\n", name1)
 
-	//获取任务实例列表
+	//获取任务实例列表，并杀死所有实例
 	<-time.After(10 * time.Second)
-	list = []*cron.RunInfo{}
-	err = c.Call("Calculator.GetJobInstance", name1, &list)
+	list, err := c.GetJobInstance(name1)
 	if err != nil {
-		log.Printf("arith error:", err)
+		log.Printf("GetJobInstance error: %s", err)
 	}
 	fmt.Printf("GetJobInstance %s\n", name1)
-	for pid, runInfo := range list {
+	for _, runInfo := range list {
 		fmt.Printf("Date : %s, ObjectId : %s\n", runInfo.Date, runInfo.ObjectId)
-		fmt.Printf("KillJobInstance %d\n", pid)
-		err = c.Call("Calculator.KillJobInstance", &cron.JobInstance{name1, runInfo.ObjectId}, &reply)
-		if err != nil {
-			log.Printf("arith error:", err)
+		fmt.Printf("KillJobInstance %s\n", runInfo.ObjectId)
+		if err = c.KillJobInstance(name1, runInfo.ObjectId); err != nil {
+			log.Printf("KillJobInstance error: %s", err)
 		}
 	}
 
 	//获取任务实例列表
 	<-time.After(10 * time.Second)
-	list = []*cron.RunInfo{}
-	err = c.Call("Calculator.GetJobInstance", name1, &list)
-	if err != nil {
-		log.Printf("arith error:", err)
-	}
-	fmt.Printf("GetJobInstance %s\n", name1)
-	for _, runInfo := range list {
-		fmt.Printf("Date : %s, ObjectId : %s\n", runInfo.Date, runInfo.ObjectId)
-	}
+	printInstance()
 
 	//获取任务列表
 	<-time.After(10 * time.Second)
 	fmt.Printf("GetJobList \n")
-	var flag = true
-	jobList := []*cron.JobList{}
-	err = c.Call("Calculator.GetJobList", flag, &jobList)
+	jobList, err := c.GetJobList()
 	if err != nil {
-		log.Printf("arith error:", err)
+		log.Printf("GetJobList error: %s", err)
 	}
 	for _, job := range jobList {
-		log.Printf("job name : %s, job count : %d", job.Name, len(job.RunInstance))
+		log.Printf("job name : %s, job count : %d, next : %s", job.Name, len(job.RunInstance), job.Next)
 	}
 
 	<-time.After(10 * time.Second)
@@ -0,0 +1,575 @@
+// jcronagent 调度系统worker agent，向调度程序注册后接收运行请求，在本机执行php任务并把输出和结果发回
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"jcron/modules/api"
+	"jcron/modules/client"
+	"jcron/modules/proc"
+	"log"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 心跳间隔，调度程序15秒没有收到心跳视为失联
+const heartbeatInterval = 5 * time.Second
+
+// 运行结果发送失败时的重试次数
+const exitRetry = 3
+
+// 每个实例等待发回的最大输出字节数，调度节点响应慢时超出的输出丢弃
+const maxPendingOutput = 1 << 20
+
+var (
+	schedulers = flag.String("scheduler", env("JCRON_ADDR", "127.0.0.1:1234"), "scheduler jsonrpc addresses separated by comma, env JCRON_ADDR")
+	listen     = flag.String("listen", ":1240", "agent jsonrpc listen address")
+	advertise  = flag.String("addr", "", "address the scheduler uses to reach this agent, default hostname with the listen port")
+	name       = flag.String("name", "", "agent name, default hostname")
+	labels     = flag.String("labels", "", "labels matched against job Labels, e.g. zone=a,php=7")
+	capacity   = flag.Int("capacity", runtime.NumCPU(), "max number of concurrent runs")
+	token      = flag.String("token", os.Getenv("JCRON_TOKEN"), "api token of an agent user, env JCRON_TOKEN")
+	useTLS     = flag.Bool("tls", false, "connect to the scheduler with tls")
+	caFile     = flag.String("ca", "", "ca certificate to verify the scheduler")
+	certFile   = flag.String("cert", "", "certificate of the agent listener, enable tls when set")
+	keyFile    = flag.String("key", "", "private key of the agent listener")
+	clientCa   = flag.String("client-ca", "", "ca certificate to verify the scheduler client certificate, require it when set")
+	root       = flag.String("root", "", "only run executables under this directory")
+	allow      = flag.String("allow", "", "executables allowed to run separated by comma")
+)
+
+func env(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+// 一个调度节点的连接
+type scheduler struct {
+	addr   string
+	lock   sync.Mutex
+	client *client.Client
+	node   string // 注册时调度节点返回的名称
+}
+
+// agent状态
+type Agent struct {
+	info       api.AgentInfo
+	opt        *client.Options
+	schedulers []*scheduler
+	lock       sync.Mutex
+	procs      map[string]*os.Process // 正在运行的实例，启动前为nil占用运行位置
+	root       string                 // 允许运行的执行文件目录
+	allow      map[string]bool        // 允许运行的执行文件
+}
+
+/**
+ * 调用调度节点接口，未连接或调用出错时重新连接
+ */
+func (s *scheduler) call(opt *client.Options, method string, args interface{}, reply interface{}) error {
+	s.lock.Lock()
+	c := s.client
+	s.lock.Unlock()
+	if c == nil {
+		var err error
+		c, err = client.Dial(s.addr, opt)
+		if err != nil {
+			return err
+		}
+		s.lock.Lock()
+		if s.client != nil {
+			c.Close()
+			c = s.client
+		} else {
+			s.client = c
+		}
+		s.lock.Unlock()
+	}
+	err := c.Call(method, args, reply)
+	// 接口返回的错误不需要重新连接，调度程序平滑重启后重新连接到新进程
+	if _, ok := err.(rpc.ServerError); err != nil && (!ok || err.Error() == api.ErrHandedOver) {
+		s.lock.Lock()
+		if s.client == c {
+			s.client = nil
+		}
+		s.lock.Unlock()
+		c.Close()
+	}
+	return err
+}
+
+/**
+ * 按节点名称查找调度节点
+ */
+func (a *Agent) scheduler(node string) *scheduler {
+	for _, s := range a.schedulers {
+		s.lock.Lock()
+		found := s.node == node
+		s.lock.Unlock()
+		if found {
+			return s
+		}
+	}
+	return nil
+}
+
+/**
+ * 向所有调度节点注册，作为心跳定期调用
+ */
+func (a *Agent) register() {
+	a.lock.Lock()
+	info := a.info
+	info.Running = []string{}
+	for objectId := range a.procs {
+		info.Running = append(info.Running, objectId)
+	}
+	a.lock.Unlock()
+	for _, s := range a.schedulers {
+		var node string
+		if err := s.call(a.opt, "RegisterAgent", &info, &node); err != nil {
+			log.Printf("RegisterAgent %s error: %s\n", s.addr, err)
+			continue
+		}
+		s.lock.Lock()
+		if s.node != node {
+			log.Printf("Registered to %s (%s)\n", node, s.addr)
+		}
+		s.node = node
+		s.lock.Unlock()
+	}
+}
+
+/**
+ * 实例输出的发送队列，写入时只加入队列，由发送协程按顺序发回调度节点，调度节点响应慢时不阻塞进程的输出
+ */
+type outputQueue struct {
+	agent    *Agent
+	s        *scheduler
+	objectId string
+	lock     sync.Mutex
+	pending  []*api.AgentOutput
+	size     int           // 队列中的字节数
+	dropped  int           // 队列已满时丢弃的字节数
+	notify   chan struct{} // 有新输出或关闭
+	closed   bool
+	done     chan struct{} // 发送协程退出
+}
+
+func newOutputQueue(a *Agent, s *scheduler, objectId string) *outputQueue {
+	q := &outputQueue{agent: a, s: s, objectId: objectId, notify: make(chan struct{}, 1), done: make(chan struct{})}
+	go q.loop()
+	return q
+}
+
+// 加入队列，和上一段输出类型相同时合并
+func (q *outputQueue) push(fromType int, p []byte) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return
+	}
+	if q.size+len(p) > maxPendingOutput {
+		q.dropped += len(p)
+		return
+	}
+	if n := len(q.pending); n > 0 && q.pending[n-1].FromType == fromType {
+		q.pending[n-1].Content += string(p)
+	} else {
+		q.pending = append(q.pending, &api.AgentOutput{Agent: q.agent.info.Name, ObjectId: q.objectId, FromType: fromType, Content: string(p)})
+	}
+	q.size += len(p)
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// 发送协程，关闭后发完队列中的输出再退出
+func (q *outputQueue) loop() {
+	defer close(q.done)
+	for range q.notify {
+		q.lock.Lock()
+		pending, dropped, closed := q.pending, q.dropped, q.closed
+		q.pending, q.size, q.dropped = nil, 0, 0
+		q.lock.Unlock()
+		if dropped > 0 {
+			pending = append(pending, &api.AgentOutput{Agent: q.agent.info.Name, ObjectId: q.objectId, FromType: 1,
+				Content: fmt.Sprintf("%d bytes of output dropped, scheduler is too slow\n", dropped)})
+		}
+		for _, args := range pending {
+			q.send(args)
+		}
+		if closed {
+			return
+		}
+	}
+}
+
+func (q *outputQueue) send(args *api.AgentOutput) {
+	var reply int
+	err := q.s.call(q.agent.opt, "AgentOutput", args, &reply)
+	// 调度程序平滑重启时发给新进程
+	if err != nil && err.Error() == api.ErrHandedOver {
+		err = q.s.call(q.agent.opt, "AgentOutput", args, &reply)
+	}
+	if err != nil {
+		log.Printf("AgentOutput %s error: %s\n", q.objectId, err)
+	}
+}
+
+// 关闭队列，等待已写入的输出发送完成，在发回运行结果之前调用
+func (q *outputQueue) close() {
+	q.lock.Lock()
+	if !q.closed {
+		q.closed = true
+		select {
+		case q.notify <- struct{}{}:
+		default:
+		}
+	}
+	q.lock.Unlock()
+	<-q.done
+}
+
+// 进程的标准输出或错误输出
+type output struct {
+	queue    *outputQueue
+	fromType int
+}
+
+func (o *output) Write(p []byte) (int, error) {
+	o.queue.push(o.fromType, p)
+	return len(p), nil
+}
+
+// 校验调度程序下发请求时携带的令牌
+func (a *Agent) checkToken(token string) error {
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.info.Token)) != 1 {
+		return errors.New("invalid token")
+	}
+	return nil
+}
+
+/**
+ * 校验执行文件，只允许运行-allow中的文件或者-root目录下的文件，符号链接按实际路径校验
+ */
+func (a *Agent) checkPath(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		return "", errors.New("path must be absolute: " + path)
+	}
+	path = filepath.Clean(path)
+	if a.allow[path] {
+		return path, nil
+	}
+	if a.root != "" {
+		real, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return "", err
+		}
+		if rel, err := filepath.Rel(a.root, real); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return real, nil
+		}
+	}
+	return "", errors.New("path not allowed: " + path)
+}
+
+// agent的jsonrpc接口
+type Service struct {
+	agent *Agent
+}
+
+/**
+ * jsonrpc接口，运行一个实例，返回进程id
+ */
+func (t *Service) Run(req *api.RunRequest, reply *int) error {
+	a := t.agent
+	if err := a.checkToken(req.Token); err != nil {
+		return err
+	}
+	s := a.scheduler(req.Node)
+	if s == nil {
+		return errors.New("not registered to " + req.Node)
+	}
+	path, err := a.checkPath(req.Path)
+	if err != nil {
+		return err
+	}
+	// 检查容量的同时占用运行位置，并发的请求不会超出容量
+	a.lock.Lock()
+	if _, ok := a.procs[req.ObjectId]; ok {
+		a.lock.Unlock()
+		return errors.New("run " + req.ObjectId + " is already running")
+	}
+	if len(a.procs) >= a.info.Capacity {
+		a.lock.Unlock()
+		return errors.New("agent is full")
+	}
+	a.procs[req.ObjectId] = nil
+	a.lock.Unlock()
+
+	queue := newOutputQueue(a, s, req.ObjectId)
+	args := append([]string{"-c", req.Ini}, req.Args...)
+	cmd := exec.Command(path, args...)
+	cmd.Dir = req.Pwd
+	cmd.Stdout = &output{queue, 0}
+	cmd.Stderr = &output{queue, 1}
+	cmd.Stdout.Write([]byte("start running on " + a.info.Name + " \n"))
+	if err := cmd.Start(); err != nil {
+		a.lock.Lock()
+		delete(a.procs, req.ObjectId)
+		a.lock.Unlock()
+		queue.close()
+		return err
+	}
+	a.lock.Lock()
+	a.procs[req.ObjectId] = cmd.Process
+	a.lock.Unlock()
+	log.Printf("%s is running, objectid is %s, pid is %d\n", req.JobName, req.ObjectId, cmd.Process.Pid)
+
+	go func() {
+		err := cmd.Wait()
+		a.lock.Lock()
+		delete(a.procs, req.ObjectId)
+		a.lock.Unlock()
+		exit := &api.AgentExit{Agent: a.info.Name, ObjectId: req.ObjectId, Success: err == nil}
+		if err != nil {
+			exit.Error = err.Error()
+		} else {
+			cmd.Stdout.Write([]byte("finished !\n"))
+		}
+		// 输出发完后再发回结果，调度节点收到结果后不再接收输出
+		queue.close()
+		for i := 0; i < exitRetry; i++ {
+			var reply int
+			err = s.call(a.opt, "AgentExit", exit, &reply)
+			if err == nil || strings.HasPrefix(err.Error(), "unknown run") {
+				break
+			}
+			log.Printf("AgentExit %s error: %s\n", req.ObjectId, err)
+			time.Sleep(time.Second)
+		}
+	}()
+	*reply = cmd.Process.Pid
+	return nil
+}
+
+/**
+ * jsonrpc接口，杀死实例
+ */
+func (t *Service) Kill(req *api.KillRequest, reply *int) error {
+	a := t.agent
+	if err := a.checkToken(req.Token); err != nil {
+		return err
+	}
+	a.lock.Lock()
+	process, ok := a.procs[req.ObjectId]
+	a.lock.Unlock()
+	if !ok {
+		return errors.New("run " + req.ObjectId + " not found")
+	}
+	if process == nil {
+		return errors.New("run " + req.ObjectId + " is starting")
+	}
+	log.Printf("Kill objectid : %s, pid : %d\n", req.ObjectId, process.Pid)
+	//先杀死子进程，再杀死进程本身
+	proc.KillGroup(process.Pid)
+	return process.Kill()
+}
+
+// 解析标签，格式为k=v,k2=v2
+func parseLabels(s string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, errors.New("invalid label " + item + ", want key=value")
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels, nil
+}
+
+// 每次启动随机生成令牌，调度程序据此判断agent是否重启
+func newToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func newAgent() (*Agent, error) {
+	agentName := *name
+	if agentName == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		agentName = host
+	}
+	addr := *advertise
+	if addr == "" {
+		_, port, err := net.SplitHostPort(*listen)
+		if err != nil {
+			return nil, err
+		}
+		addr = net.JoinHostPort(agentName, port)
+	}
+	agentLabels, err := parseLabels(*labels)
+	if err != nil {
+		return nil, err
+	}
+	if *capacity < 1 {
+		return nil, errors.New("capacity must greater than zero")
+	}
+
+	opt := &client.Options{Token: *token}
+	if *useTLS || *caFile != "" {
+		config := &tls.Config{}
+		if *caFile != "" {
+			ca, err := ioutil.ReadFile(*caFile)
+			if err != nil {
+				return nil, err
+			}
+			config.RootCAs = x509.NewCertPool()
+			if !config.RootCAs.AppendCertsFromPEM(ca) {
+				return nil, errors.New("no certificate found in " + *caFile)
+			}
+		}
+		opt.TLS = config
+	}
+
+	allowed := map[string]bool{}
+	for _, path := range strings.Split(*allow, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		if !filepath.IsAbs(path) {
+			return nil, errors.New("allow path must be absolute: " + path)
+		}
+		allowed[filepath.Clean(path)] = true
+	}
+	rootDir := *root
+	if rootDir != "" {
+		if rootDir, err = filepath.Abs(rootDir); err == nil {
+			rootDir, err = filepath.EvalSymlinks(rootDir)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(allowed) == 0 && rootDir == "" {
+		return nil, errors.New("allow or root must be set")
+	}
+
+	a := &Agent{
+		info: api.AgentInfo{
+			Name:     agentName,
+			Addr:     addr,
+			Labels:   agentLabels,
+			Capacity: *capacity,
+			Token:    newToken(),
+		},
+		opt:   opt,
+		procs: map[string]*os.Process{},
+		root:  rootDir,
+		allow: allowed,
+	}
+	for _, schedulerAddr := range strings.Split(*schedulers, ",") {
+		if schedulerAddr = strings.TrimSpace(schedulerAddr); schedulerAddr != "" {
+			a.schedulers = append(a.schedulers, &scheduler{addr: schedulerAddr})
+		}
+	}
+	if len(a.schedulers) == 0 {
+		return nil, errors.New("scheduler must not be empty")
+	}
+	return a, nil
+}
+
+// 配置了证书时返回agent监听的tls配置，配置了-client-ca时要求调度程序提供客户端证书，否则返回nil
+func listenTLSConfig() (*tls.Config, error) {
+	if *certFile == "" && *keyFile == "" && *clientCa == "" {
+		return nil, nil
+	}
+	if *certFile == "" || *keyFile == "" {
+		return nil, errors.New("cert and key must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if *clientCa != "" {
+		ca, err := ioutil.ReadFile(*clientCa)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no certificate found in " + *clientCa)
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+func main() {
+	flag.Parse()
+	var config *tls.Config
+	a, err := newAgent()
+	if err == nil {
+		config, err = listenTLSConfig()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "jcronagent: %s\n", err)
+		os.Exit(2)
+	}
+
+	server := rpc.NewServer()
+	server.RegisterName("Agent", &Service{a})
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatal("listen error: ", err)
+	}
+	if config != nil {
+		listener = tls.NewListener(listener, config)
+	} else {
+		//令牌明文传输，没有开启tls时只应监听本机或内网地址
+		log.Printf("Warning: agent listener is not using tls, token is sent in cleartext\n")
+	}
+	log.Printf("Agent %s listening on %s, capacity %d\n", a.info.Name, *listen, a.info.Capacity)
+
+	go func() {
+		a.register()
+		for range time.Tick(heartbeatInterval) {
+			a.register()
+		}
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("accept error: %s\n", err)
+			continue
+		}
+		go server.ServeCodec(jsonrpc.NewServerCodec(conn))
+	}
+}
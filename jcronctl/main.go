@@ -0,0 +1,573 @@
+// jcronctl 调度系统命令行工具
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"jcron/modules/api"
+	"jcron/modules/client"
+	"jcron/modules/cron"
+	"jcron/modules/jobfile"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage: jcronctl [flags] <command> [args]
+
+Commands:
+  jobs                        list scheduled jobs with next run
+  start <name>                start a job
+  stop <name> [mode] [timeout]
+                              stop a job, mode detach (default) keeps instances running,
+                              drain waits up to timeout seconds for them, kill kills them
+  pause <name>                pause a job, it stays scheduled but does not fire
+  resume [-misfire] <name>    resume a paused job, -misfire applies the job's misfire policy
+                              to the fires missed while paused
+  run <name> [param...]       run a job once with params
+  instances <name>            list running instances of a job
+  kill <name> <objectid>      kill a running instance
+  runs <name>                 list recent runs of a job
+  tail [-f] [-now] <name> <objectid>
+                              print the output of a run, -f follows until it finishes,
+                              -now starts from the current output instead of the beginning
+  cron <expr>                 validate a cron expression and print next fire times
+  check <dir>                 parse job definition files locally without connecting
+  diff                        show what syncing the server's job definition files would change
+  sync                        sync the server's job definition files
+  reconcile                   reconcile stored job status with scheduled jobs now
+  leader                      show which node is the leader and runs the scheduler
+  agents                      list registered worker agents
+  maintenance [start|end] [-until until] [-reason reason] [category]
+                              list maintenance pauses, start or end one, an empty category
+                              pauses all jobs, until is a duration or a time to resume
+
+Flags:
+`
+
+// 时间输出格式
+const timeFormat = "2006-01-02 15:04:05"
+
+var (
+	addr     = flag.String("addr", env("JCRON_ADDR", "127.0.0.1:1234"), "jsonrpc address, env JCRON_ADDR")
+	token    = flag.String("token", os.Getenv("JCRON_TOKEN"), "api token, env JCRON_TOKEN")
+	user     = flag.String("user", os.Getenv("JCRON_USER"), "user for hmac login, env JCRON_USER")
+	secret   = flag.String("secret", os.Getenv("JCRON_SECRET"), "secret for hmac login, env JCRON_SECRET")
+	useTLS   = flag.Bool("tls", false, "connect with tls")
+	caFile   = flag.String("ca", "", "ca certificate to verify the server")
+	certFile = flag.String("cert", "", "client certificate")
+	keyFile  = flag.String("key", "", "client certificate key")
+	jsonOut  = flag.Bool("json", false, "print json instead of table")
+	count    = flag.Int("n", 20, "number of runs or fire times to print")
+)
+
+func env(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(args[0], args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "jcronctl: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+/**
+ * 执行子命令
+ */
+func run(command string, args []string) error {
+	// 校验cron表达式不需要连接服务端
+	if command == "cron" {
+		return cronCheck(args)
+	}
+	if command == "check" {
+		return check(args)
+	}
+
+	need := map[string]int{"jobs": 0, "start": 1, "stop": 1, "pause": 1, "resume": 1, "run": 1, "instances": 1, "kill": 2, "runs": 1, "tail": 0, "diff": 0, "sync": 0, "reconcile": 0, "leader": 0, "agents": 0, "maintenance": 0}
+	n, ok := need[command]
+	if !ok {
+		return errors.New("unknown command " + command)
+	}
+	if len(args) < n {
+		return fmt.Errorf("%s needs %d argument(s)", command, n)
+	}
+
+	c, err := connect()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	switch command {
+	case "jobs":
+		return jobs(c)
+	case "start":
+		return done(c.StartJob(args[0]), "started "+args[0])
+	case "stop":
+		return stop(c, args)
+	case "pause":
+		return done(c.PauseJob(args[0]), "paused "+args[0])
+	case "resume":
+		return resume(c, args)
+	case "run":
+		return done(c.RunOnceJob(args[0], args[1:]), "triggered "+args[0])
+	case "instances":
+		return instances(c, args[0])
+	case "kill":
+		return done(c.KillJobInstance(args[0], args[1]), "killed "+args[1])
+	case "runs":
+		return runs(c, args[0])
+	case "tail":
+		return tail(c, args)
+	case "diff":
+		return syncJobFile(c, true)
+	case "sync":
+		return syncJobFile(c, false)
+	case "reconcile":
+		return reconcile(c)
+	case "leader":
+		return leader(c)
+	case "agents":
+		return agents(c)
+	case "maintenance":
+		return maintenance(c, args)
+	}
+	return nil
+}
+
+/**
+ * 连接服务端
+ */
+func connect() (*client.Client, error) {
+	opt := &client.Options{Token: *token, User: *user, Secret: *secret}
+	if *useTLS || *caFile != "" || *certFile != "" {
+		config := &tls.Config{}
+		if *caFile != "" {
+			ca, err := ioutil.ReadFile(*caFile)
+			if err != nil {
+				return nil, err
+			}
+			config.RootCAs = x509.NewCertPool()
+			if !config.RootCAs.AppendCertsFromPEM(ca) {
+				return nil, errors.New("no certificate found in " + *caFile)
+			}
+		}
+		if *certFile != "" {
+			cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+			if err != nil {
+				return nil, err
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+		if host := strings.Split(*addr, ":")[0]; host != "" {
+			config.ServerName = host
+		}
+		opt.TLS = config
+	}
+	return client.Dial(*addr, opt)
+}
+
+// 输出操作结果
+func done(err error, msg string) error {
+	if err != nil {
+		return err
+	}
+	if *jsonOut {
+		return printJSON(map[string]string{"result": msg})
+	}
+	fmt.Println(msg)
+	return nil
+}
+
+// 停止job，指定了处理方式时使用StopJobWithMode
+func stop(c *client.Client, args []string) error {
+	if len(args) == 1 {
+		return done(c.StopJob(args[0]), "stopped "+args[0])
+	}
+	timeout := 0
+	if len(args) > 2 {
+		var err error
+		if timeout, err = strconv.Atoi(args[2]); err != nil {
+			return errors.New("timeout must be seconds")
+		}
+	}
+	return done(c.StopJobWithMode(args[0], args[1], timeout), "stopped "+args[0]+" ("+args[1]+")")
+}
+
+// 恢复暂停的job
+func resume(c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("resume", flag.ContinueOnError)
+	misfire := fs.Bool("misfire", false, "apply the job's misfire policy to the fires missed while paused")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return errors.New("resume needs <name>")
+	}
+	return done(c.ResumeJob(fs.Arg(0), *misfire), "resumed "+fs.Arg(0))
+}
+
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(timeFormat)
+}
+
+// 运行结果名称
+func resultName(result int) string {
+	switch result {
+	case api.ResultRunning:
+		return "running"
+	case api.ResultSuccess:
+		return "success"
+	case api.ResultFailed:
+		return "failed"
+	case api.ResultLost:
+		return "lost"
+	case api.ResultInterrupted:
+		return "interrupted"
+	case api.ResultAbandoned:
+		return "abandoned"
+	case api.ResultSkipped:
+		return "skipped"
+	}
+	return fmt.Sprintf("%d", result)
+}
+
+func jobs(c *client.Client) error {
+	list, err := c.GetJobList()
+	if err != nil {
+		return err
+	}
+	if *jsonOut {
+		return printJSON(list)
+	}
+	w := newTable()
+	fmt.Fprintln(w, "NAME\tCRON\tSTATUS\tINSTANCES\tPREV\tNEXT")
+	for _, job := range list {
+		status := "scheduled"
+		if job.Paused {
+			status = "paused"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", job.Name, job.Cron, status, len(job.RunInstance), formatTime(job.Prev), formatTime(job.Next))
+	}
+	return w.Flush()
+}
+
+func instances(c *client.Client, name string) error {
+	list, err := c.GetJobInstance(name)
+	if err != nil {
+		return err
+	}
+	if *jsonOut {
+		return printJSON(list)
+	}
+	w := newTable()
+	fmt.Fprintln(w, "OBJECTID\tPID\tAGENT\tSTARTED")
+	for _, run := range list {
+		pid := "-"
+		if run.Proc != nil {
+			pid = fmt.Sprintf("%d", run.Proc.Pid)
+		}
+		agent := run.Agent
+		if agent == "" {
+			agent = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", run.ObjectId, pid, agent, formatTime(run.Date))
+	}
+	return w.Flush()
+}
+
+func runs(c *client.Client, name string) error {
+	page, err := c.GetJobRun(&api.RunQuery{Name: name, Limit: *count})
+	if err != nil {
+		return err
+	}
+	if *jsonOut {
+		return printJSON(page)
+	}
+	w := newTable()
+	fmt.Fprintln(w, "OBJECTID\tTRIGGER\tRESULT\tPID\tSTARTED\tDURATION")
+	for _, record := range page.List {
+		duration := "-"
+		if record.Result != api.ResultRunning {
+			duration = record.EndTime.Sub(record.StartTime).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", record.Id.Hex(), record.Trigger, resultName(record.Result), record.Pid, formatTime(record.StartTime), duration)
+	}
+	return w.Flush()
+}
+
+/**
+ * 输出一次运行的日志，-f时持续输出直到运行结束
+ */
+func tail(c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ContinueOnError)
+	follow := fs.Bool("f", false, "follow until the run finishes")
+	now := fs.Bool("now", false, "start from the current output")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		return errors.New("tail needs <name> <objectid>")
+	}
+	followArgs := &api.FollowArgs{JobName: fs.Arg(0), ObjectId: fs.Arg(1), Wait: -1}
+	if *now {
+		followArgs.Offset = -1
+	}
+	if *follow {
+		followArgs.Wait = 0
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	for {
+		reply, err := c.FollowJobRun(followArgs)
+		if err != nil {
+			return err
+		}
+		for _, item := range reply.Items {
+			if *jsonOut {
+				encoder.Encode(item)
+				continue
+			}
+			out := os.Stdout
+			if item.FromType == 1 {
+				out = os.Stderr
+			}
+			fmt.Fprint(out, item.Content)
+		}
+		followArgs.Offset = reply.Offset
+		if !*follow || reply.Finished {
+			return nil
+		}
+	}
+}
+
+/**
+ * 校验cron表达式，输出之后的执行时间
+ */
+func cronCheck(args []string) error {
+	if len(args) == 0 {
+		return errors.New("cron needs an expression")
+	}
+	schedule, err := cron.Parse(strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+	times := []time.Time{}
+	next := time.Now()
+	for i := 0; i < *count; i++ {
+		next = schedule.Next(next)
+		if next.IsZero() {
+			break
+		}
+		times = append(times, next)
+	}
+	if *jsonOut {
+		return printJSON(times)
+	}
+	for _, t := range times {
+		fmt.Println(formatTime(t))
+	}
+	return nil
+}
+
+/**
+ * 同步服务端的job定义文件，dryRun时只输出变更
+ */
+func syncJobFile(c *client.Client, dryRun bool) error {
+	changes, err := c.SyncJobFile(dryRun)
+	if err != nil {
+		return err
+	}
+	if *jsonOut {
+		return printJSON(changes)
+	}
+	if len(changes) == 0 {
+		fmt.Println("no changes")
+		return nil
+	}
+	for _, change := range changes {
+		fmt.Printf("%s %s\n", change.Action, change.Name)
+		for _, diff := range change.Diffs {
+			fmt.Printf("    %s: %v -> %v\n", diff.Field, diff.From, diff.To)
+		}
+		if change.Error != "" {
+			fmt.Printf("    error: %s\n", change.Error)
+		}
+	}
+	return nil
+}
+
+/**
+ * 输出已注册的agent
+ */
+func agents(c *client.Client) error {
+	list, err := c.GetAgents()
+	if err != nil {
+		return err
+	}
+	if *jsonOut {
+		return printJSON(list)
+	}
+	w := newTable()
+	fmt.Fprintln(w, "NAME\tADDR\tRUNNING\tLABELS\tLAST SEEN")
+	for _, info := range list {
+		labels := []string{}
+		for key, value := range info.Labels {
+			labels = append(labels, key+"="+value)
+		}
+		sort.Strings(labels)
+		fmt.Fprintf(w, "%s\t%s\t%d/%d\t%s\t%s\n", info.Name, info.Addr, len(info.Running), info.Capacity, strings.Join(labels, ","), formatTime(info.LastSeen))
+	}
+	return w.Flush()
+}
+
+/**
+ * 立即对账，输出不一致的job
+ */
+func reconcile(c *client.Client) error {
+	result, err := c.ReconcileNow()
+	if err != nil {
+		return err
+	}
+	if *jsonOut {
+		return printJSON(result)
+	}
+	fmt.Println(result)
+	return nil
+}
+
+/**
+ * 输出领导者选举状态
+ */
+func leader(c *client.Client) error {
+	status, err := c.GetLeader()
+	if err != nil {
+		return err
+	}
+	if *jsonOut {
+		return printJSON(status)
+	}
+	if !status.Enabled {
+		fmt.Println("leader election disabled, this node runs the scheduler")
+		return nil
+	}
+	role := "standby"
+	if status.Leader {
+		role = "leader"
+	}
+	fmt.Printf("node    %s (%s)\nleader  %s\ntoken   %d\nexpire  %s\n", status.Node, role, status.Holder, status.Token, status.Expire.Local().Format(timeFormat))
+	return nil
+}
+
+/**
+ * 在本地解析job定义文件，校验格式和cron表达式，服务端同步时还会做完整校验
+ */
+func check(args []string) error {
+	if len(args) == 0 {
+		return errors.New("check needs a directory")
+	}
+	jobList, err := jobfile.Load(args[0])
+	if err != nil {
+		return err
+	}
+	for _, jobData := range jobList {
+		if _, err := cron.Parse(jobData.Cron); err != nil {
+			return fmt.Errorf("%s: Cron is invalid: %s", jobData.Source, err)
+		}
+	}
+	if *jsonOut {
+		return printJSON(jobList)
+	}
+	for _, jobData := range jobList {
+		fmt.Printf("%s\t%s\t%s\n", jobData.Name, jobData.Cron, strings.TrimPrefix(jobData.Source, jobfile.SourcePrefix))
+	}
+	return nil
+}
+
+/**
+ * 查询、开始、结束维护暂停
+ */
+func maintenance(c *client.Client, args []string) error {
+	if len(args) == 0 {
+		list, err := c.GetMaintenance()
+		if err != nil {
+			return err
+		}
+		if *jsonOut {
+			return printJSON(list)
+		}
+		w := newTable()
+		fmt.Fprintln(w, "CATEGORY\tUSER\tSINCE\tUNTIL\tSKIPPED\tREASON")
+		for _, pause := range list {
+			category := pause.Category
+			if category == "" {
+				category = "*"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", category, pause.User, formatTime(pause.Since), formatTime(pause.Until), pause.Skipped, pause.Reason)
+		}
+		return w.Flush()
+	}
+
+	fs := flag.NewFlagSet("maintenance", flag.ContinueOnError)
+	until := fs.String("until", "", "resume automatically after a duration like 30m or at a time like \""+timeFormat+"\"")
+	reason := fs.String("reason", "", "reason of the maintenance")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	category := fs.Arg(0)
+	scope := "all jobs"
+	if category != "" {
+		scope = "category " + category
+	}
+	switch args[0] {
+	case "start":
+		maintenanceArgs := &api.MaintenanceArgs{Category: category, Reason: *reason}
+		if *until != "" {
+			if d, err := time.ParseDuration(*until); err == nil {
+				maintenanceArgs.Until = time.Now().Add(d)
+			} else if t, err := time.ParseInLocation(timeFormat, *until, time.Local); err == nil {
+				maintenanceArgs.Until = t
+			} else {
+				return errors.New("invalid until " + *until)
+			}
+		}
+		return done(c.StartMaintenance(maintenanceArgs), "paused "+scope)
+	case "end":
+		return done(c.EndMaintenance(category), "resumed "+scope)
+	}
+	return errors.New("unknown maintenance command " + args[0])
+}
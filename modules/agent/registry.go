@@ -0,0 +1,251 @@
+// worker agent注册表：记录agent的标签、容量和正在运行的实例，按运行位置限制选择agent
+package agent
+
+import (
+	"errors"
+	"jcron/modules/api"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 没有满足运行位置限制且有空闲容量的agent
+var ErrNoAgent = errors.New("no agent with free capacity matches the placement")
+
+// 一个agent的状态
+type agent struct {
+	info     api.AgentInfo
+	reserved int             // 已选择但还没有下发的运行位置
+	runs     map[string]bool // 已下发的实例
+}
+
+// 空闲容量
+func (a *agent) free() int {
+	return a.info.Capacity - a.reserved - len(a.runs)
+}
+
+// agent注册表，超过Timeout没有心跳的agent视为失联
+type Registry struct {
+	Timeout time.Duration
+
+	mu     sync.Mutex
+	agents map[string]*agent
+}
+
+/**
+ * 注册或心跳，Token变化时视为agent重启，返回重启前正在运行的实例
+ */
+func (r *Registry) Register(info *api.AgentInfo, now time.Time) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.agents == nil {
+		r.agents = map[string]*agent{}
+	}
+	lost := []string{}
+	a, ok := r.agents[info.Name]
+	if ok && a.info.Token != info.Token {
+		lost = a.runList()
+	}
+	if !ok || a.info.Token != info.Token {
+		a = &agent{runs: map[string]bool{}}
+		r.agents[info.Name] = a
+	}
+	a.info = *info
+	a.info.LastSeen = now
+	return lost
+}
+
+// 已下发的实例，按id排序
+func (a *agent) runList() []string {
+	runs := []string{}
+	for objectId := range a.runs {
+		runs = append(runs, objectId)
+	}
+	sort.Strings(runs)
+	return runs
+}
+
+/**
+ * 判断agent是否满足运行位置限制
+ */
+func Match(info *api.AgentInfo, placement *api.Placement) bool {
+	if placement == nil {
+		return true
+	}
+	if len(placement.Hosts) > 0 {
+		found := false
+		for _, host := range placement.Hosts {
+			if host == info.Name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for key, value := range placement.Labels {
+		if info.Labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+/**
+ * 选择满足运行位置限制、空闲容量最多的agent并占用一个运行位置，之后需要调用Attach或Cancel
+ */
+func (r *Registry) Pick(placement *api.Placement) (*api.AgentInfo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var best *agent
+	for _, a := range r.agents {
+		if a.free() <= 0 || !Match(&a.info, placement) {
+			continue
+		}
+		if best == nil || a.free() > best.free() || (a.free() == best.free() && a.info.Name < best.info.Name) {
+			best = a
+		}
+	}
+	if best == nil {
+		return nil, ErrNoAgent
+	}
+	best.reserved++
+	info := best.info
+	return &info, nil
+}
+
+/**
+ * 把占用的运行位置关联到实例，agent已失联时返回false
+ */
+func (r *Registry) Attach(name, objectId string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	a, ok := r.agents[name]
+	if !ok {
+		return false
+	}
+	if a.reserved > 0 {
+		a.reserved--
+	}
+	a.runs[objectId] = true
+	return true
+}
+
+/**
+ * 释放没有下发成功的运行位置
+ */
+func (r *Registry) Cancel(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if a, ok := r.agents[name]; ok && a.reserved > 0 {
+		a.reserved--
+	}
+}
+
+/**
+ * 实例结束，释放运行位置，实例不存在时返回false
+ */
+func (r *Registry) Done(name, objectId string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	a, ok := r.agents[name]
+	if !ok || !a.runs[objectId] {
+		return false
+	}
+	delete(a.runs, objectId)
+	return true
+}
+
+/**
+ * 移除超时没有心跳的agent，返回失联的agent和它们正在运行的实例
+ */
+func (r *Registry) Expire(now time.Time) map[string][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	lost := map[string][]string{}
+	for name, a := range r.agents {
+		if now.Sub(a.info.LastSeen) <= r.Timeout {
+			continue
+		}
+		lost[name] = a.runList()
+		delete(r.agents, name)
+	}
+	return lost
+}
+
+/**
+ * 获取agent信息，不存在时返回nil
+ */
+func (r *Registry) Get(name string) *api.AgentInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	a, ok := r.agents[name]
+	if !ok {
+		return nil
+	}
+	info := a.info
+	return &info
+}
+
+/**
+ * 所有agent，按名称排序，Running为调度程序下发的实例，不返回Token
+ */
+func (r *Registry) List() []*api.AgentInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := []*api.AgentInfo{}
+	for _, a := range r.agents {
+		info := a.info
+		info.Token = ""
+		info.Running = a.runList()
+		list = append(list, &info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+/**
+ * 已注册的agent数
+ */
+func (r *Registry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.agents)
+}
+
+/**
+ * 所有agent，包含Token，Running为调度程序下发的实例，平滑重启时交给新进程
+ */
+func (r *Registry) Export() []*api.AgentInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := []*api.AgentInfo{}
+	for _, a := range r.agents {
+		info := a.info
+		info.Running = a.runList()
+		list = append(list, &info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+/**
+ * 恢复旧进程交来的agent和已下发的实例，心跳时间按now计算
+ */
+func (r *Registry) Restore(list []*api.AgentInfo, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.agents == nil {
+		r.agents = map[string]*agent{}
+	}
+	for _, info := range list {
+		a := &agent{info: *info, runs: map[string]bool{}}
+		for _, objectId := range info.Running {
+			a.runs[objectId] = true
+		}
+		a.info.Running = nil
+		a.info.LastSeen = now
+		r.agents[info.Name] = a
+	}
+}
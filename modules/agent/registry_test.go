@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"jcron/modules/api"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMatch(t *testing.T) {
+	info := &api.AgentInfo{Name: "worker1", Labels: map[string]string{"zone": "a", "php": "7"}}
+	tests := []struct {
+		placement *api.Placement
+		want      bool
+	}{
+		{nil, true},
+		{&api.Placement{}, true},
+		{&api.Placement{Labels: map[string]string{"zone": "a"}}, true},
+		{&api.Placement{Labels: map[string]string{"zone": "b"}}, false},
+		{&api.Placement{Labels: map[string]string{"gpu": ""}}, true},
+		{&api.Placement{Labels: map[string]string{"gpu": "1"}}, false},
+		{&api.Placement{Hosts: []string{"worker2", "worker1"}}, true},
+		{&api.Placement{Hosts: []string{"worker2"}, Labels: map[string]string{"zone": "a"}}, false},
+	}
+	for _, test := range tests {
+		if got := Match(info, test.placement); got != test.want {
+			t.Errorf("Match(%+v) = %v, want %v", test.placement, got, test.want)
+		}
+	}
+}
+
+func TestPick(t *testing.T) {
+	r := &Registry{Timeout: 10 * time.Second}
+	now := time.Now()
+	r.Register(&api.AgentInfo{Name: "a", Capacity: 1, Labels: map[string]string{"zone": "x"}}, now)
+	r.Register(&api.AgentInfo{Name: "b", Capacity: 2}, now)
+
+	// 空闲容量最多的优先
+	info, err := r.Pick(nil)
+	if err != nil || info.Name != "b" {
+		t.Fatalf("Pick = %v, %v, want b", info, err)
+	}
+	r.Attach("b", "run1")
+	info, err = r.Pick(nil)
+	if err != nil || info.Name != "a" {
+		t.Fatalf("Pick = %v, %v, want a", info, err)
+	}
+	r.Cancel("a")
+
+	zone := &api.Placement{Labels: map[string]string{"zone": "x"}}
+	info, err = r.Pick(zone)
+	if err != nil || info.Name != "a" {
+		t.Fatalf("Pick zone = %v, %v, want a", info, err)
+	}
+	r.Attach("a", "run2")
+	if _, err := r.Pick(zone); err != ErrNoAgent {
+		t.Errorf("expected ErrNoAgent, got %v", err)
+	}
+
+	if !r.Done("a", "run2") || r.Done("a", "run2") {
+		t.Error("Done should release a run only once")
+	}
+	if _, err := r.Pick(zone); err != nil {
+		t.Errorf("expected free capacity after Done, got %v", err)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	r := &Registry{Timeout: 10 * time.Second}
+	now := time.Now()
+	r.Register(&api.AgentInfo{Name: "a", Capacity: 2, Token: "t1"}, now)
+	r.Register(&api.AgentInfo{Name: "b", Capacity: 2}, now)
+	r.Pick(&api.Placement{Hosts: []string{"a"}})
+	r.Attach("a", "run1")
+
+	// b继续心跳，a失联
+	r.Register(&api.AgentInfo{Name: "b", Capacity: 2}, now.Add(8*time.Second))
+	lost := r.Expire(now.Add(15 * time.Second))
+	want := map[string][]string{"a": {"run1"}}
+	if !reflect.DeepEqual(lost, want) {
+		t.Errorf("Expire = %v, want %v", lost, want)
+	}
+	if r.Len() != 1 || r.Get("a") != nil {
+		t.Errorf("lost agent not removed: %v", r.List())
+	}
+
+	// 重启后Token变化，之前的实例视为丢失
+	r.Register(&api.AgentInfo{Name: "b", Capacity: 2, Token: "t1"}, now)
+	r.Pick(nil)
+	r.Attach("b", "run2")
+	lostRuns := r.Register(&api.AgentInfo{Name: "b", Capacity: 2, Token: "t2"}, now)
+	if !reflect.DeepEqual(lostRuns, []string{"run2"}) {
+		t.Errorf("Register after restart = %v, want [run2]", lostRuns)
+	}
+}
+
+func TestExportRestore(t *testing.T) {
+	r := &Registry{Timeout: 10 * time.Second}
+	now := time.Now()
+	r.Register(&api.AgentInfo{Name: "a", Addr: "a:1", Capacity: 2, Token: "t1"}, now)
+	r.Pick(nil)
+	r.Attach("a", "run1")
+
+	list := r.Export()
+	if len(list) != 1 || list[0].Token != "t1" || !reflect.DeepEqual(list[0].Running, []string{"run1"}) {
+		t.Fatalf("Export = %+v", list)
+	}
+
+	// 新进程恢复后实例继续占用运行位置，Token不变时心跳不会丢失实例
+	restored := &Registry{Timeout: 10 * time.Second}
+	later := now.Add(time.Minute)
+	restored.Restore(list, later)
+	if info := restored.Get("a"); info == nil || info.Token != "t1" || !info.LastSeen.Equal(later) {
+		t.Fatalf("restored agent = %+v", info)
+	}
+	if lost := restored.Register(&api.AgentInfo{Name: "a", Addr: "a:1", Capacity: 2, Token: "t1"}, later); len(lost) != 0 {
+		t.Errorf("heartbeat after restore lost %v", lost)
+	}
+	restored.Pick(nil)
+	restored.Attach("a", "run2")
+	if _, err := restored.Pick(nil); err != ErrNoAgent {
+		t.Errorf("restored run should hold capacity, got %v", err)
+	}
+	if !restored.Done("a", "run1") {
+		t.Error("restored run should be released by Done")
+	}
+}
@@ -0,0 +1,427 @@
+// 调度系统rpc和http接口的参数、返回值定义，服务端和客户端共用
+package api
+
+import (
+	"jcron/modules/cron"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// 运行结果
+const (
+	ResultRunning     = 0 // 运行中
+	ResultSuccess     = 1 // 正常
+	ResultFailed      = 2 // 异常
+	ResultLost        = 3 // 丢失，运行的agent失联
+	ResultInterrupted = 4 // 中断，调度程序重启时http请求被中断
+	ResultAbandoned   = 5 // 遗弃，调度程序退出时正在运行，重启后没有恢复
+	ResultSkipped     = 6 // 跳过，维护暂停或平滑重启期间到了执行时间
+)
+
+// 登录成功后的会话信息
+type Session struct {
+	User  string
+	Admin bool
+	Agent bool // agent用户，可以调用agent接口
+	Addr  string
+}
+
+// 登录参数，Token和Sign二选一
+type LoginArgs struct {
+	// 访问令牌
+	Token string
+	// 用户名
+	User string
+	// 签名时间戳，单位秒
+	Timestamp int64
+	// 随机数，签名有效期内不能重复使用
+	Nonce string
+	// hex(hmac-sha256(Secret, User + "\n" + Timestamp + "\n" + Nonce))
+	Sign string
+}
+
+// 操作日志集合
+type OperateLog struct {
+	//操作人
+	User string
+	//操作来源地址
+	Addr string
+	//操作时间
+	Time time.Time
+	//接口名称
+	Method string
+	//job名称
+	JobName string
+	//job实例id
+	ObjectId string `bson:",omitempty"`
+	//接口参数
+	Params interface{} `bson:",omitempty"`
+	//操作结果，0成功，-1失败
+	Result int
+	//失败原因
+	Error string `bson:",omitempty"`
+	//修改前的值
+	Before interface{} `bson:",omitempty"`
+	//修改后的值
+	After interface{} `bson:",omitempty"`
+}
+
+// 操作日志查询条件，为空的条件不过滤
+type OperateLogQuery struct {
+	JobName string
+	User    string
+	Start   time.Time
+	End     time.Time
+	Skip    int
+	Limit   int
+}
+
+// job配置版本集合，只新增不修改
+type JobRevision struct {
+	//job名称
+	Name string
+	//版本号，从1开始递增
+	Version int
+	//变更类型，import、create、update、delete、rollback
+	Action string
+	//该版本的job配置
+	Job cron.JobCollection
+	//操作人
+	User string
+	//操作时间
+	Time time.Time
+}
+
+// 版本对比参数，版本号为0时表示当前配置
+type RevisionDiffArgs struct {
+	Name string
+	From int
+	To   int
+}
+
+// 停止job时正在运行实例的处理方式
+const (
+	StopDetach = "detach" // 实例继续运行，仍可查看和杀死
+	StopDrain  = "drain"  // 等待实例结束，超时后返回错误，实例继续运行
+	StopKill   = "kill"   // 杀死所有实例
+)
+
+// 停止job参数
+type StopJobArgs struct {
+	Name string
+	//正在运行实例的处理方式，为空时为detach
+	Mode string
+	//drain等待的秒数，为0时等待60秒
+	Timeout int
+}
+
+// 恢复暂停的job参数
+type ResumeJobArgs struct {
+	Name string
+	//是否按job的Misfire设置处理暂停期间错过的执行，为false时直接跳过
+	Misfire bool
+}
+
+// 版本回滚参数
+type RollbackArgs struct {
+	Name    string
+	Version int
+}
+
+// 字段差异
+type FieldDiff struct {
+	Field string
+	From  interface{}
+	To    interface{}
+}
+
+// 运行记录查询条件
+type RunQuery struct {
+	//job名称
+	Name string
+	//开始时间范围
+	Start time.Time
+	End   time.Time
+	//运行结果，为空不过滤
+	Result *int
+	//触发方式，为空不过滤
+	Trigger string
+	Skip    int
+	Limit   int
+}
+
+// 运行记录分页结果，列表不包含日志内容
+type RunPage struct {
+	Total int
+	List  []*RunRecord
+}
+
+// 统计查询条件，Name和Category二选一，时间范围默认最近7天
+type StatQuery struct {
+	Name     string
+	Category string
+	Start    time.Time
+	End      time.Time
+}
+
+// 运行统计，耗时单位为秒，只统计已结束的运行记录
+type JobStat struct {
+	Name     string
+	Category string
+	//总次数
+	Total int
+	//正常次数
+	Success int
+	//异常次数
+	Failed int
+	//运行中次数
+	Running int
+	//维护暂停跳过的次数，不计入成功率
+	Skipped int
+	//成功率
+	SuccessRate float64
+	//耗时
+	P50 float64
+	P95 float64
+	Max float64
+	//当前连续失败次数
+	FailureStreak int
+	//最长连续失败次数
+	MaxFailureStreak int
+}
+
+// 运行日志
+type LogItem struct {
+	Time time.Time
+	//0正常输出，1错误输出
+	FromType int
+	Content  string
+}
+
+// 运行记录，和日志集合的文档结构一致
+type RunRecord struct {
+	Id        bson.ObjectId `bson:"_id"`
+	Name      string        // 任务名称
+	StartTime time.Time     // 开始时间
+	EndTime   time.Time     // 结束时间
+	Content   []LogItem     // 日志内容
+	Pid       int           // 实例进程id
+	Result    int           // 运行结果，0运行中，1正常，2异常，3丢失，4中断，5遗弃
+	Trigger   string        // 触发方式，cron定时触发，manual手动触发
+	Agent     string        // 运行的agent，为空时在调度程序所在主机运行
+}
+
+// cron表达式解析参数
+type CronArgs struct {
+	Cron string
+	//返回之后的执行时间个数，默认5个
+	Count int
+}
+
+// 跟踪实例输出参数
+type FollowArgs struct {
+	JobName  string
+	ObjectId string
+	//从第几条输出开始读取，0从头开始，-1从当前位置开始
+	Offset int
+	//没有新输出时最多等待的秒数，0为默认30秒，-1不等待
+	Wait int
+}
+
+// 跟踪实例输出结果
+type FollowReply struct {
+	Items []LogItem
+	//下次读取的Offset
+	Offset int
+	//实例是否已结束，结束后不需要再读取
+	Finished bool
+}
+
+// 错误日志处理状态
+const (
+	ErrLogUnread   = "unread"   // 未读
+	ErrLogAcked    = "acked"    // 已确认，不再重复告警
+	ErrLogResolved = "resolved" // 已解决
+)
+
+// 错误日志查询条件
+type ErrLogQuery struct {
+	//job名称，为空查询所有有查看权限的job
+	Name string
+	//处理状态，为空不过滤
+	Status string
+	//时间范围
+	Start time.Time
+	End   time.Time
+	Skip  int
+	Limit int
+}
+
+// 错误日志，同一次运行的多条错误输出只记录一次
+type ErrLog struct {
+	Name string
+	//最后一次错误输出时间
+	Time time.Time
+	//运行记录id
+	LogId string
+	//处理状态，unread、acked、resolved
+	Status string
+	//处理人
+	User string
+	//处理时间
+	StatusTime time.Time
+	//处理备注
+	Note string
+}
+
+// 确认或解决错误日志的参数，只指定Name时表示该job未读的错误日志（单次最多1000条），同时指定时只修改LogIds中属于该job的
+type ErrLogAckArgs struct {
+	LogIds []string
+	Name   string
+	//备注
+	Note string
+}
+
+// 同步job定义文件参数
+type SyncJobFileArgs struct {
+	//只返回变更，不执行
+	DryRun bool
+}
+
+// job定义文件同步的变更
+type JobChange struct {
+	Name string
+	//add、update、remove
+	Action string
+	//修改的字段
+	Diffs []*FieldDiff
+	//执行出错时的错误信息
+	Error string
+}
+
+// job对账结果，数据库中状态为1的job和正在调度的job对比，均为job名称
+type ReconcileResult struct {
+	//数据库中为调度状态、但没有调度的，已开始调度
+	Added []string
+	//正在调度、但数据库中已停止或删除的，已停止调度
+	Removed []string
+	//配置和数据库不一致的，已应用数据库中的配置
+	Changed []string
+	//配置无效或启动失败的
+	Failed []string
+}
+
+func (r *ReconcileResult) String() string {
+	return "added [" + strings.Join(r.Added, ",") + "], removed [" + strings.Join(r.Removed, ",") +
+		"], changed [" + strings.Join(r.Changed, ",") + "], failed [" + strings.Join(r.Failed, ",") + "]"
+}
+
+// 维护暂停，暂停期间任务照常计算下次执行时间，到了执行时间不触发，记录为跳过
+type Maintenance struct {
+	//暂停的类别，为空时为全局暂停
+	Category string `bson:"_id"`
+	//暂停原因
+	Reason string
+	//操作人
+	User string
+	//开始时间
+	Since time.Time
+	//自动恢复时间，为零值时需要手动恢复
+	Until time.Time
+	//本节点暂停期间跳过的触发次数，重启后重新计数
+	Skipped int `bson:"-"`
+}
+
+// 开始维护暂停参数
+type MaintenanceArgs struct {
+	//类别，为空时全局暂停
+	Category string
+	Reason   string
+	//自动恢复时间，为零值时需要手动恢复
+	Until time.Time
+}
+
+// 领导者选举状态
+type LeaderStatus struct {
+	//是否开启选举，未开启时当前节点始终调度
+	Enabled bool
+	//当前节点是否为领导者
+	Leader bool
+	//当前节点名称
+	Node string
+	//租约持有者，即正在调度的节点
+	Holder string
+	//防护令牌，每次换主加1
+	Token int64
+	//租约过期时间
+	Expire time.Time
+}
+
+// job运行位置限制，都为空时可以在任意agent运行
+type Placement struct {
+	//agent需要具有的所有标签
+	Labels map[string]string
+	//只在这些agent运行
+	Hosts []string
+}
+
+// worker agent注册信息，agent定期重新注册作为心跳
+type AgentInfo struct {
+	//agent名称，不能重复，默认为主机名
+	Name string
+	//agent的rpc监听地址，调度程序通过该地址下发运行请求
+	Addr string
+	//标签，和job的Labels匹配
+	Labels map[string]string
+	//最大同时运行实例数
+	Capacity int
+	//调度程序下发请求时携带的令牌，agent每次启动随机生成，GetAgents不返回
+	Token string `json:",omitempty"`
+	//agent上正在运行的实例
+	Running []string
+	//最近一次心跳时间，调度程序填写
+	LastSeen time.Time
+}
+
+// 下发给agent的运行请求
+type RunRequest struct {
+	Token string
+	//下发请求的调度节点，agent把输出和结果发回该节点
+	Node     string
+	JobName  string
+	ObjectId string
+	//php执行文件、配置文件、工作目录，需要在agent上存在
+	Path string
+	Ini  string
+	Pwd  string
+	Args []string
+}
+
+// 调度程序平滑重启、已把agent上的实例交给新进程时AgentOutput和AgentExit返回的错误，agent重新连接后重试
+const ErrHandedOver = "handed over to the successor"
+
+// 杀死agent上的实例
+type KillRequest struct {
+	Token    string
+	ObjectId string
+}
+
+// agent发回的一段输出
+type AgentOutput struct {
+	Agent    string
+	ObjectId string
+	//0标准输出，1错误输出
+	FromType int
+	Content  string
+}
+
+// agent发回的运行结果
+type AgentExit struct {
+	Agent    string
+	ObjectId string
+	Success  bool
+	//失败原因
+	Error string
+}
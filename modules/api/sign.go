@@ -0,0 +1,23 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+)
+
+// 计算登录签名，hex(hmac-sha256(secret, user + "\n" + timestamp + "\n" + nonce))
+func Sign(secret, user string, timestamp int64, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(user + "\n" + strconv.FormatInt(timestamp, 10) + "\n" + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// 生成签名使用的随机数，每次登录不同
+func NewNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
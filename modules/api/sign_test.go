@@ -0,0 +1,21 @@
+package api
+
+import "testing"
+
+// 测试签名结果稳定，和用户、时间戳、随机数相关
+func TestSign(t *testing.T) {
+	sign := Sign("secret", "zhangsan", 1500000000, "n1")
+	if len(sign) != 64 {
+		t.Fatalf("unexpected sign length %d", len(sign))
+	}
+	if sign != Sign("secret", "zhangsan", 1500000000, "n1") {
+		t.Fatal("sign is not stable")
+	}
+	if sign == Sign("secret", "zhangsan", 1500000001, "n1") || sign == Sign("secret", "lisi", 1500000000, "n1") ||
+		sign == Sign("secret", "zhangsan", 1500000000, "n2") {
+		t.Fatal("sign should depend on user, timestamp and nonce")
+	}
+	if NewNonce() == NewNonce() {
+		t.Fatal("nonce should be random")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"jcron/modules/api"
+	"jcron/modules/handle"
+	"log"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// 操作日志单次查询最大条数
+const maxOperateLogLimit = 1000
+
+/**
+ * 记录一次操作，写入失败只输出日志，不影响接口调用
+ */
+func (s *Session) audit(operate *api.OperateLog, err error) {
+	operate.User = s.User
+	operate.Addr = s.Addr
+	operate.Time = time.Now()
+	if err != nil {
+		operate.Result = -1
+		operate.Error = err.Error()
+	}
+	if e := insertOperateLog(operate); e != nil {
+		log.Printf("audit %s %s error: %s\n", operate.Method, operate.JobName, e)
+	}
+}
+
+// 写入操作日志
+var insertOperateLog = func(operate *api.OperateLog) error {
+	insert := func(c *mgo.Collection) error {
+		return c.Insert(operate)
+	}
+	return handle.WitchCollection(handle.Config().JobDb, handle.Config().OperateLogCollection, insert)
+}
+
+/**
+ * jsonrpc接口，查询操作日志，按时间倒序，非管理员只能查询有查看权限的job
+ */
+func (t *Calculator) GetOperateLog(query *api.OperateLogQuery, reply *[]*api.OperateLog) error {
+	*reply = []*api.OperateLog{}
+	if !t.session.Admin {
+		if query.JobName == "" {
+			if !t.session.login {
+				return ErrUnauthenticated
+			}
+			return errors.New("JobName is required")
+		}
+		if err := t.session.Check(query.JobName, permView); err != nil {
+			return err
+		}
+	}
+
+	cond, limit := operateLogCond(query)
+	find := func(c *mgo.Collection) error {
+		return c.Find(cond).Sort("-time").Skip(query.Skip).Limit(limit).All(reply)
+	}
+	return handle.WitchCollection(handle.Config().JobDb, handle.Config().OperateLogCollection, find)
+}
+
+// 操作日志的查询条件和条数
+func operateLogCond(query *api.OperateLogQuery) (bson.M, int) {
+	cond := bson.M{}
+	if query.JobName != "" {
+		cond["jobname"] = query.JobName
+	}
+	if query.User != "" {
+		cond["user"] = query.User
+	}
+	timeCond := bson.M{}
+	if !query.Start.IsZero() {
+		timeCond["$gte"] = query.Start
+	}
+	if !query.End.IsZero() {
+		timeCond["$lt"] = query.End
+	}
+	if len(timeCond) > 0 {
+		cond["time"] = timeCond
+	}
+	limit := query.Limit
+	if limit <= 0 || limit > maxOperateLogLimit {
+		limit = maxOperateLogLimit
+	}
+	return cond, limit
+}
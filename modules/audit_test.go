@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"jcron/modules/api"
+	"jcron/modules/cron"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestAudit(t *testing.T) {
+	_, _, audits := stubJobWrites(t)
+	calc := loginAs("alice", false)
+	calc.session.Addr = "10.0.0.1:5000"
+
+	calc.session.audit(&api.OperateLog{Method: "StartJob", JobName: "php1"}, nil)
+	calc.session.audit(&api.OperateLog{Method: "StopJob", JobName: "php1"}, errors.New("not the leader"))
+	if len(*audits) != 2 {
+		t.Fatalf("expected 2 audits, got %d", len(*audits))
+	}
+	ok, failed := (*audits)[0], (*audits)[1]
+	if ok.User != "alice" || ok.Addr != "10.0.0.1:5000" || ok.Result != 0 || ok.Error != "" || time.Since(ok.Time) > time.Minute {
+		t.Errorf("unexpected audit %+v", ok)
+	}
+	if failed.Result != -1 || failed.Error != "not the leader" {
+		t.Errorf("unexpected failed audit %+v", failed)
+	}
+}
+
+func TestOperateLogCond(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	tests := []struct {
+		query *api.OperateLogQuery
+		cond  bson.M
+		limit int
+	}{
+		{&api.OperateLogQuery{}, bson.M{}, maxOperateLogLimit},
+		{&api.OperateLogQuery{JobName: "php1", Limit: 20}, bson.M{"jobname": "php1"}, 20},
+		{&api.OperateLogQuery{User: "alice", Start: start, Limit: maxOperateLogLimit + 1}, bson.M{"user": "alice", "time": bson.M{"$gte": start}}, maxOperateLogLimit},
+		{&api.OperateLogQuery{Start: start, End: end, Limit: -1}, bson.M{"time": bson.M{"$gte": start, "$lt": end}}, maxOperateLogLimit},
+	}
+	for _, test := range tests {
+		cond, limit := operateLogCond(test.query)
+		if !reflect.DeepEqual(cond, test.cond) || limit != test.limit {
+			t.Errorf("%+v: expected %v %d, got %v %d", test.query, test.cond, test.limit, cond, limit)
+		}
+	}
+}
+
+func TestGetOperateLogPermission(t *testing.T) {
+	stubJobs(t, &cron.JobCollection{Name: "php1", AddPerson: "alice"})
+	var reply []*api.OperateLog
+	if err := (&Calculator{&Session{}}).GetOperateLog(&api.OperateLogQuery{}, &reply); err != ErrUnauthenticated {
+		t.Errorf("expected ErrUnauthenticated, got %v", err)
+	}
+	if err := loginAs("alice", false).GetOperateLog(&api.OperateLogQuery{}, &reply); err == nil || err.Error() != "JobName is required" {
+		t.Errorf("expected JobName is required, got %v", err)
+	}
+	if err := loginAs("eve", false).GetOperateLog(&api.OperateLogQuery{JobName: "php1"}, &reply); err != ErrPermissionDenied {
+		t.Errorf("expected ErrPermissionDenied, got %v", err)
+	}
+}
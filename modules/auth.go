@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/subtle"
+	"errors"
+	"jcron/modules/api"
+	"jcron/modules/cron"
+	"jcron/modules/handle"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+var (
+	// 未登录或登录信息错误
+	ErrUnauthenticated = errors.New("unauthenticated")
+	// 已登录，但没有操作该job的权限
+	ErrPermissionDenied = errors.New("permission denied")
+)
+
+// hmac签名允许的时间误差
+const signExpire = 5 * time.Minute
+
+// 随机数的最大长度
+const maxNonceLen = 64
+
+// 签名有效期内已使用的随机数，按用户和随机数保存过期时间，防止签名被重放
+var usedNonces = struct {
+	sync.Mutex
+	expires map[string]time.Time
+}{expires: map[string]time.Time{}}
+
+// 权限类型
+const (
+	permView = iota // 查看
+	permEdit        // 启停、运行、杀死实例等操作
+)
+
+// 连接会话，每个rpc连接一个
+type Session struct {
+	api.Session
+	login bool
+}
+
+// 是否开启认证
+func authEnabled() bool {
+	return len(handle.Config().ApiUsers) > 0
+}
+
+// 新建会话，未开启认证时默认拥有所有权限
+func newSession(addr string) *Session {
+	if !authEnabled() {
+		return &Session{api.Session{Admin: true, Addr: addr}, true}
+	}
+	return &Session{api.Session{Addr: addr}, false}
+}
+
+// 根据用户名查找接口用户
+func findApiUser(name string) *handle.ApiUser {
+	for i, user := range handle.Config().ApiUsers {
+		if user.Name == name {
+			return &handle.Config().ApiUsers[i]
+		}
+	}
+	return nil
+}
+
+// 校验登录参数，成功后会话绑定到对应用户
+func (s *Session) Login(args *api.LoginArgs) error {
+	if !authEnabled() {
+		return nil
+	}
+	var user *handle.ApiUser
+	if args.Token != "" {
+		for i, u := range handle.Config().ApiUsers {
+			if u.Token != "" && subtle.ConstantTimeCompare([]byte(u.Token), []byte(args.Token)) == 1 {
+				user = &handle.Config().ApiUsers[i]
+				break
+			}
+		}
+	} else if args.Sign != "" {
+		u := findApiUser(args.User)
+		if u != nil && u.Secret != "" {
+			diff := time.Since(time.Unix(args.Timestamp, 0))
+			if args.Nonce != "" && len(args.Nonce) <= maxNonceLen && diff < signExpire && diff > -signExpire &&
+				hmac.Equal([]byte(api.Sign(u.Secret, u.Name, args.Timestamp, args.Nonce)), []byte(args.Sign)) &&
+				useNonce(u.Name, args.Nonce, time.Unix(args.Timestamp, 0).Add(signExpire)) {
+				user = u
+			}
+		}
+	}
+	if user == nil {
+		return ErrUnauthenticated
+	}
+	s.bind(user)
+	return nil
+}
+
+/**
+ * 记录签名使用的随机数，保存到签名过期，已使用过时返回false，同时清理已过期的随机数
+ */
+func useNonce(user, nonce string, expire time.Time) bool {
+	now := time.Now()
+	key := user + "\n" + nonce
+	usedNonces.Lock()
+	defer usedNonces.Unlock()
+	for k, t := range usedNonces.expires {
+		if now.After(t) {
+			delete(usedNonces.expires, k)
+		}
+	}
+	if _, ok := usedNonces.expires[key]; ok {
+		return false
+	}
+	usedNonces.expires[key] = expire
+	return true
+}
+
+// 会话绑定用户
+func (s *Session) bind(user *handle.ApiUser) {
+	s.User = user.Name
+	s.Admin = user.Admin
+	s.Agent = user.Agent
+	s.login = true
+}
+
+// 检查会话对job的权限
+func (s *Session) Check(name string, perm int) error {
+	if !s.login {
+		return ErrUnauthenticated
+	}
+	if s.Admin {
+		return nil
+	}
+	jobData, err := findJob(name)
+	if err != nil {
+		return ErrPermissionDenied
+	}
+	if !s.allow(jobData, perm) {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+// 根据job的人员字段判断是否有权限
+func (s *Session) allow(jobData *cron.JobCollection, perm int) bool {
+	if s.Admin {
+		return true
+	}
+	persons := jobData.AddPerson + "," + jobData.EditPerson
+	if perm == permView {
+		persons += "," + jobData.ViewPerson
+	}
+	for _, person := range strings.Split(persons, ",") {
+		if strings.TrimSpace(person) == s.User && s.User != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// 获取会话有查看权限的job
+func (s *Session) viewableJobs() ([]*cron.JobCollection, error) {
+	if !s.login {
+		return nil, ErrUnauthenticated
+	}
+	jobList, err := findJobs()
+	if err != nil {
+		return nil, err
+	}
+	allowed := jobList[:0]
+	for _, jobData := range jobList {
+		if s.allow(jobData, permView) {
+			allowed = append(allowed, jobData)
+		}
+	}
+	return allowed, nil
+}
+
+// 按名称排序读取所有job配置
+var findJobs = func() ([]*cron.JobCollection, error) {
+	jobList := []*cron.JobCollection{}
+	find := func(c *mgo.Collection) error {
+		return c.Find(nil).Sort("name").All(&jobList)
+	}
+	err := handle.WitchCollection(handle.Config().JobDb, handle.Config().JobCollection, find)
+	return jobList, err
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"jcron/modules/api"
+	"jcron/modules/cron"
+	"jcron/modules/handle"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+// 替换配置中的接口用户
+func stubApiUsers(t *testing.T, users []handle.ApiUser) {
+	old := handle.Config()
+	t.Cleanup(func() { handle.SetConfig(old) })
+	conf := *old
+	conf.ApiUsers = users
+	handle.SetConfig(&conf)
+}
+
+// 测试签名登录的随机数不能重复使用
+func TestLoginNonce(t *testing.T) {
+	stubApiUsers(t, []handle.ApiUser{{Name: "zhangsan", Secret: "secret"}})
+
+	now := time.Now().Unix()
+	args := &api.LoginArgs{User: "zhangsan", Timestamp: now, Nonce: api.NewNonce()}
+	args.Sign = api.Sign("secret", args.User, args.Timestamp, args.Nonce)
+	if err := newSession("test").Login(args); err != nil {
+		t.Fatal(err)
+	}
+	if err := newSession("test").Login(args); err != ErrUnauthenticated {
+		t.Errorf("replayed sign should be rejected, got %v", err)
+	}
+
+	args = &api.LoginArgs{User: "zhangsan", Timestamp: now}
+	args.Sign = api.Sign("secret", args.User, args.Timestamp, "")
+	if err := newSession("test").Login(args); err != ErrUnauthenticated {
+		t.Errorf("sign without nonce should be rejected, got %v", err)
+	}
+
+	args = &api.LoginArgs{User: "zhangsan", Timestamp: now, Nonce: api.NewNonce()}
+	args.Sign = api.Sign("secret", args.User, args.Timestamp, args.Nonce)
+	if err := newSession("test").Login(args); err != nil {
+		t.Errorf("new nonce should be accepted, got %v", err)
+	}
+}
+
+// 替换job配置的读取，测试结束后恢复
+func stubJobs(t *testing.T, jobs ...*cron.JobCollection) {
+	find, findAll := findJob, findJobs
+	t.Cleanup(func() {
+		findJob, findJobs = find, findAll
+	})
+	findJob = func(name string) (*cron.JobCollection, error) {
+		for _, jobData := range jobs {
+			if jobData.Name == name {
+				return jobData, nil
+			}
+		}
+		return nil, mgo.ErrNotFound
+	}
+	findJobs = func() ([]*cron.JobCollection, error) {
+		return jobs, nil
+	}
+}
+
+func TestSessionCheck(t *testing.T) {
+	stubJobs(t, &cron.JobCollection{Name: "report", AddPerson: "alice", EditPerson: "bob, carol", ViewPerson: "dave"})
+	login := func(user string, admin bool) *Session {
+		s := newSession("test")
+		s.bind(&handle.ApiUser{Name: user, Admin: admin})
+		return s
+	}
+	tests := []struct {
+		session *Session
+		name    string
+		perm    int
+		err     error
+	}{
+		{login("alice", false), "report", permEdit, nil},
+		{login("alice", false), "report", permView, nil},
+		{login("carol", false), "report", permEdit, nil},
+		{login("dave", false), "report", permView, nil},
+		{login("dave", false), "report", permEdit, ErrPermissionDenied},
+		{login("eve", false), "report", permView, ErrPermissionDenied},
+		{login("", false), "report", permView, ErrPermissionDenied},
+		{login("alice", false), "missing", permView, ErrPermissionDenied},
+		{login("root", true), "report", permEdit, nil},
+		{login("root", true), "missing", permEdit, nil},
+		{&Session{}, "report", permView, ErrUnauthenticated},
+	}
+	for _, test := range tests {
+		if err := test.session.Check(test.name, test.perm); err != test.err {
+			t.Errorf("%s check %s perm %d: expected %v, got %v", test.session.User, test.name, test.perm, test.err, err)
+		}
+	}
+}
+
+func TestGetJobListFilter(t *testing.T) {
+	stubApiUsers(t, []handle.ApiUser{
+		{Name: "alice", Token: "alice-token"},
+		{Name: "root", Token: "root-token", Admin: true},
+	})
+	stubJobs(t,
+		&cron.JobCollection{Name: "auth-a", AddPerson: "alice"},
+		&cron.JobCollection{Name: "auth-b", AddPerson: "bob", ViewPerson: "alice"},
+		&cron.JobCollection{Name: "auth-c", AddPerson: "bob"},
+	)
+	for _, name := range []string{"auth-a", "auth-b", "auth-c"} {
+		c.AddFunc(name, "", "0 0 * * * *", func() {})
+		defer c.RemoveFunc(name)
+	}
+	list := func(token string) []string {
+		s := newSession("test")
+		var reply []*cron.JobList
+		if err := (&Calculator{s}).GetJobList(true, &reply); err != ErrUnauthenticated {
+			t.Fatalf("expected ErrUnauthenticated before login, got %v", err)
+		}
+		if err := s.Login(&api.LoginArgs{Token: token}); err != nil {
+			t.Fatal(err)
+		}
+		if err := (&Calculator{s}).GetJobList(true, &reply); err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, job := range reply {
+			names = append(names, job.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	if names := list("alice-token"); !reflect.DeepEqual(names, []string{"auth-a", "auth-b"}) {
+		t.Errorf("alice expected auth-a auth-b, got %v", names)
+	}
+	if names := list("root-token"); !reflect.DeepEqual(names, []string{"auth-a", "auth-b", "auth-c"}) {
+		t.Errorf("root expected all jobs, got %v", names)
+	}
+}
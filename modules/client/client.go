@@ -0,0 +1,303 @@
+// 调度系统jsonrpc接口的客户端
+package client
+
+import (
+	"crypto/tls"
+	"jcron/modules/api"
+	"jcron/modules/cron"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"time"
+)
+
+// 连接参数，开启认证时Token和User、Secret二选一
+type Options struct {
+	// 访问令牌
+	Token string
+	// 签名登录的用户名和密钥
+	User   string
+	Secret string
+	// 不为空时使用tls连接
+	TLS *tls.Config
+	// 连接超时时间，默认10秒
+	Timeout time.Duration
+}
+
+type Client struct {
+	rpc     *rpc.Client
+	Session api.Session
+}
+
+/**
+ * 连接调度系统，配置了登录信息时自动登录
+ */
+func Dial(addr string, opt *Options) (*Client, error) {
+	if opt == nil {
+		opt = &Options{}
+	}
+	timeout := opt.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if opt.TLS != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, opt.TLS)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{rpc: jsonrpc.NewClient(conn)}
+
+	args := &api.LoginArgs{Token: opt.Token}
+	if opt.Token == "" && opt.Secret != "" {
+		args.User = opt.User
+		args.Timestamp = time.Now().Unix()
+		args.Nonce = api.NewNonce()
+		args.Sign = api.Sign(opt.Secret, opt.User, args.Timestamp, args.Nonce)
+	}
+	if args.Token != "" || args.Sign != "" {
+		if err = c.Login(args); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// 关闭连接
+func (c *Client) Close() error {
+	return c.rpc.Close()
+}
+
+// 调用任意接口，method不需要Calculator前缀
+func (c *Client) Call(method string, args interface{}, reply interface{}) error {
+	return c.rpc.Call("Calculator."+method, args, reply)
+}
+
+// 登录
+func (c *Client) Login(args *api.LoginArgs) error {
+	return c.Call("Login", args, &c.Session)
+}
+
+// 获取正在调度的job列表
+func (c *Client) GetJobList() ([]*cron.JobList, error) {
+	reply := []*cron.JobList{}
+	err := c.Call("GetJobList", true, &reply)
+	return reply, err
+}
+
+// 获取job正在运行的实例
+func (c *Client) GetJobInstance(name string) ([]*cron.RunInfo, error) {
+	reply := []*cron.RunInfo{}
+	err := c.Call("GetJobInstance", name, &reply)
+	return reply, err
+}
+
+// 获取有查看权限的job配置，category为空时返回全部
+func (c *Client) GetJobs(category string) ([]*cron.JobCollection, error) {
+	reply := []*cron.JobCollection{}
+	err := c.Call("GetJobs", category, &reply)
+	return reply, err
+}
+
+// 获取job配置
+func (c *Client) GetJob(name string) (*cron.JobCollection, error) {
+	reply := &cron.JobCollection{}
+	err := c.Call("GetJob", name, reply)
+	return reply, err
+}
+
+// 启动job
+func (c *Client) StartJob(name string) error {
+	reply := 0
+	return c.Call("StartJob", name, &reply)
+}
+
+// 停止job
+func (c *Client) StopJob(name string) error {
+	reply := 0
+	return c.Call("StopJob", name, &reply)
+}
+
+// 停止job，mode为正在运行实例的处理方式，见api.StopDetach等，timeout为drain等待的秒数
+func (c *Client) StopJobWithMode(name, mode string, timeout int) error {
+	reply := 0
+	return c.Call("StopJobWithMode", &api.StopJobArgs{Name: name, Mode: mode, Timeout: timeout}, &reply)
+}
+
+// 暂停job，job保留在调度列表中，到了执行时间不触发
+func (c *Client) PauseJob(name string) error {
+	reply := 0
+	return c.Call("PauseJob", name, &reply)
+}
+
+// 恢复暂停的job，misfire为true时按job的Misfire设置处理暂停期间错过的执行
+func (c *Client) ResumeJob(name string, misfire bool) error {
+	reply := 0
+	return c.Call("ResumeJob", &api.ResumeJobArgs{Name: name, Misfire: misfire}, &reply)
+}
+
+// 手动运行一次job
+func (c *Client) RunOnceJob(name string, param []string) error {
+	reply := 0
+	return c.Call("RunOnceJob", &cron.TestJob{Name: name, Param: param}, &reply)
+}
+
+// 杀死job实例
+func (c *Client) KillJobInstance(name, objectId string) error {
+	reply := 0
+	return c.Call("KillJobInstance", &cron.JobInstance{JobName: name, ObjectId: objectId}, &reply)
+}
+
+// 新建job
+func (c *Client) CreateJob(jobData *cron.JobCollection) error {
+	reply := 0
+	return c.Call("CreateJob", jobData, &reply)
+}
+
+// 修改job
+func (c *Client) UpdateJob(jobData *cron.JobCollection) error {
+	reply := 0
+	return c.Call("UpdateJob", jobData, &reply)
+}
+
+// 删除job
+func (c *Client) DeleteJob(name string) error {
+	reply := 0
+	return c.Call("DeleteJob", name, &reply)
+}
+
+// 校验cron表达式，返回之后的执行时间
+func (c *Client) ParseCron(spec string, count int) ([]time.Time, error) {
+	reply := []time.Time{}
+	err := c.Call("ParseCron", &api.CronArgs{Cron: spec, Count: count}, &reply)
+	return reply, err
+}
+
+// 跟踪实例的输出，没有新输出时阻塞等待
+func (c *Client) FollowJobRun(args *api.FollowArgs) (*api.FollowReply, error) {
+	reply := &api.FollowReply{}
+	err := c.Call("FollowJobRun", args, reply)
+	return reply, err
+}
+
+// 查询运行记录
+func (c *Client) GetJobRun(query *api.RunQuery) (*api.RunPage, error) {
+	reply := &api.RunPage{}
+	err := c.Call("GetJobRun", query, reply)
+	return reply, err
+}
+
+// 获取一次运行的完整日志
+func (c *Client) GetJobRunLog(name, objectId string) (*api.RunRecord, error) {
+	reply := &api.RunRecord{}
+	err := c.Call("GetJobRunLog", &cron.JobInstance{JobName: name, ObjectId: objectId}, reply)
+	return reply, err
+}
+
+// 运行统计
+func (c *Client) GetJobStat(query *api.StatQuery) (*api.JobStat, error) {
+	reply := &api.JobStat{}
+	err := c.Call("GetJobStat", query, reply)
+	return reply, err
+}
+
+// 查询操作日志
+func (c *Client) GetOperateLog(query *api.OperateLogQuery) ([]*api.OperateLog, error) {
+	reply := []*api.OperateLog{}
+	err := c.Call("GetOperateLog", query, &reply)
+	return reply, err
+}
+
+// 获取job配置版本列表
+func (c *Client) GetJobRevision(name string) ([]*api.JobRevision, error) {
+	reply := []*api.JobRevision{}
+	err := c.Call("GetJobRevision", name, &reply)
+	return reply, err
+}
+
+// 对比两个版本
+func (c *Client) DiffJobRevision(name string, from, to int) ([]*api.FieldDiff, error) {
+	reply := []*api.FieldDiff{}
+	err := c.Call("DiffJobRevision", &api.RevisionDiffArgs{Name: name, From: from, To: to}, &reply)
+	return reply, err
+}
+
+// 回滚到指定版本
+func (c *Client) RollbackJob(name string, version int) error {
+	reply := 0
+	return c.Call("RollbackJob", &api.RollbackArgs{Name: name, Version: version}, &reply)
+}
+
+// 同步job定义文件，dryRun为true时只返回变更
+func (c *Client) SyncJobFile(dryRun bool) ([]*api.JobChange, error) {
+	reply := []*api.JobChange{}
+	err := c.Call("SyncJobFile", &api.SyncJobFileArgs{DryRun: dryRun}, &reply)
+	return reply, err
+}
+
+// 获取已注册的agent
+func (c *Client) GetAgents() ([]*api.AgentInfo, error) {
+	reply := []*api.AgentInfo{}
+	err := c.Call("GetAgents", true, &reply)
+	return reply, err
+}
+
+// 获取领导者选举状态
+func (c *Client) GetLeader() (*api.LeaderStatus, error) {
+	reply := &api.LeaderStatus{}
+	err := c.Call("GetLeader", true, reply)
+	return reply, err
+}
+
+// 立即对账，返回不一致的job
+func (c *Client) ReconcileNow() (*api.ReconcileResult, error) {
+	reply := &api.ReconcileResult{}
+	err := c.Call("ReconcileNow", true, reply)
+	return reply, err
+}
+
+// 开始维护暂停
+func (c *Client) StartMaintenance(args *api.MaintenanceArgs) error {
+	reply := 0
+	return c.Call("StartMaintenance", args, &reply)
+}
+
+// 结束维护暂停，类别为空时结束全局暂停
+func (c *Client) EndMaintenance(category string) error {
+	reply := 0
+	return c.Call("EndMaintenance", category, &reply)
+}
+
+// 查询正在生效的维护暂停
+func (c *Client) GetMaintenance() ([]*api.Maintenance, error) {
+	reply := []*api.Maintenance{}
+	err := c.Call("GetMaintenance", true, &reply)
+	return reply, err
+}
+
+// 查询错误日志
+func (c *Client) GetErrLog(query *api.ErrLogQuery) ([]*api.ErrLog, error) {
+	reply := []*api.ErrLog{}
+	err := c.Call("GetErrLog", query, &reply)
+	return reply, err
+}
+
+// 确认错误日志，返回确认的条数
+func (c *Client) AckErrLog(args *api.ErrLogAckArgs) (int, error) {
+	reply := 0
+	err := c.Call("AckErrLog", args, &reply)
+	return reply, err
+}
+
+// 将错误日志标记为已解决，返回修改的条数
+func (c *Client) ResolveErrLog(args *api.ErrLogAckArgs) (int, error) {
+	reply := 0
+	err := c.Call("ResolveErrLog", args, &reply)
+	return reply, err
+}
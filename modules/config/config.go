@@ -0,0 +1,311 @@
+// 调度系统配置：默认值、配置文件（json或yaml）、环境变量依次覆盖，最后统一校验
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"jcron/modules/handle"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v2"
+)
+
+// 环境变量前缀，字段名转为大写下划线形式，如DbHost对应JCRON_DB_HOST
+const EnvPrefix = "JCRON_"
+
+// 输出配置时替换敏感信息
+const redacted = "******"
+
+/**
+ * 默认配置
+ */
+func Default() *handle.Configuration {
+	return &handle.Configuration{
+		JobDb:                 "Job",
+		JobLogDb:              "JobLog",
+		DbHost:                "localhost",
+		DbPort:                "27017",
+		JobCollection:         "job",
+		JobSnapshotCollection: "jobSnapshot",
+		CurProcessCollection:  "curProcess",
+		ErrLogCollection:      "errLog",
+		ErrLogViewCollection:  "errLogView",
+		OperateLogCollection:  "operateLog",
+		JobRevisionCollection: "jobRevision",
+		LeaseCollection:       "lease",
+		MaintenanceCollection: "maintenance",
+		JsonRpcPort:           "1234",
+		SpoolPath:             "spool",
+	}
+}
+
+/**
+ * 加载配置：默认值 < 配置文件 < 环境变量，path为空时不读取配置文件
+ * lookupEnv一般为os.LookupEnv
+ */
+func Load(path string, lookupEnv func(string) (string, bool)) (*handle.Configuration, error) {
+	conf := Default()
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := Decode(filepath.Ext(path), data, conf); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	if err := ApplyEnv(conf, lookupEnv); err != nil {
+		return nil, err
+	}
+	if err := Validate(conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+/**
+ * 解析配置文件，.yaml、.yml为yaml格式，其他为json格式，字段名和json一致，不认识的字段视为错误
+ */
+func Decode(ext string, data []byte, conf *handle.Configuration) error {
+	if ext == ".yaml" || ext == ".yml" {
+		var value interface{}
+		if err := yaml.Unmarshal(data, &value); err != nil {
+			return err
+		}
+		var err error
+		data, err = json.Marshal(jsonValue(value))
+		if err != nil {
+			return err
+		}
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(conf)
+}
+
+// yaml解析出的map[interface{}]interface{}转为json可以序列化的map[string]interface{}
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for key, item := range v {
+			m[fmt.Sprint(key)] = jsonValue(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range v {
+			v[i] = jsonValue(item)
+		}
+	}
+	return value
+}
+
+/**
+ * 字段名转为环境变量名，如JsonRpcPort转为JCRON_JSON_RPC_PORT
+ */
+func EnvName(field string) string {
+	var buf bytes.Buffer
+	for i, r := range field {
+		if i > 0 && unicode.IsUpper(r) {
+			buf.WriteByte('_')
+		}
+		buf.WriteRune(unicode.ToUpper(r))
+	}
+	return EnvPrefix + buf.String()
+}
+
+/**
+ * 使用环境变量覆盖配置，字符串字段直接使用，ApiUsers为json格式
+ */
+func ApplyEnv(conf *handle.Configuration, lookupEnv func(string) (string, bool)) error {
+	value := reflect.ValueOf(conf).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		name := EnvName(field.Name)
+		env, ok := lookupEnv(name)
+		if !ok {
+			continue
+		}
+		switch field.Type.Kind() {
+		case reflect.String:
+			value.Field(i).SetString(env)
+		default:
+			if err := json.Unmarshal([]byte(env), value.Field(i).Addr().Interface()); err != nil {
+				return fmt.Errorf("%s is not valid json: %s", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+/**
+ * 校验所有字段，返回所有错误
+ */
+func Validate(conf *handle.Configuration) error {
+	errs := []string{}
+	check := func(field string, err error) {
+		if err != nil {
+			errs = append(errs, field+": "+err.Error())
+		}
+	}
+
+	check("JobDb", checkDbName(conf.JobDb))
+	check("JobLogDb", checkDbName(conf.JobLogDb))
+	if conf.DbHost == "" {
+		check("DbHost", errors.New("must not be empty, e.g. localhost"))
+	}
+	check("DbPort", checkPort(conf.DbPort, true))
+	if conf.DbPassword != "" && conf.DbUser == "" {
+		check("DbUser", errors.New("must be set when DbPassword is set"))
+	}
+	check("JobCollection", checkCollection(conf.JobCollection))
+	check("JobSnapshotCollection", checkCollection(conf.JobSnapshotCollection))
+	check("CurProcessCollection", checkCollection(conf.CurProcessCollection))
+	check("ErrLogCollection", checkCollection(conf.ErrLogCollection))
+	check("ErrLogViewCollection", checkCollection(conf.ErrLogViewCollection))
+	check("OperateLogCollection", checkCollection(conf.OperateLogCollection))
+	check("JobRevisionCollection", checkCollection(conf.JobRevisionCollection))
+	check("LeaseCollection", checkCollection(conf.LeaseCollection))
+	check("MaintenanceCollection", checkCollection(conf.MaintenanceCollection))
+	check("PhpBinPath", checkAbs(conf.PhpBinPath))
+	check("PhpIniPath", checkAbs(conf.PhpIniPath))
+	check("JobPath", checkAbs(conf.JobPath))
+	check("JobFilePath", checkPath(conf.JobFilePath, true))
+	check("JsonRpcPort", checkPort(conf.JsonRpcPort, true))
+	check("HttpPort", checkPort(conf.HttpPort, false))
+	if conf.HttpPort != "" && conf.HttpPort == conf.JsonRpcPort {
+		check("HttpPort", errors.New("must be different from JsonRpcPort"))
+	}
+	if (conf.TlsCertFile == "") != (conf.TlsKeyFile == "") {
+		check("TlsKeyFile", errors.New("TlsCertFile and TlsKeyFile must be set together"))
+	}
+	check("TlsCertFile", checkPath(conf.TlsCertFile, false))
+	check("TlsKeyFile", checkPath(conf.TlsKeyFile, false))
+	check("TlsClientCaFile", checkPath(conf.TlsClientCaFile, false))
+	if conf.TlsClientCaFile != "" && conf.TlsCertFile == "" {
+		check("TlsClientCaFile", errors.New("requires TlsCertFile and TlsKeyFile"))
+	}
+	check("AgentCaFile", checkPath(conf.AgentCaFile, false))
+
+	if conf.LeaderLease != 0 && conf.LeaderLease < 3 {
+		check("LeaderLease", errors.New("must be 0 (disabled) or at least 3 seconds"))
+	}
+
+	names := map[string]bool{}
+	tokens := map[string]bool{}
+	for i, user := range conf.ApiUsers {
+		field := fmt.Sprintf("ApiUsers[%d]", i)
+		if user.Name == "" {
+			check(field+".Name", errors.New("must not be empty"))
+		} else if names[user.Name] {
+			check(field+".Name", errors.New("duplicated user "+user.Name))
+		}
+		names[user.Name] = true
+		if user.Token == "" && user.Secret == "" {
+			check(field, errors.New("Token or Secret is required"))
+		}
+		if user.Token != "" {
+			if tokens[user.Token] {
+				check(field+".Token", errors.New("duplicated token"))
+			}
+			tokens[user.Token] = true
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New("invalid config: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// 数据库名称不能为空，不能包含mongo不允许的字符
+func checkDbName(name string) error {
+	if name == "" {
+		return errors.New("must not be empty")
+	}
+	if strings.ContainsAny(name, "/\\. \"$*<>:|?") {
+		return errors.New("must not contain any of /\\. \"$*<>:|?")
+	}
+	return nil
+}
+
+// 集合名称不能为空，不能包含$，不能以system.开头
+func checkCollection(name string) error {
+	if name == "" {
+		return errors.New("must not be empty")
+	}
+	if strings.Contains(name, "$") || strings.HasPrefix(name, "system.") {
+		return errors.New("must not contain $ or start with system.")
+	}
+	return nil
+}
+
+// 端口为1-65535的数字，required为false时可以为空
+func checkPort(port string, required bool) error {
+	if port == "" {
+		if required {
+			return errors.New("must not be empty")
+		}
+		return nil
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return errors.New(port + " is not a port number between 1 and 65535")
+	}
+	return nil
+}
+
+// 路径为空时不检查，否则必须是绝对路径
+func checkAbs(path string) error {
+	if path != "" && !filepath.IsAbs(path) {
+		return errors.New(path + " is not an absolute path")
+	}
+	return nil
+}
+
+// 路径为空时不检查，否则必须存在，dir为true时必须是目录
+func checkPath(path string, dir bool) error {
+	if path == "" {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return errors.New(path + " not exist")
+	}
+	if dir && !info.IsDir() {
+		return errors.New(path + " is not a directory")
+	}
+	if !dir && info.IsDir() {
+		return errors.New(path + " is a directory")
+	}
+	return nil
+}
+
+/**
+ * 复制一份配置，敏感信息替换为******，用于输出
+ */
+func Redact(conf *handle.Configuration) *handle.Configuration {
+	copied := *conf
+	if copied.DbPassword != "" {
+		copied.DbPassword = redacted
+	}
+	copied.ApiUsers = make([]handle.ApiUser, len(conf.ApiUsers))
+	for i, user := range conf.ApiUsers {
+		if user.Token != "" {
+			user.Token = redacted
+		}
+		if user.Secret != "" {
+			user.Secret = redacted
+		}
+		copied.ApiUsers[i] = user
+	}
+	return &copied
+}
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"io/ioutil"
+	"jcron/modules/handle"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := vars[key]
+		return value, ok
+	}
+}
+
+func writeFile(t *testing.T, dir, name, data string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEnvName(t *testing.T) {
+	tests := map[string]string{
+		"DbHost":               "JCRON_DB_HOST",
+		"JsonRpcPort":          "JCRON_JSON_RPC_PORT",
+		"ErrLogViewCollection": "JCRON_ERR_LOG_VIEW_COLLECTION",
+	}
+	for field, want := range tests {
+		if got := EnvName(field); got != want {
+			t.Errorf("EnvName(%s) = %s, want %s", field, got, want)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	jsonPath := writeFile(t, dir, "conf.json", `{"DbHost" : "mongo", "HttpPort" : "1235"}`)
+	conf, err := Load(jsonPath, env(map[string]string{
+		"JCRON_DB_PORT":   "27018",
+		"JCRON_API_USERS": `[{"Name" : "ops", "Token" : "t1", "Admin" : true}]`,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.DbHost != "mongo" || conf.DbPort != "27018" || conf.HttpPort != "1235" || conf.JobDb != "Job" {
+		t.Errorf("unexpected config %+v", conf)
+	}
+	if len(conf.ApiUsers) != 1 || conf.ApiUsers[0].Name != "ops" || !conf.ApiUsers[0].Admin {
+		t.Errorf("unexpected ApiUsers %+v", conf.ApiUsers)
+	}
+
+	yamlPath := writeFile(t, dir, "conf.yaml", "DbHost: mongo\nApiUsers:\n  - Name: ops\n    Secret: s1\n")
+	conf, err = Load(yamlPath, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.DbHost != "mongo" || len(conf.ApiUsers) != 1 || conf.ApiUsers[0].Secret != "s1" {
+		t.Errorf("unexpected config %+v", conf)
+	}
+
+	unknownPath := writeFile(t, dir, "unknown.json", `{"DbHots" : "mongo"}`)
+	if _, err := Load(unknownPath, env(nil)); err == nil || !strings.Contains(err.Error(), "DbHots") {
+		t.Errorf("expected unknown field error, got %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	conf := Default()
+	conf.DbPort = "abc"
+	conf.JobDb = "a.b"
+	conf.HttpPort = conf.JsonRpcPort
+	conf.TlsCertFile = "/not/exist.pem"
+	conf.LeaderLease = 1
+	conf.ApiUsers = []handle.ApiUser{{Name: "a", Token: "t"}, {Name: "a"}}
+	err := Validate(conf)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for _, field := range []string{"DbPort", "JobDb", "HttpPort", "TlsKeyFile", "TlsCertFile", "LeaderLease", "ApiUsers[1].Name", "ApiUsers[1]:"} {
+		if !strings.Contains(err.Error(), field) {
+			t.Errorf("error %q does not mention %s", err, field)
+		}
+	}
+	if err := Validate(Default()); err != nil {
+		t.Errorf("default config is invalid: %s", err)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	conf := Default()
+	conf.DbPassword = "pass"
+	conf.ApiUsers = []handle.ApiUser{{Name: "a", Token: "token", Secret: "secret"}}
+	redactedConf := Redact(conf)
+	if redactedConf.DbPassword != redacted || redactedConf.ApiUsers[0].Token != redacted || redactedConf.ApiUsers[0].Secret != redacted {
+		t.Errorf("secrets not redacted: %+v", redactedConf)
+	}
+	if conf.DbPassword != "pass" || conf.ApiUsers[0].Token != "token" {
+		t.Error("original config modified")
+	}
+}
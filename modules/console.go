@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io"
+	"net/http"
+)
+
+// 控制台页面路径
+const consolePath = "/console/"
+
+func init() {
+	httpMux.HandleFunc(consolePath, serveConsole)
+	httpMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, consolePath, http.StatusFound)
+	})
+}
+
+/**
+ * 控制台页面，页面本身不需要认证，页面中通过/api/和/stream接口操作，使用接口的认证方式
+ */
+func serveConsole(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != consolePath {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Frame-Options", "DENY")
+	io.WriteString(w, consoleHtml)
+}
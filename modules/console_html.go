@@ -0,0 +1,513 @@
+package main
+
+// 控制台页面，只使用调度系统自身的/api/和/stream接口
+const consoleHtml = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>jcron</title>
+<style>
+body{font-family:sans-serif;font-size:14px;margin:0;color:#333}
+header{background:#2d3a4b;color:#fff;padding:8px 16px;display:flex;align-items:center}
+header b{margin-right:24px}
+header a{color:#cfd8e3;margin-right:16px;cursor:pointer;text-decoration:none}
+header a.on{color:#fff;font-weight:bold}
+header span{margin-left:auto}
+main{padding:16px}
+table{border-collapse:collapse;width:100%}
+th,td{border:1px solid #ddd;padding:4px 8px;text-align:left;vertical-align:top}
+th{background:#f5f5f5}
+button{margin-right:4px}
+input[type=text],input[type=password],input[type=number],select,textarea{width:100%;box-sizing:border-box}
+form td:first-child{width:120px}
+pre{background:#1e1e1e;color:#ddd;padding:8px;max-height:600px;overflow:auto;white-space:pre-wrap}
+pre .err{color:#f66}
+.msg{color:#c00;margin:8px 0}
+.tip{color:#888}
+.hide{display:none}
+</style>
+</head>
+<body>
+<header>
+<b>jcron</b>
+<a data-view="jobs">任务</a>
+<a data-view="errors">错误日志</a>
+<span><span id="user"></span> <button id="logout">退出</button></span>
+</header>
+<main>
+<div id="msg" class="msg"></div>
+
+<div id="login" class="view hide">
+<p>请输入访问令牌（未开启认证时留空）</p>
+<input type="password" id="token" style="width:320px"> <button id="loginBtn">登录</button>
+</div>
+
+<div id="jobs" class="view hide">
+<p>
+<input type="text" id="filter" placeholder="按名称或类别过滤" style="width:240px">
+<button id="refresh">刷新</button>
+<button id="create">新建任务</button>
+</p>
+<table>
+<thead><tr><th>名称</th><th>类别</th><th>描述</th><th>执行频率</th><th>状态</th><th>运行实例</th><th>上次执行</th><th>下次执行</th><th>操作</th></tr></thead>
+<tbody id="jobList"></tbody>
+</table>
+</div>
+
+<div id="edit" class="view hide">
+<h3 id="editTitle"></h3>
+<form id="editForm">
+<table>
+<tr><td>名称</td><td><input type="text" name="Name"></td></tr>
+<tr><td>类别</td><td><input type="text" name="Category"></td></tr>
+<tr><td>描述</td><td><input type="text" name="Desc"></td></tr>
+<tr><td>执行频率</td><td><input type="text" name="Cron" placeholder="秒 分 时 日 月 周"><div id="cronPreview" class="tip"></div></td></tr>
+<tr><td>最大并发数</td><td><input type="number" name="Channel" min="1"></td></tr>
+<tr><td>错过执行</td><td><select name="Misfire"><option value="">跳过</option><option value="once">恢复暂停时补执行一次</option></select></td></tr>
+<tr><td>执行程序类型</td><td><select name="ExecType"><option value="php">php</option><option value="http">http</option></select></td></tr>
+<tr><td>执行程序环境</td><td><textarea name="ExecEnv" rows="3" placeholder="php类型的执行环境"></textarea></td></tr>
+<tr><td>运行内容</td><td><textarea name="Content" rows="4" placeholder="每行一个参数，http类型为url"></textarea></td></tr>
+<tr><td>可见人</td><td><input type="text" name="ViewPerson" placeholder="多个用逗号分隔"></td></tr>
+<tr><td>通知人</td><td><input type="text" name="NoticePerson"></td></tr>
+<tr id="startRow"><td>创建后启动</td><td><input type="checkbox" name="Status"></td></tr>
+</table>
+<p><button type="submit">保存</button><button type="button" id="cancel">取消</button></p>
+</form>
+</div>
+
+<div id="runs" class="view hide">
+<h3 id="runsTitle"></h3>
+<p>
+<select id="runResult"><option value="">全部结果</option><option value="0">运行中</option><option value="1">正常</option><option value="2">异常</option><option value="3">丢失</option><option value="4">中断</option><option value="5">遗弃</option><option value="6">跳过</option></select>
+<select id="runTrigger"><option value="">全部触发方式</option><option value="cron">定时</option><option value="manual">手动</option></select>
+<button id="runsRefresh">刷新</button>
+<button id="runsPrev">上一页</button><button id="runsNext">下一页</button>
+<span id="runsPage" class="tip"></span>
+</p>
+<table>
+<thead><tr><th>实例id</th><th>开始时间</th><th>结束时间</th><th>结果</th><th>触发方式</th><th>进程id</th><th>操作</th></tr></thead>
+<tbody id="runList"></tbody>
+</table>
+<h4 id="outputTitle"></h4>
+<pre id="output" class="hide"></pre>
+</div>
+
+<div id="errors" class="view hide">
+<p>
+<select id="errStatus"><option value="unread">未读</option><option value="acked">已确认</option><option value="resolved">已解决</option><option value="">全部</option></select>
+<input type="text" id="errName" placeholder="任务名称" style="width:200px">
+<button id="errRefresh">刷新</button>
+<button id="errAckAll">确认当前页</button>
+</p>
+<table>
+<thead><tr><th>任务</th><th>时间</th><th>实例id</th><th>状态</th><th>处理人</th><th>处理时间</th><th>备注</th><th>操作</th></tr></thead>
+<tbody id="errList"></tbody>
+</table>
+</div>
+</main>
+
+<script>
+(function() {
+var $ = function(id) { return document.getElementById(id); };
+var token = sessionStorage.getItem("jcron_token") || "";
+var state = {view: "", jobs: [], job: null, runs: {skip: 0, limit: 20, total: 0}, errors: [], stream: null};
+
+function esc(s) {
+	return String(s == null ? "" : s).replace(/[&<>"']/g, function(c) {
+		return {"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;", "'": "&#39;"}[c];
+	});
+}
+
+function fmt(t) {
+	if (!t || t.indexOf("0001-01-01") == 0) {
+		return "";
+	}
+	var d = new Date(t);
+	var pad = function(n) { return n < 10 ? "0" + n : n; };
+	return d.getFullYear() + "-" + pad(d.getMonth() + 1) + "-" + pad(d.getDate()) + " " +
+		pad(d.getHours()) + ":" + pad(d.getMinutes()) + ":" + pad(d.getSeconds());
+}
+
+function headers() {
+	var h = {"Content-Type": "application/json"};
+	if (token) {
+		h["Authorization"] = "Bearer " + token;
+	}
+	return h;
+}
+
+function showMsg(s) {
+	$("msg").textContent = s || "";
+}
+
+// 调用/api/接口，返回result，出错时reject错误信息
+function api(method, params) {
+	return fetch("/api/" + method, {method: "POST", headers: headers(), body: JSON.stringify(params === undefined ? null : params)})
+		.then(function(resp) {
+			return resp.json().then(function(data) {
+				if (resp.status == 401) {
+					show("login");
+				}
+				if (data.error) {
+					throw data.error;
+				}
+				return data.result;
+			});
+		});
+}
+
+function fail(err) {
+	showMsg(String(err));
+}
+
+function show(view) {
+	if (state.stream) {
+		state.stream.abort();
+		state.stream = null;
+	}
+	state.view = view;
+	var views = document.querySelectorAll(".view");
+	for (var i = 0; i < views.length; i++) {
+		views[i].classList.toggle("hide", views[i].id != view);
+	}
+	var links = document.querySelectorAll("header a");
+	for (var i = 0; i < links.length; i++) {
+		links[i].classList.toggle("on", links[i].getAttribute("data-view") == view);
+	}
+}
+
+// 登录，没有令牌时（未开启认证或使用客户端证书）直接访问接口
+function login() {
+	var check = token ? api("Login", {Token: token}) : api("GetJobList", true).then(function() { return {}; });
+	check.then(function(session) {
+		$("user").textContent = session.User || "";
+		loadJobs();
+	}, function(err) {
+		show("login");
+		if (token) {
+			fail(err);
+		}
+	});
+}
+
+// 任务列表，合并job配置和调度信息
+function loadJobs() {
+	showMsg("");
+	show("jobs");
+	Promise.all([api("GetJobs", ""), api("GetJobList", true)]).then(function(res) {
+		var entries = {};
+		res[1].forEach(function(e) { entries[e.Name] = e; });
+		state.jobs = res[0].map(function(job) {
+			return {job: job, entry: entries[job.Name]};
+		});
+		renderJobs();
+	}, fail);
+}
+
+function renderJobs() {
+	var filter = $("filter").value.trim();
+	var html = "";
+	state.jobs.forEach(function(item, i) {
+		var job = item.job, entry = item.entry;
+		if (filter && job.Name.indexOf(filter) < 0 && (job.Category || "").indexOf(filter) < 0) {
+			return;
+		}
+		html += "<tr><td>" + esc(job.Name) + "</td><td>" + esc(job.Category) + "</td><td>" + esc(job.Desc) +
+			"</td><td>" + esc(job.Cron) + "</td><td>" + (entry ? (entry.Paused ? "已暂停" : "调度中") : "已停止") +
+			"</td><td>" + (entry ? entry.RunInstance.length + "/" + job.Channel : "") +
+			"</td><td>" + (entry ? fmt(entry.Prev) : "") + "</td><td>" + (entry ? fmt(entry.Next) : "") +
+			"</td><td data-i='" + i + "'>" +
+			(entry ? "<button data-act='stop'>停止</button>" : "<button data-act='start'>启动</button>") +
+			(entry ? (entry.Paused ? "<button data-act='resume'>恢复</button>" : "<button data-act='pause'>暂停</button>") : "") +
+			"<button data-act='run'>运行</button>" +
+			(job.Source ? "<span class='tip' title='" + esc(job.Source) + "'>文件管理</span> " : "<button data-act='edit'>编辑</button>") +
+			"<button data-act='runs'>运行记录</button></td></tr>";
+	});
+	$("jobList").innerHTML = html;
+}
+
+function jobAction(act, job) {
+	showMsg("");
+	if (act == "start" || act == "stop") {
+		api(act == "start" ? "StartJob" : "StopJob", job.Name).then(loadJobs, fail);
+	} else if (act == "pause") {
+		api("PauseJob", job.Name).then(loadJobs, fail);
+	} else if (act == "resume") {
+		var misfire = job.Misfire == "once" && confirm("补执行一次暂停期间错过的执行？");
+		api("ResumeJob", {Name: job.Name, Misfire: misfire}).then(loadJobs, fail);
+	} else if (act == "run") {
+		var param = prompt("运行参数，多个用空格分隔", "");
+		if (param === null) {
+			return;
+		}
+		param = param.trim() ? param.trim().split(/\s+/) : [];
+		api("RunOnceJob", {Name: job.Name, Param: param}).then(function() {
+			showMsg("已启动 " + job.Name);
+			loadJobs();
+		}, fail);
+	} else if (act == "edit") {
+		api("GetJob", job.Name).then(editJob, fail);
+	} else if (act == "runs") {
+		state.job = job;
+		state.runs.skip = 0;
+		loadRuns();
+	}
+}
+
+// 编辑任务，job为空时新建
+function editJob(job) {
+	showMsg("");
+	show("edit");
+	state.job = job;
+	var form = $("editForm");
+	var data = job || {Channel: 1, ExecType: "php", Content: []};
+	$("editTitle").textContent = job ? "编辑 " + job.Name : "新建任务";
+	form.Name.readOnly = !!job;
+	$("startRow").classList.toggle("hide", !!job);
+	["Name", "Category", "Desc", "Cron", "Channel", "Misfire", "ExecType", "ExecEnv", "ViewPerson", "NoticePerson"].forEach(function(k) {
+		form[k].value = data[k] == null ? "" : data[k];
+	});
+	form.Content.value = (data.Content || []).join("\n");
+	form.Status.checked = false;
+	previewCron();
+}
+
+function saveJob(e) {
+	e.preventDefault();
+	var form = $("editForm");
+	var job = {};
+	if (state.job) {
+		for (var k in state.job) {
+			job[k] = state.job[k];
+		}
+	}
+	["Name", "Category", "Desc", "Cron", "Misfire", "ExecType", "ExecEnv", "ViewPerson", "NoticePerson"].forEach(function(k) {
+		job[k] = form[k].value.trim();
+	});
+	job.Channel = parseInt(form.Channel.value, 10) || 0;
+	job.Content = form.Content.value.split("\n").map(function(s) { return s.trim(); }).filter(function(s) { return s; });
+	if (!state.job) {
+		job.Status = form.Status.checked ? 1 : 0;
+	}
+	api(state.job ? "UpdateJob" : "CreateJob", job).then(loadJobs, fail);
+}
+
+// cron表达式实时预览
+var previewTimer = null;
+function previewCron() {
+	clearTimeout(previewTimer);
+	previewTimer = setTimeout(function() {
+		var spec = $("editForm").Cron.value.trim();
+		if (!spec) {
+			$("cronPreview").textContent = "";
+			return;
+		}
+		api("ParseCron", {Cron: spec, Count: 5}).then(function(times) {
+			$("cronPreview").textContent = "之后执行：" + times.map(fmt).join("，");
+		}, function(err) {
+			$("cronPreview").textContent = "表达式错误：" + err;
+		});
+	}, 300);
+}
+
+// 运行记录
+function loadRuns() {
+	show("runs");
+	$("runsTitle").textContent = state.job.Name + " 运行记录";
+	$("output").classList.add("hide");
+	$("outputTitle").textContent = "";
+	var query = {Name: state.job.Name, Skip: state.runs.skip, Limit: state.runs.limit, Trigger: $("runTrigger").value};
+	if ($("runResult").value !== "") {
+		query.Result = parseInt($("runResult").value, 10);
+	}
+	api("GetJobRun", query).then(function(page) {
+		state.runs.total = page.Total;
+		$("runsPage").textContent = (state.runs.skip + 1) + "-" + (state.runs.skip + page.List.length) + " / " + page.Total;
+		var results = ["运行中", "正常", "异常", "丢失", "中断", "遗弃", "跳过"];
+		$("runList").innerHTML = page.List.map(function(run) {
+			return "<tr><td>" + esc(run.Id) + "</td><td>" + fmt(run.StartTime) + "</td><td>" +
+				(run.Result == 0 ? "" : fmt(run.EndTime)) + "</td><td>" + (results[run.Result] || run.Result) +
+				"</td><td>" + esc(run.Trigger) + "</td><td>" + (run.Pid || "") + "</td><td data-id='" + esc(run.Id) + "'>" +
+				"<button data-act='log'>输出</button>" + (run.Result == 0 ? "<button data-act='kill'>杀死</button>" : "") +
+				"</td></tr>";
+		}).join("");
+	}, fail);
+}
+
+function runAction(act, id) {
+	showMsg("");
+	if (act == "kill") {
+		if (!confirm("确定杀死实例 " + id + " ？")) {
+			return;
+		}
+		api("KillJobInstance", {JobName: state.job.Name, ObjectId: id}).then(loadRuns, fail);
+	} else if (act == "log") {
+		streamLog(id);
+	}
+}
+
+// 通过/stream接口输出实例日志，运行中的实例持续输出直到结束
+function streamLog(id) {
+	if (state.stream) {
+		state.stream.abort();
+	}
+	var out = $("output");
+	out.innerHTML = "";
+	out.classList.remove("hide");
+	$("outputTitle").textContent = "实例 " + id + " 输出";
+	var ctrl = window.AbortController ? new AbortController() : {abort: function() {}};
+	state.stream = ctrl;
+	var url = "/stream?job=" + encodeURIComponent(state.job.Name) + "&objectid=" + encodeURIComponent(id) + "&from=start";
+	fetch(url, {headers: headers(), signal: ctrl.signal}).then(function(resp) {
+		if (!resp.ok) {
+			return resp.text().then(function(s) { throw s; });
+		}
+		var reader = resp.body.getReader();
+		var decoder = new TextDecoder();
+		var buf = "";
+		var read = function() {
+			return reader.read().then(function(r) {
+				if (r.done) {
+					return;
+				}
+				buf += decoder.decode(r.value, {stream: true});
+				var lines = buf.split("\n");
+				buf = lines.pop();
+				lines.forEach(function(line) {
+					if (!line) {
+						return;
+					}
+					var item = JSON.parse(line);
+					var span = document.createElement("span");
+					if (item.error) {
+						span.className = "err";
+						span.textContent = item.error + "\n";
+					} else {
+						if (item.FromType == 1) {
+							span.className = "err";
+						}
+						span.textContent = item.Content;
+					}
+					out.appendChild(span);
+				});
+				out.scrollTop = out.scrollHeight;
+				return read();
+			});
+		};
+		return read();
+	}).catch(function(err) {
+		if (!err || err.name != "AbortError") {
+			fail(err);
+		}
+	});
+}
+
+// 错误日志
+function loadErrors() {
+	showMsg("");
+	show("errors");
+	var status = {unread: "未读", acked: "已确认", resolved: "已解决"};
+	api("GetErrLog", {Name: $("errName").value.trim(), Status: $("errStatus").value, Limit: 100}).then(function(list) {
+		state.errors = list;
+		$("errList").innerHTML = list.map(function(e, i) {
+			return "<tr><td>" + esc(e.Name) + "</td><td>" + fmt(e.Time) + "</td><td>" + esc(e.LogId) +
+				"</td><td>" + (status[e.Status] || esc(e.Status)) + "</td><td>" + esc(e.User) + "</td><td>" +
+				fmt(e.StatusTime) + "</td><td>" + esc(e.Note) + "</td><td data-i='" + i + "'>" +
+				"<button data-act='log'>输出</button>" +
+				(e.Status == "unread" ? "<button data-act='ack'>确认</button>" : "") +
+				(e.Status != "resolved" ? "<button data-act='resolve'>解决</button>" : "") +
+				"</td></tr>";
+		}).join("");
+	}, fail);
+}
+
+function errAction(act, e) {
+	showMsg("");
+	if (act == "ack") {
+		api("AckErrLog", {LogIds: [e.LogId]}).then(loadErrors, fail);
+	} else if (act == "resolve") {
+		var note = prompt("处理备注", "");
+		if (!note) {
+			return;
+		}
+		api("ResolveErrLog", {LogIds: [e.LogId], Note: note}).then(loadErrors, fail);
+	} else if (act == "log") {
+		state.job = {Name: e.Name};
+		state.runs.skip = 0;
+		loadRuns();
+		streamLog(e.LogId);
+	}
+}
+
+function ackAll() {
+	var logIds = state.errors.filter(function(e) { return e.Status == "unread"; }).map(function(e) { return e.LogId; });
+	if (!logIds.length) {
+		return;
+	}
+	api("AckErrLog", {LogIds: logIds}).then(function(n) {
+		loadErrors();
+		showMsg("已确认 " + n + " 条");
+	}, fail);
+}
+
+// 事件绑定
+function delegate(id, attr, fn) {
+	$(id).addEventListener("click", function(e) {
+		var act = e.target.getAttribute("data-act");
+		if (!act) {
+			return;
+		}
+		fn(act, e.target.parentNode.getAttribute(attr));
+	});
+}
+
+delegate("jobList", "data-i", function(act, i) { jobAction(act, state.jobs[i].job); });
+delegate("runList", "data-id", runAction);
+delegate("errList", "data-i", function(act, i) { errAction(act, state.errors[i]); });
+var links = document.querySelectorAll("header a");
+for (var i = 0; i < links.length; i++) {
+	links[i].addEventListener("click", function(e) {
+		e.target.getAttribute("data-view") == "jobs" ? loadJobs() : loadErrors();
+	});
+}
+$("loginBtn").onclick = function() {
+	token = $("token").value.trim();
+	sessionStorage.setItem("jcron_token", token);
+	showMsg("");
+	login();
+};
+$("logout").onclick = function() {
+	token = "";
+	sessionStorage.removeItem("jcron_token");
+	$("user").textContent = "";
+	show("login");
+};
+$("filter").oninput = renderJobs;
+$("refresh").onclick = loadJobs;
+$("create").onclick = function() { editJob(null); };
+$("cancel").onclick = loadJobs;
+$("editForm").onsubmit = saveJob;
+$("editForm").Cron.oninput = previewCron;
+$("runsRefresh").onclick = loadRuns;
+$("runResult").onchange = function() { state.runs.skip = 0; loadRuns(); };
+$("runTrigger").onchange = $("runResult").onchange;
+$("runsPrev").onclick = function() {
+	state.runs.skip = Math.max(0, state.runs.skip - state.runs.limit);
+	loadRuns();
+};
+$("runsNext").onclick = function() {
+	if (state.runs.skip + state.runs.limit < state.runs.total) {
+		state.runs.skip += state.runs.limit;
+		loadRuns();
+	}
+};
+$("errRefresh").onclick = loadErrors;
+$("errStatus").onchange = loadErrors;
+$("errAckAll").onclick = ackAll;
+
+login();
+})();
+</script>
+</body>
+</html>
+`
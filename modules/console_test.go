@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestServeConsole(t *testing.T) {
+	tests := []struct {
+		path     string
+		status   int
+		location string
+	}{
+		{consolePath, http.StatusOK, ""},
+		{"/", http.StatusFound, consolePath},
+		{consolePath + "app.js", http.StatusNotFound, ""},
+		{"/other", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		httpMux.ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+		if w.Code != test.status || w.Header().Get("Location") != test.location {
+			t.Errorf("%s: expected %d %q, got %d %q", test.path, test.status, test.location, w.Code, w.Header().Get("Location"))
+		}
+	}
+
+	w := httptest.NewRecorder()
+	httpMux.ServeHTTP(w, httptest.NewRequest("GET", consolePath, nil))
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") || w.Header().Get("X-Frame-Options") != "DENY" {
+		t.Errorf("unexpected headers %v", w.Header())
+	}
+	if w.Body.String() != consoleHtml {
+		t.Error("unexpected console body")
+	}
+}
+
+// 测试页面调用的接口都存在
+func TestConsoleApis(t *testing.T) {
+	calls := regexp.MustCompile(`api\("(\w+)"`).FindAllStringSubmatch(consoleHtml, -1)
+	if len(calls) == 0 {
+		t.Fatal("no api calls found")
+	}
+	cal := reflect.ValueOf(&Calculator{})
+	for _, call := range calls {
+		if !cal.MethodByName(call[1]).IsValid() {
+			t.Errorf("console calls unknown api %s", call[1])
+		}
+	}
+}
@@ -3,13 +3,23 @@
 package cron
 
 import (
+	"errors"
 	"log"
 	"os"
+	"reflect"
 	"runtime"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// 调度循环的心跳间隔，没有任务触发时也会按这个间隔更新心跳
+const heartbeatInterval = time.Second
+
+// 从指定的下次执行时间开始调度时，一个任务最多记录的合并触发次数
+const maxCoalesced = 100
+
 // Cron keeps track of any number of entries, invoking the associated func as
 // specified by the schedule. It may be started, stopped, and the entries may
 // be inspected while running.
@@ -18,23 +28,87 @@ type Cron struct {
 	stop     chan struct{} // 停止任务
 	add      chan *Entry   // 添加任务
 	remove   chan string   // 删除任务
+	update   chan *Entry   // 修改任务
 	snapshot chan []*Entry
+	pause    chan *pauseRequest // 暂停、恢复任务
 	running  bool
 	ErrorLog *log.Logger
 	location *time.Location
+	// 任务触发时的回调，用于统计调度延迟，scheduled为计划执行时间，now为实际执行时间
+	OnFire func(name string, scheduled, now time.Time)
+	// 任务触发前的检查，返回false时跳过本次触发，用于只允许领导者节点运行任务
+	Gate func() bool
+	// 单个任务触发前的检查，返回true时跳过本次触发，下次执行时间照常计算，用于维护暂停，scheduled为计划执行时间
+	Hold func(name string, scheduled time.Time) bool
+	// 从指定的下次执行时间开始调度时，已过期的任务只执行一次，其他错过的触发时间通过该回调记录，在调度循环中调用，不能阻塞
+	OnSkip func(name string, scheduled time.Time)
+	// 调度循环最近一次迭代的时间（UnixNano）和当时的任务数，不经过调度循环读取
+	lastLoop   int64
+	entryCount int64
+	// 已删除、还有实例在运行的任务，重新添加同名任务时把实例交给新的任务管理
+	removed     map[string]Job
+	removedLock sync.Mutex
+	// 启动时使用的下次执行时间，用于从上一个进程停止的位置继续调度
+	startNext map[string]time.Time
+}
+
+// 暂停、恢复请求，运行中时由调度循环处理
+type pauseRequest struct {
+	name    string
+	paused  bool
+	catchUp bool
+	missed  int // 恢复时返回暂停期间错过的触发次数
+	done    chan error
 }
 
 type RunInfo struct {
 	Date     time.Time   //启动时间
 	Proc     *os.Process // 命令行进程句柄
 	ObjectId string
+	Agent    string // 运行的agent，为空时在本机运行
+	ExecType string // 执行程序类型，php或http，写入实例日志，重启后按类型恢复
+}
+
+// 实例日志，实例开始和结束时记录，调度程序重启后据此恢复正在运行的实例
+type Journal interface {
+	// 实例开始，name为job名称
+	Start(name string, run *RunInfo)
+	// 实例结束
+	Finish(objectId string)
+}
+
+// 调度程序设置的实例日志，为nil时不记录
+var InstanceJournal Journal
+
+// 记录实例开始
+func JournalStart(name string, run *RunInfo) {
+	if InstanceJournal != nil && run.ObjectId != "" {
+		InstanceJournal.Start(name, run)
+	}
+}
+
+// 记录实例结束
+func JournalFinish(objectId string) {
+	if InstanceJournal != nil && objectId != "" {
+		InstanceJournal.Finish(objectId)
+	}
 }
 
 type JobList struct {
 	Name        string
 	RunInstance []*RunInfo
+	Cron        string    // 执行频率
+	Next        time.Time // 下次执行时间
+	Prev        time.Time // 上次执行时间
+	Paused      bool      // 是否已暂停
 }
 
+// 触发方式
+const (
+	TriggerCron   = "cron"   // 定时触发
+	TriggerManual = "manual" // 手动触发
+)
+
 type TestJob struct {
 	Name  string
 	Param []string
@@ -43,10 +117,12 @@ type TestJob struct {
 // Job is an interface for submitted cron jobs.
 type Job interface {
 	Run(param []string)
+	RunOnce(param []string)
 	Add(runInfo *RunInfo)
 	Kill(objectId string) error
 	List() []*RunInfo
 	Channel() int
+	SetChannel(num int)
 }
 
 //job集合
@@ -63,7 +139,7 @@ type JobCollection struct {
 	Channel int
 	//运行内容
 	Content []string
-	//运行状态，0未运行，1运行中
+	//运行状态，0未运行，1运行中，2已暂停
 	Status int
 	//添加人
 	AddPerson string
@@ -83,8 +159,29 @@ type JobCollection struct {
 	ExecType string
 	//执行程序环境变量
 	ExecEnv string
+	//job来源，为空表示通过接口或网站添加，file:<文件名>表示由job定义文件管理
+	Source string
+	//运行位置限制，只在具有所有标签的agent上运行
+	Labels map[string]string
+	//运行位置限制，只在这些agent上运行
+	Hosts []string
+	//错过执行时间的处理方式，恢复暂停时使用，skip或为空时跳过，once补执行一次
+	Misfire string
 }
 
+// job运行状态
+const (
+	StatusStopped = 0 // 未运行
+	StatusRunning = 1 // 运行中
+	StatusPaused  = 2 // 已暂停，仍在调度列表中，到了执行时间不触发
+)
+
+// 错过执行时间的处理方式
+const (
+	MisfireSkip = "skip" // 跳过
+	MisfireOnce = "once" // 补执行一次
+)
+
 //job实例
 type JobInstance struct {
 	//job name
@@ -123,6 +220,12 @@ type Entry struct {
 
 	// The Job to run.
 	Job Job
+
+	// 是否已暂停，暂停的任务不触发，下次执行时间照常计算
+	Paused bool
+
+	// 暂停期间错过的触发次数
+	Missed int
 }
 
 // byTime is a wrapper for sorting the entry array by time
@@ -155,8 +258,10 @@ func NewWithLocation(location *time.Location) *Cron {
 		entries:  nil,
 		add:      make(chan *Entry),
 		remove:   make(chan string),
+		update:   make(chan *Entry),
 		stop:     make(chan struct{}),
 		snapshot: make(chan []*Entry),
+		pause:    make(chan *pauseRequest),
 		running:  false,
 		ErrorLog: nil,
 		location: location,
@@ -167,10 +272,12 @@ func NewWithLocation(location *time.Location) *Cron {
 type FuncJob func()
 
 func (f FuncJob) Run(param []string)         { f() }
+func (f FuncJob) RunOnce(param []string)     { f() }
 func (f FuncJob) Add(runInfo *RunInfo)       { f() }
 func (f FuncJob) Kill(objectId string) error { return nil }
 func (f FuncJob) List() []*RunInfo           { return []*RunInfo{} }
 func (f FuncJob) Channel() int               { return 0 }
+func (f FuncJob) SetChannel(num int)         {}
 
 // AddFunc adds a func to the Cron to be run on the given schedule.
 func (c *Cron) AddFunc(name, desc, cron string, cmd func()) (int, error) {
@@ -186,6 +293,26 @@ func (c *Cron) RemoveFunc(name string) {
 	}
 }
 
+// 修改计划任务的描述和执行频率，正在运行的实例不受影响
+func (c *Cron) UpdateJob(name, desc, cron string) error {
+	schedule, err := Parse(cron)
+	if err != nil {
+		return err
+	}
+	entry := &Entry{
+		Name:     name,
+		Desc:     desc,
+		Cron:     cron,
+		Schedule: schedule,
+	}
+	if !c.running {
+		c.updateEntry(entry)
+	} else {
+		c.update <- entry
+	}
+	return nil
+}
+
 // AddJob adds a Job to the Cron to be run on the given schedule.
 func (c *Cron) AddJob(name, desc, cron string, cmd Job) (int, error) {
 	schedule, err := Parse(cron)
@@ -198,12 +325,17 @@ func (c *Cron) AddJob(name, desc, cron string, cmd Job) (int, error) {
 
 // Schedule adds a Job to the Cron to be run on the given schedule.
 func (c *Cron) Schedule(name, desc, cron string, schedule Schedule, cmd Job) int {
-	//这里判断一下，添加重复任务时（name重复），id返回0
-	for _, entry := range c.entries {
+	//这里判断一下，添加重复任务时（name重复），id返回0，运行中时调度列表只能在调度循环中读取
+	entries := c.entries
+	if c.running {
+		entries = c.Entries()
+	}
+	for _, entry := range entries {
 		if entry.Name == name {
 			return -1
 		}
 	}
+	c.adopt(name, cmd)
 	var entry = &Entry{
 		Name:     name,
 		Desc:     desc,
@@ -220,6 +352,78 @@ func (c *Cron) Schedule(name, desc, cron string, schedule Schedule, cmd Job) int
 	return 0
 }
 
+// 替换任务的job对象、描述和执行频率，cmd需要是新创建的job，原job还在运行的实例按adopt加入新的job，任务不存在时添加。
+// 在调度循环中替换，不会出现任务被删除后还没有重新添加的间隙
+func (c *Cron) ReplaceJob(name, desc, cron string, cmd Job) error {
+	schedule, err := Parse(cron)
+	if err != nil {
+		return err
+	}
+	entry := &Entry{
+		Name:     name,
+		Desc:     desc,
+		Cron:     cron,
+		Schedule: schedule,
+		Job:      cmd,
+	}
+	if !c.running {
+		c.updateEntry(entry)
+	} else {
+		c.update <- entry
+	}
+	return nil
+}
+
+// 暂停任务，任务保留在调度列表中，实例列表不变，到了执行时间不触发，已暂停时不做修改
+func (c *Cron) Pause(name string) error {
+	_, err := c.setPaused(&pauseRequest{name: name, paused: true})
+	return err
+}
+
+// 恢复暂停的任务，返回暂停期间错过的触发次数，catchUp为true且有错过时立即执行一次，未暂停时返回0
+func (c *Cron) Resume(name string, catchUp bool) (int, error) {
+	return c.setPaused(&pauseRequest{name: name, catchUp: catchUp})
+}
+
+func (c *Cron) setPaused(req *pauseRequest) (int, error) {
+	if !c.running {
+		err := c.applyPause(req)
+		return req.missed, err
+	}
+	req.done = make(chan error, 1)
+	c.pause <- req
+	err := <-req.done
+	return req.missed, err
+}
+
+// 修改任务的暂停状态，在调度循环中执行
+func (c *Cron) applyPause(req *pauseRequest) error {
+	for _, entry := range c.entries {
+		if entry.Name != req.name {
+			continue
+		}
+		if req.paused {
+			if !entry.Paused {
+				entry.Paused = true
+				entry.Missed = 0
+			}
+			return nil
+		}
+		if !entry.Paused {
+			return nil
+		}
+		entry.Paused = false
+		req.missed = entry.Missed
+		entry.Missed = 0
+		// 补执行和定时触发一样受Gate、Hold限制，未启动时不补执行
+		if req.catchUp && req.missed > 0 && c.running && (c.Gate == nil || c.Gate()) && (c.Hold == nil || !c.Hold(entry.Name, time.Now().In(c.location))) {
+			go c.runWithRecovery(entry.Job)
+		}
+		return nil
+	}
+	return errors.New("job is not scheduled: " + req.name)
+}
+
 // Entries returns a snapshot of the cron entries.
 func (c *Cron) Entries() []*Entry {
 	if c.running {
@@ -230,6 +434,15 @@ func (c *Cron) Entries() []*Entry {
 	return c.entrySnapshot()
 }
 
+// 返回调度循环最近一次迭代的时间和任务数，调度循环卡住时时间不再更新，未启动时返回零值
+func (c *Cron) Heartbeat() (time.Time, int) {
+	last := atomic.LoadInt64(&c.lastLoop)
+	if last == 0 {
+		return time.Time{}, 0
+	}
+	return time.Unix(0, last), int(atomic.LoadInt64(&c.entryCount))
+}
+
 // Location gets the time zone location
 func (c *Cron) Location() *time.Location {
 	return c.location
@@ -244,6 +457,16 @@ func (c *Cron) Start() {
 	go c.run()
 }
 
+// 从指定的下次执行时间开始调度，next为上一个进程停止时各任务的下次执行时间，
+// 已过期的立即执行一次，不在next中的任务从当前时间计算
+func (c *Cron) StartFrom(next map[string]time.Time) {
+	if c.running {
+		return
+	}
+	c.startNext = next
+	c.Start()
+}
+
 func (c *Cron) runWithRecovery(j Job) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -262,10 +485,22 @@ func (c *Cron) run() {
 	// Figure out the next activation times for each entry.
 	now := time.Now().In(c.location)
 	for _, entry := range c.entries {
-		entry.Next = entry.Schedule.Next(now)
+		if next, ok := c.startNext[entry.Name]; ok && !next.IsZero() {
+			entry.Next = next.In(c.location)
+			c.coalesce(entry, now)
+		} else {
+			entry.Next = entry.Schedule.Next(now)
+		}
 	}
+	c.startNext = nil
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
 
 	for {
+		atomic.StoreInt64(&c.lastLoop, time.Now().UnixNano())
+		atomic.StoreInt64(&c.entryCount, int64(len(c.entries)))
+
 		// Determine the next entry to run.
 		sort.Sort(byTime(c.entries))
 
@@ -283,11 +518,19 @@ func (c *Cron) run() {
 		case now = <-timer.C:
 			now = now.In(c.location)
 			// Run every entry whose next time was this effective time.
+			allowed := c.Gate == nil || c.Gate()
 			for _, e := range c.entries {
 				if e.Next != effective {
 					break
 				}
-				go c.runWithRecovery(e.Job)
+				if e.Paused {
+					e.Missed++
+				} else if allowed && (c.Hold == nil || !c.Hold(e.Name, effective)) {
+					go c.runWithRecovery(e.Job)
+					if c.OnFire != nil {
+						c.OnFire(e.Name, effective, now)
+					}
+				}
 				e.Prev = e.Next
 				e.Next = e.Schedule.Next(now)
 			}
@@ -300,9 +543,17 @@ func (c *Cron) run() {
 		case name := <-c.remove:
 			c.delEntry(name)
 
+		case newEntry := <-c.update:
+			c.updateEntry(newEntry)
+
 		case <-c.snapshot:
 			c.snapshot <- c.entrySnapshot()
 
+		case req := <-c.pause:
+			req.done <- c.applyPause(req)
+
+		case <-heartbeat.C:
+
 		case <-c.stop:
 			timer.Stop()
 			return
@@ -314,6 +565,22 @@ func (c *Cron) run() {
 	}
 }
 
+// 已过期的下次执行时间只触发一次，之后到now为止错过的触发时间暂停中的计入错过次数，否则交给OnSkip记录
+func (c *Cron) coalesce(entry *Entry, now time.Time) {
+	t := entry.Next
+	for i := 0; i < maxCoalesced; i++ {
+		t = entry.Schedule.Next(t)
+		if t.IsZero() || t.After(now) {
+			return
+		}
+		if entry.Paused {
+			entry.Missed++
+		} else if c.OnSkip != nil {
+			c.OnSkip(entry.Name, t)
+		}
+	}
+}
+
 // Logs an error to stderr or to the configured error log
 func (c *Cron) logf(format string, args ...interface{}) {
 	if c.ErrorLog != nil {
@@ -328,7 +595,95 @@ func (c *Cron) delEntry(name string) {
 	for i, entry := range c.entries {
 		if entry.Name == name {
 			c.entries = append(c.entries[:i], c.entries[i+1:]...)
+			c.keepRemoved(name, entry.Job)
+		}
+	}
+}
+
+/**
+ * 保存不在调度中、还有实例在运行的任务，实例在全部结束前可以通过Lookup查看和杀死，重新添加任务时转入新的任务
+ */
+func (c *Cron) Keep(name string, job Job) {
+	c.keepRemoved(name, job)
+}
+
+// 记录删除时还有实例在运行的任务，同时清理实例已全部结束的任务
+func (c *Cron) keepRemoved(name string, job Job) {
+	c.removedLock.Lock()
+	defer c.removedLock.Unlock()
+	for removedName, removedJob := range c.removed {
+		if len(removedJob.List()) == 0 {
+			delete(c.removed, removedName)
+		}
+	}
+	if len(job.List()) == 0 {
+		return
+	}
+	if c.removed == nil {
+		c.removed = map[string]Job{}
+	}
+	c.removed[name] = job
+}
+
+/**
+ * 查找任务，正在调度的任务不存在时查找已删除、还有实例在运行的任务，都不存在时返回nil
+ */
+func (c *Cron) Lookup(name string) Job {
+	for _, entry := range c.Entries() {
+		if entry.Name == name {
+			return entry.Job
+		}
+	}
+	c.removedLock.Lock()
+	defer c.removedLock.Unlock()
+	job := c.removed[name]
+	if job != nil && len(job.List()) == 0 {
+		delete(c.removed, name)
+		return nil
+	}
+	return job
+}
+
+// 重新添加已删除的任务时，把还在运行的命令行实例和agent上的实例加入新的任务，命令行实例占用新任务的并发数，执行程序类型不同时不加入
+func (c *Cron) adopt(name string, job Job) {
+	c.removedLock.Lock()
+	old := c.removed[name]
+	delete(c.removed, name)
+	c.removedLock.Unlock()
+	if old == nil || reflect.TypeOf(old) != reflect.TypeOf(job) {
+		return
+	}
+	for _, runInfo := range old.List() {
+		if runInfo.Proc != nil || runInfo.Agent != "" {
+			job.Add(runInfo)
+		}
+	}
+}
+
+// 修改计划任务，运行中时重新计算下次执行时间，newEntry带有job时替换job，任务不存在时添加
+func (c *Cron) updateEntry(newEntry *Entry) {
+	for _, entry := range c.entries {
+		if entry.Name == newEntry.Name {
+			entry.Desc = newEntry.Desc
+			entry.Cron = newEntry.Cron
+			entry.Schedule = newEntry.Schedule
+			if newEntry.Job != nil {
+				c.keepRemoved(entry.Name, entry.Job)
+				c.adopt(entry.Name, newEntry.Job)
+				entry.Job = newEntry.Job
+			}
+			if c.running {
+				entry.Next = entry.Schedule.Next(time.Now().In(c.location))
+			}
+			return
+		}
+	}
+	if newEntry.Job != nil {
+		c.adopt(newEntry.Name, newEntry.Job)
+		if c.running {
+			newEntry.Next = newEntry.Schedule.Next(time.Now().In(c.location))
 		}
+		c.entries = append(c.entries, newEntry)
 	}
 }
 
@@ -353,6 +708,8 @@ func (c *Cron) entrySnapshot() []*Entry {
 			Next:     e.Next,
 			Prev:     e.Prev,
 			Job:      e.Job,
+			Paused:   e.Paused,
+			Missed:   e.Missed,
 		})
 	}
 	return entries
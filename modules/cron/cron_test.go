@@ -16,7 +16,7 @@ func TestFuncPanicRecovery(t *testing.T) {
 	cron := New()
 	cron.Start()
 	defer cron.Stop()
-	cron.AddFunc("TestFuncPanicRecovery", "* * * * * ?", func() { panic("YOLO") })
+	cron.AddFunc("TestFuncPanicRecovery", "", "* * * * * ?", func() { panic("YOLO") })
 
 	select {
 	case <-time.After(ONE_SECOND):
@@ -24,9 +24,11 @@ func TestFuncPanicRecovery(t *testing.T) {
 	}
 }
 
-type DummyJob struct{}
+type DummyJob struct {
+	FuncJob
+}
 
-func (d DummyJob) Run() {
+func (d DummyJob) Run(param []string) {
 	panic("YOLO")
 }
 
@@ -36,7 +38,7 @@ func TestJobPanicRecovery(t *testing.T) {
 	cron := New()
 	cron.Start()
 	defer cron.Stop()
-	cron.AddJob("TestJobPanicRecovery", "* * * * * ?", job)
+	cron.AddJob("TestJobPanicRecovery", "", "* * * * * ?", job)
 
 	select {
 	case <-time.After(ONE_SECOND):
@@ -64,7 +66,7 @@ func TestStopCausesJobsToNotRun(t *testing.T) {
 	cron := New()
 	cron.Start()
 	cron.Stop()
-	cron.AddFunc("TestStopCausesJobsToNotRun", "* * * * * ?", func() { wg.Done() })
+	cron.AddFunc("TestStopCausesJobsToNotRun", "", "* * * * * ?", func() { wg.Done() })
 
 	select {
 	case <-time.After(ONE_SECOND):
@@ -80,7 +82,7 @@ func TestAddBeforeRunning(t *testing.T) {
 	wg.Add(1)
 
 	cron := New()
-	cron.AddFunc("TestAddBeforeRunning", "* * * * * ?", func() { wg.Done() })
+	cron.AddFunc("TestAddBeforeRunning", "", "* * * * * ?", func() { wg.Done() })
 	cron.Start()
 	defer cron.Stop()
 
@@ -100,7 +102,7 @@ func TestAddWhileRunning(t *testing.T) {
 	cron := New()
 	cron.Start()
 	defer cron.Stop()
-	cron.AddFunc("TestAddWhileRunning", "* * * * * ?", func() { wg.Done() })
+	cron.AddFunc("TestAddWhileRunning", "", "* * * * * ?", func() { wg.Done() })
 
 	select {
 	case <-time.After(ONE_SECOND):
@@ -116,7 +118,7 @@ func TestAddWhileRunningWithDelay(t *testing.T) {
 	defer cron.Stop()
 	time.Sleep(5 * time.Second)
 	var calls = 0
-	cron.AddFunc("TestAddWhileRunningWithDelay", "* * * * * *", func() { calls += 1 })
+	cron.AddFunc("TestAddWhileRunningWithDelay", "", "* * * * * *", func() { calls += 1 })
 
 	<-time.After(ONE_SECOND)
 	if calls != 1 {
@@ -131,7 +133,7 @@ func TestSnapshotEntries(t *testing.T) {
 	wg.Add(1)
 
 	cron := New()
-	cron.AddFunc("TestSnapshotEntries", "@every 2s", func() { wg.Done() })
+	cron.AddFunc("TestSnapshotEntries", "", "@every 2s", func() { wg.Done() })
 	cron.Start()
 	defer cron.Stop()
 
@@ -159,10 +161,10 @@ func TestMultipleEntries(t *testing.T) {
 	wg.Add(2)
 
 	cron := New()
-	cron.AddFunc("TestMultipleEntries_1", "0 0 0 1 1 ?", func() {})
-	cron.AddFunc("TestMultipleEntries_2", "* * * * * ?", func() { wg.Done() })
-	cron.AddFunc("TestMultipleEntries_3", "0 0 0 31 12 ?", func() {})
-	cron.AddFunc("TestMultipleEntries_4", "* * * * * ?", func() { wg.Done() })
+	cron.AddFunc("TestMultipleEntries_1", "", "0 0 0 1 1 ?", func() {})
+	cron.AddFunc("TestMultipleEntries_2", "", "* * * * * ?", func() { wg.Done() })
+	cron.AddFunc("TestMultipleEntries_3", "", "0 0 0 31 12 ?", func() {})
+	cron.AddFunc("TestMultipleEntries_4", "", "* * * * * ?", func() { wg.Done() })
 
 	cron.Start()
 	defer cron.Stop()
@@ -180,9 +182,9 @@ func TestRunningJobTwice(t *testing.T) {
 	wg.Add(2)
 
 	cron := New()
-	cron.AddFunc("TestRunningJobTwice_1", "0 0 0 1 1 ?", func() {})
-	cron.AddFunc("TestRunningJobTwice_2", "0 0 0 31 12 ?", func() {})
-	cron.AddFunc("TestRunningJobTwice_3", "* * * * * ?", func() { wg.Done() })
+	cron.AddFunc("TestRunningJobTwice_1", "", "0 0 0 1 1 ?", func() {})
+	cron.AddFunc("TestRunningJobTwice_2", "", "0 0 0 31 12 ?", func() {})
+	cron.AddFunc("TestRunningJobTwice_3", "", "* * * * * ?", func() { wg.Done() })
 
 	cron.Start()
 	defer cron.Stop()
@@ -199,12 +201,12 @@ func TestRunningMultipleSchedules(t *testing.T) {
 	wg.Add(2)
 
 	cron := New()
-	cron.AddFunc("TestRunningMultipleSchedules_1", "0 0 0 1 1 ?", func() {})
-	cron.AddFunc("TestRunningMultipleSchedules_2", "0 0 0 31 12 ?", func() {})
-	cron.AddFunc("TestRunningMultipleSchedules_3", "* * * * * ?", func() { wg.Done() })
-	cron.Schedule("TestRunningMultipleSchedules_4", "every minute", Every(time.Minute), FuncJob(func() {}))
-	cron.Schedule("TestRunningMultipleSchedules_5", "every Second", Every(time.Second), FuncJob(func() { wg.Done() }))
-	cron.Schedule("TestRunningMultipleSchedules_6", "every Hour", Every(time.Hour), FuncJob(func() {}))
+	cron.AddFunc("TestRunningMultipleSchedules_1", "", "0 0 0 1 1 ?", func() {})
+	cron.AddFunc("TestRunningMultipleSchedules_2", "", "0 0 0 31 12 ?", func() {})
+	cron.AddFunc("TestRunningMultipleSchedules_3", "", "* * * * * ?", func() { wg.Done() })
+	cron.Schedule("TestRunningMultipleSchedules_4", "every minute", "", Every(time.Minute), FuncJob(func() {}))
+	cron.Schedule("TestRunningMultipleSchedules_5", "every Second", "", Every(time.Second), FuncJob(func() { wg.Done() }))
+	cron.Schedule("TestRunningMultipleSchedules_6", "every Hour", "", Every(time.Hour), FuncJob(func() {}))
 
 	cron.Start()
 	defer cron.Stop()
@@ -221,58 +223,56 @@ func TestRemoveBeforeRun(t *testing.T) {
 	wg.Add(1)
 
 	cron := New()
-	id, err := cron.AddFunc("TestRemoveBeforeRun", "* * * * * ?", func() {
+	_, err := cron.AddFunc("TestRemoveBeforeRun", "", "* * * * * ?", func() {
 		wg.Done()
 		fmt.Println("TestRemoveBeforeRun")
 	})
 	if err != nil {
 		t.Log(err.Error())
 	}
-	cron.RemoveFunc(id)
+	cron.RemoveFunc("TestRemoveBeforeRun")
 
 	cron.Start()
 	defer cron.Stop()
 
-	// Give cron 2 seconds to run our job (which is always activated).
+	// Give cron 2 seconds to run our job (which is always activated), the removed job must not run.
 	select {
 	case <-time.After(2 * ONE_SECOND):
-		t.FailNow()
 	case <-wait(wg):
+		t.FailNow()
 	}
 }
 
+// Remove a job while running, expect it stops running and the other job keeps running.
 func TestRemoveWithRun(t *testing.T) {
-	wg := &sync.WaitGroup{}
-	wg.Add(8)
+	removed := make(chan bool, 10)
+	kept := make(chan bool, 10)
+
 	cron := New()
-	id_1, err := cron.AddFunc("TestRemoveWithRun_1", "* * * * * ?", func() {
-		wg.Done()
-		fmt.Println("TestRemoveWithRun_1")
-	})
-	if err != nil {
-		t.Log(err.Error())
-	}
+	cron.AddFunc("TestRemoveWithRun_1", "", "* * * * * ?", func() { removed <- true })
 	cron.Start()
 	defer cron.Stop()
+	cron.AddFunc("TestRemoveWithRun_2", "", "* * * * * ?", func() { kept <- true })
 
-	_, err = cron.AddFunc("TestRemoveWithRun_2", "* * * * * ?", func() {
-		wg.Done()
-		fmt.Println("TestRemoveWithRun_2")
-	})
-	if err != nil {
-		t.Log(err.Error())
-	}
-
-	// Give cron 2 seconds to run our job (which is always activated).
 	select {
-	case <-time.After(2 * ONE_SECOND):
-		cron.RemoveFunc(id_1)
-	case <-wait(wg):
+	case <-time.After(ONE_SECOND):
+		t.Fatal("job not run")
+	case <-removed:
+	}
+	cron.RemoveFunc("TestRemoveWithRun_1")
+	// 删除前已触发的运行可能还没有写入
+	time.Sleep(100 * time.Millisecond)
+	for len(removed) > 0 {
+		<-removed
 	}
 
 	select {
 	case <-time.After(2 * ONE_SECOND):
-		t.FailNow()
+		t.Fatal("kept job not run")
+	case <-kept:
+	}
+	if len(removed) > 0 {
+		t.Error("removed job should not run")
 	}
 }
 
@@ -286,7 +286,7 @@ func TestLocalTimezone(t *testing.T) {
 		now.Second()+1, now.Second()+2, now.Minute(), now.Hour(), now.Day(), now.Month())
 
 	cron := New()
-	cron.AddFunc("TestLocalTimezone", spec, func() { wg.Done() })
+	cron.AddFunc("TestLocalTimezone", "", spec, func() { wg.Done() })
 	cron.Start()
 	defer cron.Stop()
 
@@ -313,7 +313,7 @@ func TestNonLocalTimezone(t *testing.T) {
 		now.Second()+1, now.Second()+2, now.Minute(), now.Hour(), now.Day(), now.Month())
 
 	cron := NewWithLocation(loc)
-	cron.AddFunc(spec, func() { wg.Done() })
+	cron.AddFunc("TestNonLocalTimezone", "", spec, func() { wg.Done() })
 	cron.Start()
 	defer cron.Stop()
 
@@ -332,42 +332,45 @@ func TestStopWithoutStart(t *testing.T) {
 }
 
 type testJob struct {
+	FuncJob
 	wg   *sync.WaitGroup
 	name string
 }
 
-func (t testJob) Run() {
+func (t testJob) Run(param []string) {
 	t.wg.Done()
 	fmt.Println(t.name)
 }
 
 func TestEveryJon(t *testing.T) {
 	wg := &sync.WaitGroup{}
-	wg.Add(10)
+	wg.Add(2)
 
 	cron := New()
-	cron.Schedule("test every jon", "every 25 second", Every(25*time.Second), testJob{wg, "test every 25 second"})
+	cron.Schedule("test every jon", "every second", "", Every(time.Second), testJob{wg: wg, name: "test every second"})
 
 	cron.Start()
 	defer cron.Stop()
 
 	select {
+	case <-time.After(3 * ONE_SECOND):
+		t.FailNow()
 	case <-wait(wg):
 	}
 }
 
 // Simple test using Runnables.
-func TestJob(t *testing.T) {
+func TestJobs(t *testing.T) {
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
 
 	cron := New()
-	cron.AddJob("TestJob_0", "0 0 0 30 Feb ?", testJob{wg, "job0"})
-	cron.AddJob("TestJob_1", "0 0 0 1 1 ?", testJob{wg, "job1"})
-	cron.AddJob("TestJob_2", "* * * * * ?", testJob{wg, "job2"})
-	cron.AddJob("TestJob_3", "1 0 0 1 1 ?", testJob{wg, "job3"})
-	cron.Schedule("TestJob_4", "every 5 second", Every(5*time.Second+5*time.Nanosecond), testJob{wg, "job4"})
-	cron.Schedule("TestJob_5", "every 5 Minute", Every(5*time.Minute), testJob{wg, "job5"})
+	cron.AddJob("TestJob_0", "", "0 0 0 30 Feb ?", testJob{wg: wg, name: "job0"})
+	cron.AddJob("TestJob_1", "", "0 0 0 1 1 ?", testJob{wg: wg, name: "job1"})
+	cron.AddJob("TestJob_2", "", "* * * * * ?", testJob{wg: wg, name: "job2"})
+	cron.AddJob("TestJob_3", "", "1 0 0 1 1 ?", testJob{wg: wg, name: "job3"})
+	cron.Schedule("TestJob_4", "every 5 second", "", Every(5*time.Second+5*time.Nanosecond), testJob{wg: wg, name: "job4"})
+	cron.Schedule("TestJob_5", "every 5 Minute", "", Every(5*time.Minute), testJob{wg: wg, name: "job5"})
 
 	cron.Start()
 	defer cron.Stop()
@@ -394,6 +397,216 @@ func TestJob(t *testing.T) {
 	}
 }
 
+// 前left次按interval触发，之后很久不再触发，用于区分定时触发和补执行
+type countSchedule struct {
+	lock     sync.Mutex
+	left     int
+	interval time.Duration
+}
+
+func (s *countSchedule) Next(t time.Time) time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.left > 0 {
+		s.left--
+		return t.Add(s.interval)
+	}
+	return t.AddDate(10, 0, 0)
+}
+
+// 暂停期间到了执行时间的不触发，记录错过的次数，恢复后返回错过的次数，catchUp为true时立即补执行一次
+func testPauseResume(t *testing.T, catchUp bool) {
+	runs := make(chan bool, 10)
+	cron := New()
+	cron.Schedule("TestPauseResume", "", "", &countSchedule{left: 3, interval: 50 * time.Millisecond}, FuncJob(func() { runs <- true }))
+	if err := cron.Pause("TestPauseResume"); err != nil {
+		t.Fatal(err)
+	}
+	cron.Start()
+	defer cron.Stop()
+
+	// 三次触发都在暂停期间
+	time.Sleep(300 * time.Millisecond)
+	if len(runs) > 0 {
+		t.Fatal("paused job should not run")
+	}
+	entries := cron.Entries()
+	if !entries[0].Paused || entries[0].Missed != 3 {
+		t.Fatalf("expected paused with 3 missed, got paused %v missed %d", entries[0].Paused, entries[0].Missed)
+	}
+
+	missed, err := cron.Resume("TestPauseResume", catchUp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missed != 3 {
+		t.Errorf("expected 3 missed, got %d", missed)
+	}
+	select {
+	case <-runs:
+		if !catchUp {
+			t.Error("job should not run without catch up")
+		}
+	case <-time.After(200 * time.Millisecond):
+		if catchUp {
+			t.Error("job should run once on resume with catch up")
+		}
+	}
+	entries = cron.Entries()
+	if entries[0].Paused || entries[0].Missed != 0 {
+		t.Errorf("expected resumed with 0 missed, got paused %v missed %d", entries[0].Paused, entries[0].Missed)
+	}
+
+	// 再次恢复没有错过的次数，不补执行
+	if missed, _ = cron.Resume("TestPauseResume", catchUp); missed != 0 {
+		t.Errorf("expected 0 missed when not paused, got %d", missed)
+	}
+	select {
+	case <-runs:
+		t.Error("job should not run again")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPauseResumeCatchUp(t *testing.T) {
+	testPauseResume(t, true)
+}
+
+func TestPauseResumeWithoutCatchUp(t *testing.T) {
+	testPauseResume(t, false)
+}
+
+// 补执行和定时触发一样受Hold限制
+func TestResumeCatchUpHeld(t *testing.T) {
+	runs := make(chan bool, 10)
+	held := make(chan string, 10)
+	cron := New()
+	cron.Hold = func(name string, scheduled time.Time) bool {
+		held <- name
+		return true
+	}
+	cron.Schedule("TestResumeCatchUpHeld", "", "", &countSchedule{left: 1, interval: 50 * time.Millisecond}, FuncJob(func() { runs <- true }))
+	cron.Pause("TestResumeCatchUpHeld")
+	cron.Start()
+	defer cron.Stop()
+
+	time.Sleep(150 * time.Millisecond)
+	if len(held) > 0 {
+		t.Fatal("paused job should be counted as missed before hold")
+	}
+	if missed, err := cron.Resume("TestResumeCatchUpHeld", true); err != nil || missed != 1 {
+		t.Fatalf("expected 1 missed, got %d %v", missed, err)
+	}
+	select {
+	case <-runs:
+		t.Error("held job should not catch up")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if len(held) != 1 {
+		t.Errorf("expected hold checked once, got %d", len(held))
+	}
+}
+
+// 暂停、恢复不存在的任务返回错误
+func TestPauseNotScheduled(t *testing.T) {
+	cron := New()
+	if err := cron.Pause("TestPauseNotScheduled"); err == nil {
+		t.Error("expected error before start")
+	}
+	cron.Start()
+	defer cron.Stop()
+	if _, err := cron.Resume("TestPauseNotScheduled", true); err == nil {
+		t.Error("expected error while running")
+	}
+}
+
+// 从过期的下次执行时间开始调度时只执行一次，合并掉的触发时间交给OnSkip，暂停中的计入错过次数
+func TestStartFromCoalesce(t *testing.T) {
+	runs := make(chan bool, 10)
+	skipped := make(chan time.Time, 10)
+	cron := New()
+	cron.OnSkip = func(name string, scheduled time.Time) {
+		skipped <- scheduled
+	}
+	cron.Schedule("TestStartFromCoalesce", "", "", Every(time.Minute), FuncJob(func() { runs <- true }))
+	cron.Schedule("TestStartFromCoalescePaused", "", "", Every(time.Minute), FuncJob(func() { runs <- true }))
+	cron.Pause("TestStartFromCoalescePaused")
+	now := time.Now()
+	next := now.Add(-3*time.Minute - 30*time.Second)
+	cron.StartFrom(map[string]time.Time{"TestStartFromCoalesce": next, "TestStartFromCoalescePaused": next})
+	defer cron.Stop()
+
+	select {
+	case <-runs:
+	case <-time.After(ONE_SECOND):
+		t.Fatal("overdue job should run once")
+	}
+	select {
+	case <-runs:
+		t.Error("overdue job should run only once")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if len(skipped) != 3 {
+		t.Fatalf("expected 3 coalesced fires, got %d", len(skipped))
+	}
+	for i := 0; i < 3; i++ {
+		if scheduled := <-skipped; !scheduled.After(next) || scheduled.After(now) {
+			t.Errorf("coalesced fire %s out of range", scheduled)
+		}
+	}
+	for _, entry := range cron.Entries() {
+		if !entry.Next.After(now) {
+			t.Errorf("%s next %s should be in the future", entry.Name, entry.Next)
+		}
+		if entry.Name == "TestStartFromCoalescePaused" && entry.Missed != 4 {
+			t.Errorf("expected 4 missed for paused job, got %d", entry.Missed)
+		}
+	}
+}
+
+// 测试运行中替换任务的job，调度列表中始终只有一个任务，替换后触发新的job
+func TestReplaceJob(t *testing.T) {
+	cron := New()
+	cron.Start()
+	defer cron.Stop()
+	old := make(chan bool, 10)
+	cron.AddFunc("TestReplaceJob", "", "0 0 0 1 1 ?", func() { old <- true })
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			if len(cron.Entries()) != 1 {
+				t.Error("entry missing while replacing")
+			}
+		}
+		done <- true
+	}()
+	replaced := make(chan bool, 10)
+	if err := cron.ReplaceJob("TestReplaceJob", "", "* * * * * ?", FuncJob(func() { replaced <- true })); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	select {
+	case <-replaced:
+	case <-old:
+		t.Fatal("old job should not run after replace")
+	case <-time.After(ONE_SECOND):
+		t.Fatal("replaced job should run")
+	}
+	if entries := cron.Entries(); len(entries) != 1 || entries[0].Cron != "* * * * * ?" {
+		t.Errorf("unexpected entries %v", entries)
+	}
+
+	// 不存在的任务直接添加
+	if err := cron.ReplaceJob("TestReplaceJobNew", "", "0 0 0 1 1 ?", FuncJob(func() {})); err != nil {
+		t.Fatal(err)
+	}
+	if len(cron.Entries()) != 2 {
+		t.Error("missing job should be added")
+	}
+}
+
 func wait(wg *sync.WaitGroup) chan bool {
 	ch := make(chan bool)
 	go func() {
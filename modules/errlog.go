@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"jcron/modules/api"
+	"jcron/modules/handle"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// 错误日志单次查询最大条数
+const maxErrLogLimit = 1000
+
+// 单次确认的最大条数
+const maxErrLogAck = 1000
+
+/**
+ * jsonrpc接口，查询错误日志，按时间倒序，只返回有查看权限的job，可按处理状态过滤
+ */
+func (t *Calculator) GetErrLog(query *api.ErrLogQuery, reply *[]*api.ErrLog) error {
+	*reply = []*api.ErrLog{}
+	cond := bson.M{}
+	if query.Name != "" {
+		if err := t.session.Check(query.Name, permView); err != nil {
+			return err
+		}
+		cond["name"] = query.Name
+	} else if !t.session.Admin {
+		jobList, err := t.session.viewableJobs()
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(jobList))
+		for _, jobData := range jobList {
+			names = append(names, jobData.Name)
+		}
+		cond["name"] = bson.M{"$in": names}
+	}
+
+	// 处理状态保存在ErrLogViewCollection，先查出对应的运行记录id
+	switch query.Status {
+	case "":
+	case api.ErrLogUnread, api.ErrLogAcked, api.ErrLogResolved:
+		viewCond := bson.M{}
+		if name, ok := cond["name"]; ok {
+			viewCond["name"] = name
+		}
+		if query.Status != api.ErrLogUnread {
+			viewCond["status"] = query.Status
+		}
+		logIds := []string{}
+		err := handle.WitchCollection(handle.Config().JobDb, handle.Config().ErrLogViewCollection, func(c *mgo.Collection) error {
+			return c.Find(viewCond).Distinct("logid", &logIds)
+		})
+		if err != nil {
+			return err
+		}
+		if query.Status == api.ErrLogUnread {
+			cond["logid"] = bson.M{"$nin": logIds}
+		} else {
+			cond["logid"] = bson.M{"$in": logIds}
+		}
+	default:
+		return errors.New("Status not support: " + query.Status)
+	}
+
+	timeCond := bson.M{}
+	if !query.Start.IsZero() {
+		timeCond["$gte"] = query.Start
+	}
+	if !query.End.IsZero() {
+		timeCond["$lt"] = query.End
+	}
+	if len(timeCond) > 0 {
+		cond["time"] = timeCond
+	}
+	limit := query.Limit
+	if limit <= 0 || limit > maxErrLogLimit {
+		limit = maxErrLogLimit
+	}
+	find := func(c *mgo.Collection) error {
+		return c.Find(cond).Sort("-time").Skip(query.Skip).Limit(limit).All(reply)
+	}
+	err := handle.WitchCollection(handle.Config().JobDb, handle.Config().ErrLogCollection, find)
+	if err != nil || len(*reply) == 0 {
+		return err
+	}
+
+	// 补充处理状态
+	logIds := make([]string, 0, len(*reply))
+	for _, errLog := range *reply {
+		logIds = append(logIds, errLog.LogId)
+	}
+	views, err := findErrLogView(logIds)
+	if err != nil {
+		return err
+	}
+	for _, errLog := range *reply {
+		errLog.Status = api.ErrLogUnread
+		if view, ok := views[errLog.LogId]; ok {
+			errLog.Status = view.Status
+			errLog.User = view.User
+			errLog.StatusTime = view.Time
+			errLog.Note = view.Note
+		}
+	}
+	return nil
+}
+
+/**
+ * 批量获取错误日志的处理记录，key为运行记录id
+ */
+var findErrLogView = func(logIds []string) (map[string]*handle.ErrLogView, error) {
+	views := []*handle.ErrLogView{}
+	find := func(c *mgo.Collection) error {
+		return c.Find(bson.M{"logid": bson.M{"$in": logIds}}).All(&views)
+	}
+	err := handle.WitchCollection(handle.Config().JobDb, handle.Config().ErrLogViewCollection, find)
+	if err != nil {
+		return nil, err
+	}
+	viewMap := map[string]*handle.ErrLogView{}
+	for _, view := range views {
+		viewMap[view.LogId] = view
+	}
+	return viewMap, nil
+}
+
+/**
+ * 查找要修改处理状态的错误日志：同时指定Name和LogIds时取交集，只指定Name时为该job未读的错误日志，最多maxErrLogAck条
+ */
+var findErrLogsToMark = func(args *api.ErrLogAckArgs) ([]*api.ErrLog, error) {
+	cond := bson.M{}
+	if len(args.LogIds) > 0 {
+		cond["logid"] = bson.M{"$in": args.LogIds}
+	}
+	if args.Name != "" {
+		cond["name"] = args.Name
+	}
+	if len(args.LogIds) == 0 {
+		logIds := []string{}
+		err := handle.WitchCollection(handle.Config().JobDb, handle.Config().ErrLogViewCollection, func(c *mgo.Collection) error {
+			return c.Find(bson.M{"name": args.Name}).Distinct("logid", &logIds)
+		})
+		if err != nil {
+			return nil, err
+		}
+		cond["logid"] = bson.M{"$nin": logIds}
+	}
+	errLogs := []*api.ErrLog{}
+	find := func(c *mgo.Collection) error {
+		return c.Find(cond).Sort("time").Limit(maxErrLogAck).All(&errLogs)
+	}
+	err := handle.WitchCollection(handle.Config().JobDb, handle.Config().ErrLogCollection, find)
+	return errLogs, err
+}
+
+// 保存错误日志的处理记录
+var upsertErrLogView = func(view *handle.ErrLogView) error {
+	upsert := func(c *mgo.Collection) error {
+		_, err := c.Upsert(bson.M{"logid": view.LogId}, view)
+		return err
+	}
+	return handle.WitchCollection(handle.Config().JobDb, handle.Config().ErrLogViewCollection, upsert)
+}
+
+/**
+ * 修改错误日志的处理状态，需要job的修改权限，已解决的不会改回已确认，返回修改的条数
+ * 只指定Name时修改该job未读的错误日志，单次最多maxErrLogAck条，超过时需要再次调用
+ */
+func (s *Session) setErrLogStatus(args *api.ErrLogAckArgs, status string) (int, error) {
+	if args.Name == "" && len(args.LogIds) == 0 {
+		return 0, errors.New("LogIds or Name is required")
+	}
+	if len(args.LogIds) > maxErrLogAck {
+		return 0, errors.New("too many LogIds")
+	}
+	if args.Name != "" {
+		if err := s.Check(args.Name, permEdit); err != nil {
+			return 0, err
+		}
+	} else if !s.login {
+		return 0, ErrUnauthenticated
+	}
+
+	errLogs, err := findErrLogsToMark(args)
+	if err != nil {
+		return 0, err
+	}
+	if len(errLogs) == 0 {
+		return 0, errors.New("error log not exist")
+	}
+	logIds := make([]string, 0, len(errLogs))
+	checked := map[string]bool{}
+	for _, errLog := range errLogs {
+		if !checked[errLog.Name] {
+			if err := s.Check(errLog.Name, permEdit); err != nil {
+				return 0, err
+			}
+			checked[errLog.Name] = true
+		}
+		logIds = append(logIds, errLog.LogId)
+	}
+	views, err := findErrLogView(logIds)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, errLog := range errLogs {
+		if view, ok := views[errLog.LogId]; ok {
+			//只指定Name时只修改未读的
+			if len(args.LogIds) == 0 || view.Status == api.ErrLogResolved || view.Status == status {
+				continue
+			}
+		}
+		view := &handle.ErrLogView{
+			LogId:  errLog.LogId,
+			Name:   errLog.Name,
+			Status: status,
+			User:   s.User,
+			Time:   time.Now(),
+			Note:   args.Note,
+		}
+		if err = upsertErrLogView(view); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+/**
+ * jsonrpc接口，确认错误日志，确认后该次运行的错误输出不再重复告警，返回确认的条数
+ */
+func (t *Calculator) AckErrLog(args *api.ErrLogAckArgs, reply *int) (err error) {
+	defer func() {
+		t.session.audit(&api.OperateLog{Method: "AckErrLog", JobName: args.Name, Params: args}, err)
+	}()
+	*reply, err = t.session.setErrLogStatus(args, api.ErrLogAcked)
+	return err
+}
+
+/**
+ * jsonrpc接口，将错误日志标记为已解决，需要填写备注，返回修改的条数
+ */
+func (t *Calculator) ResolveErrLog(args *api.ErrLogAckArgs, reply *int) (err error) {
+	defer func() {
+		t.session.audit(&api.OperateLog{Method: "ResolveErrLog", JobName: args.Name, Params: args}, err)
+	}()
+	if args.Note == "" {
+		return errors.New("Note is required")
+	}
+	*reply, err = t.session.setErrLogStatus(args, api.ErrLogResolved)
+	return err
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"jcron/modules/api"
+	"jcron/modules/cron"
+	"jcron/modules/handle"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestSetErrLogStatus(t *testing.T) {
+	stubJobs(t,
+		&cron.JobCollection{Name: "php1", AddPerson: "alice", ViewPerson: "dave"},
+		&cron.JobCollection{Name: "php2", AddPerson: "bob"},
+	)
+	stubJobWrites(t)
+	defer func(find func(*api.ErrLogAckArgs) ([]*api.ErrLog, error), views func([]string) (map[string]*handle.ErrLogView, error), upsert func(*handle.ErrLogView) error) {
+		findErrLogsToMark, findErrLogView, upsertErrLogView = find, views, upsert
+	}(findErrLogsToMark, findErrLogView, upsertErrLogView)
+
+	errLogs := []*api.ErrLog{
+		{Name: "php1", LogId: "a"},
+		{Name: "php1", LogId: "b"},
+		{Name: "php1", LogId: "c"},
+		{Name: "php2", LogId: "d"},
+	}
+	stored := map[string]*handle.ErrLogView{}
+	findErrLogsToMark = func(args *api.ErrLogAckArgs) ([]*api.ErrLog, error) {
+		ids := map[string]bool{}
+		for _, id := range args.LogIds {
+			ids[id] = true
+		}
+		list := []*api.ErrLog{}
+		for _, errLog := range errLogs {
+			if (args.Name == "" || errLog.Name == args.Name) && (len(args.LogIds) == 0 || ids[errLog.LogId]) {
+				list = append(list, errLog)
+			}
+		}
+		return list, nil
+	}
+	findErrLogView = func(logIds []string) (map[string]*handle.ErrLogView, error) {
+		views := map[string]*handle.ErrLogView{}
+		for _, id := range logIds {
+			if view, ok := stored[id]; ok {
+				views[id] = view
+			}
+		}
+		return views, nil
+	}
+	var marked []string
+	upsertErrLogView = func(view *handle.ErrLogView) error {
+		marked = append(marked, view.LogId+":"+view.Status)
+		return nil
+	}
+
+	tests := []struct {
+		desc   string
+		calc   *Calculator
+		args   *api.ErrLogAckArgs
+		status string
+		err    error
+		marked []string
+	}{
+		{"viewer by ids", loginAs("dave", false), &api.ErrLogAckArgs{LogIds: []string{"a"}}, api.ErrLogAcked, ErrPermissionDenied, nil},
+		{"viewer by name", loginAs("dave", false), &api.ErrLogAckArgs{Name: "php1"}, api.ErrLogAcked, ErrPermissionDenied, nil},
+		{"other job id", loginAs("alice", false), &api.ErrLogAckArgs{LogIds: []string{"a", "d"}}, api.ErrLogAcked, ErrPermissionDenied, nil},
+		{"name and ids", loginAs("alice", false), &api.ErrLogAckArgs{Name: "php1", LogIds: []string{"a", "d"}}, api.ErrLogAcked, nil, []string{"a:acked"}},
+		{"name only unread", loginAs("alice", false), &api.ErrLogAckArgs{Name: "php1"}, api.ErrLogAcked, nil, []string{"c:acked"}},
+		{"resolve name only unread", loginAs("alice", false), &api.ErrLogAckArgs{Name: "php1", Note: "fixed"}, api.ErrLogResolved, nil, []string{"c:resolved"}},
+		{"resolve acked by id", loginAs("alice", false), &api.ErrLogAckArgs{LogIds: []string{"a", "b"}, Note: "fixed"}, api.ErrLogResolved, nil, []string{"a:resolved"}},
+		{"admin", loginAs("root", true), &api.ErrLogAckArgs{LogIds: []string{"d"}}, api.ErrLogAcked, nil, []string{"d:acked"}},
+	}
+	//b已解决，a在同时指定Name和LogIds时确认
+	stored["b"] = &handle.ErrLogView{LogId: "b", Name: "php1", Status: api.ErrLogResolved}
+	for _, test := range tests {
+		marked = nil
+		count, err := test.calc.session.setErrLogStatus(test.args, test.status)
+		sort.Strings(marked)
+		if err != test.err || count != len(test.marked) || (len(marked) > 0 || len(test.marked) > 0) && !reflect.DeepEqual(marked, test.marked) {
+			t.Errorf("%s: expected %v %v, got %v %d %v", test.desc, test.err, test.marked, err, count, marked)
+		}
+		if test.desc == "name and ids" {
+			stored["a"] = &handle.ErrLogView{LogId: "a", Name: "php1", Status: api.ErrLogAcked}
+		}
+	}
+
+	var n int
+	if err := loginAs("alice", false).AckErrLog(&api.ErrLogAckArgs{}, &n); err == nil {
+		t.Error("expected LogIds or Name is required")
+	}
+	if err := loginAs("alice", false).AckErrLog(&api.ErrLogAckArgs{LogIds: make([]string, maxErrLogAck+1)}, &n); err == nil {
+		t.Error("expected too many LogIds")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"jcron/modules/api"
+	"jcron/modules/stream"
+	"net/http"
+	"time"
+)
+
+// 跟踪输出的默认和最大等待时间
+const (
+	defaultFollowWait = 30 * time.Second
+	maxFollowWait     = 60 * time.Second
+)
+
+// 实例不在内存中且仍在运行时（如重启前启动的实例），从数据库轮询的间隔
+const followPollInterval = time.Second
+
+func init() {
+	httpMux.HandleFunc("/stream", serveStream)
+}
+
+/**
+ * 读取实例的输出，优先从内存读取，实例已结束并从内存中删除时从数据库回放，ctx结束时停止等待
+ */
+func follow(ctx context.Context, args *api.FollowArgs) (*api.FollowReply, error) {
+	wait := defaultFollowWait
+	if args.Wait > 0 {
+		wait = time.Duration(args.Wait) * time.Second
+	} else if args.Wait < 0 {
+		wait = 0
+	}
+	if wait > maxFollowWait {
+		wait = maxFollowWait
+	}
+
+	//重新接管的实例在内存中只有接管后的输出，更早的部分从数据库读取，只读取属于该job的实例
+	if s := stream.Get(args.JobName, args.ObjectId); s != nil && (args.Offset < 0 || args.Offset >= s.Base()) {
+		from := args.Offset
+		if from < 0 {
+			from = s.Tail()
+		}
+		items, next, finished := s.Read(ctx, from, wait)
+		return &api.FollowReply{Items: items, Offset: next, Finished: finished}, nil
+	}
+
+	record, err := findRun(args.JobName, args.ObjectId)
+	if err != nil {
+		return nil, err
+	}
+	from := args.Offset
+	if from < 0 || from > len(record.Content) {
+		from = len(record.Content)
+	}
+	reply := &api.FollowReply{
+		Items:    append([]api.LogItem{}, record.Content[from:]...),
+		Offset:   len(record.Content),
+		Finished: record.Result != api.ResultRunning,
+	}
+	if len(reply.Items) == 0 && !reply.Finished && wait > 0 {
+		if wait > followPollInterval {
+			wait = followPollInterval
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+		}
+	}
+	return reply, nil
+}
+
+/**
+ * jsonrpc接口，跟踪实例的输出，没有新输出时阻塞等待，客户端用返回的Offset循环调用直到Finished
+ */
+func (t *Calculator) FollowJobRun(args *api.FollowArgs, reply *api.FollowReply) error {
+	*reply = api.FollowReply{Items: []api.LogItem{}}
+	if err := t.session.Check(args.JobName, permView); err != nil {
+		return err
+	}
+	result, err := follow(context.Background(), args)
+	if err != nil {
+		return err
+	}
+	*reply = *result
+	return nil
+}
+
+/**
+ * http接口，以chunked方式持续输出实例的日志，每行一个json，实例结束后关闭
+ * GET /stream?job=<job名称>&objectid=<实例id>&from=start|tail
+ */
+func serveStream(w http.ResponseWriter, r *http.Request) {
+	session, err := httpSession(r)
+	if err == nil {
+		err = session.Check(r.FormValue("job"), permView)
+	}
+	if err != nil {
+		status := http.StatusForbidden
+		if err == ErrUnauthenticated {
+			status = http.StatusUnauthorized
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	args := &api.FollowArgs{JobName: r.FormValue("job"), ObjectId: r.FormValue("objectid")}
+	if r.FormValue("from") == "tail" {
+		args.Offset = -1
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	encoder := json.NewEncoder(w)
+	//客户端断开时停止等待新输出
+	ctx := r.Context()
+	for {
+		reply, err := follow(ctx, args)
+		if err != nil {
+			encoder.Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		for _, item := range reply.Items {
+			encoder.Encode(item)
+		}
+		flusher.Flush()
+		if reply.Finished {
+			return
+		}
+		args.Offset = reply.Offset
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"jcron/modules/api"
+	"jcron/modules/cron"
+	"jcron/modules/stream"
+	"testing"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// 测试不能通过有权限的job读取其他job实例的输出
+func TestFollowOtherJob(t *testing.T) {
+	defer func(find func(string, string) (*api.RunRecord, error)) {
+		findRun = find
+	}(findRun)
+	objectId := bson.NewObjectId().Hex()
+	//运行记录按job名称保存在不同的集合中
+	findRun = func(name, id string) (*api.RunRecord, error) {
+		if name == "jobB" && id == objectId {
+			return &api.RunRecord{Content: []api.LogItem{{Content: "secret"}}, Result: api.ResultRunning}, nil
+		}
+		return nil, mgo.ErrNotFound
+	}
+	s := stream.Open("jobB", objectId)
+	defer s.Close()
+	s.Write(0, []byte("secret"))
+
+	stubJobs(t, &cron.JobCollection{Name: "jobA", AddPerson: "alice"}, &cron.JobCollection{Name: "jobB", AddPerson: "bob"})
+	var reply api.FollowReply
+	err := loginAs("alice", false).FollowJobRun(&api.FollowArgs{JobName: "jobA", ObjectId: objectId, Wait: -1}, &reply)
+	if err == nil || len(reply.Items) != 0 {
+		t.Errorf("expected error and no output, got %v %v", err, reply.Items)
+	}
+	if err := loginAs("alice", false).FollowJobRun(&api.FollowArgs{JobName: "jobB", ObjectId: objectId, Wait: -1}, &reply); err != ErrPermissionDenied {
+		t.Errorf("expected ErrPermissionDenied, got %v", err)
+	}
+
+	err = loginAs("bob", false).FollowJobRun(&api.FollowArgs{JobName: "jobB", ObjectId: objectId, Wait: -1}, &reply)
+	if err != nil || len(reply.Items) != 1 || reply.Items[0].Content != "secret" {
+		t.Errorf("owner should read the output, got %v %v", err, reply.Items)
+	}
+}
@@ -17,6 +17,14 @@ func (c *console) NewLoger() (Loger, string) {
 	return c, ""
 }
 
+func (c *console) OpenLoger(objectId string) Loger {
+	return c
+}
+
+func (c *console) Name() string {
+	return "console"
+}
+
 func (c *console) NewLogPipe() io.Writer {
 	return c
 }
@@ -14,4 +14,7 @@ type Loger interface {
 // 新建日志接口
 type Handler interface {
 	NewLoger() (Loger, string)
+	// 打开已有的运行记录，重启后重新接管实例时使用，记录id无效时返回nil
+	OpenLoger(objectId string) Loger
+	Name() string
 }
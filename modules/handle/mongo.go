@@ -5,8 +5,13 @@ package handle
 import (
 	"fmt"
 	"io"
+	"jcron/modules/api"
 	"jcron/modules/cron"
+	"jcron/modules/metrics"
+	"jcron/modules/stream"
 	"juanpi_modules/qywechat"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"gopkg.in/mgo.v2"
@@ -18,19 +23,58 @@ type Configuration struct {
 	JobLogDb              string
 	DbHost                string
 	DbPort                string
+	DbUser                string // 数据库用户名，为空时不认证
+	DbPassword            string // 数据库密码
 	JobCollection         string
 	JobSnapshotCollection string
 	CurProcessCollection  string
 	ErrLogCollection      string
 	ErrLogViewCollection  string
 	OperateLogCollection  string
+	JobRevisionCollection string
+	LeaseCollection       string // 领导者租约
+	MaintenanceCollection string // 维护暂停
 	PhpBinPath            string
 	PhpIniPath            string
 	JobPath               string
+	JobFilePath           string // job定义文件目录，为空时不开启
 	JsonRpcPort           string
+	HttpPort              string    // http接口端口，为空时不开启
+	ApiUsers              []ApiUser // 接口用户，为空时不开启认证
+	TlsCertFile           string    // rpc监听证书，为空时不开启tls
+	TlsKeyFile            string    // rpc监听证书私钥
+	TlsClientCaFile       string    // 客户端证书ca，不为空时要求客户端提供证书
+	AgentCaFile           string    // agent证书ca，不为空时使用tls连接agent，配置了TlsCertFile时作为客户端证书出示
+	LeaderLease           int       // 领导者租约秒数，为0时不开启选举，单机运行
+	NodeName              string    // 选举使用的节点名称，为空时使用主机名:pid
+	SpoolPath             string    // 命令行任务输出和状态目录，相对路径基于工作目录，为空时不使用shim，重启后无法接管输出
 }
 
-var Conf = Configuration{}
+// 接口用户
+type ApiUser struct {
+	Name   string // 用户名，和job的AddPerson、ViewPerson、EditPerson对应
+	Token  string // 访问令牌
+	Secret string // hmac签名密钥
+	Admin  bool   // 管理员拥有所有job的权限
+	Agent  bool   // agent用户，只能调用RegisterAgent、AgentOutput、AgentExit等agent接口，没有job的权限
+}
+
+// 当前配置，热加载时整体替换，rpc、调度和实例日志等协程同时读取
+var currentConf atomic.Value
+
+func init() {
+	currentConf.Store(&Configuration{})
+}
+
+// 获取当前配置，返回的配置是只读的，修改配置使用SetConfig
+func Config() *Configuration {
+	return currentConf.Load().(*Configuration)
+}
+
+// 替换当前配置
+func SetConfig(c *Configuration) {
+	currentConf.Store(c)
+}
 
 type logItem struct {
 	Time     time.Time
@@ -43,6 +87,7 @@ type logList []logItem
 type pipe struct {
 	record     *Record
 	collection string
+	stream     *stream.Stream // 实时输出
 }
 
 type logPipe pipe
@@ -56,6 +101,13 @@ type MongoLog struct {
 	collection string  // 数据表
 }
 
+// 运行结果
+const (
+	ResultRunning = api.ResultRunning // 运行中
+	ResultSuccess = api.ResultSuccess // 正常
+	ResultFailed  = api.ResultFailed  // 异常
+)
+
 type Record struct {
 	Id        bson.ObjectId `bson:"_id"`
 	Name      string        // 任务名称
@@ -63,7 +115,8 @@ type Record struct {
 	EndTime   time.Time     // 结束时间
 	Content   logList       // 日志内容
 	Pid       int           // 实例进程id
-	Result    int           // 运行结果，1正常，2异常
+	Result    int           // 运行结果，0运行中，1正常，2异常
+	Trigger   string        // 触发方式，cron定时触发，manual手动触发
 }
 
 type ErrLog struct {
@@ -72,12 +125,38 @@ type ErrLog struct {
 	LogId string
 }
 
+// 错误日志处理记录，保存在ErrLogViewCollection，没有记录的错误日志为未读
+type ErrLogView struct {
+	LogId  string
+	Name   string
+	Status string    // acked或resolved
+	User   string    // 处理人
+	Time   time.Time // 处理时间
+	Note   string    // 处理备注
+}
+
+// 获取错误日志的处理状态
+func ErrLogStatus(logId string) string {
+	view := ErrLogView{}
+	find := func(c *mgo.Collection) error {
+		return c.Find(bson.M{"logid": logId}).One(&view)
+	}
+	err := WitchCollection(Config().JobDb, Config().ErrLogViewCollection, find)
+	if err != nil || view.Status == "" {
+		return api.ErrLogUnread
+	}
+	return view.Status
+}
+
 var mgoSession *mgo.Session
+var sessionLock sync.Mutex
 
 func getSession() *mgo.Session {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
 	if mgoSession == nil {
 		var err error
-		mgoSession, err = mgo.Dial(Conf.DbHost + ":" + Conf.DbPort)
+		mgoSession, err = mgo.DialWithInfo(dialInfo(Config()))
 		if err != nil {
 			panic(err) //直接终止程序运行
 		}
@@ -86,18 +165,66 @@ func getSession() *mgo.Session {
 	return mgoSession.Clone()
 }
 
+// 检查数据库连接
+func Ping() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	session := getSession()
+	defer session.Close()
+	return session.Ping()
+}
+
+// 数据库连接参数
+func dialInfo(conf *Configuration) *mgo.DialInfo {
+	return &mgo.DialInfo{
+		Addrs:    []string{conf.DbHost + ":" + conf.DbPort},
+		Username: conf.DbUser,
+		Password: conf.DbPassword,
+		Timeout:  10 * time.Second,
+	}
+}
+
+// 使用新的配置重新连接数据库，连接失败时保持原连接
+func Reconnect(conf *Configuration) error {
+	session, err := mgo.DialWithInfo(dialInfo(conf))
+	if err != nil {
+		return err
+	}
+	sessionLock.Lock()
+	old := mgoSession
+	mgoSession = session
+	sessionLock.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
 //公共方法，获取collection对象
 func WitchCollection(database, collection string, s func(*mgo.Collection) error) error {
 	session := getSession()
 	defer session.Close()
 	c := session.DB(database).C(collection)
-	return s(c)
+	start := time.Now()
+	err := s(c)
+	metrics.StorageDuration.Observe(time.Since(start).Seconds(), database, collection)
+	if err != nil && err != mgo.ErrNotFound {
+		metrics.StorageErrors.Inc(database, collection)
+	}
+	return err
 }
 
 func NewMongoC(job string) Handler {
 	return mongoC(job)
 }
 
+func (c mongoC) Name() string {
+	return string(c)
+}
+
 func (c mongoC) NewLoger() (Loger, string) {
 	var log logList
 	objectId := bson.NewObjectId()
@@ -109,22 +236,77 @@ func (c mongoC) NewLoger() (Loger, string) {
 		nowTime,
 		log,
 		0,
-		1,
+		ResultRunning,
+		"",
 	}
 	insert := func(c *mgo.Collection) error {
 		return c.Insert(record)
 	}
-	WitchCollection(Conf.JobLogDb, string(c), insert)
+	WitchCollection(Config().JobLogDb, string(c), insert)
 
+	s := stream.Open(string(c), objectId.Hex())
 	return &MongoLog{
-		logPipe{record, string(c)},
-		errPipe{record, string(c)},
+		logPipe{record, string(c), s},
+		errPipe{record, string(c), s},
 		string(c),
 	}, fmt.Sprintf(`%x`, string(objectId))
 }
 
+func (c mongoC) OpenLoger(objectId string) Loger {
+	if !bson.IsObjectIdHex(objectId) {
+		return nil
+	}
+	record := &Record{Id: bson.ObjectIdHex(objectId), Name: string(c)}
+	//已在内存中的输出流直接复用，否则从已保存的日志条数开始编号，和数据库中的序号一致
+	s := stream.Get(string(c), objectId)
+	if s == nil {
+		s = stream.Attach(string(c), objectId, contentLen(string(c), record.Id))
+	}
+	return &MongoLog{
+		logPipe{record, string(c), s},
+		errPipe{record, string(c), s},
+		string(c),
+	}
+}
+
+// 运行记录中已保存的日志条数，查询失败时返回0
+func contentLen(collection string, id bson.ObjectId) int {
+	var result struct {
+		N int `bson:"n"`
+	}
+	count := func(c *mgo.Collection) error {
+		pipeline := []bson.M{
+			{"$match": bson.M{"_id": id}},
+			{"$project": bson.M{"n": bson.M{"$size": bson.M{"$ifNull": []interface{}{"$content", []interface{}{}}}}}},
+		}
+		return c.Pipe(pipeline).One(&result)
+	}
+	WitchCollection(Config().JobLogDb, collection, count)
+	return result.N
+}
+
+/**
+ * 写入一条跳过的运行记录，开始和结束时间为计划执行时间，原因写入运行日志，不报警
+ */
+func SkipRecord(name string, scheduled time.Time, msg string) error {
+	record := &Record{
+		Id:        bson.NewObjectId(),
+		Name:      name,
+		StartTime: scheduled,
+		EndTime:   scheduled,
+		Content:   logList{{time.Now(), 0, msg}},
+		Result:    api.ResultSkipped,
+		Trigger:   cron.TriggerCron,
+	}
+	insert := func(c *mgo.Collection) error {
+		return c.Insert(record)
+	}
+	return WitchCollection(Config().JobLogDb, name, insert)
+}
+
 // 正常日志管道
 func (l *logPipe) Write(p []byte) (n int, err error) {
+	l.stream.Write(0, p)
 	nowTime := time.Now()
 	item := logItem{
 		nowTime,
@@ -134,13 +316,14 @@ func (l *logPipe) Write(p []byte) (n int, err error) {
 	update := func(c *mgo.Collection) error {
 		return c.Update(bson.M{"_id": l.record.Id}, bson.M{"$push": bson.M{"content": &item}})
 	}
-	WitchCollection(Conf.JobLogDb, l.collection, update)
+	WitchCollection(Config().JobLogDb, l.collection, update)
 
 	return len(p), nil
 }
 
 // 错误日志管道
 func (e *errPipe) Write(p []byte) (n int, err error) {
+	e.stream.Write(1, p)
 	curTime := time.Now()
 	item := logItem{
 		curTime,
@@ -150,7 +333,7 @@ func (e *errPipe) Write(p []byte) (n int, err error) {
 	update := func(c *mgo.Collection) error {
 		return c.Update(bson.M{"_id": e.record.Id}, bson.M{"$push": bson.M{"content": &item}})
 	}
-	WitchCollection(Conf.JobLogDb, e.collection, update)
+	WitchCollection(Config().JobLogDb, e.collection, update)
 
 	// 写入错误告警日志
 	errLog := &ErrLog{e.record.Name, curTime, fmt.Sprintf(`%x`, string(e.record.Id))}
@@ -158,14 +341,19 @@ func (e *errPipe) Write(p []byte) (n int, err error) {
 		_, err := c.Upsert(bson.M{"logid": errLog.LogId}, &errLog)
 		return err
 	}
-	WitchCollection(Conf.JobDb, Conf.ErrLogCollection, upsert)
+	WitchCollection(Config().JobDb, Config().ErrLogCollection, upsert)
+
+	//已确认或已解决的错误不再重复报警
+	if ErrLogStatus(errLog.LogId) != api.ErrLogUnread {
+		return len(p), nil
+	}
 
 	//微信报警
 	job := cron.JobCollection{}
 	find := func(c *mgo.Collection) error {
 		return c.Find(bson.M{"name": e.collection}).One(&job)
 	}
-	err = WitchCollection(Conf.JobDb, Conf.JobCollection, find)
+	err = WitchCollection(Config().JobDb, Config().JobCollection, find)
 	qywechat.Alert(job.NoticePerson, job.Name, "任务名称："+job.Name+"\n告警内容："+string(p))
 
 	return len(p), nil
@@ -185,5 +373,10 @@ func (m *MongoLog) Update(data map[string]interface{}) {
 	update := func(c *mgo.Collection) error {
 		return c.Update(bson.M{"_id": m.logPipe.record.Id}, bson.M{"$set": &data})
 	}
-	WitchCollection(Conf.JobLogDb, m.collection, update)
+	WitchCollection(Config().JobLogDb, m.collection, update)
+
+	// 运行结束后关闭实时输出
+	if _, ok := data["endtime"]; ok {
+		m.logPipe.stream.Close()
+	}
 }
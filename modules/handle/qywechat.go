@@ -34,6 +34,16 @@ func (wechat *QyWechat) NewLoger() (Loger, string) {
 	}, ""
 }
 
+// 重新打开的实例从头发送
+func (wechat *QyWechat) OpenLoger(objectId string) Loger {
+	loger, _ := wechat.NewLoger()
+	return loger
+}
+
+func (wechat *QyWechat) Name() string {
+	return "qywechat"
+}
+
 func (log *WechatLoger) NewLogPipe() io.Writer {
 	return log.buff
 }
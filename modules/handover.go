@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"jcron/modules/api"
+	"jcron/modules/handle"
+	"jcron/modules/job/cmd"
+	"jcron/modules/systemd"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 平滑重启时传给新进程的环境变量，值为继承的监听数量，监听从文件描述符3开始，之后依次为就绪管道和状态管道
+const handoverEnv = "JCRON_HANDOVER"
+
+// 等待新进程就绪的超时时间
+const handoverTimeout = time.Minute
+
+// 交接前等待http实例结束的超时时间，超时未结束的在新进程中标记为中断
+const handoverDrain = 30 * time.Second
+
+// 退出前等待处理中的rpc和http请求返回的超时时间
+const handoverClose = 10 * time.Second
+
+// 旧进程交给新进程的调度状态
+type handoverState struct {
+	//停止调度时各任务的下次执行时间，没有在调度时为空
+	Next map[string]time.Time
+	//agent上正在运行的实例和agent注册信息，新进程继续接收输出和结果
+	Runs   []handoverRun
+	Agents []*api.AgentInfo
+}
+
+var (
+	// 继承的监听，按端口取用
+	inherited = struct {
+		sync.Mutex
+		list []net.Listener
+	}{}
+	// 本进程使用的监听，平滑重启时传给新进程
+	listening = struct {
+		sync.Mutex
+		list []*net.TCPListener
+	}{}
+	// 平滑重启启动时和旧进程通信的管道，不是平滑重启启动时为nil
+	handoverReady *os.File
+	handoverFrom  *os.File
+	// 从旧进程接收的下次执行时间，开始调度时使用一次
+	handoverNext map[string]time.Time
+	// 同一时间只允许一次交接
+	handoverLock sync.Mutex
+	// 已交给新进程，不再接受连接
+	handedOver int32
+	// 由旧进程交接启动
+	handedFrom bool
+)
+
+func init() {
+	c.OnSkip = handoverSkip
+}
+
+/**
+ * 新进程从旧进程停止的位置开始调度，交接期间错过多次的任务只执行一次，合并掉的触发写入跳过的运行记录
+ */
+func handoverSkip(name string, scheduled time.Time) {
+	log.Printf("%s coalesced after handover, scheduled at %s\n", name, scheduled.Format("2006-01-02 15:04:05"))
+	//调度循环中不能等待数据库
+	go func() {
+		msg := "skipped during handover, coalesced into one run, scheduled at " + scheduled.Format("2006-01-02 15:04:05")
+		if err := skipRecord(name, scheduled, msg); err != nil {
+			log.Printf("Skip record %s error: %s\n", name, err)
+		}
+	}()
+}
+
+/**
+ * 读取继承的监听：平滑重启时由旧进程传入，或者由systemd socket激活传入
+ */
+func inheritListeners() {
+	value := os.Getenv(handoverEnv)
+	if value == "" {
+		list, err := systemd.Listeners()
+		if err != nil {
+			log.Fatal("socket activation error: ", err)
+		}
+		inherited.list = list
+		return
+	}
+	os.Unsetenv(handoverEnv)
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Fatal("invalid " + handoverEnv + ": " + value)
+	}
+	inherited.list, err = systemd.FileListeners(systemd.ListenFdsStart, n)
+	if err != nil {
+		log.Fatal("inherit listener error: ", err)
+	}
+	handoverReady = os.NewFile(uintptr(systemd.ListenFdsStart+n), "handover-ready")
+	handoverFrom = os.NewFile(uintptr(systemd.ListenFdsStart+n+1), "handover-state")
+}
+
+// 取出端口一致的继承监听，没有时返回nil
+func inheritedListener(port string) net.Listener {
+	inherited.Lock()
+	defer inherited.Unlock()
+	for i, listener := range inherited.list {
+		if addr, ok := listener.Addr().(*net.TCPAddr); ok && strconv.Itoa(addr.Port) == port {
+			inherited.list = append(inherited.list[:i], inherited.list[i+1:]...)
+			return listener
+		}
+	}
+	return nil
+}
+
+// 是否有端口一致的继承监听
+func hasInherited(port string) bool {
+	inherited.Lock()
+	defer inherited.Unlock()
+	for _, listener := range inherited.list {
+		if addr, ok := listener.Addr().(*net.TCPAddr); ok && strconv.Itoa(addr.Port) == port {
+			return true
+		}
+	}
+	return false
+}
+
+// 创建tcp监听，有继承的监听时直接使用，记录下来用于平滑重启
+func listenTCP(port string) (net.Listener, error) {
+	listener := inheritedListener(port)
+	if listener == nil {
+		var err error
+		listener, err = net.Listen("tcp", ":"+port)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if tcp, ok := listener.(*net.TCPListener); ok {
+		listening.Lock()
+		listening.list = append(listening.list, tcp)
+		listening.Unlock()
+	}
+	return listener, nil
+}
+
+/**
+ * 平滑重启启动时通知旧进程已就绪，等待旧进程停止调度、保存实例日志后发来调度状态，返回是否由旧进程交接
+ */
+func waitHandover() bool {
+	if handoverReady == nil {
+		return false
+	}
+	//数据库不可用时退出，旧进程继续运行
+	if err := handle.Ping(); err != nil {
+		log.Fatal("Handover: database error: ", err)
+	}
+	log.Printf("Handover: ready, waiting for the predecessor\n")
+	handoverReady.Write([]byte{1})
+	handoverReady.Close()
+
+	state := handoverState{}
+	err := json.NewDecoder(handoverFrom).Decode(&state)
+	handoverFrom.Close()
+	if err != nil {
+		// 旧进程交接失败时已经退出或继续运行，按正常启动处理
+		log.Printf("Handover: no state from the predecessor: %s\n", err)
+		return false
+	}
+	log.Printf("Handover: received %d entries\n", len(state.Next))
+	handoverNext = state.Next
+	restoreRemoteRuns(state.Runs, state.Agents)
+	return true
+}
+
+// 取出从旧进程接收的下次执行时间，只使用一次
+func takeHandoverNext() map[string]time.Time {
+	next := handoverNext
+	handoverNext = nil
+	return next
+}
+
+/**
+ * 平滑重启：启动新的程序并把监听交给它，新进程就绪后等待http实例结束、停止调度、保存实例日志，
+ * 把各任务的下次执行时间交给新进程，等待处理中的请求返回后退出。新进程启动失败或超时时继续运行
+ */
+func handover() {
+	handoverLock.Lock()
+	defer handoverLock.Unlock()
+	log.Printf("Handover\n")
+
+	successor, state, err := startSuccessor()
+	if err != nil {
+		log.Printf("Handover aborted: %s\n", err)
+		return
+	}
+	log.Printf("Handover: successor %d is ready\n", successor)
+
+	//1、http实例无法交接，等待结束，期间继续调度
+	deadline := time.Now().Add(handoverDrain)
+	drainHTTP(handoverDrain)
+	//2、停止调度，记录各任务的下次执行时间，新进程从这里继续，不会漏掉或重复触发
+	next := map[string]time.Time{}
+	if atomic.LoadInt32(&schedulerRunning) == 1 {
+		stopScheduler()
+		for _, entry := range c.Entries() {
+			next[entry.Name] = entry.Next
+		}
+		//等待期间新启动的http实例
+		drainHTTP(time.Until(deadline))
+	}
+	//3、停止读取shim的输出，命令行实例写入实例日志，由新进程接管，agent上的实例交给新进程
+	cmd.DetachWatchers()
+	SaveJobSnapshot()
+	runs, agentList := takeRemoteHandover()
+	if elector != nil {
+		if err := elector.Resign(); err != nil {
+			log.Printf("Resign error: %s\n", err)
+		}
+	}
+	//4、不再接受连接，systemd的主进程改为新进程，发送调度状态后退出
+	atomic.StoreInt32(&handedOver, 1)
+	listening.Lock()
+	for _, listener := range listening.list {
+		listener.Close()
+	}
+	listening.Unlock()
+	systemd.Notify(fmt.Sprintf("MAINPID=%d", successor))
+	if err := json.NewEncoder(state).Encode(&handoverState{Next: next, Runs: runs, Agents: agentList}); err != nil {
+		log.Printf("Handover: send state error: %s\n", err)
+	}
+	state.Close()
+	//5、等待处理中的请求返回后关闭连接
+	closeConns(handoverClose)
+	log.Printf("Handover: handed over to %d, exit\n", successor)
+	os.Exit(0)
+}
+
+// 启动新进程并等待它就绪，返回新进程id和发送调度状态的管道
+func startSuccessor() (int, *os.File, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return 0, nil, err
+	}
+	files := []*os.File{}
+	closeAll := func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}
+	listening.Lock()
+	for _, listener := range listening.list {
+		file, err := listener.File()
+		if err != nil {
+			listening.Unlock()
+			closeAll()
+			return 0, nil, err
+		}
+		files = append(files, file)
+	}
+	listening.Unlock()
+	n := len(files)
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		closeAll()
+		return 0, nil, err
+	}
+	stateR, stateW, err := os.Pipe()
+	if err != nil {
+		readyR.Close()
+		readyW.Close()
+		closeAll()
+		return 0, nil, err
+	}
+	files = append(files, readyW, stateR)
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = successorEnv(os.Environ(), n)
+	cmd.ExtraFiles = files
+	err = cmd.Start()
+	// 子进程已持有这些文件，关闭本进程的副本，子进程退出时读取就绪管道才会返回
+	closeAll()
+	if err != nil {
+		readyR.Close()
+		stateW.Close()
+		return 0, nil, err
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := readyR.Read(buf)
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(handoverTimeout):
+		err = errors.New("successor is not ready in " + handoverTimeout.String())
+	}
+	readyR.Close()
+	if err != nil {
+		stateW.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, nil, err
+	}
+	return cmd.Process.Pid, stateW, nil
+}
+
+/**
+ * 新进程的环境变量：去掉看门狗进程id，新进程成为主进程后由它发送看门狗通知，加上继承的监听数量
+ */
+func successorEnv(environ []string, n int) []string {
+	env := []string{}
+	for _, kv := range environ {
+		if strings.HasPrefix(kv, "WATCHDOG_PID=") || strings.HasPrefix(kv, handoverEnv+"=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return append(env, fmt.Sprintf("%s=%d", handoverEnv, n))
+}
+
+// 平滑关闭rpc和http连接，超时后返回
+func closeConns(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		closeRPCConns(timeout)
+		close(done)
+	}()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Printf("Handover: http shutdown error: %s\n", err)
+	}
+	<-done
+}
+
+// 等待本机的http实例结束，超时后返回
+func drainHTTP(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		running := 0
+		for _, entry := range c.Entries() {
+			for _, run := range entry.Job.List() {
+				if run.Proc == nil && run.Agent == "" {
+					running++
+				}
+			}
+		}
+		if running == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			log.Printf("Handover: %d http instances still running\n", running)
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
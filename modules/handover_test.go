@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"jcron/modules/agent"
+	"jcron/modules/api"
+	"jcron/modules/handle"
+	"jcron/modules/job/cmd"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestSuccessorEnv(t *testing.T) {
+	environ := []string{
+		"PATH=/usr/bin",
+		"NOTIFY_SOCKET=/run/systemd/notify",
+		"WATCHDOG_USEC=60000000",
+		"WATCHDOG_PID=100",
+		handoverEnv + "=1",
+	}
+	want := []string{
+		"PATH=/usr/bin",
+		"NOTIFY_SOCKET=/run/systemd/notify",
+		"WATCHDOG_USEC=60000000",
+		handoverEnv + "=2",
+	}
+	if got := successorEnv(environ, 2); !reflect.DeepEqual(got, want) {
+		t.Errorf("successorEnv = %v, want %v", got, want)
+	}
+}
+
+// 记录输出和结果的运行记录
+type bufferLoger struct {
+	out  bytes.Buffer
+	data map[string]interface{}
+}
+
+func (l *bufferLoger) NewLogPipe() io.Writer { return &l.out }
+
+func (l *bufferLoger) NewErrPipe() io.Writer { return &l.out }
+
+func (l *bufferLoger) Update(data map[string]interface{}) {
+	for key, value := range data {
+		l.data[key] = value
+	}
+}
+
+// 测试平滑重启时agent上的实例交给新进程，新进程继续接收输出和结果
+func TestRemoteHandover(t *testing.T) {
+	oldAgents, oldLoger := agents, openLoger
+	defer func() {
+		agents, openLoger = oldAgents, oldLoger
+		remoteRuns.Lock()
+		remoteRuns.runs, remoteRuns.handedOver = map[string]*remoteRun{}, false
+		remoteRuns.Unlock()
+	}()
+	host, _ := os.Hostname()
+	objectId := bson.NewObjectId().Hex()
+	stored := stubJournal(t, JournalEntry{ObjectId: objectId, Name: "remote1", Host: host, Agent: "agent1", Date: time.Now()})
+	session := loginAs("root", true)
+
+	//旧进程：agent上有一个正在运行的实例
+	agents = &agent.Registry{Timeout: agentTimeout}
+	agents.Register(&api.AgentInfo{Name: "agent1", Addr: "agent1:7001", Capacity: 1, Token: "t1"}, time.Now())
+	agents.Pick(nil)
+	agents.Attach("agent1", objectId)
+	remoteRuns.Lock()
+	remoteRuns.runs[objectId] = &remoteRun{"remote1", "agent1", &bufferLoger{data: map[string]interface{}{}}, func(bool) {
+		t.Error("run handed over should not be finished by the predecessor")
+	}}
+	remoteRuns.Unlock()
+
+	runs, list := takeRemoteHandover()
+	if want := []handoverRun{{ObjectId: objectId, Name: "remote1", Agent: "agent1"}}; !reflect.DeepEqual(runs, want) {
+		t.Fatalf("handover runs = %v, want %v", runs, want)
+	}
+	var reply int
+	err := session.AgentExit(&api.AgentExit{Agent: "agent1", ObjectId: objectId, Success: true}, &reply)
+	if err == nil || err.Error() != api.ErrHandedOver {
+		t.Fatalf("predecessor AgentExit error = %v, want %s", err, api.ErrHandedOver)
+	}
+
+	//新进程：恢复agent和实例，加载实例日志时加入job的实例列表
+	agents = &agent.Registry{Timeout: agentTimeout}
+	remoteRuns.Lock()
+	remoteRuns.runs, remoteRuns.handedOver = map[string]*remoteRun{}, false
+	remoteRuns.Unlock()
+	loger := &bufferLoger{data: map[string]interface{}{}}
+	openLoger = func(name, id string) handle.Loger {
+		if name != "remote1" || id != objectId {
+			t.Errorf("open loger %s %s", name, id)
+		}
+		return loger
+	}
+	restoreRemoteRuns(runs, list)
+
+	job, err := cmd.NewPHPJob(&cmd.PHPEnv{}, handle.Console, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.AddJob("remote1", "", "0 0 0 1 1 ?", job); err != nil {
+		t.Fatal(err)
+	}
+	defer c.RemoveFunc("remote1")
+	loadJournal(c.Entries())
+	if list := job.List(); len(list) != 1 || list[0].ObjectId != objectId || list[0].Agent != "agent1" {
+		t.Fatalf("handed over run should be listed, got %v", list)
+	}
+	if _, ok := stored[objectId]; !ok {
+		t.Fatal("journal of handed over run should be kept")
+	}
+
+	if err := session.AgentOutput(&api.AgentOutput{Agent: "agent1", ObjectId: objectId, Content: "after handover\n"}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.AgentExit(&api.AgentExit{Agent: "agent1", ObjectId: objectId, Success: true}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if loger.out.String() != "after handover\n" || loger.data["result"] != handle.ResultSuccess {
+		t.Errorf("output %q, record %v", loger.out.String(), loger.data)
+	}
+	if len(job.List()) != 0 {
+		t.Error("finished run should be removed from the job")
+	}
+	if _, ok := stored[objectId]; ok {
+		t.Error("journal of finished run should be removed")
+	}
+	if _, err := agents.Pick(nil); err != nil {
+		t.Errorf("agent capacity should be released, got %v", err)
+	}
+}
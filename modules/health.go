@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"jcron/modules/handle"
+	"jcron/modules/metrics"
+	"jcron/modules/systemd"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// 调度循环超过该时间没有心跳视为卡住
+const stallTimeout = 30 * time.Second
+
+// 看门狗检查间隔
+const watchdogInterval = 5 * time.Second
+
+var (
+	// rpc端口是否在监听
+	rpcListening int32
+	// job和快照是否加载完成
+	jobsLoaded int32
+	// 调度循环是否卡住
+	schedulerStalled int32
+)
+
+// 健康检查结果
+type HealthStatus struct {
+	//ok或fail
+	Status string
+	//数据库连接状态，ok或错误信息
+	Storage string
+	//调度循环最近一次迭代时间
+	SchedulerLastLoop time.Time
+	//调度循环是否卡住
+	SchedulerStalled bool
+	//rpc端口是否在监听
+	RpcListening bool
+	//job是否加载完成
+	JobsLoaded bool
+	//正在调度的job数
+	Jobs int
+	//选举身份，leader或standby，未开启选举时为空
+	Role string
+}
+
+func init() {
+	httpMux.HandleFunc("/healthz", serveHealth(false))
+	httpMux.HandleFunc("/readyz", serveHealth(true))
+
+	metrics.NewGaugeFunc("jcron_scheduler_stalled", "Whether the scheduler loop is stalled.", func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(atomic.LoadInt32(&schedulerStalled))}}
+	})
+}
+
+/**
+ * 判断调度循环是否卡住
+ */
+func isStalled() (time.Time, int, bool) {
+	last, count := c.Heartbeat()
+	//备用节点没有启动调度循环
+	if atomic.LoadInt32(&schedulerRunning) == 0 {
+		return last, count, false
+	}
+	return last, count, last.IsZero() || time.Since(last) > stallTimeout
+}
+
+/**
+ * 检查健康状态，ready为false时只检查存活（调度循环），为true时检查所有依赖
+ */
+func checkHealth(ready bool) (*HealthStatus, bool) {
+	last, count, stalled := isStalled()
+	status := &HealthStatus{
+		Storage:           "ok",
+		SchedulerLastLoop: last,
+		SchedulerStalled:  stalled,
+		RpcListening:      atomic.LoadInt32(&rpcListening) == 1,
+		JobsLoaded:        atomic.LoadInt32(&jobsLoaded) == 1,
+		Jobs:              count,
+	}
+	if elector != nil {
+		status.Role = "standby"
+		if elector.IsLeader() {
+			status.Role = "leader"
+		}
+	}
+	healthy := !stalled
+	if ready {
+		if err := handle.Ping(); err != nil {
+			status.Storage = err.Error()
+			healthy = false
+		}
+		//备用节点不加载job，只提供接口
+		healthy = healthy && status.RpcListening && (status.JobsLoaded || status.Role == "standby")
+	}
+	status.Status = "ok"
+	if !healthy {
+		status.Status = "fail"
+	}
+	return status, healthy
+}
+
+/**
+ * 健康检查接口，健康时返回200，否则返回503
+ */
+func serveHealth(ready bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, healthy := checkHealth(ready)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+/**
+ * rpc端口开始监听后通知systemd启动完成
+ */
+func markReady() {
+	atomic.StoreInt32(&rpcListening, 1)
+	if _, err := systemd.Notify(systemd.Ready); err != nil {
+		log.Printf("sd_notify READY error: %s\n", err)
+	}
+}
+
+/**
+ * 看门狗，定期检查调度循环，卡住时输出日志并停止向systemd发送WATCHDOG，由systemd重启进程
+ */
+func watchdog() {
+	interval := watchdogInterval
+	timeout := systemd.WatchdogTimeout()
+	if timeout > 0 && timeout/2 < interval {
+		interval = timeout / 2
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		last, _, stalled := isStalled()
+		if stalled {
+			if atomic.SwapInt32(&schedulerStalled, 1) == 0 {
+				log.Printf("watchdog: scheduler loop stalled, last loop at %s\n", last)
+			}
+			continue
+		}
+		if atomic.SwapInt32(&schedulerStalled, 0) == 1 {
+			log.Printf("watchdog: scheduler loop recovered\n")
+		}
+		if timeout > 0 {
+			if _, err := systemd.Notify(systemd.Watchdog); err != nil {
+				log.Printf("sd_notify WATCHDOG error: %s\n", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"jcron/modules/api"
+	"jcron/modules/cron"
+	"jcron/modules/handle"
+	"sort"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// 运行记录单次查询最大条数
+const maxRunLimit = 1000
+
+// 统计默认时间范围
+const defaultStatRange = 7 * 24 * time.Hour
+
+/**
+ * 时间范围查询条件
+ */
+func timeRange(start, end time.Time) bson.M {
+	cond := bson.M{}
+	if !start.IsZero() {
+		cond["$gte"] = start
+	}
+	if !end.IsZero() {
+		cond["$lt"] = end
+	}
+	return cond
+}
+
+/**
+ * jsonrpc接口，分页查询job的运行记录，按开始时间倒序
+ */
+func (t *Calculator) GetJobRun(query *api.RunQuery, reply *api.RunPage) error {
+	*reply = api.RunPage{List: []*api.RunRecord{}}
+	if err := t.session.Check(query.Name, permView); err != nil {
+		return err
+	}
+	cond := bson.M{}
+	if r := timeRange(query.Start, query.End); len(r) > 0 {
+		cond["starttime"] = r
+	}
+	if query.Result != nil {
+		cond["result"] = *query.Result
+	}
+	if query.Trigger != "" {
+		cond["trigger"] = query.Trigger
+	}
+	limit := query.Limit
+	if limit <= 0 || limit > maxRunLimit {
+		limit = maxRunLimit
+	}
+	find := func(c *mgo.Collection) error {
+		var err error
+		q := c.Find(cond)
+		reply.Total, err = q.Count()
+		if err != nil {
+			return err
+		}
+		return q.Select(bson.M{"content": 0}).Sort("-starttime").Skip(query.Skip).Limit(limit).All(&reply.List)
+	}
+	return handle.WitchCollection(handle.Config().JobLogDb, query.Name, find)
+}
+
+/**
+ * jsonrpc接口，获取一次运行的完整日志
+ */
+func (t *Calculator) GetJobRunLog(jobInstance *cron.JobInstance, reply *api.RunRecord) error {
+	if err := t.session.Check(jobInstance.JobName, permView); err != nil {
+		return err
+	}
+	record, err := findRun(jobInstance.JobName, jobInstance.ObjectId)
+	if err != nil {
+		return err
+	}
+	*reply = *record
+	return nil
+}
+
+/**
+ * 根据实例id查找运行记录
+ */
+var findRun = func(name, objectId string) (*api.RunRecord, error) {
+	if !bson.IsObjectIdHex(objectId) {
+		return nil, errors.New("ObjectId is invalid")
+	}
+	record := &api.RunRecord{}
+	find := func(c *mgo.Collection) error {
+		return c.FindId(bson.ObjectIdHex(objectId)).One(record)
+	}
+	err := handle.WitchCollection(handle.Config().JobLogDb, name, find)
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+/**
+ * jsonrpc接口，统计单个job或一个类别下所有job的运行情况
+ */
+func (t *Calculator) GetJobStat(query *api.StatQuery, reply *api.JobStat) error {
+	if query.Name == "" && query.Category == "" {
+		return errors.New("Name or Category is required")
+	}
+	var names []string
+	if query.Name != "" {
+		if err := t.session.Check(query.Name, permView); err != nil {
+			return err
+		}
+		names = []string{query.Name}
+	} else {
+		if !t.session.login {
+			return ErrUnauthenticated
+		}
+		var jobList []cron.JobCollection
+		find := func(c *mgo.Collection) error {
+			return c.Find(bson.M{"category": query.Category}).All(&jobList)
+		}
+		err := handle.WitchCollection(handle.Config().JobDb, handle.Config().JobCollection, find)
+		if err != nil {
+			return err
+		}
+		for i := range jobList {
+			if t.session.allow(&jobList[i], permView) {
+				names = append(names, jobList[i].Name)
+			}
+		}
+	}
+
+	start, end := query.Start, query.End
+	if start.IsZero() {
+		start = time.Now().Add(-defaultStatRange)
+	}
+	cond := bson.M{"starttime": timeRange(start, end)}
+	records := []*api.RunRecord{}
+	streak, maxStreak := 0, 0
+	for _, name := range names {
+		var list []*api.RunRecord
+		find := func(c *mgo.Collection) error {
+			return c.Find(cond).Select(bson.M{"content": 0}).Sort("starttime").All(&list)
+		}
+		err := handle.WitchCollection(handle.Config().JobLogDb, name, find)
+		if err != nil {
+			return err
+		}
+		records = append(records, list...)
+		//连续失败按job分别计算，类别统计取各job的最大值
+		current, longest := failureStreak(list)
+		if current > streak {
+			streak = current
+		}
+		if longest > maxStreak {
+			maxStreak = longest
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].StartTime.Before(records[j].StartTime)
+	})
+	*reply = stat(records)
+	reply.FailureStreak, reply.MaxFailureStreak = streak, maxStreak
+	reply.Name = query.Name
+	reply.Category = query.Category
+	return nil
+}
+
+/**
+ * 统计运行记录，records按开始时间升序
+ */
+func stat(records []*api.RunRecord) api.JobStat {
+	s := api.JobStat{}
+	durations := []float64{}
+	for _, record := range records {
+		s.Total++
+		switch record.Result {
+		case api.ResultRunning:
+			s.Running++
+			continue
+		case api.ResultSkipped:
+			s.Skipped++
+			continue
+		case api.ResultSuccess:
+			s.Success++
+		default:
+			s.Failed++
+		}
+		durations = append(durations, record.EndTime.Sub(record.StartTime).Seconds())
+	}
+	s.FailureStreak, s.MaxFailureStreak = failureStreak(records)
+	if s.Success+s.Failed > 0 {
+		s.SuccessRate = float64(s.Success) / float64(s.Success+s.Failed)
+	}
+	if len(durations) > 0 {
+		sort.Float64s(durations)
+		s.P50 = percentile(durations, 0.5)
+		s.P95 = percentile(durations, 0.95)
+		s.Max = durations[len(durations)-1]
+	}
+	return s
+}
+
+/**
+ * 计算一个job的当前和最长连续失败次数，records按开始时间升序，运行中和跳过的不打断连续失败
+ */
+func failureStreak(records []*api.RunRecord) (int, int) {
+	streak, longest := 0, 0
+	for _, record := range records {
+		switch record.Result {
+		case api.ResultRunning, api.ResultSkipped:
+		case api.ResultSuccess:
+			streak = 0
+		default:
+			streak++
+			if streak > longest {
+				longest = streak
+			}
+		}
+	}
+	return streak, longest
+}
+
+/**
+ * 计算百分位数，values已升序排列
+ */
+func percentile(values []float64, p float64) float64 {
+	i := int(float64(len(values))*p+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(values) {
+		i = len(values) - 1
+	}
+	return values[i]
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"jcron/modules/api"
+	"testing"
+)
+
+func TestFailureStreak(t *testing.T) {
+	records := func(results ...int) []*api.RunRecord {
+		list := []*api.RunRecord{}
+		for _, result := range results {
+			list = append(list, &api.RunRecord{Result: result})
+		}
+		return list
+	}
+	f, s := api.ResultFailed, api.ResultSuccess
+	current, longest := failureStreak(records(f, f, s, f, api.ResultSkipped, f, f, api.ResultRunning))
+	if current != 3 || longest != 3 {
+		t.Errorf("expected 3 3, got %d %d", current, longest)
+	}
+	current, longest = failureStreak(records(f, f, s))
+	if current != 0 || longest != 2 {
+		t.Errorf("expected 0 2, got %d %d", current, longest)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"jcron/modules/api"
+	"jcron/modules/handle"
+	"log"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// http接口前缀，/api/<方法名>对应Calculator.<方法名>
+const apiPrefix = "/api/"
+
+// http接口返回格式，和jsonrpc保持一致
+type apiResponse struct {
+	Result interface{} `json:"result"`
+	Error  interface{} `json:"error"`
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// 只读接口，可以用GET调用，其他接口只接受POST
+var readOnlyApis = map[string]bool{
+	"GetAgents":       true,
+	"GetErrLog":       true,
+	"GetJob":          true,
+	"GetJobInstance":  true,
+	"GetJobList":      true,
+	"GetJobRevision":  true,
+	"GetJobRun":       true,
+	"GetJobRunLog":    true,
+	"GetJobStat":      true,
+	"GetJobs":         true,
+	"GetLeader":       true,
+	"GetMaintenance":  true,
+	"GetOperateLog":   true,
+	"DiffJobRevision": true,
+	"FollowJobRun":    true,
+	"ParseCron":       true,
+}
+
+// 非只读接口没有使用POST调用
+var ErrPostRequired = errors.New("method requires POST")
+
+// 请求体不是json格式，防止跨站的表单或text/plain请求调用接口
+var ErrJsonRequired = errors.New("Content-Type must be application/json")
+
+// http服务路由
+var httpMux = http.NewServeMux()
+
+// http服务，平滑重启时等待处理中的请求返回后关闭
+var httpServer = &http.Server{Handler: httpMux}
+
+func init() {
+	httpMux.HandleFunc(apiPrefix, serveApi)
+}
+
+/**
+ * 根据http请求头登录，支持
+ *   Authorization: Bearer <Token>
+ *   X-Jcron-User、X-Jcron-Timestamp、X-Jcron-Nonce、X-Jcron-Sign
+ */
+func httpSession(r *http.Request) (*Session, error) {
+	session := newSession(r.RemoteAddr)
+	if !authEnabled() {
+		return session, nil
+	}
+	certLogin(session, r.TLS)
+	if session.login {
+		return session, nil
+	}
+	args := &api.LoginArgs{}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		args.Token = strings.TrimPrefix(auth, "Bearer ")
+	} else if sign := r.Header.Get("X-Jcron-Sign"); sign != "" {
+		args.User = r.Header.Get("X-Jcron-User")
+		args.Timestamp, _ = strconv.ParseInt(r.Header.Get("X-Jcron-Timestamp"), 10, 64)
+		args.Nonce = r.Header.Get("X-Jcron-Nonce")
+		args.Sign = sign
+	} else {
+		return session, nil
+	}
+	return session, session.Login(args)
+}
+
+/**
+ * http接口，请求体为json格式的参数，调用对应的jsonrpc接口
+ */
+func serveApi(w http.ResponseWriter, r *http.Request) {
+	resp := &apiResponse{}
+	status := http.StatusOK
+	defer func() {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(resp)
+	}()
+
+	session, err := httpSession(r)
+	if err != nil {
+		status = http.StatusUnauthorized
+		resp.Error = err.Error()
+		return
+	}
+	result, err := callApi(&Calculator{session}, strings.TrimPrefix(r.URL.Path, apiPrefix), r)
+	if err != nil {
+		switch err {
+		case ErrUnauthenticated:
+			status = http.StatusUnauthorized
+		case ErrPermissionDenied:
+			status = http.StatusForbidden
+		case ErrPostRequired:
+			status = http.StatusMethodNotAllowed
+			w.Header().Set("Allow", http.MethodPost)
+		case ErrJsonRequired:
+			status = http.StatusUnsupportedMediaType
+		}
+		resp.Error = err.Error()
+		return
+	}
+	resp.Result = result
+}
+
+/**
+ * 通过反射调用Calculator的方法，方法签名为 func(args T, reply *R) error，只读接口以外需要使用POST，
+ * 有请求体时Content-Type需要为application/json
+ */
+func callApi(cal *Calculator, name string, r *http.Request) (interface{}, error) {
+	method := reflect.ValueOf(cal).MethodByName(name)
+	if !method.IsValid() || method.Type().NumIn() != 2 || method.Type().NumOut() != 1 ||
+		method.Type().Out(0) != errorType || method.Type().In(1).Kind() != reflect.Ptr {
+		return nil, errors.New("method not found: " + name)
+	}
+	if r.Method != http.MethodPost && !readOnlyApis[name] {
+		return nil, ErrPostRequired
+	}
+
+	argType := method.Type().In(0)
+	var args reflect.Value
+	if argType.Kind() == reflect.Ptr {
+		args = reflect.New(argType.Elem())
+	} else {
+		args = reflect.New(argType)
+	}
+	if r.ContentLength != 0 && r.Body != nil {
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+			return nil, ErrJsonRequired
+		}
+		if err := json.NewDecoder(r.Body).Decode(args.Interface()); err != nil {
+			return nil, errors.New("invalid params: " + err.Error())
+		}
+	}
+	if argType.Kind() != reflect.Ptr {
+		args = args.Elem()
+	}
+
+	reply := reflect.New(method.Type().In(1).Elem())
+	ret := method.Call([]reflect.Value{args, reply})
+	if err, _ := ret[0].Interface().(error); err != nil {
+		return nil, err
+	}
+	return reply.Interface(), nil
+}
+
+/**
+ * 启动http服务
+ */
+func registerHTTP() {
+	if handle.Config().HttpPort == "" {
+		return
+	}
+	log.Printf("StartHttp Port : %s\n", handle.Config().HttpPort)
+	listener, err := newListener(handle.Config().HttpPort)
+	if err != nil {
+		log.Fatal("http listen error:", err)
+	}
+	err = httpServer.Serve(listener)
+	if err != nil && err != http.ErrServerClosed {
+		log.Printf("http serve error: %s\n", err)
+	}
+}
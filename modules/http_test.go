@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCallApiMethod(t *testing.T) {
+	cal := &Calculator{newSession("test")}
+	r := httptest.NewRequest("GET", apiPrefix+"StopJob", strings.NewReader(`"php1"`))
+	if _, err := callApi(cal, "StopJob", r); err != ErrPostRequired {
+		t.Errorf("expected ErrPostRequired for GET StopJob, got %v", err)
+	}
+
+	// 跨站的text/plain请求不能调用接口
+	r = httptest.NewRequest("POST", apiPrefix+"StopJob", strings.NewReader(`"php1"`))
+	r.Header.Set("Content-Type", "text/plain")
+	if _, err := callApi(cal, "StopJob", r); err != ErrJsonRequired {
+		t.Errorf("expected ErrJsonRequired for text/plain StopJob, got %v", err)
+	}
+
+	r = httptest.NewRequest("GET", apiPrefix+"ParseCron", strings.NewReader(`{"Cron" : "0 * * * * *", "Count" : 2}`))
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	result, err := callApi(cal, "ParseCron", r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if times := *result.(*[]time.Time); len(times) != 2 {
+		t.Errorf("expected 2 times, got %v", times)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"jcron/modules/api"
+	"jcron/modules/cron"
+	"jcron/modules/handle"
+	"jcron/modules/job/cmd"
+	"jcron/modules/job/web"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// 正在调度的job创建或最后一次修改时使用的配置，热加载时用于判断配置是否修改
+var appliedJobs = struct {
+	sync.Mutex
+	jobs map[string]*cron.JobCollection
+}{jobs: map[string]*cron.JobCollection{}}
+
+// 记录job使用的配置
+func setApplied(jobData *cron.JobCollection) {
+	applied := *jobData
+	appliedJobs.Lock()
+	appliedJobs.jobs[jobData.Name] = &applied
+	appliedJobs.Unlock()
+}
+
+// 获取job使用的配置，没有记录时返回nil
+func getApplied(name string) *cron.JobCollection {
+	appliedJobs.Lock()
+	defer appliedJobs.Unlock()
+	return appliedJobs.jobs[name]
+}
+
+/**
+ * 根据job配置创建job对象，并记录使用的配置
+ */
+func newJob(jobData *cron.JobCollection) (cron.Job, error) {
+	job, err := createJob(jobData)
+	if err != nil {
+		return nil, err
+	}
+	setApplied(jobData)
+	return job, nil
+}
+
+// 根据执行程序类型创建job对象
+func createJob(jobData *cron.JobCollection) (cron.Job, error) {
+	objHandle := handle.NewMongoC(jobData.Name)
+	if jobData.ExecType == "php" {
+		job, err := cmd.NewPHPJob(cmd.DefaultPHP(jobData.ExecEnv), objHandle, jobData.Channel, jobData.Content...)
+		if err != nil {
+			return nil, err
+		}
+		job.SetPlacement(placementOf(jobData))
+		return job, nil
+	} else if jobData.ExecType == "http" {
+		if len(jobData.Content) == 0 {
+			return nil, errors.New("Content must not be empty")
+		}
+		return web.NewWebJob(objHandle, jobData.Channel, jobData.Content[0])
+	}
+	return nil, errors.New("job not support")
+}
+
+// job的运行位置限制，没有限制时返回nil
+func placementOf(jobData *cron.JobCollection) *api.Placement {
+	if len(jobData.Labels) == 0 && len(jobData.Hosts) == 0 {
+		return nil
+	}
+	return &api.Placement{Labels: jobData.Labels, Hosts: jobData.Hosts}
+}
+
+/**
+ * 校验job配置，job名称会作为日志集合名称
+ */
+func validateJob(jobData *cron.JobCollection) error {
+	name := jobData.Name
+	if name == "" || strings.ContainsAny(name, "$\x00") || strings.HasPrefix(name, "system.") {
+		return errors.New("Name is invalid: " + name)
+	}
+	if _, err := cron.Parse(jobData.Cron); err != nil {
+		return errors.New("Cron is invalid: " + err.Error())
+	}
+	if jobData.Channel < 1 {
+		return errors.New("Channel must greater than zero")
+	}
+	if len(jobData.Content) == 0 || jobData.Content[0] == "" {
+		return errors.New("Content must not be empty")
+	}
+	switch jobData.ExecType {
+	case "php":
+		// 限制运行位置的job在agent上运行，执行环境只需要在agent上存在
+		if placementOf(jobData) != nil {
+			if err := json.Unmarshal([]byte(jobData.ExecEnv), &cmd.PHPEnv{}); err != nil {
+				return errors.New("ExecEnv is invalid: " + jobData.ExecEnv + " is not json format")
+			}
+		} else if _, err := cmd.ParsePHPEnv(jobData.ExecEnv); err != nil {
+			return errors.New("ExecEnv is invalid: " + err.Error())
+		}
+	case "http":
+		if placementOf(jobData) != nil {
+			return errors.New("Labels and Hosts only apply to php jobs")
+		}
+		u, err := url.Parse(jobData.Content[0])
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("Content is not a http url: " + jobData.Content[0])
+		}
+	default:
+		return errors.New("ExecType not support: " + jobData.ExecType)
+	}
+	if jobData.Misfire != "" && jobData.Misfire != cron.MisfireSkip && jobData.Misfire != cron.MisfireOnce {
+		return errors.New("Misfire must be skip or once: " + jobData.Misfire)
+	}
+	return nil
+}
+
+/**
+ * 将修改后的job配置应用到正在调度的任务，正在运行的实例不受影响
+ */
+func applyJob(entry *cron.Entry, old, jobData *cron.JobCollection) error {
+	if old.ExecType != jobData.ExecType {
+		return errors.New("ExecType can not be changed while job is running, stop it first")
+	}
+	if err := c.UpdateJob(jobData.Name, jobData.Desc, jobData.Cron); err != nil {
+		return err
+	}
+	entry.Job.SetChannel(jobData.Channel)
+	switch job := entry.Job.(type) {
+	case *cmd.PHPJob:
+		job.Reset(cmd.DefaultPHP(jobData.ExecEnv), jobData.Content...)
+		job.SetPlacement(placementOf(jobData))
+	case *web.WebJob:
+		job.Reset(jobData.Content[0])
+	}
+	setApplied(jobData)
+	return nil
+}
+
+/**
+ * 保存修改后的job配置，正在调度的job立即生效，运行状态由启动、停止、暂停修改，这里不写入。
+ * 先应用到正在调度的任务再写入，应用失败时不写入，写入失败时恢复原配置，保存的配置和调度中的一致
+ */
+func saveJob(old, jobData *cron.JobCollection) error {
+	entry := findEntry(jobData.Name)
+	if entry != nil && old.ExecType != jobData.ExecType {
+		return errors.New("ExecType can not be changed while job is running, stop it first")
+	}
+	fields, err := jobFields(jobData)
+	if err != nil {
+		return err
+	}
+	if entry != nil {
+		if err = applyJob(entry, old, jobData); err != nil {
+			return err
+		}
+	}
+	err = updateJob(jobData.Name, fields)
+	if err != nil && entry != nil {
+		if rollback := applyJob(entry, jobData, old); rollback != nil {
+			log.Printf("Rollback job %s error: %s\n", jobData.Name, rollback)
+		}
+	}
+	return err
+}
+
+// 修改配置时写入的字段，不包括运行状态
+func jobFields(jobData *cron.JobCollection) (bson.M, error) {
+	data, err := bson.Marshal(jobData)
+	if err != nil {
+		return nil, err
+	}
+	fields := bson.M{}
+	if err = bson.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	delete(fields, "status")
+	return fields, nil
+}
+
+// 修改job配置的字段
+var updateJob = func(name string, fields bson.M) error {
+	update := func(c *mgo.Collection) error {
+		return c.Update(bson.M{"name": name}, bson.M{"$set": fields})
+	}
+	return handle.WitchCollection(handle.Config().JobDb, handle.Config().JobCollection, update)
+}
+
+// 删除已停止的job配置，job不存在或没有停止时返回mgo.ErrNotFound
+var removeStoppedJob = func(name string) error {
+	remove := func(c *mgo.Collection) error {
+		return c.Remove(bson.M{"name": name, "status": cron.StatusStopped})
+	}
+	return handle.WitchCollection(handle.Config().JobDb, handle.Config().JobCollection, remove)
+}
+
+/**
+ * 根据名称查找job配置
+ */
+var findJob = func(name string) (*cron.JobCollection, error) {
+	jobData := &cron.JobCollection{}
+	find := func(c *mgo.Collection) error {
+		return c.Find(bson.M{"name": name}).One(jobData)
+	}
+	err := handle.WitchCollection(handle.Config().JobDb, handle.Config().JobCollection, find)
+	if err != nil {
+		return nil, err
+	}
+	return jobData, nil
+}
+
+/**
+ * 根据名称查找正在调度的任务
+ */
+func findEntry(name string) *cron.Entry {
+	for _, entry := range c.Entries() {
+		if entry.Name == name {
+			return entry
+		}
+	}
+	return nil
+}
@@ -3,28 +3,89 @@ package cmd
 import (
 	"encoding/json"
 	"errors"
+	"jcron/modules/api"
 	"jcron/modules/cron"
 	"jcron/modules/handle"
+	"jcron/modules/metrics"
 	"jcron/modules/proc"
+	"jcron/modules/shim"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // php执行环境
 type PHPEnv struct {
-	Path string `json: "path"` // php执行文件路径
-	Ini  string `json: "ini"`  // php配置文件路径
-	Pwd  string `json: "pwd"`  // 工作目录
+	Path string `json:"path"` // php执行文件路径
+	Ini  string `json:"ini"`  // php配置文件路径
+	Pwd  string `json:"pwd"`  // 工作目录
+}
+
+// 在agent上执行，由调度程序设置，为nil时只在本机执行
+type Remote interface {
+	// 选择满足运行位置限制的agent并占用一个运行位置，返回空字符串时在本机执行，没有可用agent时返回错误
+	Pick(placement *api.Placement) (string, error)
+	// 在选择的agent上执行，实例结束或agent失联时调用done
+	Run(agent string, req *api.RunRequest, loger handle.Loger, done func(success bool)) error
+	// 杀死agent上的实例
+	Kill(agent, objectId string) error
+}
+
+var RemoteExec Remote
+
+// 检查加入的进程是否结束的间隔
+var adoptedPollInterval = time.Second
+
+var (
+	// shim程序路径，一般为调度程序自身，为空时直接启动php进程
+	ShimPath string
+	// shim写入输出和状态的目录，每个实例一个子目录
+	SpoolPath string
+)
+
+// 正在读取spool目录和等待加入进程的协程，平滑重启时停止，实例由新进程接管
+var watchers = struct {
+	sync.Mutex
+	stop     chan struct{}
+	wg       sync.WaitGroup
+	detached bool
+}{stop: make(chan struct{})}
+
+// 登记一个读取协程，已停止时返回false
+func addWatcher() bool {
+	watchers.Lock()
+	defer watchers.Unlock()
+	if watchers.detached {
+		return false
+	}
+	watchers.wg.Add(1)
+	return true
+}
+
+/**
+ * 停止读取spool目录和等待加入的进程，等待这些协程退出，之后不再启动。
+ * 停止后实例的输出、结果、实例日志和spool目录都留给新进程处理，平滑重启时在交出调度状态之前调用
+ */
+func DetachWatchers() {
+	watchers.Lock()
+	if !watchers.detached {
+		watchers.detached = true
+		close(watchers.stop)
+	}
+	watchers.Unlock()
+	watchers.wg.Wait()
 }
 
 type PHPJob struct {
 	env         *PHPEnv
 	handler     handle.Handler // 输出处理
 	args        []string
-	channel     chan int        // 当前任务的执行并发数
+	placement   *api.Placement  // 运行位置限制
+	running     int             // 当前任务的执行并发数
 	num         int             //最大同时执行的个数
 	RunInfoList []*cron.RunInfo // 当前PHPJob正在运行的所有进程句柄
 	runLock     sync.Mutex
@@ -39,6 +100,21 @@ func Exist(filename string) bool {
 
 //var PHPJobList = make(map[string]*PHPJob)
 
+// 解析并校验php执行环境
+func ParsePHPEnv(content string) (*PHPEnv, error) {
+	var env PHPEnv
+	err := json.Unmarshal([]byte(content), &env)
+	if err != nil {
+		return nil, errors.New(content + " is not json format")
+	}
+	for _, path := range []string{env.Path, env.Ini, env.Pwd} {
+		if !Exist(path) {
+			return nil, errors.New(path + " not exist")
+		}
+	}
+	return &env, nil
+}
+
 func DefaultPHP(content string) *PHPEnv {
 	var env PHPEnv
 	err := json.Unmarshal([]byte(content), &env)
@@ -58,9 +134,9 @@ func DefaultPHP(content string) *PHPEnv {
 }
 
 /**
- * 执行PHP
+ * 执行PHP，runInfo为已加入实例列表的实例，启动后设置进程句柄
  */
-func (env *PHPEnv) Run(loger handle.Loger, job *PHPJob, channel chan int, args ...string) *os.Process {
+func (env *PHPEnv) Run(loger handle.Loger, job *PHPJob, runInfo *cron.RunInfo, args ...string) *os.Process {
 	// 参数合并，加入配置文件
 	iniArgs := []string{"-c", env.Ini}
 	args = append(iniArgs, args...)
@@ -73,43 +149,92 @@ func (env *PHPEnv) Run(loger handle.Loger, job *PHPJob, channel chan int, args .
 	cmd.Stderr = loger.NewErrPipe()
 
 	cmd.Stdout.Write([]byte("start running \n"))
+	name := job.handler.Name()
+	metrics.JobStarted.Inc(name)
+	start := time.Now()
 	err := cmd.Start()
 	if err != nil {
 		// 释放信号量
-		<-channel
+		job.release()
+		metrics.JobFinish(name, false, time.Since(start).Seconds())
 
 		cmd.Stderr.Write([]byte(err.Error()))
 		data := make(map[string]interface{})
 		data["endtime"] = time.Now()
+		data["result"] = handle.ResultFailed
 		loger.Update(data)
 		return nil
 	}
 
+	job.started(runInfo, cmd.Process)
+
 	// 异步等待程序执行完成
 	go func() {
-		pid := cmd.Process.Pid
 		err = cmd.Wait()
 
-		job.runLock.Lock()
-		for i, run := range job.RunInfoList {
-			if run.Proc.Pid == pid {
-				job.RunInfoList = append(job.RunInfoList[:i], job.RunInfoList[i+1:]...)
-				break
-			}
-		}
-		job.runLock.Unlock()
+		job.remove(runInfo.ObjectId)
+		cron.JournalFinish(runInfo.ObjectId)
 
-		<-channel
+		job.release()
 
+		data := make(map[string]interface{})
 		if err != nil {
 			cmd.Stderr.Write([]byte(err.Error()))
+			data["result"] = handle.ResultFailed
 		} else {
 			cmd.Stdout.Write([]byte("finished !\n"))
+			data["result"] = handle.ResultSuccess
 		}
+		data["endtime"] = time.Now()
+		loger.Update(data)
+		metrics.JobFinish(name, err == nil, time.Since(start).Seconds())
+	}()
+
+	data := make(map[string]interface{})
+	data["pid"] = cmd.Process.Pid
+	loger.Update(data)
+	return cmd.Process
+}
+
+/**
+ * 通过shim执行PHP，shim把输出和退出状态写入spool目录，调度程序重启后可以重新接管
+ */
+func (env *PHPEnv) runShim(loger handle.Loger, job *PHPJob, runInfo *cron.RunInfo, args []string) *os.Process {
+	name := job.handler.Name()
+	objectId := runInfo.ObjectId
+	dir := filepath.Join(SpoolPath, objectId)
+	loger.NewLogPipe().Write([]byte("start running \n"))
+	metrics.JobStarted.Inc(name)
+	start := time.Now()
+
+	err := os.MkdirAll(dir, 0755)
+	var cmd *exec.Cmd
+	if err == nil {
+		cmd = shim.Command(ShimPath, dir, env.Path, append([]string{"-c", env.Ini}, args...)...)
+		cmd.Dir = env.Pwd
+		err = cmd.Start()
+	}
+	if err != nil {
+		job.release()
+		metrics.JobFinish(name, false, time.Since(start).Seconds())
+		loger.NewErrPipe().Write([]byte(err.Error()))
 		data := make(map[string]interface{})
 		data["endtime"] = time.Now()
+		data["result"] = handle.ResultFailed
 		loger.Update(data)
+		os.RemoveAll(dir)
+		return nil
+	}
+
+	job.started(runInfo, cmd.Process)
+
+	// 回收shim进程，shim退出后读取剩余输出和退出状态
+	var exited int32
+	go func() {
+		cmd.Wait()
+		atomic.StoreInt32(&exited, 1)
 	}()
+	go job.watch(dir, objectId, loger, func() bool { return atomic.LoadInt32(&exited) == 0 }, start)
 
 	data := make(map[string]interface{})
 	data["pid"] = cmd.Process.Pid
@@ -117,6 +242,90 @@ func (env *PHPEnv) Run(loger handle.Loger, job *PHPJob, channel chan int, args .
 	return cmd.Process
 }
 
+// 读取shim的输出写入日志管道，shim结束后记录运行结果，平滑重启停止读取后由新进程接管
+func (job *PHPJob) watch(dir, objectId string, loger handle.Loger, alive func() bool, start time.Time) {
+	if !addWatcher() {
+		return
+	}
+	defer watchers.wg.Done()
+	logPipe := loger.NewLogPipe()
+	errPipe := loger.NewErrPipe()
+	state := shim.Watch(dir, alive, watchers.stop, func(item *api.LogItem) {
+		if item.FromType == 1 {
+			errPipe.Write([]byte(item.Content))
+		} else {
+			logPipe.Write([]byte(item.Content))
+		}
+	})
+	if state == nil {
+		return
+	}
+
+	job.remove(objectId)
+	job.release()
+	cron.JournalFinish(objectId)
+
+	data := make(map[string]interface{})
+	success := false
+	if !state.Exited {
+		errPipe.Write([]byte("shim exited without exit status"))
+		data["result"] = handle.ResultFailed
+	} else if state.Error != "" {
+		errPipe.Write([]byte(state.Error))
+		data["result"] = handle.ResultFailed
+	} else {
+		logPipe.Write([]byte("finished !\n"))
+		data["result"] = handle.ResultSuccess
+		success = true
+	}
+	data["endtime"] = time.Now()
+	if !state.EndTime.IsZero() {
+		data["endtime"] = state.EndTime
+	}
+	loger.Update(data)
+	metrics.JobFinish(job.handler.Name(), success, time.Since(start).Seconds())
+	os.RemoveAll(dir)
+}
+
+/**
+ * 重启后重新接管shim启动的实例，实例已结束时记录结果，没有spool目录时返回错误
+ */
+func (job *PHPJob) Reattach(objectId string, date time.Time) error {
+	if SpoolPath == "" {
+		return errors.New("spool is disabled")
+	}
+	dir := filepath.Join(SpoolPath, objectId)
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+	state, err := shim.ReadState(dir)
+	if err != nil {
+		return err
+	}
+	loger := job.handler.OpenLoger(objectId)
+	if loger == nil {
+		return errors.New("invalid objectid " + objectId)
+	}
+	alive := func() bool {
+		return state != nil && shim.Alive(state.ShimPid, state.ShimStart)
+	}
+
+	var runInfo *cron.RunInfo
+	job.runLock.Lock()
+	job.running++
+	if alive() {
+		process, _ := os.FindProcess(state.ShimPid)
+		runInfo = &cron.RunInfo{Date: date, Proc: process, ObjectId: objectId, ExecType: "php"}
+		job.RunInfoList = append(job.RunInfoList, runInfo)
+	}
+	job.runLock.Unlock()
+	if runInfo != nil {
+		cron.JournalStart(job.handler.Name(), runInfo)
+	}
+	go job.watch(dir, objectId, loger, alive, date)
+	return nil
+}
+
 /**
  * 创建一个新的PHP任务
  */
@@ -128,7 +337,6 @@ func NewPHPJob(phpenv *PHPEnv, handler handle.Handler, num int, args ...string)
 		env:         phpenv,
 		handler:     handler,
 		args:        args,
-		channel:     make(chan int, num),
 		num:         num,
 		RunInfoList: []*cron.RunInfo{},
 		runLock:     sync.Mutex{},
@@ -139,35 +347,197 @@ func NewPHPJob(phpenv *PHPEnv, handler handle.Handler, num int, args ...string)
  * 执行一个PHP任务
  */
 func (job *PHPJob) Run(param []string) {
-	select {
-	case job.channel <- 1:
+	job.run(cron.TriggerCron, param)
+}
+
+/**
+ * 手动执行一次PHP任务
+ */
+func (job *PHPJob) RunOnce(param []string) {
+	job.run(cron.TriggerManual, param)
+}
+
+func (job *PHPJob) run(trigger string, param []string) {
+	if job.acquire() {
+		job.runLock.Lock()
+		env := job.env
+		args := append(append([]string{}, job.args...), param...)
+		placement := job.placement
+		job.runLock.Unlock()
+		agent := ""
+		if RemoteExec != nil {
+			var err error
+			agent, err = RemoteExec.Pick(placement)
+			if err != nil {
+				job.release()
+				metrics.JobSkipped.Inc(job.handler.Name())
+				log.Printf("%s skipped: %s\n", job.handler.Name(), err)
+				return
+			}
+		}
 		loger, objectId := job.handler.NewLoger()
-		args := append(job.args, param...)
-		proc := job.env.Run(loger, job, job.channel, args...)
-		runInfo := &cron.RunInfo{
-			time.Now(),
-			proc,
-			objectId,
+		loger.Update(map[string]interface{}{"trigger": trigger})
+		if agent != "" {
+			job.runRemote(agent, env, loger, objectId, args)
+			return
 		}
-		if proc != nil {
-			job.runLock.Lock()
-			job.RunInfoList = append(job.RunInfoList, runInfo)
-			job.runLock.Unlock()
+		// 启动前加入实例列表并写入实例日志，进程很快结束时结束处理一定在这之后，不会留下已结束的实例
+		runInfo := &cron.RunInfo{Date: time.Now(), ObjectId: objectId, ExecType: "php"}
+		job.runLock.Lock()
+		job.RunInfoList = append(job.RunInfoList, runInfo)
+		job.runLock.Unlock()
+		cron.JournalStart(job.handler.Name(), runInfo)
 
-			log.Printf("%s is running, pid is %d\n", job.args[0], proc.Pid)
+		var proc *os.Process
+		if ShimPath != "" && SpoolPath != "" {
+			proc = env.runShim(loger, job, runInfo, args)
+		} else {
+			proc = env.Run(loger, job, runInfo, args...)
+		}
+		if proc == nil {
+			// 启动失败，撤销实例
+			job.remove(objectId)
+			cron.JournalFinish(objectId)
+			return
 		}
-	default:
-		//print(job.args[0] + " channel is full !\n")
+		log.Printf("%s is running, pid is %d\n", args[0], proc.Pid)
+	} else {
+		metrics.JobSkipped.Inc(job.handler.Name())
 	}
 }
 
+// 在agent上执行，输出和结果由agent发回
+func (job *PHPJob) runRemote(agent string, env *PHPEnv, loger handle.Loger, objectId string, args []string) {
+	name := job.handler.Name()
+	req := &api.RunRequest{
+		JobName:  name,
+		ObjectId: objectId,
+		Path:     env.Path,
+		Ini:      env.Ini,
+		Pwd:      env.Pwd,
+		Args:     args,
+	}
+	runInfo := &cron.RunInfo{Date: time.Now(), ObjectId: objectId, Agent: agent, ExecType: "php"}
+	job.runLock.Lock()
+	job.RunInfoList = append(job.RunInfoList, runInfo)
+	job.runLock.Unlock()
+	cron.JournalStart(name, runInfo)
+
+	metrics.JobStarted.Inc(name)
+	start := time.Now()
+	done := func(success bool) {
+		job.remove(objectId)
+		job.release()
+		cron.JournalFinish(objectId)
+		metrics.JobFinish(name, success, time.Since(start).Seconds())
+	}
+	loger.Update(map[string]interface{}{"agent": agent})
+	if err := RemoteExec.Run(agent, req, loger, done); err != nil {
+		loger.NewErrPipe().Write([]byte(err.Error()))
+		loger.Update(map[string]interface{}{"endtime": time.Now(), "result": handle.ResultFailed})
+		done(false)
+		return
+	}
+	log.Printf("%s is running on agent %s, objectid is %s\n", args[0], agent, objectId)
+}
+
+// 进程启动后设置实例的进程句柄，实例日志补充进程id，在启动等待协程之前调用
+func (job *PHPJob) started(runInfo *cron.RunInfo, process *os.Process) {
+	job.runLock.Lock()
+	runInfo.Proc = process
+	job.runLock.Unlock()
+	cron.JournalStart(job.handler.Name(), runInfo)
+}
+
+// 从实例列表移除
+func (job *PHPJob) remove(objectId string) {
+	job.runLock.Lock()
+	defer job.runLock.Unlock()
+	for i, run := range job.RunInfoList {
+		if run.ObjectId == objectId {
+			job.RunInfoList = append(job.RunInfoList[:i], job.RunInfoList[i+1:]...)
+			break
+		}
+	}
+}
+
+// 占用一个并发数，已达到最大并发数时返回false
+func (job *PHPJob) acquire() bool {
+	job.runLock.Lock()
+	defer job.runLock.Unlock()
+	if job.running >= job.num {
+		return false
+	}
+	job.running++
+	return true
+}
+
+// 释放并发数
+func (job *PHPJob) release() {
+	job.runLock.Lock()
+	if job.running > 0 {
+		job.running--
+	}
+	job.runLock.Unlock()
+}
+
 /**
- * 添加实例
+ * 添加实例，重启后加载或从停止前的任务转入的进程占用一个并发数，进程结束后释放
  */
 func (job *PHPJob) Add(runInfo *cron.RunInfo) {
+	reserve := runInfo.Proc != nil && runInfo.Agent == ""
 	job.runLock.Lock()
 	job.RunInfoList = append(job.RunInfoList, runInfo)
+	if reserve {
+		job.running++
+	}
+	job.runLock.Unlock()
+	if reserve {
+		go job.waitAdopted(runInfo)
+	}
+}
+
+/**
+ * 移除实例，不释放并发数，agent上的实例结束时从接管它的job中移除
+ */
+func (job *PHPJob) Remove(objectId string) {
+	job.remove(objectId)
+}
+
+// 定期检查加入的进程，进程结束后移除实例并释放并发数
+func (job *PHPJob) waitAdopted(runInfo *cron.RunInfo) {
+	if !addWatcher() {
+		return
+	}
+	defer watchers.wg.Done()
+	pid := runInfo.Proc.Pid
+	// 进程id被复用时启动时间不同，不会一直占用并发数
+	start, _ := proc.StartTime(pid)
+	for {
+		alive := shim.Alive(pid, start)
+		if start == 0 {
+			alive = proc.Exist(pid) == nil
+		}
+		if !alive {
+			break
+		}
+		select {
+		case <-watchers.stop:
+			return
+		case <-time.After(adoptedPollInterval):
+		}
+	}
+
+	job.runLock.Lock()
+	for i, run := range job.RunInfoList {
+		if run == runInfo {
+			job.RunInfoList = append(job.RunInfoList[:i], job.RunInfoList[i+1:]...)
+			break
+		}
+	}
 	job.runLock.Unlock()
+	job.release()
+	cron.JournalFinish(runInfo.ObjectId)
 }
 
 // 杀死正在运行的进程
@@ -175,9 +545,37 @@ func (job *PHPJob) Kill(objectId string) error {
 	job.runLock.Lock()
 	for i, runInfo := range job.RunInfoList {
 		if runInfo.ObjectId == objectId {
+			// agent上的实例结束后由agent发回结果再移除
+			if runInfo.Agent != "" {
+				job.runLock.Unlock()
+				metrics.JobKilled.Inc(job.handler.Name())
+				return RemoteExec.Kill(runInfo.Agent, objectId)
+			}
+			// 正在启动，还没有进程句柄
+			if runInfo.Proc == nil {
+				job.runLock.Unlock()
+				return errors.New("instance is starting, retry later")
+			}
 			job.RunInfoList = append(job.RunInfoList[:i], job.RunInfoList[i+1:]...)
-			err := proc.KillGroup(runInfo.Proc.Pid)
+			pid := runInfo.Proc.Pid
+			// shim启动的实例杀死php进程，由shim记录退出状态
+			shimRun := false
+			if SpoolPath != "" {
+				dir := filepath.Join(SpoolPath, objectId)
+				_, err := os.Stat(dir)
+				shimRun = err == nil
+				state, _ := shim.ReadState(dir)
+				if state != nil && shim.Alive(state.Pid, state.PidStart) {
+					pid = state.Pid
+				}
+			}
+			err := proc.KillGroup(pid)
 			job.runLock.Unlock()
+			metrics.JobKilled.Inc(job.handler.Name())
+			// 已从实例列表移除，直接启动的进程结束时不会再记录
+			if !shimRun {
+				cron.JournalFinish(objectId)
+			}
 			return err
 		}
 	}
@@ -189,20 +587,53 @@ func (job *PHPJob) Kill(objectId string) error {
  * 获取当前任务的正在运行实例列表
  */
 func (job *PHPJob) List() []*cron.RunInfo {
+	exited := ""
 	job.runLock.Lock()
 	for i, run := range job.RunInfoList {
+		// agent上的实例由agent心跳和结果维护
+		if run.Agent != "" || run.Proc == nil {
+			continue
+		}
 		//_, err := os.FindProcess(pid)
 		err := proc.Exist(run.Proc.Pid)
 		if err != nil {
+			exited = run.ObjectId
 			job.RunInfoList = append(job.RunInfoList[:i], job.RunInfoList[i+1:]...)
 			break
 		}
 	}
+	list := append([]*cron.RunInfo{}, job.RunInfoList...)
 	job.runLock.Unlock()
-	return job.RunInfoList
+	// 重启后加载的实例没有等待进程结束，在这里记录结束
+	cron.JournalFinish(exited)
+	return list
 }
 
 //EditJob接口调用
 func (job *PHPJob) Channel() int {
+	job.runLock.Lock()
+	defer job.runLock.Unlock()
 	return job.num
 }
+
+// 修改最大并发数，超出的正在运行实例不会被杀死，运行完成后才会启动新的实例
+func (job *PHPJob) SetChannel(num int) {
+	job.runLock.Lock()
+	job.num = num
+	job.runLock.Unlock()
+}
+
+// 修改运行位置限制，下次运行时生效
+func (job *PHPJob) SetPlacement(placement *api.Placement) {
+	job.runLock.Lock()
+	job.placement = placement
+	job.runLock.Unlock()
+}
+
+// 修改执行环境和参数，下次运行时生效
+func (job *PHPJob) Reset(phpenv *PHPEnv, args ...string) {
+	job.runLock.Lock()
+	job.env = phpenv
+	job.args = args
+	job.runLock.Unlock()
+}
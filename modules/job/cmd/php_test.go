@@ -1,118 +1,571 @@
 package cmd
 
 import (
+	"bytes"
+	"io"
+	"io/ioutil"
 	"jcron/modules/cron"
 	"jcron/modules/handle"
+	"jcron/modules/shim"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
-var testHandle = handle.NewMongoC("php")
+// 测试程序作为shim运行时执行shim入口
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == shim.Arg {
+		os.Exit(shim.Main(os.Args[2:]))
+	}
+	adoptedPollInterval = 10 * time.Millisecond
+	os.Exit(m.Run())
+}
 
-// 测试基础运行是否正确
-func TestPHP(t *testing.T) {
-	channel := make(chan int, 1)
-	channel <- 1
-	proc := DefaultPHP.Run(testHandle.NewLoger(), channel, "test.php")
-	if proc != nil {
-		proc.Wait()
+// 记录输出和运行结果的日志处理
+type testHandler struct {
+	lock   sync.Mutex
+	seq    int
+	logers map[string]*testLoger
+}
+
+type testLoger struct {
+	lock sync.Mutex
+	out  bytes.Buffer
+	err  bytes.Buffer
+	data map[string]interface{}
+	done chan struct{}
+}
+
+type testPipe struct {
+	loger *testLoger
+	buf   *bytes.Buffer
+}
+
+func newTestHandler() *testHandler {
+	return &testHandler{logers: map[string]*testLoger{}}
+}
+
+func (h *testHandler) NewLoger() (handle.Loger, string) {
+	h.lock.Lock()
+	h.seq++
+	objectId := "run" + strconv.Itoa(h.seq)
+	h.lock.Unlock()
+	return h.OpenLoger(objectId), objectId
+}
+
+func (h *testHandler) OpenLoger(objectId string) handle.Loger {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	loger := h.logers[objectId]
+	if loger == nil {
+		loger = &testLoger{data: map[string]interface{}{}, done: make(chan struct{})}
+		h.logers[objectId] = loger
 	}
+	return loger
+}
 
-	<-time.After(20 * time.Second)
+func (h *testHandler) Name() string {
+	return "test"
 }
 
-// 测试多任务
-func TestChannelPHP(t *testing.T) {
-	phpjob3 := NewPHPJob(DefaultPHP, testHandle, 2, "delay3.php")
+func (h *testHandler) loger(objectId string) *testLoger {
+	return h.OpenLoger(objectId).(*testLoger)
+}
 
-	c := cron.New()
-	c.AddJob("test3", "* * * * * ", phpjob3)
-	c.Start()
-	defer c.Stop()
+func (l *testLoger) NewLogPipe() io.Writer {
+	return &testPipe{l, &l.out}
+}
 
-	<-time.After(20 * time.Second)
+func (l *testLoger) NewErrPipe() io.Writer {
+	return &testPipe{l, &l.err}
 }
 
-// 测试中途Kill任务
-func TestKillPHP(t *testing.T) {
-	killjob := NewPHPJob(DefaultPHP, testHandle, 2, "kill.php")
+// 写入结束时间后视为结束
+func (l *testLoger) Update(data map[string]interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for key, value := range data {
+		l.data[key] = value
+	}
+	if _, ok := data["endtime"]; ok {
+		close(l.done)
+	}
+}
 
-	c := cron.New()
-	c.AddJob("killjob", "* * * * * ", killjob)
-	c.Start()
-	defer c.Stop()
+// 等待运行结束，返回结果、标准输出和错误输出
+func (l *testLoger) wait(t *testing.T, timeout time.Duration) (interface{}, string, string) {
+	select {
+	case <-l.done:
+	case <-time.After(timeout):
+		t.Fatal("run did not finish")
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.data["result"], l.out.String(), l.err.String()
+}
 
-	<-time.After(10 * time.Second)
+func (p *testPipe) Write(b []byte) (int, error) {
+	p.loger.lock.Lock()
+	defer p.loger.lock.Unlock()
+	return p.buf.Write(b)
+}
 
-	for i, runInfo := range killjob.runInfoList {
+// 测试用的php执行环境：php为sh脚本，跳过-c和配置文件，其余参数交给sh执行
+func fakePHP(t *testing.T) *PHPEnv {
+	dir, err := ioutil.TempDir("", "php")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "php")
+	script := "#!/bin/sh\nshift 2\nexec /bin/sh \"$@\"\n"
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ini := filepath.Join(dir, "php.ini")
+	if err := ioutil.WriteFile(ini, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return &PHPEnv{Path: path, Ini: ini, Pwd: dir}
+}
+
+// 通过shim执行，测试结束后恢复直接执行
+func useShim(t *testing.T) {
+	spool, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shimPath, spoolPath := ShimPath, SpoolPath
+	t.Cleanup(func() {
+		ShimPath, SpoolPath = shimPath, spoolPath
+		os.RemoveAll(spool)
+	})
+	ShimPath, SpoolPath = os.Args[0], spool
+}
 
-		if killjob.Status(i) {
-			print(i, " is running, start date is "+runInfo.date+"\n")
-		} else {
-			print(i, " is not running\n")
+// 等待实例列表为空，超时返回false
+func waitEmpty(job *PHPJob, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if len(job.List()) == 0 {
+			return true
 		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
 
-		killjob.Kill(i)
+// 测试基础运行是否正确
+func TestPHP(t *testing.T) {
+	handler := newTestHandler()
+	job, err := NewPHPJob(fakePHP(t), handler, 1, "-c", "echo hello world; echo this is a err >&2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.RunOnce(nil)
+	loger := handler.loger("run1")
+	result, out, errOut := loger.wait(t, 5*time.Second)
+	if result != handle.ResultSuccess {
+		t.Errorf("result %v, want success", result)
+	}
+	if !strings.Contains(out, "hello world\n") || !strings.Contains(out, "finished !") {
+		t.Errorf("unexpected output %q", out)
+	}
+	if errOut != "this is a err\n" {
+		t.Errorf("unexpected error output %q", errOut)
+	}
+	if loger.data["trigger"] != cron.TriggerManual || loger.data["pid"] == nil {
+		t.Errorf("unexpected record %v", loger.data)
+	}
+	if !waitEmpty(job, time.Second) || !job.acquire() {
+		t.Error("finished run should be removed and release its slot")
+	}
+}
 
-		if killjob.Status(i) {
-			print(i, " is running, start date is "+runInfo.date+"\n")
-		} else {
-			print(i, " is not running\n")
-		}
+// 测试执行失败时记录失败
+func TestFailedPHP(t *testing.T) {
+	handler := newTestHandler()
+	job, _ := NewPHPJob(fakePHP(t), handler, 1, "-c", "exit 2")
+	job.Run(nil)
+	if result, _, errOut := handler.loger("run1").wait(t, 5*time.Second); result != handle.ResultFailed || errOut == "" {
+		t.Errorf("result %v, error output %q", result, errOut)
+	}
 
-		// 每20秒kill一个进程
-		<-time.After(20 * time.Second)
+	//执行文件不存在时启动失败，撤销实例并释放并发数
+	handler = newTestHandler()
+	job, _ = NewPHPJob(&PHPEnv{Path: "/not/exist/php"}, handler, 1)
+	job.Run(nil)
+	if result, _, _ := handler.loger("run1").wait(t, time.Second); result != handle.ResultFailed {
+		t.Errorf("result %v, want failed", result)
+	}
+	if len(job.List()) != 0 || !job.acquire() {
+		t.Error("failed start should not leave an instance or hold a slot")
 	}
+}
 
-	<-time.After(10 * time.Second)
+// 测试多任务，达到最大并发数时跳过
+func TestChannelPHP(t *testing.T) {
+	handler := newTestHandler()
+	job, _ := NewPHPJob(fakePHP(t), handler, 2, "-c", "sleep 0.3")
+	for i := 0; i < 3; i++ {
+		job.Run(nil)
+	}
+	if list := job.List(); len(list) != 2 {
+		t.Fatalf("expected 2 instances, got %d", len(list))
+	}
+	if _, ok := handler.logers["run3"]; ok {
+		t.Error("run over channel should be skipped")
+	}
+	for _, objectId := range []string{"run1", "run2"} {
+		if result, _, _ := handler.loger(objectId).wait(t, 5*time.Second); result != handle.ResultSuccess {
+			t.Errorf("%s result %v, want success", objectId, result)
+		}
+	}
+	if !waitEmpty(job, time.Second) {
+		t.Error("finished runs should be removed")
+	}
+}
+
+// 测试中途Kill任务
+func TestKillPHP(t *testing.T) {
+	handler := newTestHandler()
+	job, _ := NewPHPJob(fakePHP(t), handler, 1, "-c", "echo running the kill job; exec sleep 30")
+	job.Run(nil)
+	list := job.List()
+	if len(list) != 1 {
+		t.Fatalf("expected 1 instance, got %d", len(list))
+	}
+	if err := job.Kill(list[0].ObjectId); err != nil {
+		t.Fatal(err)
+	}
+	if len(job.List()) != 0 {
+		t.Error("killed instance should be removed")
+	}
+	if result, _, _ := handler.loger("run1").wait(t, 5*time.Second); result != handle.ResultFailed {
+		t.Errorf("result %v, want failed", result)
+	}
+	if !waitAcquire(job, time.Second) {
+		t.Error("slot should be released after kill")
+	}
+	//已结束的实例再次kill时忽略
+	if err := job.Kill(list[0].ObjectId); err != nil {
+		t.Error(err)
+	}
 }
 
 // 测试多个计划任务
 func TestMultiPHP(t *testing.T) {
-	phpjob3 := NewPHPJob(DefaultPHP, testHandle, 2, "delay3.php")
-	phpjob6 := NewPHPJob(DefaultPHP, testHandle, 2, "delay6.php")
+	env := fakePHP(t)
+	handler3, handler6 := newTestHandler(), newTestHandler()
+	job3, _ := NewPHPJob(env, handler3, 2, "-c", "sleep 0.3")
+	job6, _ := NewPHPJob(env, handler6, 2, "-c", "sleep 0.6")
 
 	c := cron.New()
-	c.AddJob("test3second", "* * * * * *", phpjob3)
-	c.AddJob("test6second", "* * * * * *", phpjob6)
-
+	c.AddJob("test3second", "", "* * * * * *", job3)
+	c.AddJob("test6second", "", "* * * * * *", job6)
 	c.Start()
 	defer c.Stop()
 
-	<-time.After(30 * time.Second)
+	handler3.loger("run1").wait(t, 3*time.Second)
+	handler6.loger("run1").wait(t, 3*time.Second)
 }
 
+// 测试企业微信作为日志处理时可以运行和kill
 func TestWechatHandler(t *testing.T) {
-	var userWechat = handle.NewQyWechat("huali")
-	//phpjob3 := NewPHPJob(DefaultPHP, userWechat, 1, "delay3.php")
+	job, _ := NewPHPJob(fakePHP(t), handle.NewQyWechat("huali"), 3, "-c", "exec sleep 30")
+	job.Run(nil)
+	list := job.List()
+	if len(list) != 1 {
+		t.Fatalf("expected 1 instance, got %d", len(list))
+	}
+	if err := job.Kill(list[0].ObjectId); err != nil {
+		t.Fatal(err)
+	}
+	if !waitAcquire(job, 5*time.Second) {
+		t.Error("slot should be released after kill")
+	}
+}
+
+// 测试通过shim执行，输出和退出状态由shim写入spool目录
+func TestShimPHP(t *testing.T) {
+	useShim(t)
+	handler := newTestHandler()
+	job, _ := NewPHPJob(fakePHP(t), handler, 1, "-c", "echo hello world; echo this is a err >&2")
+	job.Run(nil)
+	result, out, errOut := handler.loger("run1").wait(t, 5*time.Second)
+	if result != handle.ResultSuccess || !strings.Contains(out, "hello world\n") || errOut != "this is a err\n" {
+		t.Errorf("result %v, output %q, error output %q", result, out, errOut)
+	}
+	if !waitEmpty(job, time.Second) {
+		t.Error("finished run should be removed")
+	}
+	//记录结果后删除spool目录
+	dir := filepath.Join(SpoolPath, "run1")
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("spool directory should be removed after the run finishes")
+		}
+	}
+}
 
-	// 注意不同的环境要设置不同的缓冲区用于接收日志
-	phpjob6 := NewPHPJob(DefaultPHP, userWechat, 3, "delay6.php")
+// 测试kill通过shim执行的实例：杀死php进程，由shim记录退出状态
+func TestKillShim(t *testing.T) {
+	useShim(t)
+	handler := newTestHandler()
+	job, _ := NewPHPJob(fakePHP(t), handler, 1, "-c", "exec sleep 30")
+	job.Run(nil)
+	// 等待shim写入php进程id，kill时杀死php进程而不是shim
+	dir := filepath.Join(SpoolPath, "run1")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if state, _ := shim.ReadState(dir); state != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("shim did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := job.Kill("run1"); err != nil {
+		t.Fatal(err)
+	}
+	result, _, errOut := handler.loger("run1").wait(t, 5*time.Second)
+	if result != handle.ResultFailed || errOut == "" {
+		t.Errorf("result %v, error output %q", result, errOut)
+	}
+	if !waitAcquire(job, time.Second) {
+		t.Error("slot should be released after kill")
+	}
+}
 
-	c := cron.New()
-	//c.AddJob("test3second", "* * * * * *", phpjob3)
-	c.AddJob("test6second", "* * * * * *", phpjob6)
+// 测试重启后重新接管shim启动的实例：占用并发数，继续读取输出，结束后记录结果
+func TestReattach(t *testing.T) {
+	useShim(t)
+	env := fakePHP(t)
+	dir := filepath.Join(SpoolPath, "old")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	//模拟上一个调度程序启动的shim
+	cmd := shim.Command(ShimPath, dir, env.Path, "-c", env.Ini, "-c", "echo before; sleep 0.5; echo after")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go cmd.Wait()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if state, _ := shim.ReadState(dir); state != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("shim did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
 
-	c.Start()
-	defer c.Stop()
+	handler := newTestHandler()
+	job, _ := NewPHPJob(env, handler, 1)
+	if err := job.Reattach("missing", time.Now()); err == nil {
+		t.Error("reattach without spool directory should fail")
+	}
+	if err := job.Reattach("old", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if list := job.List(); len(list) != 1 || list[0].ObjectId != "old" {
+		t.Fatalf("reattached instance should be listed, got %v", list)
+	}
+	if job.acquire() {
+		t.Fatal("reattached instance should hold the only slot")
+	}
+	result, out, _ := handler.loger("old").wait(t, 5*time.Second)
+	if result != handle.ResultSuccess || !strings.Contains(out, "before\n") || !strings.Contains(out, "after\n") {
+		t.Errorf("result %v, output %q", result, out)
+	}
+	if !waitAcquire(job, time.Second) {
+		t.Error("slot should be released after the reattached run finishes")
+	}
+}
 
+// 测试平滑重启停止读取shim输出后，旧进程不记录结果、不删除spool目录，新进程从保存的位置继续读取
+func TestDetachWatchers(t *testing.T) {
+	useShim(t)
+	//新进程的读取协程没有停止
+	reset := func() {
+		watchers.Lock()
+		watchers.stop, watchers.detached = make(chan struct{}), false
+		watchers.Unlock()
+	}
+	t.Cleanup(reset)
+	env := fakePHP(t)
+	handler := newTestHandler()
+	job, _ := NewPHPJob(env, handler, 1, "-c", "echo before; sleep 0.5; echo after")
+	job.Run(nil)
+	loger := handler.loger("run1")
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		loger.lock.Lock()
+		started := strings.Contains(loger.out.String(), "before\n")
+		loger.lock.Unlock()
+		if started {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("shim output not read")
+		}
+	}
+
+	DetachWatchers()
+	time.Sleep(time.Second)
 	select {
-	case <-time.After(10 * time.Second):
-		for i, runInfo := range phpjob6.runInfoList {
-			if phpjob6.Status(i) {
-				print(i, " is running, start date is "+runInfo.date+"\n")
-			} else {
-				print(i, " is not running\n")
-			}
-			print("Kill ", i, "\n")
-			phpjob6.Kill(i)
-			if phpjob6.Status(i) {
-				print(i, " is running, start date is "+runInfo.date+"\n")
-			} else {
-				print(i, " is not running\n")
-			}
+	case <-loger.done:
+		t.Fatal("detached run should not be finished by the predecessor")
+	default:
+	}
+	if _, err := os.Stat(filepath.Join(SpoolPath, "run1")); err != nil {
+		t.Fatalf("spool directory should be kept for the successor: %v", err)
+	}
+
+	reset()
+	successor, _ := NewPHPJob(env, newTestHandler(), 1)
+	if err := successor.Reattach("run1", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	result, out, _ := successor.handler.(*testHandler).loger("run1").wait(t, 5*time.Second)
+	if result != handle.ResultSuccess || out != "after\nfinished !\n" {
+		t.Errorf("result %v, successor output %q", result, out)
+	}
+}
+
+// 启动一个运行duration的进程，结束后回收，返回结束通知
+func startProcess(t *testing.T, duration string) (*exec.Cmd, chan bool) {
+	cmd := exec.Command("sleep", duration)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan bool)
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	return cmd, exited
+}
+
+// 等待并发数释放，超时返回false
+func waitAcquire(job *PHPJob, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if job.acquire() {
+			return true
 		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func newTestJob(t *testing.T, num int) *PHPJob {
+	job, err := NewPHPJob(&PHPEnv{}, handle.Console, num)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+// 测试加入的进程占用并发数，达到最大并发数时不能启动新实例，进程结束后移除实例并释放
+func TestAddReservesSlot(t *testing.T) {
+	job := newTestJob(t, 1)
+	cmd, exited := startProcess(t, "0.3")
+	job.Add(&cron.RunInfo{Date: time.Now(), Proc: cmd.Process, ObjectId: "adopted"})
+
+	if job.acquire() {
+		t.Fatal("adopted process should hold the only slot")
+	}
+	if len(job.List()) != 1 {
+		t.Fatalf("expected 1 instance, got %d", len(job.List()))
+	}
+
+	<-exited
+	if !waitAcquire(job, time.Second) {
+		t.Fatal("slot should be released after the process exits")
+	}
+	if len(job.List()) != 0 {
+		t.Errorf("expected no instance, got %d", len(job.List()))
 	}
+	if job.acquire() {
+		t.Error("released slot should be used by one new run only")
+	}
+}
+
+// 测试agent上的实例和没有进程的实例加入时不占用并发数
+func TestAddWithoutProcess(t *testing.T) {
+	job := newTestJob(t, 1)
+	job.Add(&cron.RunInfo{Date: time.Now(), ObjectId: "agent", Agent: "agent1"})
+	job.Add(&cron.RunInfo{Date: time.Now(), ObjectId: "noproc"})
+	if !job.acquire() {
+		t.Error("instances without local process should not hold a slot")
+	}
+}
 
-	<-time.After(10 * time.Second)
+// 测试删除后重新添加的任务接管还在运行的实例，占用新任务的并发数，结束后释放
+func TestAdoptCarriedOver(t *testing.T) {
+	c := cron.New()
+	old := newTestJob(t, 1)
+	if _, err := c.AddJob("carried", "", "0 0 0 1 1 ?", old); err != nil {
+		t.Fatal(err)
+	}
+	cmd, exited := startProcess(t, "0.3")
+	old.Add(&cron.RunInfo{Date: time.Now(), Proc: cmd.Process, ObjectId: "carried"})
+
+	c.RemoveFunc("carried")
+	if c.Lookup("carried") != old {
+		t.Fatal("removed job with running instance should be kept")
+	}
+
+	job := newTestJob(t, 1)
+	if _, err := c.AddJob("carried", "", "0 0 0 1 1 ?", job); err != nil {
+		t.Fatal(err)
+	}
+	if list := job.List(); len(list) != 1 || list[0].ObjectId != "carried" {
+		t.Fatalf("running instance should be carried over, got %v", list)
+	}
+	if job.acquire() {
+		t.Fatal("carried over process should hold the only slot")
+	}
+
+	<-exited
+	if !waitAcquire(job, time.Second) {
+		t.Fatal("slot should be released after the carried over process exits")
+	}
+}
+
+// 测试删除后重新添加的任务接管agent上的实例，不占用并发数，结束后由调度程序移除
+func TestAdoptRemote(t *testing.T) {
+	c := cron.New()
+	old := newTestJob(t, 1)
+	if _, err := c.AddJob("remote", "", "0 0 0 1 1 ?", old); err != nil {
+		t.Fatal(err)
+	}
+	old.Add(&cron.RunInfo{Date: time.Now(), ObjectId: "remote", Agent: "agent1"})
+	c.RemoveFunc("remote")
+
+	job := newTestJob(t, 1)
+	if _, err := c.AddJob("remote", "", "0 0 0 1 1 ?", job); err != nil {
+		t.Fatal(err)
+	}
+	if list := job.List(); len(list) != 1 || list[0].ObjectId != "remote" || list[0].Agent != "agent1" {
+		t.Fatalf("agent instance should be carried over, got %v", list)
+	}
+	if !job.acquire() {
+		t.Fatal("carried over agent instance should not hold a slot")
+	}
+	job.Remove("remote")
+	if len(job.List()) != 0 {
+		t.Error("removed instance should not be listed")
+	}
 }
@@ -1,21 +1,30 @@
 package web
 
 import (
+	"context"
 	"errors"
 	"io/ioutil"
 	"jcron/modules/cron"
 	"jcron/modules/handle"
+	"jcron/modules/metrics"
 	"net/http"
 	"time"
 )
 
+// 单次请求的最长时间，包括读取响应
+const RequestTimeout = time.Hour
+
+// 执行请求的客户端
+var client = &http.Client{Timeout: RequestTimeout}
+
 type WebJob struct {
 	loger       handle.Handler // 输出处理
 	url         string
-	channel     chan int
+	running     int             // 当前任务的执行并发数
 	num         int             //最大同时执行的个数
 	RunInfoList []*cron.RunInfo // 当前WebJob正在运行的所有进程句柄
 	runLock     chan int
+	cancels     map[string]context.CancelFunc // 本进程发起的请求，杀死实例时取消
 }
 
 /**
@@ -25,21 +34,59 @@ func NewWebJob(loger handle.Handler, num int, url string) (*WebJob, error) {
 	if num < 1 {
 		return &WebJob{}, errors.New("Channel must greater than zero")
 	}
-	return &WebJob{loger, url, make(chan int, num), num, []*cron.RunInfo{}, make(chan int, 1)}, nil
+	return &WebJob{loger, url, 0, num, []*cron.RunInfo{}, make(chan int, 1), map[string]context.CancelFunc{}}, nil
 }
 
 /**
- * 执行一个PHP任务
+ * 执行一个http任务
  */
 func (job *WebJob) Run(param []string) {
-	select {
-	case job.channel <- 1:
-		handle, objectId := job.loger.NewLoger()
-		logPipe := handle.NewLogPipe()
-		errPipe := handle.NewErrPipe()
+	job.run(cron.TriggerCron)
+}
+
+/**
+ * 手动执行一次http任务
+ */
+func (job *WebJob) RunOnce(param []string) {
+	job.run(cron.TriggerManual)
+}
+
+func (job *WebJob) run(trigger string) {
+	if job.acquire() {
+		job.runLock <- 1
+		url := job.url
+		<-job.runLock
+		loger, objectId := job.loger.NewLoger()
+		loger.Update(map[string]interface{}{"trigger": trigger})
+		logPipe := loger.NewLogPipe()
+		errPipe := loger.NewErrPipe()
 		logPipe.Write([]byte("start running \n"))
+		name := job.loger.Name()
+		metrics.JobStarted.Inc(name)
+		start := time.Now()
+		// 先记录实例再发起请求，请求很快结束时不会留下已结束的实例
+		runInfo := &cron.RunInfo{
+			Date:     start,
+			ObjectId: objectId,
+			ExecType: "http",
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		job.runLock <- 1
+		job.RunInfoList = append(job.RunInfoList, runInfo)
+		job.cancels[objectId] = cancel
+		<-job.runLock
+		cron.JournalStart(name, runInfo)
 		go func() {
-			resp, err := http.Get(job.url)
+			defer cancel()
+			data := make(map[string]interface{})
+			defer func() {
+				metrics.JobFinish(name, data["result"] == handle.ResultSuccess, time.Since(start).Seconds())
+			}()
+			var resp *http.Response
+			req, err := http.NewRequest(http.MethodGet, url, nil)
+			if err == nil {
+				resp, err = client.Do(req.WithContext(ctx))
+			}
 			job.runLock <- 1
 			for i, run := range job.RunInfoList {
 				if run.ObjectId == objectId {
@@ -47,43 +94,59 @@ func (job *WebJob) Run(param []string) {
 					break
 				}
 			}
+			delete(job.cancels, objectId)
+			job.running--
 			<-job.runLock
-			<-job.channel
+			cron.JournalFinish(objectId)
+			if ctx.Err() == context.Canceled {
+				err = errors.New("killed")
+			}
 			if err != nil {
 				errPipe.Write([]byte(err.Error()))
-				data := make(map[string]interface{})
 				data["endtime"] = time.Now()
-				handle.Update(data)
+				data["result"] = handle.ResultFailed
+				loger.Update(data)
 				return
 			}
 
 			defer resp.Body.Close()
 			body, err := ioutil.ReadAll(resp.Body)
+			if ctx.Err() == context.Canceled {
+				err = errors.New("killed")
+			}
 			if err != nil {
 				errPipe.Write([]byte(err.Error()))
-				data := make(map[string]interface{})
 				data["endtime"] = time.Now()
-				handle.Update(data)
+				data["result"] = handle.ResultFailed
+				loger.Update(data)
 				return
 			}
 			logPipe.Write([]byte(body))
-			data := make(map[string]interface{})
+			if resp.StatusCode >= http.StatusBadRequest {
+				errPipe.Write([]byte("http status " + resp.Status))
+				data["result"] = handle.ResultFailed
+			} else {
+				data["result"] = handle.ResultSuccess
+			}
 			data["endtime"] = time.Now()
-			handle.Update(data)
+			loger.Update(data)
 		}()
-		runInfo := &cron.RunInfo{
-			time.Now(),
-			nil,
-			objectId,
-		}
-		job.runLock <- 1
-		job.RunInfoList = append(job.RunInfoList, runInfo)
-		<-job.runLock
-	default:
-		//print(job.args[0] + " channel is full !\n")
+	} else {
+		metrics.JobSkipped.Inc(job.loger.Name())
 	}
 }
 
+// 占用一个并发数，已达到最大并发数时返回false
+func (job *WebJob) acquire() bool {
+	job.runLock <- 1
+	defer func() { <-job.runLock }()
+	if job.running >= job.num {
+		return false
+	}
+	job.running++
+	return true
+}
+
 /**
  * 添加实例
  */
@@ -93,11 +156,18 @@ func (job *WebJob) Add(runInfo *cron.RunInfo) {
 	<-job.runLock
 }
 
-// 杀死正在运行的进程
+// 杀死正在运行的实例：取消请求，请求返回后从实例列表移除，不是本进程发起的请求无法取消
 func (job *WebJob) Kill(objectId string) error {
-	for i, runInfo := range job.RunInfoList {
+	job.runLock <- 1
+	defer func() { <-job.runLock }()
+	for _, runInfo := range job.RunInfoList {
 		if runInfo.ObjectId == objectId {
-			job.RunInfoList = append(job.RunInfoList[:i], job.RunInfoList[i+1:]...)
+			cancel, ok := job.cancels[objectId]
+			if !ok {
+				return errors.New("kill is not supported for http instances not started by this process")
+			}
+			cancel()
+			metrics.JobKilled.Inc(job.loger.Name())
 			break
 		}
 	}
@@ -108,10 +178,28 @@ func (job *WebJob) Kill(objectId string) error {
  * 获取当前任务的正在运行实例列表
  */
 func (job *WebJob) List() []*cron.RunInfo {
-	return job.RunInfoList
+	job.runLock <- 1
+	defer func() { <-job.runLock }()
+	return append([]*cron.RunInfo{}, job.RunInfoList...)
 }
 
 //EditJob接口调用
 func (job *WebJob) Channel() int {
+	job.runLock <- 1
+	defer func() { <-job.runLock }()
 	return job.num
 }
+
+// 修改最大并发数，超出的正在运行实例不会被中断
+func (job *WebJob) SetChannel(num int) {
+	job.runLock <- 1
+	job.num = num
+	<-job.runLock
+}
+
+// 修改请求地址，下次运行时生效
+func (job *WebJob) Reset(url string) {
+	job.runLock <- 1
+	job.url = url
+	<-job.runLock
+}
@@ -0,0 +1,70 @@
+package web
+
+import (
+	"jcron/modules/cron"
+	"jcron/modules/handle"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// 等待实例全部结束，超时返回false
+func waitDone(job *WebJob, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if len(job.List()) == 0 {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// 测试杀死实例时取消请求
+func TestKillCancelsRequest(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	job, err := NewWebJob(handle.Console, 1, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.Run(nil)
+	list := job.List()
+	if len(list) != 1 {
+		t.Fatalf("expected 1 instance, got %d", len(list))
+	}
+	if err := job.Kill(list[0].ObjectId); err != nil {
+		t.Fatal(err)
+	}
+	// 服务端一直不返回，只有请求被取消实例才会结束
+	if !waitDone(job, 5*time.Second) {
+		t.Fatal("killed request should be cancelled and removed")
+	}
+	if !job.acquire() {
+		t.Error("slot should be released after kill")
+	}
+}
+
+// 测试不是本进程发起的请求不能杀死
+func TestKillUnsupported(t *testing.T) {
+	job, err := NewWebJob(handle.Console, 1, "http://127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.Add(&cron.RunInfo{Date: time.Now(), ObjectId: "restored"})
+	if err := job.Kill("restored"); err == nil {
+		t.Error("expected kill to be unsupported")
+	}
+	if len(job.List()) != 1 {
+		t.Error("instance should be kept when kill is unsupported")
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"jcron/modules/cron"
+	"jcron/modules/handle"
+	"jcron/modules/job/cmd"
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestValidateJob(t *testing.T) {
+	env := `{"path" : "/", "ini" : "/", "pwd" : "/"}`
+	valid := func(modify func(*cron.JobCollection)) *cron.JobCollection {
+		jobData := &cron.JobCollection{Name: "php1", Cron: "0 * * * * *", Channel: 1, Content: []string{"/tmp/a.php"}, ExecType: "php", ExecEnv: env}
+		if modify != nil {
+			modify(jobData)
+		}
+		return jobData
+	}
+	tests := []struct {
+		desc    string
+		jobData *cron.JobCollection
+		err     string
+	}{
+		{"php", valid(nil), ""},
+		{"http", valid(func(j *cron.JobCollection) { j.ExecType = "http"; j.Content = []string{"https://example.com/run"} }), ""},
+		{"empty name", valid(func(j *cron.JobCollection) { j.Name = "" }), "Name is invalid"},
+		{"dollar name", valid(func(j *cron.JobCollection) { j.Name = "a$b" }), "Name is invalid"},
+		{"system name", valid(func(j *cron.JobCollection) { j.Name = "system.users" }), "Name is invalid"},
+		{"cron", valid(func(j *cron.JobCollection) { j.Cron = "* *" }), "Cron is invalid"},
+		{"channel", valid(func(j *cron.JobCollection) { j.Channel = 0 }), "Channel must greater than zero"},
+		{"no content", valid(func(j *cron.JobCollection) { j.Content = nil }), "Content must not be empty"},
+		{"empty content", valid(func(j *cron.JobCollection) { j.Content = []string{""} }), "Content must not be empty"},
+		{"env not json", valid(func(j *cron.JobCollection) { j.ExecEnv = "php7" }), "ExecEnv is invalid"},
+		{"env missing path", valid(func(j *cron.JobCollection) { j.ExecEnv = `{"path" : "/not/exist", "ini" : "/", "pwd" : "/"}` }), "ExecEnv is invalid"},
+		{"agent env", valid(func(j *cron.JobCollection) {
+			j.ExecEnv = `{"path" : "/not/exist"}`
+			j.Labels = map[string]string{"zone": "a"}
+		}), ""},
+		{"agent env not json", valid(func(j *cron.JobCollection) { j.ExecEnv = "php7"; j.Hosts = []string{"web1"} }), "ExecEnv is invalid"},
+		{"http placement", valid(func(j *cron.JobCollection) {
+			j.ExecType = "http"
+			j.Content = []string{"http://example.com"}
+			j.Hosts = []string{"web1"}
+		}), "Labels and Hosts only apply to php jobs"},
+		{"http url", valid(func(j *cron.JobCollection) { j.ExecType = "http"; j.Content = []string{"ftp://example.com"} }), "Content is not a http url"},
+		{"exec type", valid(func(j *cron.JobCollection) { j.ExecType = "shell" }), "ExecType not support"},
+		{"misfire once", valid(func(j *cron.JobCollection) { j.Misfire = cron.MisfireOnce }), ""},
+		{"misfire", valid(func(j *cron.JobCollection) { j.Misfire = "all" }), "Misfire must be skip or once"},
+	}
+	for _, test := range tests {
+		err := validateJob(test.jobData)
+		if test.err == "" && err != nil {
+			t.Errorf("%s: unexpected error %v", test.desc, err)
+		} else if test.err != "" && (err == nil || !strings.HasPrefix(err.Error(), test.err)) {
+			t.Errorf("%s: expected %q, got %v", test.desc, test.err, err)
+		}
+	}
+}
+
+func TestJobFields(t *testing.T) {
+	fields, err := jobFields(&cron.JobCollection{Name: "php1", Status: cron.StatusRunning, EditPerson: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fields["status"]; ok {
+		t.Error("status should not be written by an edit")
+	}
+	if fields["name"] != "php1" || fields["editperson"] != "alice" {
+		t.Errorf("unexpected fields %v", fields)
+	}
+}
+
+// 测试写入失败时正在调度的任务恢复原配置
+func TestSaveJobRollback(t *testing.T) {
+	env := `{"path" : "/", "ini" : "/", "pwd" : "/"}`
+	old := &cron.JobCollection{Name: "save1", Cron: "0 0 0 1 1 ?", Channel: 1, Content: []string{"/tmp/a.php"}, ExecType: "php", ExecEnv: env}
+	job, _ := cmd.NewPHPJob(&cmd.PHPEnv{}, handle.Console, 1)
+	if _, err := c.AddJob(old.Name, "", old.Cron, job); err != nil {
+		t.Fatal(err)
+	}
+	defer c.RemoveFunc(old.Name)
+	defer func(update func(string, bson.M) error) { updateJob = update }(updateJob)
+	updateJob = func(name string, fields bson.M) error {
+		return errors.New("write failed")
+	}
+
+	jobData := *old
+	jobData.Cron = "0 0 * * * *"
+	jobData.Channel = 3
+	if err := saveJob(old, &jobData); err == nil || err.Error() != "write failed" {
+		t.Fatalf("expected write error, got %v", err)
+	}
+	entry := findEntry(old.Name)
+	if entry.Cron != old.Cron || entry.Job.Channel() != old.Channel || getApplied(old.Name).Cron != old.Cron {
+		t.Errorf("running job should keep the stored config, got %s %d", entry.Cron, entry.Job.Channel())
+	}
+}
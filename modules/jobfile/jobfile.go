@@ -0,0 +1,185 @@
+// 从目录加载yaml、toml格式的job定义文件，一个文件一个job，字段和cron.JobCollection对应
+package jobfile
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"jcron/modules/cron"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// 由文件管理的job，Source字段的前缀
+const SourcePrefix = "file:"
+
+// 变更类型
+const (
+	ActionAdd    = "add"
+	ActionUpdate = "update"
+	ActionRemove = "remove"
+)
+
+// 一个job的变更，Old为数据库中的配置，New为文件中的配置
+type Change struct {
+	Name   string
+	Action string
+	Old    *cron.JobCollection
+	New    *cron.JobCollection
+}
+
+// 是否由文件管理
+func Managed(jobData *cron.JobCollection) bool {
+	return strings.HasPrefix(jobData.Source, SourcePrefix)
+}
+
+/**
+ * 加载目录下所有.yaml、.yml、.toml文件，按job名称排序，任何一个文件有错误都返回错误
+ */
+func Load(dir string) ([]*cron.JobCollection, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	jobList := []*cron.JobCollection{}
+	names := map[string]string{}
+	errs := []string{}
+	for _, file := range files {
+		if file.IsDir() || !supported(file.Name()) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		jobData, err := Parse(file.Name(), data)
+		if err != nil {
+			errs = append(errs, file.Name()+": "+err.Error())
+			continue
+		}
+		if other, ok := names[jobData.Name]; ok {
+			errs = append(errs, fmt.Sprintf("%s: job %s already defined in %s", file.Name(), jobData.Name, other))
+			continue
+		}
+		names[jobData.Name] = file.Name()
+		jobList = append(jobList, jobData)
+	}
+	if len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, "; "))
+	}
+	sort.Slice(jobList, func(i, j int) bool {
+		return jobList[i].Name < jobList[j].Name
+	})
+	return jobList, nil
+}
+
+// 是否是支持的文件格式
+func supported(name string) bool {
+	switch filepath.Ext(name) {
+	case ".yaml", ".yml", ".toml":
+		return true
+	}
+	return false
+}
+
+/**
+ * 解析一个job定义文件，根据扩展名选择格式，不认识的字段视为错误
+ * 默认值：名称为文件名（不含扩展名），Status为1，Channel为1
+ */
+func Parse(name string, data []byte) (*cron.JobCollection, error) {
+	jobData := &cron.JobCollection{Status: 1, Channel: 1}
+	switch filepath.Ext(name) {
+	case ".yaml", ".yml":
+		if err := yaml.UnmarshalStrict(data, jobData); err != nil {
+			return nil, err
+		}
+	case ".toml":
+		meta, err := toml.Decode(string(data), jobData)
+		if err != nil {
+			return nil, err
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("unknown field %s", undecoded[0])
+		}
+	default:
+		return nil, errors.New("file type not support")
+	}
+	if jobData.Name == "" {
+		jobData.Name = strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+	}
+	if jobData.Status != 0 && jobData.Status != 1 {
+		return nil, errors.New("Status must be 0 or 1")
+	}
+	// 添加、编辑信息由调度系统维护
+	jobData.AddTime = ""
+	jobData.EditPerson = ""
+	jobData.EditTime = ""
+	jobData.Source = SourcePrefix + filepath.Base(name)
+	return jobData, nil
+}
+
+/**
+ * 对比数据库中的job和文件中的job，生成变更列表
+ * 文件中有、数据库中没有的新增；都有但配置不同的修改（包括接管之前通过接口添加的同名job）；
+ * 数据库中由文件管理、文件中已删除的移除
+ */
+func Plan(current, desired []*cron.JobCollection) []*Change {
+	currentMap := map[string]*cron.JobCollection{}
+	for _, jobData := range current {
+		currentMap[jobData.Name] = jobData
+	}
+	desiredMap := map[string]bool{}
+	changes := []*Change{}
+	for _, jobData := range desired {
+		desiredMap[jobData.Name] = true
+		old, ok := currentMap[jobData.Name]
+		if !ok {
+			changes = append(changes, &Change{Name: jobData.Name, Action: ActionAdd, New: jobData})
+			continue
+		}
+		merged := Merge(old, jobData)
+		if !reflect.DeepEqual(old, merged) {
+			changes = append(changes, &Change{Name: jobData.Name, Action: ActionUpdate, Old: old, New: merged})
+		}
+	}
+	for _, jobData := range current {
+		if Managed(jobData) && !desiredMap[jobData.Name] {
+			changes = append(changes, &Change{Name: jobData.Name, Action: ActionRemove, Old: jobData})
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+	return changes
+}
+
+/**
+ * 用文件中的配置覆盖数据库中的配置，保留添加、编辑信息，文件没有指定添加人时保留原添加人
+ */
+func Merge(old, jobData *cron.JobCollection) *cron.JobCollection {
+	merged := *jobData
+	merged.AddTime = old.AddTime
+	merged.EditPerson = old.EditPerson
+	merged.EditTime = old.EditTime
+	if merged.AddPerson == "" {
+		merged.AddPerson = old.AddPerson
+	}
+	// 数据库中读出的空字段不是nil，没有配置运行位置限制时和数据库保持一致
+	if len(merged.Labels) == 0 && len(old.Labels) == 0 {
+		merged.Labels = old.Labels
+	}
+	if len(merged.Hosts) == 0 && len(old.Hosts) == 0 {
+		merged.Hosts = old.Hosts
+	}
+	// 暂停由接口操作，文件中为运行时保留暂停状态
+	if merged.Status == cron.StatusRunning && old.Status == cron.StatusPaused {
+		merged.Status = old.Status
+	}
+	return &merged
+}
@@ -0,0 +1,129 @@
+package jobfile
+
+import (
+	"io/ioutil"
+	"jcron/modules/cron"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	yamlData := `
+category: report
+cron: "0 */5 * * * *"
+content:
+  - report.php
+  - daily
+exectype: php
+`
+	jobData, err := Parse("report.yaml", []byte(yamlData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &cron.JobCollection{
+		Name:     "report",
+		Category: "report",
+		Cron:     "0 */5 * * * *",
+		Channel:  1,
+		Content:  []string{"report.php", "daily"},
+		Status:   1,
+		ExecType: "php",
+		Source:   "file:report.yaml",
+	}
+	if !reflect.DeepEqual(jobData, want) {
+		t.Errorf("got %+v, want %+v", jobData, want)
+	}
+
+	tomlData := `
+Name = "ping"
+Cron = "*/10 * * * * *"
+Channel = 2
+Status = 0
+Content = ["http://127.0.0.1/ping"]
+ExecType = "http"
+`
+	jobData, err = Parse("ping.toml", []byte(tomlData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jobData.Name != "ping" || jobData.Channel != 2 || jobData.Status != 0 || jobData.Source != "file:ping.toml" {
+		t.Errorf("unexpected %+v", jobData)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"a.yaml", "cron: x\nunknown: 1\n"},
+		{"a.toml", "Cron = \"x\"\nUnknown = 1\n"},
+		{"a.yaml", "status: 2\n"},
+		{"a.json", "{}"},
+	}
+	for _, test := range tests {
+		if _, err := Parse(test.name, []byte(test.data)); err == nil {
+			t.Errorf("%s %q: expected error", test.name, test.data)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, data string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("b.yml", "cron: \"* * * * * *\"\n")
+	write("a.toml", "Cron = \"* * * * * *\"\n")
+	write("readme.txt", "ignored")
+
+	jobList, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobList) != 2 || jobList[0].Name != "a" || jobList[1].Name != "b" {
+		t.Fatalf("unexpected jobs %+v", jobList)
+	}
+
+	write("c.yaml", "name: a\n")
+	if _, err := Load(dir); err == nil || !strings.Contains(err.Error(), "already defined") {
+		t.Errorf("expected duplicate error, got %v", err)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	current := []*cron.JobCollection{
+		{Name: "same", Cron: "* * * * * *", AddPerson: "bob", AddTime: "1", Source: "file:same.yaml"},
+		{Name: "changed", Cron: "* * * * * *", Source: "file:changed.yaml"},
+		{Name: "removed", Source: "file:removed.yaml"},
+		{Name: "manual"},
+		{Name: "paused", Status: cron.StatusPaused, Source: "file:paused.yaml"},
+	}
+	desired := []*cron.JobCollection{
+		{Name: "same", Cron: "* * * * * *", Source: "file:same.yaml"},
+		{Name: "changed", Cron: "0 * * * * *", Source: "file:changed.yaml"},
+		{Name: "added", Source: "file:added.yaml"},
+		{Name: "paused", Status: cron.StatusRunning, Source: "file:paused.yaml"},
+	}
+	changes := Plan(current, desired)
+	got := []string{}
+	for _, change := range changes {
+		got = append(got, change.Action+" "+change.Name)
+	}
+	want := []string{"add added", "update changed", "remove removed"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if changes[1].New.Cron != "0 * * * * *" {
+		t.Errorf("unexpected update %+v", changes[1].New)
+	}
+}
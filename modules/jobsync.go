@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"jcron/modules/api"
+	"jcron/modules/cron"
+	"jcron/modules/handle"
+	"jcron/modules/jobfile"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// 同步job定义文件时使用的用户名
+const jobFileUser = "jobfile"
+
+// 同一时间只允许一个同步
+var syncLock sync.Mutex
+
+/**
+ * 由文件管理的job不能通过接口修改
+ */
+func checkEditable(jobData *cron.JobCollection) error {
+	if jobfile.Managed(jobData) {
+		return errors.New("job is managed by " + strings.TrimPrefix(jobData.Source, jobfile.SourcePrefix) + ", edit the file instead")
+	}
+	return nil
+}
+
+/**
+ * 加载并校验job定义文件，有任何错误都不执行同步
+ */
+func loadJobFile() ([]*cron.JobCollection, error) {
+	if handle.Config().JobFilePath == "" {
+		return nil, errors.New("JobFilePath is not configured")
+	}
+	jobList, err := jobfile.Load(handle.Config().JobFilePath)
+	if err != nil {
+		return nil, err
+	}
+	errs := []string{}
+	for _, jobData := range jobList {
+		if err := validateJob(jobData); err != nil {
+			errs = append(errs, jobData.Source+": "+err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, "; "))
+	}
+	return jobList, nil
+}
+
+/**
+ * 同步job定义文件到数据库和正在调度的job，dryRun为true时只返回变更
+ * 正在运行的实例不受影响，单个job同步失败不影响其他job
+ */
+func syncJobFile(session *Session, dryRun bool) ([]*api.JobChange, error) {
+	syncLock.Lock()
+	defer syncLock.Unlock()
+
+	//同步会修改job状态和调度列表，只由领导者执行
+	if !dryRun {
+		if err := checkLeader(); err != nil {
+			return nil, err
+		}
+	}
+	desired, err := loadJobFile()
+	if err != nil {
+		return nil, err
+	}
+	current := []*cron.JobCollection{}
+	find := func(c *mgo.Collection) error {
+		return c.Find(nil).All(&current)
+	}
+	err = handle.WitchCollection(handle.Config().JobDb, handle.Config().JobCollection, find)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []*api.JobChange{}
+	for _, change := range jobfile.Plan(current, desired) {
+		jobChange := &api.JobChange{Name: change.Name, Action: change.Action, Diffs: []*api.FieldDiff{}}
+		if change.Action == jobfile.ActionUpdate {
+			jobChange.Diffs = diffJob(change.Old, change.New)
+		}
+		changes = append(changes, jobChange)
+		if dryRun {
+			continue
+		}
+		err := applyChange(session, change)
+		if err != nil {
+			jobChange.Error = err.Error()
+		}
+		log.Printf("SyncJobFile %s %s, error : %v\n", change.Action, change.Name, err)
+	}
+	return changes, nil
+}
+
+/**
+ * 执行一个job的变更
+ */
+func applyChange(session *Session, change *jobfile.Change) (err error) {
+	operate := &api.OperateLog{Method: "SyncJobFile", JobName: change.Name, Params: change.Action}
+	if change.Old != nil {
+		operate.Before = change.Old
+	}
+	if change.New != nil {
+		operate.After = change.New
+	}
+	defer func() {
+		session.audit(operate, err)
+	}()
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	switch change.Action {
+	case jobfile.ActionAdd:
+		newData := *change.New
+		newData.AddTime = now
+		if newData.AddPerson == "" {
+			newData.AddPerson = session.User
+		}
+		newData.Status = 0
+		insert := func(c *mgo.Collection) error {
+			return c.Insert(&newData)
+		}
+		err = handle.WitchCollection(handle.Config().JobDb, handle.Config().JobCollection, insert)
+		if err != nil {
+			return err
+		}
+		if err = saveRevision("create", session.User, nil, &newData); err != nil {
+			return revisionError(err)
+		}
+		if change.New.Status == 1 {
+			return add(newData.Name)
+		}
+
+	case jobfile.ActionUpdate:
+		newData := *change.New
+		newData.EditPerson = session.User
+		newData.EditTime = now
+		// 执行程序类型修改或者不再调度时，先停止调度，正在运行的实例继续运行
+		jobStateLock.Lock()
+		entry := findEntry(newData.Name)
+		if entry != nil && (change.Old.ExecType != newData.ExecType || newData.Status == 0) {
+			c.RemoveFunc(newData.Name)
+			entry = nil
+		}
+		if entry != nil {
+			newData.Status = change.New.Status
+		} else {
+			newData.Status = 0
+		}
+		err = saveJob(change.Old, &newData)
+		if err == nil {
+			err = updateJob(newData.Name, bson.M{"status": newData.Status})
+		}
+		jobStateLock.Unlock()
+		if err != nil {
+			return err
+		}
+		if err = saveRevision("update", session.User, change.Old, &newData); err != nil {
+			return revisionError(err)
+		}
+		if change.New.Status != cron.StatusStopped && entry == nil {
+			if err = add(newData.Name); err != nil {
+				return err
+			}
+			if change.New.Status == cron.StatusPaused {
+				return pauseJob(newData.Name)
+			}
+		}
+
+	case jobfile.ActionRemove:
+		jobStateLock.Lock()
+		c.RemoveFunc(change.Name)
+		remove := func(c *mgo.Collection) error {
+			return c.Remove(bson.M{"name": change.Name})
+		}
+		err = handle.WitchCollection(handle.Config().JobDb, handle.Config().JobCollection, remove)
+		jobStateLock.Unlock()
+		if err != nil {
+			return err
+		}
+		if err = saveRevision("delete", session.User, change.Old, change.Old); err != nil {
+			return revisionError(err)
+		}
+	}
+	return nil
+}
+
+/**
+ * 启动时同步job定义文件，文件有错误时只输出日志，继续使用数据库中的配置
+ */
+func syncJobFileOnStart() {
+	if handle.Config().JobFilePath == "" {
+		return
+	}
+	session := &Session{api.Session{User: jobFileUser, Admin: true}, true}
+	changes, err := syncJobFile(session, false)
+	if err != nil {
+		log.Printf("SyncJobFile error: %s\n", err)
+		return
+	}
+	log.Printf("SyncJobFile %d changes\n", len(changes))
+}
+
+/**
+ * jsonrpc接口，同步job定义文件，DryRun为true时只返回将要执行的变更，需要管理员权限
+ */
+func (t *Calculator) SyncJobFile(args *api.SyncJobFileArgs, reply *[]*api.JobChange) error {
+	*reply = []*api.JobChange{}
+	if !t.session.login {
+		return ErrUnauthenticated
+	}
+	if !t.session.Admin {
+		return ErrPermissionDenied
+	}
+	changes, err := syncJobFile(t.session, args.DryRun)
+	if err != nil {
+		return err
+	}
+	*reply = changes
+	return nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"jcron/modules/api"
+	"jcron/modules/cron"
+	"jcron/modules/handle"
+	"jcron/modules/job/cmd"
+	"jcron/modules/lease"
+	"jcron/modules/proc"
+	"jcron/modules/shim"
+	"log"
+	"os"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// 实例日志记录，保存在JobSnapshotCollection，每个正在运行的实例一条，实例开始时写入，结束时删除
+// 每条记录单独写入，调度程序崩溃或写入失败只影响一个实例
+type JournalEntry struct {
+	//实例日志id
+	ObjectId string `bson:"_id"`
+	//job名称
+	Name string
+	//执行程序类型，php或http，旧记录为空
+	ExecType string
+	//进程id和进程启动时间，http实例和进程启动前为0
+	Pid      int
+	PidStart uint64
+	//实例启动时间
+	Date time.Time
+	//实例所在主机，只加载本机的实例
+	Host string
+	//运行的agent，为空时在本机运行
+	Agent string
+	//写入时领导者的防护令牌，未开启选举时为0
+	Fence int64 `bson:",omitempty"`
+}
+
+// 主机心跳间隔，每台主机的调度程序定时写入实例日志集合
+const journalHeartbeatInterval = 30 * time.Second
+
+// 主机超过该时间没有心跳视为已停止，其他主机启动时接管它的实例日志
+const journalHeartbeatTimeout = 3 * journalHeartbeatInterval
+
+// 主机心跳，和实例日志保存在同一个集合，_id为"heartbeat:"加主机名
+type JournalHeartbeat struct {
+	Id        string `bson:"_id"`
+	Host      string
+	Heartbeat time.Time
+}
+
+// 实例日志查询条件，排除旧版本快照和主机心跳
+func journalQuery(host interface{}) bson.M {
+	return bson.M{"host": host, "instance": bson.M{"$exists": false}, "heartbeat": bson.M{"$exists": false}}
+}
+
+// 写入mongo的实例日志
+type mongoJournal struct{}
+
+func init() {
+	cron.InstanceJournal = mongoJournal{}
+}
+
+func (mongoJournal) Start(name string, run *cron.RunInfo) {
+	entry := &JournalEntry{ObjectId: run.ObjectId, Name: name, Date: run.Date, Agent: run.Agent, ExecType: run.ExecType}
+	entry.Host, _ = os.Hostname()
+	if run.Proc != nil {
+		entry.Pid = run.Proc.Pid
+		entry.PidStart, _ = proc.StartTime(entry.Pid)
+	}
+	if err := upsertJournal(entry); err != nil {
+		log.Printf("Journal start %s error: %s\n", run.ObjectId, err)
+	}
+}
+
+func (mongoJournal) Finish(objectId string) {
+	err := removeJournal(objectId)
+	if err != nil && err != mgo.ErrNotFound {
+		log.Printf("Journal finish %s error: %s\n", objectId, err)
+	}
+}
+
+// 写入一条实例日志，其他节点已成为领导者并写入过时返回lease.ErrFenced
+var upsertJournal = func(entry *JournalEntry) error {
+	upsert := func(c *mgo.Collection) error {
+		set := bson.M{}
+		selector := fence(bson.M{"_id": entry.ObjectId}, set)
+		entry.Fence, _ = set[fenceField].(int64)
+		//令牌更大的记录不匹配，按_id插入时重复
+		_, err := c.Upsert(selector, entry)
+		if mgo.IsDup(err) {
+			return lease.ErrFenced
+		}
+		return err
+	}
+	return handle.WitchCollection(handle.Config().JobDb, handle.Config().JobSnapshotCollection, upsert)
+}
+
+// 删除一条实例日志，不存在时返回mgo.ErrNotFound，其他节点已成为领导者并写入过时返回lease.ErrFenced
+var removeJournal = func(objectId string) error {
+	remove := func(c *mgo.Collection) error {
+		err := c.Remove(fence(bson.M{"_id": objectId}, bson.M{}))
+		return fenceError(c, bson.M{"_id": objectId}, err)
+	}
+	return handle.WitchCollection(handle.Config().JobDb, handle.Config().JobSnapshotCollection, remove)
+}
+
+// 按条件读取实例日志
+var findJournal = func(query bson.M) ([]JournalEntry, error) {
+	var list []JournalEntry
+	find := func(c *mgo.Collection) error {
+		return c.Find(query).All(&list)
+	}
+	err := handle.WitchCollection(handle.Config().JobDb, handle.Config().JobSnapshotCollection, find)
+	return list, err
+}
+
+// 读取所有主机的最近心跳时间
+var findHeartbeats = func() (map[string]time.Time, error) {
+	var list []JournalHeartbeat
+	find := func(c *mgo.Collection) error {
+		return c.Find(bson.M{"heartbeat": bson.M{"$exists": true}}).All(&list)
+	}
+	if err := handle.WitchCollection(handle.Config().JobDb, handle.Config().JobSnapshotCollection, find); err != nil {
+		return nil, err
+	}
+	beats := map[string]time.Time{}
+	for _, beat := range list {
+		beats[beat.Host] = beat.Heartbeat
+	}
+	return beats, nil
+}
+
+// 写入本机心跳
+func writeHeartbeat() error {
+	host, _ := os.Hostname()
+	beat := &JournalHeartbeat{Id: "heartbeat:" + host, Host: host, Heartbeat: time.Now()}
+	upsert := func(c *mgo.Collection) error {
+		_, err := c.UpsertId(beat.Id, beat)
+		return err
+	}
+	return handle.WitchCollection(handle.Config().JobDb, handle.Config().JobSnapshotCollection, upsert)
+}
+
+/**
+ * 定时写入本机心跳，心跳过期的主机上的实例由其他主机启动时标记为遗弃和丢失
+ */
+func journalHeartbeat() {
+	ticker := time.NewTicker(journalHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		if err := writeHeartbeat(); err != nil {
+			log.Printf("Journal heartbeat error: %s\n", err)
+		}
+		<-ticker.C
+	}
+}
+
+/**
+ * 结束还在运行中的运行记录并写入原因，原因写入错误日志会按job的告警设置报警，记录已结束时不修改
+ */
+func finishRecord(name, objectId string, result int, msg string) bool {
+	if !bson.IsObjectIdHex(objectId) {
+		return false
+	}
+	return closeRecord(name, bson.M{"_id": bson.ObjectIdHex(objectId), "result": handle.ResultRunning}, result, msg)
+}
+
+// 按条件结束一条运行记录，条件需要包含_id，其他节点已成为领导者并修改过时不修改
+var closeRecord = func(name string, selector bson.M, result int, msg string) bool {
+	objectId := selector["_id"].(bson.ObjectId).Hex()
+	update := func(c *mgo.Collection) error {
+		set := bson.M{"result": result}
+		err := c.Update(fence(selector, set), bson.M{"$set": set})
+		return fenceError(c, bson.M{"_id": selector["_id"]}, err)
+	}
+	err := handle.WitchCollection(handle.Config().JobLogDb, name, update)
+	if err != nil {
+		if err != mgo.ErrNotFound {
+			log.Printf("Finish record %s error: %s\n", objectId, err)
+		}
+		return false
+	}
+	loger := handle.NewMongoC(name).OpenLoger(objectId)
+	loger.NewErrPipe().Write([]byte(msg))
+	//写入结束时间，同时关闭实时输出
+	loger.Update(map[string]interface{}{"endtime": time.Now()})
+	return true
+}
+
+/**
+ * 按实例日志恢复本机上一个进程正在运行的实例：shim启动的重新接管，进程还在运行的加入job的实例列表，
+ * 平滑重启时交接来的agent上的实例加入job的实例列表，http请求和其他agent上的实例无法恢复，标记为中断和丢失，
+ * 进程启动前写入、没有进程id的实例标记为遗弃。
+ * 已停止的job的实例加入单独的job对象，由c.Keep保存，实例结束前可以查看和杀死，返回这些job
+ */
+func loadJournal(entries []*cron.Entry) []*cron.Entry {
+	host, _ := os.Hostname()
+	list, err := findJournal(journalQuery(host))
+	if err != nil {
+		log.Printf("Load journal error: %s\n", err)
+		return nil
+	}
+
+	jobs := map[string]cron.Job{}
+	for _, entry := range entries {
+		jobs[entry.Name] = entry.Job
+	}
+	stopped := map[string]cron.Job{}
+	for i := range list {
+		je := &list[i]
+		job := jobs[je.Name]
+		if job == nil && je.ExecType != "http" {
+			if stopped[je.Name] == nil {
+				stopped[je.Name] = stoppedJob(je.Name)
+			}
+			job = stopped[je.Name]
+		}
+		switch {
+		case je.Agent != "" && getRemoteRun(je.Agent, je.ObjectId) != nil:
+			//平滑重启时交接来的实例，结束时由agent发回结果
+			job.Add(&cron.RunInfo{Date: je.Date, ObjectId: je.ObjectId, Agent: je.Agent, ExecType: je.ExecType})
+			//加入前已经结束时移除
+			if getRemoteRun(je.Agent, je.ObjectId) == nil {
+				if r, ok := job.(remover); ok {
+					r.Remove(je.ObjectId)
+				}
+			}
+			continue
+		case je.Agent != "":
+			finishRecord(je.Name, je.ObjectId, api.ResultLost, "scheduler restarted, run on agent "+je.Agent+" lost")
+		case je.ExecType == "http" || (je.ExecType == "" && je.Pid == 0):
+			//旧记录没有执行类型，进程id为0的是http实例
+			finishRecord(je.Name, je.ObjectId, api.ResultInterrupted, "scheduler restarted, http request interrupted")
+		default:
+			if reattach, ok := job.(reattacher); ok {
+				err := reattach.Reattach(je.ObjectId, je.Date)
+				if err == nil {
+					log.Printf("Reattach Name : %s, ObjectId : %s\n", je.Name, je.ObjectId)
+					continue
+				}
+				log.Printf("Reattach %s error: %s\n", je.ObjectId, err)
+			}
+			//进程启动前写入的实例日志，无法确定进程是否已启动
+			if je.Pid == 0 {
+				finishRecord(je.Name, je.ObjectId, api.ResultAbandoned, "scheduler restarted before the process started, abandoned")
+				break
+			}
+			//进程id和启动时间一致才是同一个进程，旧记录没有启动时间
+			alive := shim.Alive(je.Pid, je.PidStart)
+			if je.PidStart == 0 {
+				alive = proc.Exist(je.Pid) == nil
+			}
+			if alive {
+				process, _ := os.FindProcess(je.Pid)
+				job.Add(&cron.RunInfo{Date: je.Date, Proc: process, ObjectId: je.ObjectId, ExecType: je.ExecType})
+				continue
+			}
+		}
+		mongoJournal{}.Finish(je.ObjectId)
+	}
+
+	var kept []*cron.Entry
+	for name, job := range stopped {
+		if len(job.List()) > 0 {
+			log.Printf("Journal: job %s is not scheduled, %d runs kept\n", name, len(job.List()))
+			c.Keep(name, job)
+			kept = append(kept, &cron.Entry{Name: name, Job: job})
+		}
+	}
+	return kept
+}
+
+// 保存已停止job的实例，只用于查看、杀死和接管实例，不会执行
+func stoppedJob(name string) cron.Job {
+	job, _ := cmd.NewPHPJob(&cmd.PHPEnv{}, handle.NewMongoC(name), 1)
+	return job
+}
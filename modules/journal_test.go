@@ -0,0 +1,157 @@
+package main
+
+import (
+	"jcron/modules/api"
+	"jcron/modules/cron"
+	"jcron/modules/handle"
+	"jcron/modules/job/cmd"
+	"jcron/modules/proc"
+	"os"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// 用内存中的实例日志替换mongo读写
+func stubJournal(t *testing.T, list ...JournalEntry) map[string]JournalEntry {
+	upsert, remove, find := upsertJournal, removeJournal, findJournal
+	t.Cleanup(func() {
+		upsertJournal, removeJournal, findJournal = upsert, remove, find
+	})
+	stored := map[string]JournalEntry{}
+	for _, entry := range list {
+		stored[entry.ObjectId] = entry
+	}
+	upsertJournal = func(entry *JournalEntry) error {
+		stored[entry.ObjectId] = *entry
+		return nil
+	}
+	removeJournal = func(objectId string) error {
+		if _, ok := stored[objectId]; !ok {
+			return mgo.ErrNotFound
+		}
+		delete(stored, objectId)
+		return nil
+	}
+	findJournal = func(query bson.M) ([]JournalEntry, error) {
+		list := []JournalEntry{}
+		for _, entry := range stored {
+			switch host := query["host"].(type) {
+			case string:
+				if entry.Host != host {
+					continue
+				}
+			case bson.M:
+				if entry.Host == host["$ne"] {
+					continue
+				}
+			}
+			list = append(list, entry)
+		}
+		return list, nil
+	}
+	return stored
+}
+
+func TestJournal(t *testing.T) {
+	stored := stubJournal(t)
+	host, _ := os.Hostname()
+	self, _ := os.FindProcess(os.Getpid())
+	date := time.Now()
+
+	mongoJournal{}.Start("php1", &cron.RunInfo{ObjectId: "a", Date: date, Proc: self})
+	mongoJournal{}.Start("php1", &cron.RunInfo{ObjectId: "b", Date: date, Agent: "agent1"})
+	mongoJournal{}.Start("web1", &cron.RunInfo{ObjectId: "c", Date: date, ExecType: "http"})
+
+	a := stored["a"]
+	if a.Name != "php1" || a.Host != host || a.Pid != os.Getpid() || a.PidStart == 0 || !a.Date.Equal(date) {
+		t.Errorf("local run journal: %+v", a)
+	}
+	if b := stored["b"]; b.Agent != "agent1" || b.Pid != 0 {
+		t.Errorf("agent run journal: %+v", b)
+	}
+	if c := stored["c"]; c.Name != "web1" || c.ExecType != "http" || c.Pid != 0 || c.PidStart != 0 {
+		t.Errorf("http run journal: %+v", c)
+	}
+
+	mongoJournal{}.Finish("a")
+	//已删除的实例日志再次结束时忽略
+	mongoJournal{}.Finish("a")
+	if _, ok := stored["a"]; ok {
+		t.Error("finished run should be removed from journal")
+	}
+	if len(stored) != 2 {
+		t.Errorf("expected 2 journal entries left, got %d", len(stored))
+	}
+}
+
+// 测试按执行类型恢复实例日志：http请求标记为中断，进程启动前写入的php实例标记为遗弃
+func TestLoadJournalExecType(t *testing.T) {
+	host, _ := os.Hostname()
+	web, php, legacy := bson.NewObjectId().Hex(), bson.NewObjectId().Hex(), bson.NewObjectId().Hex()
+	stored := stubJournal(t,
+		JournalEntry{ObjectId: web, Name: "web1", Host: host, ExecType: "http"},
+		JournalEntry{ObjectId: php, Name: "journal1", Host: host, ExecType: "php"},
+		//旧记录没有执行类型
+		JournalEntry{ObjectId: legacy, Name: "web1", Host: host},
+	)
+	defer func(close func(string, bson.M, int, string) bool) { closeRecord = close }(closeRecord)
+	results := map[string]int{}
+	closeRecord = func(name string, selector bson.M, result int, msg string) bool {
+		results[selector["_id"].(bson.ObjectId).Hex()] = result
+		return true
+	}
+
+	job, _ := cmd.NewPHPJob(&cmd.PHPEnv{}, handle.Console, 1)
+	if _, err := c.AddJob("journal1", "", "0 0 0 1 1 ?", job); err != nil {
+		t.Fatal(err)
+	}
+	defer c.RemoveFunc("journal1")
+	loadJournal(c.Entries())
+
+	want := map[string]int{web: api.ResultInterrupted, php: api.ResultAbandoned, legacy: api.ResultInterrupted}
+	for id, result := range want {
+		if results[id] != result {
+			t.Errorf("run %s result %d, want %d", id, results[id], result)
+		}
+	}
+	if len(stored) != 0 || len(job.List()) != 0 {
+		t.Errorf("journal %v and runs %v should be cleared", stored, job.List())
+	}
+}
+
+// 测试已停止job的实例：进程还在运行的保留实例日志，可以通过Lookup查看，进程已结束的删除实例日志
+func TestLoadJournalStoppedJob(t *testing.T) {
+	host, _ := os.Hostname()
+	start, _ := proc.StartTime(os.Getpid())
+	alive, dead := bson.NewObjectId().Hex(), bson.NewObjectId().Hex()
+	stored := stubJournal(t,
+		JournalEntry{ObjectId: alive, Name: "stopped1", Host: host, ExecType: "php", Pid: os.Getpid(), PidStart: start},
+		//启动时间不一致，进程id已被复用
+		JournalEntry{ObjectId: dead, Name: "stopped1", Host: host, ExecType: "php", Pid: os.Getpid(), PidStart: start + 1},
+	)
+
+	kept := loadJournal(nil)
+	if len(kept) != 1 || kept[0].Name != "stopped1" {
+		t.Fatalf("stopped job should be kept, got %v", kept)
+	}
+	job := c.Lookup("stopped1")
+	if job == nil {
+		t.Fatal("stopped job should be found by Lookup")
+	}
+	if list := job.List(); len(list) != 1 || list[0].ObjectId != alive || list[0].Proc.Pid != os.Getpid() {
+		t.Errorf("alive run should be listed, got %v", list)
+	}
+	if _, ok := stored[alive]; !ok {
+		t.Error("journal of alive run should be kept")
+	}
+	if _, ok := stored[dead]; ok {
+		t.Error("journal of dead run should be removed")
+	}
+	job.(remover).Remove(alive)
+	if c.Lookup("stopped1") != nil {
+		t.Error("stopped job without runs should be dropped")
+	}
+}
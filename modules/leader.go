@@ -0,0 +1,288 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"jcron/modules/api"
+	"jcron/modules/handle"
+	"jcron/modules/lease"
+	"jcron/modules/metrics"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// 租约记录名称
+const leaseId = "leader"
+
+// 非领导者节点不能执行只允许领导者执行的操作
+var ErrNotLeader = errors.New("not the leader, this node is standby")
+
+var (
+	// 选举器，未开启选举时为nil
+	elector *lease.Elector
+	// 调度循环是否已启动
+	schedulerRunning int32
+	// 启动、停止调度循环的锁
+	schedulerLock sync.Mutex
+)
+
+func init() {
+	metrics.NewGaugeFunc("jcron_leader", "Whether this node is the leader and runs the scheduler.", func() []metrics.Sample {
+		value := 0.0
+		if isLeader() {
+			value = 1
+		}
+		return []metrics.Sample{{Value: value}}
+	})
+}
+
+// mongo中的租约存储，一个文档，以读到的持有者、令牌、过期时间为条件更新，保证只有一个节点成功
+// 同一个进程续约时令牌不变，其他情况抢占时令牌加1，节点名称相同的不同进程不会拿到相同的令牌
+type mongoLease struct {
+	db         string
+	collection string
+}
+
+func (s *mongoLease) Acquire(holder, incarnation string, ttl time.Duration, now time.Time) (*lease.Record, bool, error) {
+	rec := &lease.Record{}
+	acquired := false
+	acquire := func(c *mgo.Collection) error {
+		err := c.FindId(leaseId).One(rec)
+		if err == mgo.ErrNotFound {
+			*rec = lease.Record{Id: leaseId, Holder: holder, Incarnation: incarnation, Token: 1, Expire: now.Add(ttl)}
+			err = c.Insert(rec)
+			if mgo.IsDup(err) {
+				// 其他节点同时创建了租约
+				return c.FindId(leaseId).One(rec)
+			}
+			acquired = err == nil
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		renew := rec.Holder == holder && rec.Incarnation == incarnation
+		if !renew && now.Before(rec.Expire) {
+			return nil
+		}
+		set := bson.M{"holder": holder, "incarnation": incarnation, "expire": now.Add(ttl)}
+		token := rec.Token
+		if !renew {
+			token++
+		}
+		set["token"] = token
+		err = c.Update(bson.M{"_id": leaseId, "holder": rec.Holder, "token": rec.Token, "expire": rec.Expire}, bson.M{"$set": set})
+		if err == mgo.ErrNotFound {
+			// 读取后被其他节点修改
+			return c.FindId(leaseId).One(rec)
+		}
+		if err != nil {
+			return err
+		}
+		*rec = lease.Record{Id: leaseId, Holder: holder, Incarnation: incarnation, Token: token, Expire: now.Add(ttl)}
+		acquired = true
+		return nil
+	}
+	err := handle.WitchCollection(s.db, s.collection, acquire)
+	return rec, acquired, err
+}
+
+func (s *mongoLease) Release(holder string, token int64) error {
+	release := func(c *mgo.Collection) error {
+		err := c.Update(bson.M{"_id": leaseId, "holder": holder, "token": token}, bson.M{"$set": bson.M{"expire": time.Time{}}})
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+	return handle.WitchCollection(s.db, s.collection, release)
+}
+
+func (s *mongoLease) Current() (*lease.Record, error) {
+	rec := &lease.Record{}
+	find := func(c *mgo.Collection) error {
+		return c.FindId(leaseId).One(rec)
+	}
+	err := handle.WitchCollection(s.db, s.collection, find)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+/**
+ * 当前节点是否调度任务，未开启选举时始终为true
+ */
+func isLeader() bool {
+	return elector == nil || elector.IsLeader()
+}
+
+/**
+ * 只允许领导者执行的操作前调用，备用节点返回ErrNotLeader。只检查本地的领导者身份，写入由fence加上防护令牌
+ */
+func checkLeader() error {
+	if elector == nil || elector.IsLeader() {
+		return nil
+	}
+	return ErrNotLeader
+}
+
+// 文档上记录写入时防护令牌的字段
+const fenceField = "fence"
+
+/**
+ * 只应由领导者写入的数据加上防护令牌：selector加上文档上的令牌不大于持有的令牌的条件，set写入持有的令牌，
+ * 新领导者写入过的文档不会再被旧领导者修改。未开启选举时不修改
+ */
+func fence(selector, set bson.M) bson.M {
+	if elector == nil {
+		return selector
+	}
+	token := elector.Token()
+	set[fenceField] = token
+	return bson.M{"$and": []bson.M{selector, {"$or": []bson.M{
+		{fenceField: bson.M{"$exists": false}},
+		{fenceField: bson.M{"$lte": token}},
+	}}}}
+}
+
+// 加上防护令牌的更新没有匹配时，文档上的令牌更大返回lease.ErrFenced，否则返回原错误
+func fenceError(c *mgo.Collection, selector bson.M, err error) error {
+	if err != mgo.ErrNotFound || elector == nil {
+		return err
+	}
+	n, cerr := c.Find(bson.M{"$and": []bson.M{selector, {fenceField: bson.M{"$gt": elector.Token()}}}}).Count()
+	if cerr == nil && n > 0 {
+		return lease.ErrFenced
+	}
+	return err
+}
+
+/**
+ * 启动调度循环
+ */
+func startScheduler() {
+	schedulerLock.Lock()
+	defer schedulerLock.Unlock()
+	runScheduler()
+}
+
+// 启动调度循环，调用方持有schedulerLock
+func runScheduler() {
+	//平滑重启时从旧进程停止的位置继续调度
+	if next := takeHandoverNext(); next != nil {
+		c.StartFrom(next)
+	} else {
+		c.Start()
+	}
+	atomic.StoreInt32(&schedulerRunning, 1)
+}
+
+/**
+ * 停止调度循环，正在运行的实例继续运行
+ */
+func stopScheduler() {
+	schedulerLock.Lock()
+	defer schedulerLock.Unlock()
+	c.Stop()
+	atomic.StoreInt32(&schedulerRunning, 0)
+}
+
+/**
+ * 开启选举，成为领导者后加载job和快照并开始调度，失去领导者身份时停止调度
+ */
+func startElection() {
+	node := handle.Config().NodeName
+	if node == "" {
+		host, _ := os.Hostname()
+		node = fmt.Sprintf("%s:%d", host, os.Getpid())
+	}
+	elector = &lease.Elector{
+		Store:       &mongoLease{handle.Config().JobDb, handle.Config().LeaseCollection},
+		Holder:      node,
+		Incarnation: lease.NewIncarnation(),
+		TTL:         time.Duration(handle.Config().LeaderLease) * time.Second,
+		OnElected: func(token int64) {
+			//加载job需要等待数据库，不能阻塞续约
+			go lead(token)
+		},
+		OnDemoted: stopScheduler,
+	}
+	//租约失效后即使调度循环还没停止也不再触发任务
+	c.Gate = elector.IsLeader
+	log.Printf("Leader election enabled, node %s, lease %ds\n", node, handle.Config().LeaderLease)
+	go elector.Run(nil)
+}
+
+// 成为领导者后是否已经加载过job，由reloadLock保护
+var leaderLoaded bool
+
+/**
+ * 成为领导者后加载job并开始调度，加载期间失去领导者身份时不开始调度，
+ * 加载失败时释放租约，下一轮选举重新抢占后重试，其他节点也可以接管
+ */
+func lead(token int64) {
+	//开始调度前加载最新的维护暂停，不等待定时重新加载
+	if err := loadMaintenance(); err != nil {
+		log.Printf("Load maintenance error: %s\n", err)
+	}
+	reloadLock.Lock()
+	if !leaderLoaded {
+		//第一次成为领导者，和单机启动一样加载job和快照
+		if err := LoadJobAndSnapshot(); err != nil {
+			reloadLock.Unlock()
+			log.Printf("Elected but load jobs error: %s, resign\n", err)
+			if elector.Holding(token) {
+				if err := elector.Resign(); err != nil {
+					log.Printf("Resign error: %s\n", err)
+				}
+			}
+			return
+		}
+		leaderLoaded = true
+	} else {
+		log.Printf("Elected reload jobs %s\n", reloadJobs())
+	}
+	reloadLock.Unlock()
+
+	schedulerLock.Lock()
+	defer schedulerLock.Unlock()
+	if !elector.Holding(token) {
+		log.Printf("Lost leadership while loading jobs, token %d\n", token)
+		return
+	}
+	runScheduler()
+}
+
+/**
+ * jsonrpc接口，获取领导者选举状态
+ */
+func (t *Calculator) GetLeader(flag bool, reply *api.LeaderStatus) error {
+	*reply = api.LeaderStatus{}
+	if !t.session.login {
+		return ErrUnauthenticated
+	}
+	if elector == nil {
+		*reply = api.LeaderStatus{Leader: true}
+		return nil
+	}
+	status := elector.Status()
+	*reply = api.LeaderStatus{
+		Enabled: true,
+		Leader:  status.Leader,
+		Node:    status.Node,
+		Holder:  status.Holder,
+		Token:   status.Token,
+		Expire:  status.Expire,
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"jcron/modules/lease"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// 测试只应由领导者写入的数据带上防护令牌：条件要求文档上的令牌不大于持有的令牌，写入持有的令牌
+func TestFence(t *testing.T) {
+	defer func(e *lease.Elector) { elector = e }(elector)
+	elector = nil
+	set := bson.M{"status": 1}
+	if selector := fence(bson.M{"name": "php1"}, set); !reflect.DeepEqual(selector, bson.M{"name": "php1"}) || len(set) != 1 {
+		t.Errorf("election disabled should not fence, got %v %v", selector, set)
+	}
+
+	store := &lease.MemoryStore{}
+	elector = &lease.Elector{Store: store, Holder: "a", TTL: time.Minute}
+	elector.Tick(time.Now())
+	//其他节点接管后令牌加1，旧领导者仍用原来的令牌写入
+	(&lease.Elector{Store: store, Holder: "b", TTL: time.Minute}).Tick(time.Now().Add(2 * time.Minute))
+
+	selector := fence(bson.M{"name": "php1"}, set)
+	want := bson.M{"$and": []bson.M{{"name": "php1"}, {"$or": []bson.M{
+		{fenceField: bson.M{"$exists": false}},
+		{fenceField: bson.M{"$lte": int64(1)}},
+	}}}}
+	if !reflect.DeepEqual(selector, want) || set[fenceField] != int64(1) {
+		t.Errorf("unexpected fenced write %v %v", selector, set)
+	}
+}
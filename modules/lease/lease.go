@@ -0,0 +1,272 @@
+// 基于存储中租约记录的领导者选举，持有未过期租约的节点为领导者，每次不是本进程续约的抢占都把防护令牌加1
+package lease
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// 领导者已变更，持有的防护令牌失效，存储中已有更大的令牌写入的数据
+var ErrFenced = errors.New("lease: fencing token is stale, not the leader anymore")
+
+// 租约记录
+type Record struct {
+	//租约名称
+	Id string `bson:"_id"`
+	//持有者节点名称
+	Holder string
+	//持有者进程的标识，节点名称相同的不同进程（重启后、平滑重启的新进程、名称重复的主机）不同
+	Incarnation string
+	//防护令牌，每次抢占加1，续约不变
+	Token int64
+	//过期时间
+	Expire time.Time
+}
+
+// 租约存储，实现需要保证并发修改时只有一个节点成功
+type Store interface {
+	// 持有者为holder且进程标识为incarnation时续约，令牌不变；已过期或不存在时抢占并把令牌加1，返回操作后的记录和是否持有租约
+	Acquire(holder, incarnation string, ttl time.Duration, now time.Time) (*Record, bool, error)
+	// 持有者为holder且令牌为token时释放租约，其他节点可以立即抢占
+	Release(holder string, token int64) error
+	// 读取当前记录，不存在时返回nil
+	Current() (*Record, error)
+}
+
+// 选举器，只有领导者调度任务
+type Elector struct {
+	// 租约存储
+	Store Store
+	// 当前节点名称
+	Holder string
+	// 当前进程的标识，为空时第一次选举前自动生成
+	Incarnation string
+	// 租约时长，续约间隔为TTL的三分之一，其他节点最迟在TTL加续约间隔后接管
+	TTL time.Duration
+	// 成为领导者时调用
+	OnElected func(token int64)
+	// 失去领导者身份时调用
+	OnDemoted func()
+
+	mu       sync.Mutex
+	leader   bool
+	token    int64
+	deadline time.Time // 本地认为租约有效的截止时间
+	current  Record    // 最近一次读到的租约记录
+}
+
+// 选举状态
+type Status struct {
+	//当前节点是否为领导者
+	Leader bool
+	//当前节点名称
+	Node string
+	//租约持有者
+	Holder string
+	//防护令牌
+	Token int64
+	//租约过期时间
+	Expire time.Time
+}
+
+/**
+ * 执行一轮选举：续约或抢占租约，身份变化时调用回调
+ * 存储出错时保持身份，直到本地截止时间后放弃领导者身份
+ */
+func (e *Elector) Tick(now time.Time) {
+	rec, acquired, err := e.Store.Acquire(e.Holder, e.incarnation(), e.TTL, now)
+	if err != nil {
+		log.Printf("lease: acquire error: %s\n", err)
+		if e.IsLeader() && !now.Before(e.deadlineTime()) {
+			e.demote()
+		}
+		return
+	}
+
+	e.mu.Lock()
+	e.current = *rec
+	leader, token := e.leader, e.token
+	if acquired {
+		// 截止时间从发起请求的时间算起，避免请求耗时导致和其他节点重叠
+		e.deadline = now.Add(e.TTL)
+	}
+	e.mu.Unlock()
+
+	if leader && (!acquired || rec.Token != token) {
+		e.demote()
+		leader = false
+	}
+	if acquired && !leader {
+		e.mu.Lock()
+		e.leader = true
+		e.token = rec.Token
+		e.mu.Unlock()
+		log.Printf("lease: %s elected, token %d\n", e.Holder, rec.Token)
+		if e.OnElected != nil {
+			e.OnElected(rec.Token)
+		}
+	}
+}
+
+// 当前进程的标识，为空时生成随机值
+func (e *Elector) incarnation() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.Incarnation == "" {
+		e.Incarnation = NewIncarnation()
+	}
+	return e.Incarnation
+}
+
+// 生成随机的进程标识
+func NewIncarnation() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+/**
+ * 放弃领导者身份
+ */
+func (e *Elector) demote() {
+	e.mu.Lock()
+	e.leader = false
+	token := e.token
+	e.mu.Unlock()
+	log.Printf("lease: %s demoted, token %d\n", e.Holder, token)
+	if e.OnDemoted != nil {
+		e.OnDemoted()
+	}
+}
+
+/**
+ * 定期选举，直到stop关闭
+ */
+func (e *Elector) Run(stop <-chan struct{}) {
+	interval := e.TTL / 3
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	e.Tick(time.Now())
+	for {
+		select {
+		case <-ticker.C:
+			e.Tick(time.Now())
+		case <-stop:
+			return
+		}
+	}
+}
+
+/**
+ * 主动释放租约，退出前调用，其他节点不需要等待租约过期
+ */
+func (e *Elector) Resign() error {
+	e.mu.Lock()
+	leader, token := e.leader, e.token
+	e.leader = false
+	e.mu.Unlock()
+	if !leader {
+		return nil
+	}
+	return e.Store.Release(e.Holder, token)
+}
+
+func (e *Elector) deadlineTime() time.Time {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.deadline
+}
+
+/**
+ * 是否为领导者，本地截止时间已过时视为不是领导者
+ */
+func (e *Elector) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader && time.Now().Before(e.deadline)
+}
+
+/**
+ * 最近一次成为领导者时的防护令牌，没有成为过领导者时为0。写入只应由领导者修改的数据时和数据一起写入，
+ * 并以存储中记录的令牌不大于它为写入条件，其他节点用更大的令牌写入后旧领导者的写入不会生效
+ */
+func (e *Elector) Token() int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.token
+}
+
+/**
+ * 是否仍以token为防护令牌担任领导者，成为领导者后异步执行的操作完成时检查，期间换过主时返回false
+ */
+func (e *Elector) Holding(token int64) bool {
+	e.mu.Lock()
+	current := e.token
+	e.mu.Unlock()
+	return current == token && e.IsLeader()
+}
+
+/**
+ * 当前选举状态
+ */
+func (e *Elector) Status() *Status {
+	leader := e.IsLeader()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return &Status{
+		Leader: leader,
+		Node:   e.Holder,
+		Holder: e.current.Holder,
+		Token:  e.current.Token,
+		Expire: e.current.Expire,
+	}
+}
+
+// 内存中的租约存储，用于单进程测试
+type MemoryStore struct {
+	mu  sync.Mutex
+	rec *Record
+}
+
+func (s *MemoryStore) Acquire(holder, incarnation string, ttl time.Duration, now time.Time) (*Record, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.rec == nil:
+		s.rec = &Record{Holder: holder, Incarnation: incarnation, Token: 1}
+	case s.rec.Holder == holder && s.rec.Incarnation == incarnation:
+	case now.Before(s.rec.Expire):
+		rec := *s.rec
+		return &rec, false, nil
+	default:
+		s.rec.Holder = holder
+		s.rec.Incarnation = incarnation
+		s.rec.Token++
+	}
+	s.rec.Expire = now.Add(ttl)
+	rec := *s.rec
+	return &rec, true, nil
+}
+
+func (s *MemoryStore) Release(holder string, token int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rec != nil && s.rec.Holder == holder && s.rec.Token == token {
+		s.rec.Expire = time.Time{}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Current() (*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rec == nil {
+		return nil, nil
+	}
+	rec := *s.rec
+	return &rec, nil
+}
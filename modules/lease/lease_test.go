@@ -0,0 +1,122 @@
+package lease
+
+import (
+	"testing"
+	"time"
+)
+
+func newElector(store Store, holder string, events *[]string) *Elector {
+	return &Elector{
+		Store:     store,
+		Holder:    holder,
+		TTL:       3 * time.Second,
+		OnElected: func(token int64) { *events = append(*events, holder+" elected") },
+		OnDemoted: func() { *events = append(*events, holder+" demoted") },
+	}
+}
+
+func TestElection(t *testing.T) {
+	store := &MemoryStore{}
+	events := []string{}
+	a := newElector(store, "a", &events)
+	b := newElector(store, "b", &events)
+
+	now := time.Now()
+	a.Tick(now)
+	b.Tick(now)
+	if !a.IsLeader() || b.IsLeader() {
+		t.Fatalf("expected a to be the only leader, events %v", events)
+	}
+	if status := b.Status(); status.Holder != "a" || status.Token != 1 || status.Leader {
+		t.Errorf("unexpected standby status %+v", status)
+	}
+
+	// 续约不改变令牌
+	a.Tick(now.Add(time.Second))
+	if a.Token() != 1 {
+		t.Errorf("renew should keep token 1, got %d", a.Token())
+	}
+
+	// a没有续约，租约过期后b接管，令牌加1
+	b.Tick(now.Add(5 * time.Second))
+	if status := b.Status(); status.Holder != "b" || status.Token != 2 {
+		t.Errorf("unexpected status after takeover %+v", status)
+	}
+	if a.Token() >= b.Token() {
+		t.Errorf("old leader token %d should be less than %d", a.Token(), b.Token())
+	}
+	a.Tick(now.Add(5 * time.Second))
+	if a.IsLeader() {
+		t.Error("old leader still leader")
+	}
+
+	want := []string{"a elected", "b elected", "a demoted"}
+	if len(events) != len(want) {
+		t.Fatalf("events %v, want %v", events, want)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Errorf("events %v, want %v", events, want)
+		}
+	}
+}
+
+func TestResign(t *testing.T) {
+	store := &MemoryStore{}
+	events := []string{}
+	a := newElector(store, "a", &events)
+	b := newElector(store, "b", &events)
+
+	now := time.Now()
+	a.Tick(now)
+	if err := a.Resign(); err != nil {
+		t.Fatal(err)
+	}
+	b.Tick(now.Add(time.Second))
+	if !b.IsLeader() {
+		t.Fatal("standby did not take over after resign")
+	}
+	if status := b.Status(); status.Token != 2 {
+		t.Errorf("expected token 2, got %d", status.Token)
+	}
+}
+
+// 测试节点名称相同的不同进程不能接管未过期的租约，接管后令牌加1
+func TestSameHolderIncarnation(t *testing.T) {
+	store := &MemoryStore{}
+	events := []string{}
+	a := newElector(store, "node1", &events)
+	b := newElector(store, "node1", &events)
+
+	now := time.Now()
+	a.Tick(now)
+	b.Tick(now.Add(time.Second))
+	if !a.IsLeader() || b.IsLeader() {
+		t.Fatalf("same name process should not take an unexpired lease, events %v", events)
+	}
+	if b.Token() != 0 {
+		t.Errorf("standby with the same name should not get a token, got %d", b.Token())
+	}
+	if !a.Holding(1) || a.Holding(2) {
+		t.Error("a should hold token 1 only")
+	}
+
+	// a没有续约，过期后b接管，令牌加1，a被防护
+	b.Tick(now.Add(5 * time.Second))
+	if !b.IsLeader() || b.Status().Token != 2 {
+		t.Fatalf("expected b to take over with token 2, status %+v", b.Status())
+	}
+	if a.Token() >= b.Token() {
+		t.Errorf("old process token %d should be less than %d", a.Token(), b.Token())
+	}
+	a.Tick(now.Add(5 * time.Second))
+	if a.Holding(1) {
+		t.Error("a should not hold token 1 after takeover")
+	}
+
+	// 同一个进程续约令牌不变
+	b.Tick(now.Add(6 * time.Second))
+	if b.Token() != 2 || b.Status().Token != 2 {
+		t.Errorf("renew should keep token 2, got %d %+v", b.Token(), b.Status())
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"jcron/modules/api"
+	"jcron/modules/handle"
+	"jcron/modules/metrics"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+// 从数据库重新加载维护暂停的间隔，其他节点的修改和自动恢复在这个间隔内生效
+const maintenanceInterval = 10 * time.Second
+
+// 自动恢复在操作日志中记录的用户
+const maintenanceUser = "maintenance"
+
+// 正在生效的维护暂停，按类别保存，全局暂停的类别为空
+var maintenance = struct {
+	sync.Mutex
+	pauses map[string]*api.Maintenance
+}{pauses: map[string]*api.Maintenance{}}
+
+// 读取保存的维护暂停
+var findMaintenance = func() ([]*api.Maintenance, error) {
+	var list []*api.Maintenance
+	find := func(c *mgo.Collection) error {
+		return c.Find(nil).All(&list)
+	}
+	err := handle.WitchCollection(handle.Config().JobDb, handle.Config().MaintenanceCollection, find)
+	return list, err
+}
+
+// 写入跳过的运行记录
+var skipRecord = handle.SkipRecord
+
+func init() {
+	c.Hold = maintenanceHold
+}
+
+// 暂停范围的名称，用于日志
+func maintenanceScope(category string) string {
+	if category == "" {
+		return "global"
+	}
+	return "category " + category
+}
+
+// 是否已过自动恢复时间
+func maintenanceExpired(pause *api.Maintenance, now time.Time) bool {
+	return !pause.Until.IsZero() && !now.Before(pause.Until)
+}
+
+/**
+ * 调度循环中检查任务是否处于维护暂停，全局暂停或者任务所属类别暂停时跳过本次触发，写入跳过的运行记录
+ */
+func maintenanceHold(name string, scheduled time.Time) bool {
+	category := ""
+	if applied := getApplied(name); applied != nil {
+		category = applied.Category
+	}
+	now := time.Now()
+	maintenance.Lock()
+	pause := maintenance.pauses[""]
+	if (pause == nil || maintenanceExpired(pause, now)) && category != "" {
+		pause = maintenance.pauses[category]
+	}
+	if pause == nil || maintenanceExpired(pause, now) {
+		maintenance.Unlock()
+		return false
+	}
+	pause.Skipped++
+	scope := maintenanceScope(pause.Category)
+	maintenance.Unlock()
+
+	metrics.MaintenanceSkipped.Inc(name)
+	log.Printf("%s skipped for maintenance (%s)\n", name, scope)
+	//调度循环中不能等待数据库
+	record := skipRecord
+	go func() {
+		msg := "skipped for maintenance (" + scope + "), scheduled at " + scheduled.Format("2006-01-02 15:04:05")
+		if err := record(name, scheduled, msg); err != nil {
+			log.Printf("Skip record %s error: %s\n", name, err)
+		}
+	}()
+	return true
+}
+
+/**
+ * 从数据库加载维护暂停，保留本节点已记录的跳过次数
+ */
+func loadMaintenance() error {
+	list, err := findMaintenance()
+	if err != nil {
+		return err
+	}
+	pauses := map[string]*api.Maintenance{}
+	maintenance.Lock()
+	defer maintenance.Unlock()
+	for _, pause := range list {
+		if old := maintenance.pauses[pause.Category]; old != nil && old.Since.Equal(pause.Since) {
+			pause.Skipped = old.Skipped
+		} else {
+			log.Printf("Maintenance started (%s) by %s: %s\n", maintenanceScope(pause.Category), pause.User, pause.Reason)
+		}
+		pauses[pause.Category] = pause
+	}
+	for category, old := range maintenance.pauses {
+		if pauses[category] == nil {
+			log.Printf("Maintenance ended (%s), %d skipped\n", maintenanceScope(category), old.Skipped)
+		}
+	}
+	maintenance.pauses = pauses
+	return nil
+}
+
+/**
+ * 定期从数据库重新加载维护暂停，领导者删除已到自动恢复时间的暂停并记录操作日志
+ */
+func maintenanceMonitor() {
+	session := &Session{api.Session{User: maintenanceUser, Admin: true}, true}
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if isLeader() {
+			now := time.Now()
+			for _, pause := range listMaintenance() {
+				if maintenanceExpired(pause, now) {
+					err := removeMaintenance(pause.Category)
+					session.audit(&api.OperateLog{Method: "EndMaintenance", Params: pause.Category}, err)
+				}
+			}
+		}
+		if err := loadMaintenance(); err != nil {
+			log.Printf("Load maintenance error: %s\n", err)
+		}
+	}
+}
+
+// 当前的维护暂停，按类别排序，全局暂停在最前
+func listMaintenance() []*api.Maintenance {
+	maintenance.Lock()
+	defer maintenance.Unlock()
+	list := []*api.Maintenance{}
+	for _, pause := range maintenance.pauses {
+		copied := *pause
+		list = append(list, &copied)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Category < list[j].Category
+	})
+	return list
+}
+
+// 删除维护暂停，不存在时返回mgo.ErrNotFound
+func removeMaintenance(category string) error {
+	remove := func(c *mgo.Collection) error {
+		return c.RemoveId(category)
+	}
+	if err := handle.WitchCollection(handle.Config().JobDb, handle.Config().MaintenanceCollection, remove); err != nil {
+		return err
+	}
+	maintenance.Lock()
+	if old := maintenance.pauses[category]; old != nil {
+		log.Printf("Maintenance ended (%s), %d skipped\n", maintenanceScope(category), old.Skipped)
+		delete(maintenance.pauses, category)
+	}
+	maintenance.Unlock()
+	return nil
+}
+
+/**
+ * jsonrpc接口，开始维护暂停，类别为空时暂停所有job，已暂停时更新原因和自动恢复时间，需要管理员权限。
+ * 暂停不修改job的状态，暂停期间到了执行时间的记录为跳过
+ */
+func (t *Calculator) StartMaintenance(args *api.MaintenanceArgs, reply *int) (err error) {
+	log.Printf("StartMaintenance Category : %s, Until : %s\n", args.Category, args.Until)
+	defer func() {
+		t.session.audit(&api.OperateLog{Method: "StartMaintenance", Params: args}, err)
+	}()
+	*reply = -1
+	if !t.session.login {
+		return ErrUnauthenticated
+	}
+	if !t.session.Admin {
+		return ErrPermissionDenied
+	}
+	if !args.Until.IsZero() && !args.Until.After(time.Now()) {
+		return errors.New("Until must be in the future")
+	}
+	pause := &api.Maintenance{
+		Category: args.Category,
+		Reason:   args.Reason,
+		User:     t.session.User,
+		Since:    time.Now(),
+		Until:    args.Until,
+	}
+	maintenance.Lock()
+	old := maintenance.pauses[args.Category]
+	maintenance.Unlock()
+	//更新已有的暂停时保留开始时间和跳过次数
+	if old != nil {
+		pause.Since = old.Since
+	}
+	upsert := func(c *mgo.Collection) error {
+		_, err := c.UpsertId(pause.Category, pause)
+		return err
+	}
+	if err = handle.WitchCollection(handle.Config().JobDb, handle.Config().MaintenanceCollection, upsert); err != nil {
+		return err
+	}
+	maintenance.Lock()
+	if old = maintenance.pauses[args.Category]; old != nil && old.Since.Equal(pause.Since) {
+		pause.Skipped = old.Skipped
+	} else {
+		log.Printf("Maintenance started (%s) by %s: %s\n", maintenanceScope(pause.Category), pause.User, pause.Reason)
+	}
+	maintenance.pauses[args.Category] = pause
+	maintenance.Unlock()
+	*reply = 0
+	return nil
+}
+
+/**
+ * jsonrpc接口，结束维护暂停，参数为开始时的类别，需要管理员权限
+ */
+func (t *Calculator) EndMaintenance(category string, reply *int) (err error) {
+	log.Printf("EndMaintenance Category : %s\n", category)
+	defer func() {
+		t.session.audit(&api.OperateLog{Method: "EndMaintenance", Params: category}, err)
+	}()
+	*reply = -1
+	if !t.session.login {
+		return ErrUnauthenticated
+	}
+	if !t.session.Admin {
+		return ErrPermissionDenied
+	}
+	if err = removeMaintenance(category); err != nil {
+		if err == mgo.ErrNotFound {
+			err = errors.New("not in maintenance: " + maintenanceScope(category))
+		}
+		return err
+	}
+	*reply = 0
+	return nil
+}
+
+/**
+ * jsonrpc接口，查询正在生效的维护暂停，跳过次数为本节点的统计
+ */
+func (t *Calculator) GetMaintenance(flag bool, reply *[]*api.Maintenance) error {
+	*reply = []*api.Maintenance{}
+	if !t.session.login {
+		return ErrUnauthenticated
+	}
+	*reply = listMaintenance()
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"jcron/modules/api"
+	"jcron/modules/cron"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceHoldAfterLoad(t *testing.T) {
+	defer func(find func() ([]*api.Maintenance, error), skip func(string, time.Time, string) error) {
+		findMaintenance, skipRecord = find, skip
+		maintenance.pauses = map[string]*api.Maintenance{}
+	}(findMaintenance, skipRecord)
+
+	now := time.Now()
+	findMaintenance = func() ([]*api.Maintenance, error) {
+		return []*api.Maintenance{
+			{Category: "report", User: "alice", Since: now.Add(-time.Minute)},
+			{Category: "expired", Since: now.Add(-time.Hour), Until: now.Add(-time.Minute)},
+		}, nil
+	}
+	skipped := make(chan string, 10)
+	skipRecord = func(name string, scheduled time.Time, msg string) error {
+		skipped <- name
+		return nil
+	}
+	setApplied(&cron.JobCollection{Name: "daily", Category: "report"})
+	setApplied(&cron.JobCollection{Name: "old", Category: "expired"})
+	setApplied(&cron.JobCollection{Name: "other", Category: "sync"})
+
+	// 重启后调度前加载保存的暂停
+	if err := loadMaintenance(); err != nil {
+		t.Fatal(err)
+	}
+	if !maintenanceHold("daily", now) {
+		t.Error("daily should be held by category report")
+	}
+	if maintenanceHold("old", now) || maintenanceHold("other", now) {
+		t.Error("expired or other category should not be held")
+	}
+	waitSkip(t, skipped, "daily")
+
+	// 重新加载时保留跳过次数，全局暂停对所有job生效
+	findMaintenance = func() ([]*api.Maintenance, error) {
+		return []*api.Maintenance{
+			{Category: "report", User: "alice", Since: now.Add(-time.Minute)},
+			{Category: "", User: "bob", Since: now},
+		}, nil
+	}
+	if err := loadMaintenance(); err != nil {
+		t.Fatal(err)
+	}
+	if !maintenanceHold("other", now) {
+		t.Error("other should be held by global maintenance")
+	}
+	waitSkip(t, skipped, "other")
+	for _, pause := range listMaintenance() {
+		if pause.Category == "report" && pause.Skipped != 1 {
+			t.Errorf("report skipped %d, want 1", pause.Skipped)
+		}
+	}
+}
+
+// 等待一次跳过记录写入
+func waitSkip(t *testing.T, skipped chan string, want string) {
+	select {
+	case name := <-skipped:
+		if name != want {
+			t.Errorf("skip record for %s, want %s", name, want)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("no skip record for %s", want)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"jcron/modules/metrics"
+	"time"
+)
+
+func init() {
+	httpMux.Handle("/metrics", metrics.Handler())
+
+	c.OnFire = func(name string, scheduled, now time.Time) {
+		metrics.SchedulerLag.Observe(now.Sub(scheduled).Seconds(), name)
+	}
+
+	metrics.NewGaugeFunc("jcron_job_running_instances", "Number of running instances per job.", func() []metrics.Sample {
+		samples := []metrics.Sample{}
+		for _, entry := range c.Entries() {
+			samples = append(samples, metrics.Sample{LabelValues: []string{entry.Name}, Value: float64(len(entry.Job.List()))})
+		}
+		return samples
+	}, "job")
+	metrics.NewGaugeFunc("jcron_job_channel", "Maximum concurrent instances per job.", func() []metrics.Sample {
+		samples := []metrics.Sample{}
+		for _, entry := range c.Entries() {
+			samples = append(samples, metrics.Sample{LabelValues: []string{entry.Name}, Value: float64(entry.Job.Channel())})
+		}
+		return samples
+	}, "job")
+	metrics.NewGaugeFunc("jcron_job_next_fire_seconds", "Seconds until the next scheduled fire per job.", func() []metrics.Sample {
+		samples := []metrics.Sample{}
+		now := time.Now()
+		for _, entry := range c.Entries() {
+			if entry.Next.IsZero() {
+				continue
+			}
+			samples = append(samples, metrics.Sample{LabelValues: []string{entry.Name}, Value: entry.Next.Sub(now).Seconds()})
+		}
+		return samples
+	}, "job")
+	metrics.NewGaugeFunc("jcron_entries", "Number of scheduled jobs.", func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(len(c.Entries()))}}
+	})
+}
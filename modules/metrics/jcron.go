@@ -0,0 +1,46 @@
+package metrics
+
+// 调度延迟的分布区间，单位秒
+var lagBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 30}
+
+// 存储操作耗时的分布区间，单位秒
+var storageBuckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// job运行指标
+var (
+	JobStarted   = NewCounterVec("jcron_job_started_total", "Number of job runs started.", "job")
+	JobSucceeded = NewCounterVec("jcron_job_succeeded_total", "Number of job runs finished successfully.", "job")
+	JobFailed    = NewCounterVec("jcron_job_failed_total", "Number of job runs finished with error.", "job")
+	JobSkipped   = NewCounterVec("jcron_job_skipped_total", "Number of job runs skipped because the concurrency limit was reached.", "job")
+	JobKilled    = NewCounterVec("jcron_job_killed_total", "Number of job instances killed.", "job")
+	JobAbandoned = NewCounterVec("jcron_job_abandoned_total", "Number of orphaned job runs marked abandoned on startup.", "job")
+	JobDuration  = NewHistogramVec("jcron_job_duration_seconds", "Duration of finished job runs.", DefBuckets, "job")
+)
+
+// 调度指标
+var (
+	SchedulerLag       = NewHistogramVec("jcron_scheduler_lag_seconds", "Actual start time minus scheduled time of job fires.", lagBuckets, "job")
+	MaintenanceSkipped = NewCounterVec("jcron_maintenance_skipped_total", "Number of job fires skipped during maintenance.", "job")
+)
+
+// 对账指标
+var (
+	ReconcileRuns  = NewCounterVec("jcron_reconcile_runs_total", "Number of reconciliations between stored job status and scheduled entries.", "trigger")
+	ReconcileDrift = NewCounterVec("jcron_reconcile_drift_total", "Number of jobs found drifted by reconciliation.", "action")
+)
+
+// 存储指标
+var (
+	StorageDuration = NewHistogramVec("jcron_storage_duration_seconds", "Latency of storage operations.", storageBuckets, "db", "collection")
+	StorageErrors   = NewCounterVec("jcron_storage_errors_total", "Number of failed storage operations.", "db", "collection")
+)
+
+// 记录一次运行结束
+func JobFinish(job string, success bool, seconds float64) {
+	if success {
+		JobSucceeded.Inc(job)
+	} else {
+		JobFailed.Inc(job)
+	}
+	JobDuration.Observe(seconds, job)
+}
@@ -0,0 +1,234 @@
+// 以prometheus文本格式输出监控指标，不依赖第三方库
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 默认的耗时分布区间，单位秒
+var DefBuckets = []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 600, 1800, 3600}
+
+// 指标采集接口
+type collector interface {
+	write(w io.Writer)
+}
+
+var (
+	registryLock sync.Mutex
+	registry     []collector
+)
+
+func register(c collector) {
+	registryLock.Lock()
+	registry = append(registry, c)
+	registryLock.Unlock()
+}
+
+// 指标描述
+type desc struct {
+	name       string
+	help       string
+	labelNames []string
+}
+
+func (d *desc) header(w io.Writer, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, typ)
+}
+
+// 生成标签字符串，如 {job="php1"}
+func (d *desc) labels(values []string, extra ...string) string {
+	if len(d.labelNames) == 0 && len(extra) == 0 {
+		return ""
+	}
+	pairs := []string{}
+	for i, name := range d.labelNames {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs = append(pairs, name+`="`+escape(value)+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escape(extra[i+1])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+const labelSep = "\xff"
+
+// 按标签区分的计数器
+type CounterVec struct {
+	desc
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{desc: desc{name, help, labelNames}, values: map[string]float64{}}
+	register(c)
+	return c
+}
+
+// 计数加1
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, labelSep)
+	c.lock.Lock()
+	c.values[key] += v
+	c.lock.Unlock()
+}
+
+// 获取计数，主要用于测试
+func (c *CounterVec) Get(labelValues ...string) float64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.values[strings.Join(labelValues, labelSep)]
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.header(w, "counter")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labels(strings.Split(key, labelSep)), formatFloat(c.values[key]))
+	}
+}
+
+// 按标签区分的直方图
+type HistogramVec struct {
+	desc
+	buckets []float64
+	lock    sync.Mutex
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	h := &HistogramVec{desc: desc{name, help, labelNames}, buckets: buckets, values: map[string]*histogram{}}
+	register(h)
+	return h
+}
+
+// 记录一次观测值
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, labelSep)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	value, ok := h.values[key]
+	if !ok {
+		value = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = value
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			value.counts[i]++
+		}
+	}
+	value.count++
+	value.sum += v
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.header(w, "histogram")
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	keys := []string{}
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		values := strings.Split(key, labelSep)
+		value := h.values[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labels(values, "le", formatFloat(bound)), value.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labels(values, "le", "+Inf"), value.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labels(values), formatFloat(value.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labels(values), value.count)
+	}
+}
+
+// 采集时计算的指标值
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// 采集时调用函数计算当前值的仪表盘
+type GaugeFunc struct {
+	desc
+	collect func() []Sample
+}
+
+func NewGaugeFunc(name, help string, collect func() []Sample, labelNames ...string) *GaugeFunc {
+	g := &GaugeFunc{desc{name, help, labelNames}, collect}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	g.header(w, "gauge")
+	for _, sample := range g.collect() {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.labels(sample.LabelValues), formatFloat(sample.Value))
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// 输出所有指标
+func Write(w io.Writer) {
+	registryLock.Lock()
+	collectors := append([]collector{}, registry...)
+	registryLock.Unlock()
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// /metrics接口
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		Write(&buf)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(buf.Bytes())
+	})
+}
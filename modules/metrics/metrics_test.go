@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// 测试计数器输出
+func TestCounterVec(t *testing.T) {
+	c := &CounterVec{desc: desc{"test_total", "test counter", []string{"job"}}, values: map[string]float64{}}
+	c.Inc("a")
+	c.Inc("a")
+	c.Add(3, `b"c`)
+
+	var buf bytes.Buffer
+	c.write(&buf)
+	out := buf.String()
+	for _, line := range []string{
+		"# TYPE test_total counter",
+		`test_total{job="a"} 2`,
+		`test_total{job="b\"c"} 3`,
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("missing %q in:\n%s", line, out)
+		}
+	}
+}
+
+// 测试直方图的区间累计
+func TestHistogramVec(t *testing.T) {
+	h := &HistogramVec{desc: desc{"test_seconds", "test histogram", []string{"job"}}, buckets: []float64{1, 5}, values: map[string]*histogram{}}
+	h.Observe(0.5, "a")
+	h.Observe(3, "a")
+	h.Observe(10, "a")
+
+	var buf bytes.Buffer
+	h.write(&buf)
+	out := buf.String()
+	for _, line := range []string{
+		`test_seconds_bucket{job="a",le="1"} 1`,
+		`test_seconds_bucket{job="a",le="5"} 2`,
+		`test_seconds_bucket{job="a",le="+Inf"} 3`,
+		`test_seconds_sum{job="a"} 13.5`,
+		`test_seconds_count{job="a"} 3`,
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("missing %q in:\n%s", line, out)
+		}
+	}
+}
+
+// 测试采集时计算的仪表盘
+func TestGaugeFunc(t *testing.T) {
+	g := &GaugeFunc{desc{"test_gauge", "test gauge", []string{"job"}}, func() []Sample {
+		return []Sample{{[]string{"a"}, 1.5}}
+	}}
+	var buf bytes.Buffer
+	g.write(&buf)
+	if !strings.Contains(buf.String(), `test_gauge{job="a"} 1.5`) {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"jcron/modules/api"
+	"jcron/modules/cron"
+	"jcron/modules/handle"
+	"log"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// 修改job的运行状态，from为修改前的状态，状态不一致时返回mgo.ErrNotFound，其他节点已成为领导者并修改过时返回lease.ErrFenced
+var setStatus = func(name string, from, to int) error {
+	update := func(c *mgo.Collection) error {
+		set := bson.M{"status": to}
+		err := c.Update(fence(bson.M{"name": name, "status": from}, set), bson.M{"$set": set})
+		return fenceError(c, bson.M{"name": name}, err)
+	}
+	return handle.WitchCollection(handle.Config().JobDb, handle.Config().JobCollection, update)
+}
+
+/**
+ * 暂停job并把状态改为暂停，job保留在调度列表中，下次执行时间照常计算，实例列表仍可查看和杀死
+ */
+func pauseJob(name string) error {
+	if err := checkLeader(); err != nil {
+		return err
+	}
+	jobStateLock.Lock()
+	defer jobStateLock.Unlock()
+	if err := setStatus(name, cron.StatusRunning, cron.StatusPaused); err != nil {
+		if err == mgo.ErrNotFound {
+			return errors.New("job not exist, or job is not running")
+		}
+		return err
+	}
+	// 调度列表中暂停失败时恢复状态，避免状态为暂停但仍在触发
+	if err := c.Pause(name); err != nil {
+		if rerr := setStatus(name, cron.StatusPaused, cron.StatusRunning); rerr != nil {
+			log.Printf("Rollback status of %s error: %s\n", name, rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+/**
+ * 恢复暂停的job并把状态改为运行中，misfire为true时按job的Misfire设置处理暂停期间错过的执行，返回错过的次数
+ */
+func resumeJob(name string, misfire bool) (int, error) {
+	if err := checkLeader(); err != nil {
+		return 0, err
+	}
+	jobStateLock.Lock()
+	defer jobStateLock.Unlock()
+	if err := setStatus(name, cron.StatusPaused, cron.StatusRunning); err != nil {
+		if err == mgo.ErrNotFound {
+			return 0, errors.New("job not exist, or job is not paused")
+		}
+		return 0, err
+	}
+	catchUp := false
+	if applied := getApplied(name); misfire && applied != nil {
+		catchUp = applied.Misfire == cron.MisfireOnce
+	}
+	// 调度列表中恢复失败时恢复状态，避免状态为运行中但没有调度
+	missed, err := c.Resume(name, catchUp)
+	if err != nil {
+		if rerr := setStatus(name, cron.StatusRunning, cron.StatusPaused); rerr != nil {
+			log.Printf("Rollback status of %s error: %s\n", name, rerr)
+		}
+		return 0, err
+	}
+	return missed, nil
+}
+
+// 按数据库中的状态设置调度列表中的暂停状态，加载和对账时使用，恢复时不补执行
+func applyPaused(jobData *cron.JobCollection) error {
+	if jobData.Status == cron.StatusPaused {
+		return c.Pause(jobData.Name)
+	}
+	_, err := c.Resume(jobData.Name, false)
+	return err
+}
+
+/**
+ * jsonrpc接口，暂停job，和停止不同，job保留在调度列表中，正在运行的实例仍可查看和杀死
+ */
+func (t *Calculator) PauseJob(name string, reply *int) (err error) {
+	log.Printf("PauseJob Name : %s\n", name)
+	defer func() {
+		t.session.audit(&api.OperateLog{Method: "PauseJob", JobName: name}, err)
+	}()
+	*reply = -1
+	if err = t.session.Check(name, permEdit); err != nil {
+		return err
+	}
+	if err = pauseJob(name); err != nil {
+		return err
+	}
+	*reply = 0
+	return nil
+}
+
+/**
+ * jsonrpc接口，恢复暂停的job，Misfire为true时按job的Misfire设置处理暂停期间错过的执行
+ */
+func (t *Calculator) ResumeJob(args *api.ResumeJobArgs, reply *int) (err error) {
+	log.Printf("ResumeJob Name : %s, Misfire : %v\n", args.Name, args.Misfire)
+	defer func() {
+		t.session.audit(&api.OperateLog{Method: "ResumeJob", JobName: args.Name, Params: args}, err)
+	}()
+	*reply = -1
+	if err = t.session.Check(args.Name, permEdit); err != nil {
+		return err
+	}
+	missed, err := resumeJob(args.Name, args.Misfire)
+	if err != nil {
+		return err
+	}
+	log.Printf("ResumeJob %s, %d missed while paused\n", args.Name, missed)
+	*reply = 0
+	return nil
+}
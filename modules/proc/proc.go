@@ -14,3 +14,8 @@ func KillGroup(pid int) error {
 func Exist(pid int) error {
 	return exist(pid)
 }
+
+// 进程启动时间（系统启动后的时钟周期数），和进程id一起识别进程，避免进程id被复用时误认
+func StartTime(pid int) (uint64, error) {
+	return startTime(pid)
+}
@@ -1,6 +1,7 @@
 package proc
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
 	"strconv"
@@ -49,3 +50,17 @@ func killGroup(pid int) error {
 func exist(pid int) error {
 	return syscall.Kill(pid, 0)
 }
+
+// 读取/proc/<pid>/stat的第22个字段，进程名可能包含空格和括号，从最后一个)之后开始计数
+func startTime(pid int) (uint64, error) {
+	data, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return 0, err
+	}
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 20 {
+		return 0, errors.New("invalid /proc/" + strconv.Itoa(pid) + "/stat")
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
@@ -1,6 +1,7 @@
 package proc
 
 import (
+	"errors"
 	"os"
 )
 
@@ -25,3 +26,7 @@ func exist(pid int) error {
 	_, err := os.FindProcess(pid)
 	return err
 }
+
+func startTime(pid int) (uint64, error) {
+	return 0, errors.New("process start time is not supported")
+}
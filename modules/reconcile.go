@@ -0,0 +1,79 @@
+package main
+
+import (
+	"jcron/modules/api"
+	"jcron/modules/metrics"
+	"log"
+	"time"
+)
+
+// 定时对账间隔
+const reconcileInterval = time.Minute
+
+// 定时对账使用的用户名
+const reconcileUser = "reconciler"
+
+/**
+ * 对比数据库中状态为1、2的job和正在调度的job，启动缺少的、停止已停止的、应用修改的配置和暂停状态，
+ * 发现的不一致记录到监控指标和操作日志
+ */
+func reconcile(session *Session, trigger string) *api.ReconcileResult {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	result := reloadJobs()
+	metrics.ReconcileRuns.Inc(trigger)
+	drift := map[string][]string{
+		"added":   result.Added,
+		"removed": result.Removed,
+		"changed": result.Changed,
+		"failed":  result.Failed,
+	}
+	for action, names := range drift {
+		for _, name := range names {
+			metrics.ReconcileDrift.Inc(action)
+			// 失败的每次对账都会出现，只记录日志和指标
+			if action != "failed" {
+				session.audit(&api.OperateLog{Method: "Reconcile", JobName: name, Params: action}, nil)
+			}
+		}
+	}
+	if len(result.Added)+len(result.Removed)+len(result.Changed)+len(result.Failed) > 0 {
+		log.Printf("Reconcile %s %s\n", trigger, result)
+	}
+	return result
+}
+
+/**
+ * 定时对账
+ */
+func reconciler() {
+	session := &Session{api.Session{User: reconcileUser, Admin: true}, true}
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		//备用节点不调度，不需要对账
+		if !isLeader() {
+			continue
+		}
+		reconcile(session, "timer")
+	}
+}
+
+/**
+ * jsonrpc接口，立即对账，需要管理员权限
+ */
+func (t *Calculator) ReconcileNow(flag bool, reply *api.ReconcileResult) error {
+	*reply = api.ReconcileResult{}
+	if !t.session.login {
+		return ErrUnauthenticated
+	}
+	if !t.session.Admin {
+		return ErrPermissionDenied
+	}
+	if !isLeader() {
+		return ErrNotLeader
+	}
+	*reply = *reconcile(t.session, "manual")
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"jcron/modules/api"
+	"jcron/modules/cron"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestReconcile(t *testing.T) {
+	_, _, audits := stubJobWrites(t)
+	defer func(find func() ([]*cron.JobCollection, error)) {
+		findScheduledJobs = find
+	}(findScheduledJobs)
+
+	env := `{"path" : "/", "ini" : "/", "pwd" : "/"}`
+	job := func(name string, status int, cronSpec string) *cron.JobCollection {
+		return &cron.JobCollection{Name: name, Cron: cronSpec, Channel: 1, Content: []string{"a.php"}, ExecType: "php", ExecEnv: env, Status: status}
+	}
+	// 已在调度的job
+	for _, jobData := range []*cron.JobCollection{
+		job("rc-same", cron.StatusRunning, "0 * * * * *"),
+		job("rc-change", cron.StatusRunning, "0 * * * * *"),
+		job("rc-pause", cron.StatusRunning, "0 * * * * *"),
+		job("rc-remove", cron.StatusRunning, "0 * * * * *"),
+	} {
+		jobObj, err := newJob(jobData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.AddJob(jobData.Name, "", jobData.Cron, jobObj)
+	}
+	defer func() {
+		for _, name := range []string{"rc-add", "rc-same", "rc-change", "rc-pause", "rc-remove"} {
+			c.RemoveFunc(name)
+		}
+	}()
+	bad := job("rc-bad", cron.StatusRunning, "0 * * * * *")
+	bad.Channel = 0
+	findScheduledJobs = func() ([]*cron.JobCollection, error) {
+		return []*cron.JobCollection{
+			job("rc-add", cron.StatusRunning, "0 * * * * *"),
+			job("rc-same", cron.StatusRunning, "0 * * * * *"),
+			job("rc-change", cron.StatusRunning, "0 0 * * * *"),
+			job("rc-pause", cron.StatusPaused, "0 * * * * *"),
+			bad,
+		}, nil
+	}
+
+	session := &Session{api.Session{User: reconcileUser, Admin: true}, true}
+	result := reconcile(session, "test")
+	expected := &api.ReconcileResult{
+		Added:   []string{"rc-add"},
+		Removed: []string{"rc-remove"},
+		Changed: []string{"rc-change", "rc-pause"},
+		Failed:  []string{"rc-bad"},
+	}
+	sort.Strings(result.Changed)
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("expected %+v, got %+v", expected, result)
+	}
+	entries := map[string]*cron.Entry{}
+	for _, entry := range c.Entries() {
+		entries[entry.Name] = entry
+	}
+	if entries["rc-add"] == nil || entries["rc-remove"] != nil || entries["rc-bad"] != nil {
+		t.Errorf("unexpected entries %v", entries)
+	}
+	if entry := entries["rc-change"]; entry == nil || entry.Cron != "0 0 * * * *" {
+		t.Errorf("rc-change should use the new cron, got %+v", entry)
+	}
+	if entry := entries["rc-pause"]; entry == nil || !entry.Paused {
+		t.Errorf("rc-pause should be paused, got %+v", entry)
+	}
+	// 失败的不记录操作日志
+	logged := []string{}
+	for _, operate := range *audits {
+		logged = append(logged, operate.JobName+":"+operate.Params.(string))
+	}
+	sort.Strings(logged)
+	if !reflect.DeepEqual(logged, []string{"rc-add:added", "rc-change:changed", "rc-pause:changed", "rc-remove:removed"}) {
+		t.Errorf("unexpected audits %v", logged)
+	}
+
+	// 再次对账没有不一致
+	*audits = (*audits)[:0]
+	result = reconcile(session, "test")
+	if len(result.Added)+len(result.Removed)+len(result.Changed) != 0 || len(*audits) != 0 {
+		t.Errorf("expected no drift, got %+v", result)
+	}
+}
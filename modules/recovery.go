@@ -0,0 +1,115 @@
+package main
+
+import (
+	"jcron/modules/api"
+	"jcron/modules/cron"
+	"jcron/modules/handle"
+	"jcron/modules/metrics"
+	"log"
+	"os"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// 旧版本插入运行记录时结果为正常，结束时才更新结束时间，结束时间等于开始时间的记录没有结束
+const legacyUnfinished = "this.endtime.getTime() == this.starttime.getTime()"
+
+/**
+ * 已恢复的实例，在加载实例日志之后、开始调度之前读取，旧版本快照恢复的实例没有运行记录id，按进程id判断
+ */
+func adoptedRuns(entries []*cron.Entry) (map[string]bool, map[int]bool) {
+	adopted := map[string]bool{}
+	pids := map[int]bool{}
+	for _, entry := range entries {
+		for _, run := range entry.Job.List() {
+			adopted[run.ObjectId] = true
+			if run.Proc != nil {
+				pids[run.Proc.Pid] = true
+			}
+		}
+	}
+	return adopted, pids
+}
+
+/**
+ * 启动时检查各job的运行记录：调度程序退出时正在运行、重启后没有恢复的记录标记为遗弃，结束时间为发现时间，
+ * 原因写入错误日志，按job的告警设置报警。since之后开始的记录由当前进程运行，不检查。
+ * 其他主机心跳未过期时它的实例由所在主机恢复，心跳过期的主机已停止，agent上的实例标记为丢失，其他实例标记为遗弃
+ */
+func recoverRecords(since time.Time, adopted map[string]bool, pids map[int]bool) {
+	host, _ := os.Hostname()
+	others, err := findJournal(journalQuery(bson.M{"$ne": host}))
+	if err != nil {
+		log.Printf("Recover records error: %s\n", err)
+		return
+	}
+	beats, err := findHeartbeats()
+	if err != nil {
+		log.Printf("Recover records error: %s\n", err)
+		return
+	}
+	now := time.Now()
+	lost := 0
+	for _, entry := range others {
+		if beat, ok := beats[entry.Host]; ok && now.Sub(beat) < journalHeartbeatTimeout {
+			adopted[entry.ObjectId] = true
+			continue
+		}
+		if entry.Agent != "" {
+			if finishRecord(entry.Name, entry.ObjectId, api.ResultLost, "scheduler on "+entry.Host+" stopped, run on agent "+entry.Agent+" lost") {
+				lost++
+			}
+			//已标记为丢失，不再标记为遗弃
+			adopted[entry.ObjectId] = true
+		}
+		//所在主机上运行的实例留给下面按运行记录标记为遗弃
+		mongoJournal{}.Finish(entry.ObjectId)
+	}
+
+	jobList, err := findJobs()
+	if err != nil {
+		log.Printf("Recover records error: %s\n", err)
+		return
+	}
+
+	msg := "abandoned: scheduler stopped while running, detected at " + now.Format("2006-01-02 15:04:05")
+	count := 0
+	for _, job := range jobList {
+		records, err := findUnfinished(job.Name, since)
+		if err != nil {
+			log.Printf("Recover records %s error: %s\n", job.Name, err)
+			continue
+		}
+		for _, record := range records {
+			if adopted[record.Id.Hex()] || (record.Pid > 0 && pids[record.Pid]) {
+				continue
+			}
+			//条件包含读到的结果和结束时间，期间已结束的记录不修改
+			selector := bson.M{"_id": record.Id, "result": record.Result, "endtime": record.EndTime}
+			if closeRecord(job.Name, selector, api.ResultAbandoned, msg) {
+				metrics.JobAbandoned.Inc(job.Name)
+				count++
+			}
+		}
+	}
+	log.Printf("Recover records, %d abandoned, %d lost\n", count, lost)
+}
+
+// 读取job在since之前开始、还没有结束的运行记录
+var findUnfinished = func(name string, since time.Time) ([]handle.Record, error) {
+	query := bson.M{
+		"starttime": bson.M{"$lt": since},
+		"$or": []bson.M{
+			{"result": handle.ResultRunning},
+			{"result": handle.ResultSuccess, "$where": legacyUnfinished},
+		},
+	}
+	var records []handle.Record
+	find := func(c *mgo.Collection) error {
+		return c.Find(query).Select(bson.M{"_id": 1, "pid": 1, "result": 1, "endtime": 1}).All(&records)
+	}
+	err := handle.WitchCollection(handle.Config().JobLogDb, name, find)
+	return records, err
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"jcron/modules/api"
+	"jcron/modules/cron"
+	"jcron/modules/handle"
+	"os"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestRecoverRecords(t *testing.T) {
+	host, _ := os.Hostname()
+	ids := map[string]bson.ObjectId{}
+	for _, name := range []string{"adopted", "pid", "alive", "orphan", "dead", "deadAgent", "finished"} {
+		ids[name] = bson.NewObjectId()
+	}
+	now := time.Now()
+	stored := stubJournal(t,
+		//本机的实例日志由loadJournal恢复，这里不处理
+		JournalEntry{ObjectId: ids["adopted"].Hex(), Name: "php1", Host: host},
+		JournalEntry{ObjectId: ids["alive"].Hex(), Name: "php1", Host: "alive-host"},
+		JournalEntry{ObjectId: ids["dead"].Hex(), Name: "php1", Host: "dead-host"},
+		JournalEntry{ObjectId: ids["deadAgent"].Hex(), Name: "php2", Host: "dead-host", Agent: "agent1"},
+	)
+	stubJobs(t, &cron.JobCollection{Name: "php1"}, &cron.JobCollection{Name: "php2"})
+	defer func(beats func() (map[string]time.Time, error), find func(string, time.Time) ([]handle.Record, error), close func(string, bson.M, int, string) bool) {
+		findHeartbeats, findUnfinished, closeRecord = beats, find, close
+	}(findHeartbeats, findUnfinished, closeRecord)
+	findHeartbeats = func() (map[string]time.Time, error) {
+		return map[string]time.Time{
+			"alive-host": now.Add(-journalHeartbeatInterval),
+			"dead-host":  now.Add(-journalHeartbeatTimeout - time.Second),
+		}, nil
+	}
+	records := map[string][]handle.Record{
+		"php1": {
+			{Id: ids["adopted"], Result: handle.ResultRunning},
+			{Id: ids["pid"], Pid: 123, Result: handle.ResultRunning},
+			{Id: ids["alive"], Result: handle.ResultRunning},
+			{Id: ids["orphan"], Result: handle.ResultRunning},
+			{Id: ids["dead"], Result: handle.ResultRunning},
+		},
+		"php2": {
+			{Id: ids["deadAgent"], Result: handle.ResultRunning},
+			{Id: ids["finished"], Result: handle.ResultRunning},
+		},
+	}
+	findUnfinished = func(name string, since time.Time) ([]handle.Record, error) {
+		return records[name], nil
+	}
+	results := map[bson.ObjectId]int{}
+	closeRecord = func(name string, selector bson.M, result int, msg string) bool {
+		id := selector["_id"].(bson.ObjectId)
+		//期间已经结束的记录不修改
+		if id == ids["finished"] {
+			return false
+		}
+		if _, ok := results[id]; ok {
+			t.Errorf("record %s closed twice", id.Hex())
+			return false
+		}
+		results[id] = result
+		return true
+	}
+
+	recoverRecords(now, map[string]bool{ids["adopted"].Hex(): true}, map[int]bool{123: true})
+
+	want := map[bson.ObjectId]int{
+		ids["orphan"]:    api.ResultAbandoned,
+		ids["dead"]:      api.ResultAbandoned,
+		ids["deadAgent"]: api.ResultLost,
+	}
+	if len(results) != len(want) {
+		t.Errorf("closed records %v, want %v", results, want)
+	}
+	for id, result := range want {
+		if results[id] != result {
+			t.Errorf("record %s result %d, want %d", id.Hex(), results[id], result)
+		}
+	}
+	//心跳过期的主机的实例日志已处理，删除
+	for _, name := range []string{"dead", "deadAgent"} {
+		if _, ok := stored[ids[name].Hex()]; ok {
+			t.Errorf("journal %s of dead host should be removed", name)
+		}
+	}
+	for _, name := range []string{"adopted", "alive"} {
+		if _, ok := stored[ids[name].Hex()]; !ok {
+			t.Errorf("journal %s should be kept", name)
+		}
+	}
+}
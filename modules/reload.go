@@ -0,0 +1,185 @@
+package main
+
+import (
+	"jcron/modules/api"
+	"jcron/modules/config"
+	"jcron/modules/cron"
+	"jcron/modules/handle"
+	"jcron/modules/systemd"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// 同一时间只允许一个热加载
+var reloadLock sync.Mutex
+
+// 修改job状态和调度列表时持有，启动、停止、暂停、恢复分两步修改数据库和调度列表，
+// 对账在两步之间读取会把正在启动、停止的job当作不一致
+var jobStateLock sync.Mutex
+
+// 修改后需要重启才能生效的配置
+var restartFields = []string{"JsonRpcPort", "HttpPort", "TlsCertFile", "TlsKeyFile", "TlsClientCaFile", "LeaseCollection", "LeaderLease", "NodeName", "SpoolPath"}
+
+/**
+ * 热加载，重新读取配置文件和job，配置无效或数据库连接失败时保持原配置
+ */
+func reload() {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	log.Printf("Reload\n")
+	systemd.Notify(systemd.Reloading)
+	defer systemd.Notify(systemd.Ready)
+
+	conf, err := config.Load(*configPath, os.LookupEnv)
+	if err != nil {
+		log.Printf("Reload rejected, keep the current config: %s\n", err)
+		return
+	}
+	old := handle.Config()
+	if storageChanged(old, conf) {
+		if err := handle.Reconnect(conf); err != nil {
+			log.Printf("Reload rejected, connect %s:%s error: %s\n", conf.DbHost, conf.DbPort, err)
+			return
+		}
+		log.Printf("Reload storage reconnected to %s:%s\n", conf.DbHost, conf.DbPort)
+	}
+	for _, field := range restartChanged(old, conf) {
+		log.Printf("Reload %s changed, restart to take effect\n", field)
+	}
+	handle.SetConfig(conf)
+
+	//备用节点成为领导者时才加载job
+	if !isLeader() {
+		log.Printf("Reload standby, skip jobs\n")
+		return
+	}
+	summary := reloadJobs()
+	log.Printf("Reload jobs %s\n", summary)
+	if handle.Config().JobFilePath != "" {
+		session := &Session{api.Session{User: jobFileUser, Admin: true}, true}
+		changes, err := syncJobFile(session, false)
+		if err != nil {
+			log.Printf("Reload SyncJobFile error: %s\n", err)
+		} else {
+			log.Printf("Reload SyncJobFile %d changes\n", len(changes))
+		}
+	}
+}
+
+// 数据库连接配置是否修改
+func storageChanged(old, conf *handle.Configuration) bool {
+	return conf.DbHost != old.DbHost || conf.DbPort != old.DbPort || conf.DbUser != old.DbUser || conf.DbPassword != old.DbPassword
+}
+
+// 修改了的需要重启才能生效的配置
+func restartChanged(old, conf *handle.Configuration) []string {
+	changed := []string{}
+	oldValue := reflect.ValueOf(old).Elem()
+	newValue := reflect.ValueOf(conf).Elem()
+	for _, field := range restartFields {
+		if oldValue.FieldByName(field).Interface() != newValue.FieldByName(field).Interface() {
+			changed = append(changed, field)
+		}
+	}
+	return changed
+}
+
+// 对比两个job配置，调度状态不参与对比，空的运行位置限制视为相同
+func sameJob(a, b *cron.JobCollection) bool {
+	x, y := *a, *b
+	x.Status, y.Status = 0, 0
+	for _, jobData := range []*cron.JobCollection{&x, &y} {
+		if len(jobData.Labels) == 0 {
+			jobData.Labels = nil
+		}
+		if len(jobData.Hosts) == 0 {
+			jobData.Hosts = nil
+		}
+	}
+	return reflect.DeepEqual(&x, &y)
+}
+
+// 读取状态为运行中、已暂停的job配置
+var findScheduledJobs = func() ([]*cron.JobCollection, error) {
+	jobList := []*cron.JobCollection{}
+	find := func(c *mgo.Collection) error {
+		return c.Find(bson.M{"status": bson.M{"$in": []int{cron.StatusRunning, cron.StatusPaused}}}).All(&jobList)
+	}
+	err := handle.WitchCollection(handle.Config().JobDb, handle.Config().JobCollection, find)
+	return jobList, err
+}
+
+/**
+ * 重新读取job，和正在调度的job对比，新增、移除、修改，正在运行的实例不受影响
+ */
+func reloadJobs() *api.ReconcileResult {
+	jobStateLock.Lock()
+	defer jobStateLock.Unlock()
+	summary := &api.ReconcileResult{}
+	jobList, err := findScheduledJobs()
+	if err != nil {
+		log.Printf("Reload job Find error: %s\n", err)
+		return summary
+	}
+
+	entries := map[string]*cron.Entry{}
+	for _, entry := range c.Entries() {
+		entries[entry.Name] = entry
+	}
+	scheduled := map[string]bool{}
+	for _, jobData := range jobList {
+		scheduled[jobData.Name] = true
+		if err := validateJob(jobData); err != nil {
+			log.Printf("Reload job %s error: %s\n", jobData.Name, err)
+			summary.Failed = append(summary.Failed, jobData.Name)
+			continue
+		}
+		entry := entries[jobData.Name]
+		applied := getApplied(jobData.Name)
+		if entry != nil && applied != nil && sameJob(applied, jobData) {
+			// 只有暂停状态不一致
+			if entry.Paused != (jobData.Status == cron.StatusPaused) {
+				if err := applyPaused(jobData); err != nil {
+					log.Printf("Reload job %s error: %s\n", jobData.Name, err)
+					summary.Failed = append(summary.Failed, jobData.Name)
+				} else {
+					summary.Changed = append(summary.Changed, jobData.Name)
+				}
+			}
+			continue
+		}
+		if entry != nil && applied != nil && applied.ExecType == jobData.ExecType {
+			err = applyJob(entry, applied, jobData)
+		} else {
+			// 执行程序类型修改时重新创建job对象，在调度循环中替换
+			var jobObj cron.Job
+			jobObj, err = newJob(jobData)
+			if err == nil {
+				err = c.ReplaceJob(jobData.Name, jobData.Desc, jobData.Cron, jobObj)
+			}
+		}
+		if err == nil {
+			err = applyPaused(jobData)
+		}
+		if err != nil {
+			log.Printf("Reload job %s error: %s\n", jobData.Name, err)
+			summary.Failed = append(summary.Failed, jobData.Name)
+		} else if entry == nil {
+			summary.Added = append(summary.Added, jobData.Name)
+		} else {
+			summary.Changed = append(summary.Changed, jobData.Name)
+		}
+	}
+	for name := range entries {
+		if !scheduled[name] {
+			c.RemoveFunc(name)
+			summary.Removed = append(summary.Removed, name)
+		}
+	}
+	return summary
+}
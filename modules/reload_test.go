@@ -0,0 +1,67 @@
+package main
+
+import (
+	"jcron/modules/cron"
+	"jcron/modules/handle"
+	"reflect"
+	"testing"
+)
+
+func TestSameJob(t *testing.T) {
+	base := cron.JobCollection{Name: "php1", Cron: "0 * * * * *", Channel: 1, Content: []string{"a.php"}, Status: cron.StatusRunning}
+	tests := []struct {
+		desc   string
+		modify func(*cron.JobCollection)
+		same   bool
+	}{
+		{"equal", func(j *cron.JobCollection) {}, true},
+		{"status", func(j *cron.JobCollection) { j.Status = cron.StatusPaused }, true},
+		{"empty labels", func(j *cron.JobCollection) { j.Labels = map[string]string{} }, true},
+		{"empty hosts", func(j *cron.JobCollection) { j.Hosts = []string{} }, true},
+		{"cron", func(j *cron.JobCollection) { j.Cron = "0 0 * * * *" }, false},
+		{"channel", func(j *cron.JobCollection) { j.Channel = 2 }, false},
+		{"content", func(j *cron.JobCollection) { j.Content = []string{"a.php", "x"} }, false},
+		{"labels", func(j *cron.JobCollection) { j.Labels = map[string]string{"zone": "a"} }, false},
+		{"hosts", func(j *cron.JobCollection) { j.Hosts = []string{"web1"} }, false},
+		{"misfire", func(j *cron.JobCollection) { j.Misfire = cron.MisfireOnce }, false},
+		{"edit person", func(j *cron.JobCollection) { j.EditPerson = "bob" }, false},
+	}
+	for _, test := range tests {
+		other := base
+		test.modify(&other)
+		if same := sameJob(&base, &other); same != test.same {
+			t.Errorf("%s: expected %v, got %v", test.desc, test.same, same)
+		}
+		if same := sameJob(&other, &base); same != test.same {
+			t.Errorf("%s reversed: expected %v, got %v", test.desc, test.same, same)
+		}
+	}
+}
+
+func TestReloadChanged(t *testing.T) {
+	base := handle.Configuration{DbHost: "127.0.0.1", DbPort: "27017", JsonRpcPort: "1234", HttpPort: "1235", LeaderLease: 10}
+	tests := []struct {
+		desc    string
+		modify  func(*handle.Configuration)
+		storage bool
+		restart []string
+	}{
+		{"equal", func(c *handle.Configuration) {}, false, []string{}},
+		{"db host", func(c *handle.Configuration) { c.DbHost = "mongo" }, true, []string{}},
+		{"db password", func(c *handle.Configuration) { c.DbPassword = "secret" }, true, []string{}},
+		{"job db", func(c *handle.Configuration) { c.JobDb = "jcron2" }, false, []string{}},
+		{"ports", func(c *handle.Configuration) { c.JsonRpcPort = "2234"; c.HttpPort = "" }, false, []string{"JsonRpcPort", "HttpPort"}},
+		{"lease", func(c *handle.Configuration) { c.LeaderLease = 20; c.NodeName = "node1" }, false, []string{"LeaderLease", "NodeName"}},
+		{"spool", func(c *handle.Configuration) { c.SpoolPath = "/var/spool/jcron" }, false, []string{"SpoolPath"}},
+	}
+	for _, test := range tests {
+		conf := base
+		test.modify(&conf)
+		if changed := storageChanged(&base, &conf); changed != test.storage {
+			t.Errorf("%s: expected storage changed %v, got %v", test.desc, test.storage, changed)
+		}
+		if changed := restartChanged(&base, &conf); !reflect.DeepEqual(changed, test.restart) {
+			t.Errorf("%s: expected restart fields %v, got %v", test.desc, test.restart, changed)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"jcron/modules/agent"
+	"jcron/modules/api"
+	"jcron/modules/cron"
+	"jcron/modules/handle"
+	"jcron/modules/job/cmd"
+	"jcron/modules/metrics"
+	"log"
+	"net"
+	"net/rpc/jsonrpc"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// agent超过该时间没有心跳视为失联，agent每5秒心跳一次
+const agentTimeout = 15 * time.Second
+
+// 调用agent接口的超时时间
+const agentCallTimeout = 10 * time.Second
+
+// 已注册的agent
+var agents = &agent.Registry{Timeout: agentTimeout}
+
+// agent上正在运行的实例
+type remoteRun struct {
+	name  string // job名称
+	agent string
+	loger handle.Loger
+	done  func(success bool)
+}
+
+var remoteRuns = struct {
+	sync.Mutex
+	runs map[string]*remoteRun
+	// 已交给新进程，之后的输出和结果由新进程处理
+	handedOver bool
+}{runs: map[string]*remoteRun{}}
+
+// 平滑重启时交给新进程的agent上的实例
+type handoverRun struct {
+	ObjectId string
+	Name     string
+	Agent    string
+}
+
+// 打开已有的运行记录，交接来的agent上的实例继续写入
+var openLoger = func(name, objectId string) handle.Loger {
+	return handle.NewMongoC(name).OpenLoger(objectId)
+}
+
+func init() {
+	cmd.RemoteExec = remoteExec{}
+
+	metrics.NewGaugeFunc("jcron_agents", "Number of registered worker agents.", func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(agents.Len())}}
+	})
+}
+
+// 获取agent上正在运行的实例，agent不匹配时返回nil
+func getRemoteRun(name, objectId string) *remoteRun {
+	remoteRuns.Lock()
+	defer remoteRuns.Unlock()
+	run := remoteRuns.runs[objectId]
+	if run == nil || run.agent != name {
+		return nil
+	}
+	return run
+}
+
+// agent上的实例已交给新进程时返回ErrHandedOver，否则返回unknown run
+func unknownRun(objectId string) error {
+	remoteRuns.Lock()
+	defer remoteRuns.Unlock()
+	if remoteRuns.handedOver {
+		return errors.New(api.ErrHandedOver)
+	}
+	return errors.New("unknown run " + objectId)
+}
+
+/**
+ * 平滑重启时取出agent上的实例和agent注册信息交给新进程，之后本进程不再处理这些实例
+ */
+func takeRemoteHandover() ([]handoverRun, []*api.AgentInfo) {
+	remoteRuns.Lock()
+	runs := []handoverRun{}
+	for objectId, run := range remoteRuns.runs {
+		runs = append(runs, handoverRun{ObjectId: objectId, Name: run.name, Agent: run.agent})
+	}
+	remoteRuns.runs = map[string]*remoteRun{}
+	remoteRuns.handedOver = true
+	remoteRuns.Unlock()
+	sort.Slice(runs, func(i, j int) bool { return runs[i].ObjectId < runs[j].ObjectId })
+	return runs, agents.Export()
+}
+
+/**
+ * 接管旧进程交来的agent和agent上的实例，输出和结果继续写入原来的运行记录，在加载job之前调用
+ */
+func restoreRemoteRuns(runs []handoverRun, list []*api.AgentInfo) {
+	agents.Restore(list, time.Now())
+	remoteRuns.Lock()
+	defer remoteRuns.Unlock()
+	for _, run := range runs {
+		name, objectId := run.Name, run.ObjectId
+		loger := openLoger(name, objectId)
+		if loger == nil {
+			agents.Done(run.Agent, objectId)
+			continue
+		}
+		remoteRuns.runs[objectId] = &remoteRun{name, run.Agent, loger, func(success bool) {
+			cron.JournalFinish(objectId)
+		}}
+	}
+	log.Printf("Handover: %d runs on agents taken over\n", len(runs))
+}
+
+// 能移除实例的job，agent上的实例结束时从当前调度的job中移除
+type remover interface {
+	Remove(objectId string)
+}
+
+// 移除agent上的实例，已移除时返回nil
+func takeRemoteRun(objectId string) *remoteRun {
+	remoteRuns.Lock()
+	defer remoteRuns.Unlock()
+	run := remoteRuns.runs[objectId]
+	delete(remoteRuns.runs, objectId)
+	return run
+}
+
+/**
+ * agent上的实例结束，记录结果并释放并发数和agent的运行位置，已结束时返回false
+ */
+func finishRemoteRun(objectId string, result int, msg string) bool {
+	run := takeRemoteRun(objectId)
+	if run == nil {
+		return false
+	}
+	agents.Done(run.agent, objectId)
+	if msg != "" {
+		run.loger.NewErrPipe().Write([]byte(msg))
+	}
+	data := make(map[string]interface{})
+	data["endtime"] = time.Now()
+	data["result"] = result
+	run.loger.Update(data)
+	run.done(result == handle.ResultSuccess)
+	//停止后重新添加的job接管了实例，平滑重启时交接来的实例加入了新的job，从当前调度的job中移除
+	if job, ok := c.Lookup(run.name).(remover); ok {
+		job.Remove(objectId)
+	}
+	return true
+}
+
+// 调度节点名称，agent按名称把输出发回下发请求的节点
+func nodeName() string {
+	if elector != nil {
+		return elector.Holder
+	}
+	host, _ := os.Hostname()
+	return host
+}
+
+// 配置了AgentCaFile时返回连接agent的tls配置，配置了证书时作为客户端证书出示，否则返回nil
+func agentTLSConfig() (*tls.Config, error) {
+	if handle.Config().AgentCaFile == "" {
+		return nil, nil
+	}
+	ca, err := ioutil.ReadFile(handle.Config().AgentCaFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{RootCAs: x509.NewCertPool()}
+	if !config.RootCAs.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificate found in " + handle.Config().AgentCaFile)
+	}
+	if handle.Config().TlsCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(handle.Config().TlsCertFile, handle.Config().TlsKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// 调用agent接口
+func callAgent(addr, method string, args interface{}, reply interface{}) error {
+	config, err := agentTLSConfig()
+	if err != nil {
+		return err
+	}
+	dialer := &net.Dialer{Timeout: agentCallTimeout}
+	var conn net.Conn
+	if config != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, config)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(agentCallTimeout))
+	return jsonrpc.NewClient(conn).Call(method, args, reply)
+}
+
+// 在agent上执行php任务
+type remoteExec struct{}
+
+func (remoteExec) Pick(placement *api.Placement) (string, error) {
+	// 没有注册agent且没有运行位置限制时在本机执行，兼容单机部署
+	if agents.Len() == 0 && placement == nil {
+		return "", nil
+	}
+	info, err := agents.Pick(placement)
+	if err != nil {
+		// 没有运行位置限制的job在agent都满时回到本机执行
+		if placement == nil {
+			return "", nil
+		}
+		return "", err
+	}
+	return info.Name, nil
+}
+
+func (remoteExec) Run(name string, req *api.RunRequest, loger handle.Loger, done func(success bool)) error {
+	info := agents.Get(name)
+	if info == nil {
+		agents.Cancel(name)
+		return errors.New("agent " + name + " is lost")
+	}
+	req.Token = info.Token
+	req.Node = nodeName()
+	// 先记录实例，agent可能在返回前就发回输出
+	remoteRuns.Lock()
+	remoteRuns.runs[req.ObjectId] = &remoteRun{req.JobName, name, loger, done}
+	remoteRuns.Unlock()
+	// agent在Pick之后失联时不会出现在失联列表中，直接记录为丢失并释放并发数
+	if !agents.Attach(name, req.ObjectId) {
+		finishRemoteRun(req.ObjectId, api.ResultLost, "agent "+name+" lost before run")
+		return nil
+	}
+
+	var pid int
+	err := callAgent(info.Addr, "Agent.Run", req, &pid)
+	if err != nil {
+		// 结果已经发回时不再处理
+		if takeRemoteRun(req.ObjectId) == nil {
+			return nil
+		}
+		agents.Done(name, req.ObjectId)
+		return fmt.Errorf("agent %s: %s", name, err)
+	}
+	loger.Update(map[string]interface{}{"pid": pid})
+	return nil
+}
+
+func (remoteExec) Kill(name, objectId string) error {
+	info := agents.Get(name)
+	if info == nil {
+		return errors.New("agent " + name + " is lost")
+	}
+	var reply int
+	return callAgent(info.Addr, "Agent.Kill", &api.KillRequest{Token: info.Token, ObjectId: objectId}, &reply)
+}
+
+/**
+ * 定期检查agent心跳，失联agent上的实例标记为丢失
+ */
+func agentMonitor() {
+	ticker := time.NewTicker(agentTimeout / 3)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		for name, runs := range agents.Expire(now) {
+			log.Printf("Agent %s lost, %d runs lost\n", name, len(runs))
+			for _, objectId := range runs {
+				finishRemoteRun(objectId, api.ResultLost, "agent "+name+" lost")
+			}
+		}
+	}
+}
+
+// agent接口需要agent用户或管理员权限
+func (t *Calculator) checkAgent() error {
+	if !t.session.login {
+		return ErrUnauthenticated
+	}
+	if !t.session.Admin && !t.session.Agent {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+/**
+ * jsonrpc接口，agent注册和心跳，返回调度节点名称
+ */
+func (t *Calculator) RegisterAgent(info *api.AgentInfo, reply *string) error {
+	if err := t.checkAgent(); err != nil {
+		return err
+	}
+	if info.Name == "" || info.Addr == "" || info.Token == "" {
+		return errors.New("Name, Addr and Token must not be empty")
+	}
+	if info.Capacity < 1 {
+		return errors.New("Capacity must greater than zero")
+	}
+	if agents.Get(info.Name) == nil {
+		log.Printf("Agent %s registered, addr : %s, capacity : %d, labels : %v\n", info.Name, info.Addr, info.Capacity, info.Labels)
+	}
+	for _, objectId := range agents.Register(info, time.Now()) {
+		finishRemoteRun(objectId, api.ResultLost, "agent "+info.Name+" restarted")
+	}
+	*reply = nodeName()
+	return nil
+}
+
+/**
+ * jsonrpc接口，agent发回实例输出
+ */
+func (t *Calculator) AgentOutput(output *api.AgentOutput, reply *int) error {
+	if err := t.checkAgent(); err != nil {
+		return err
+	}
+	run := getRemoteRun(output.Agent, output.ObjectId)
+	if run == nil {
+		return unknownRun(output.ObjectId)
+	}
+	if output.FromType == 1 {
+		run.loger.NewErrPipe().Write([]byte(output.Content))
+	} else {
+		run.loger.NewLogPipe().Write([]byte(output.Content))
+	}
+	return nil
+}
+
+/**
+ * jsonrpc接口，agent发回实例运行结果
+ */
+func (t *Calculator) AgentExit(exit *api.AgentExit, reply *int) error {
+	if err := t.checkAgent(); err != nil {
+		return err
+	}
+	if getRemoteRun(exit.Agent, exit.ObjectId) == nil {
+		return unknownRun(exit.ObjectId)
+	}
+	result := handle.ResultSuccess
+	if !exit.Success {
+		result = handle.ResultFailed
+	}
+	finishRemoteRun(exit.ObjectId, result, exit.Error)
+	return nil
+}
+
+/**
+ * jsonrpc接口，获取已注册的agent
+ */
+func (t *Calculator) GetAgents(flag bool, reply *[]*api.AgentInfo) error {
+	*reply = []*api.AgentInfo{}
+	if !t.session.login {
+		return ErrUnauthenticated
+	}
+	*reply = agents.List()
+	return nil
+}
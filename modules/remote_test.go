@@ -0,0 +1,55 @@
+package main
+
+import (
+	"jcron/modules/agent"
+	"jcron/modules/api"
+	"jcron/modules/cron"
+	"jcron/modules/handle"
+	"testing"
+	"time"
+)
+
+// 测试没有运行位置限制的job在agent都满时回到本机执行，限制运行位置的job跳过
+func TestRemoteExecPick(t *testing.T) {
+	defer func(registry *agent.Registry) { agents = registry }(agents)
+	agents = &agent.Registry{Timeout: agentTimeout}
+	exec := remoteExec{}
+
+	if name, err := exec.Pick(nil); err != nil || name != "" {
+		t.Fatalf("no agent should run locally, got %q %v", name, err)
+	}
+	agents.Register(&api.AgentInfo{Name: "agent1", Addr: "agent1:7001", Capacity: 1, Token: "t1"}, time.Now())
+	if name, err := exec.Pick(nil); err != nil || name != "agent1" {
+		t.Fatalf("free agent should be picked, got %q %v", name, err)
+	}
+	if name, err := exec.Pick(nil); err != nil || name != "" {
+		t.Errorf("full agents should fall back to local, got %q %v", name, err)
+	}
+	if _, err := exec.Pick(&api.Placement{Hosts: []string{"agent1"}}); err != agent.ErrNoAgent {
+		t.Errorf("placed job should be skipped when agents are full, got %v", err)
+	}
+}
+
+// 测试agent接口允许agent用户和管理员调用，agent用户没有job的权限
+func TestCheckAgent(t *testing.T) {
+	stubApiUsers(t, []handle.ApiUser{{Name: "root", Token: "root-token", Admin: true}})
+	stubJobs(t, &cron.JobCollection{Name: "php1", AddPerson: "alice"})
+	s := newSession("test")
+	s.bind(&handle.ApiUser{Name: "worker", Agent: true})
+	worker := &Calculator{s}
+	if err := worker.checkAgent(); err != nil {
+		t.Errorf("agent user should call agent apis, got %v", err)
+	}
+	if err := worker.session.Check("php1", permView); err != ErrPermissionDenied {
+		t.Errorf("agent user should not view jobs, got %v", err)
+	}
+	if err := loginAs("root", true).checkAgent(); err != nil {
+		t.Errorf("admin should call agent apis, got %v", err)
+	}
+	if err := loginAs("alice", false).checkAgent(); err != ErrPermissionDenied {
+		t.Errorf("normal user should be denied, got %v", err)
+	}
+	if err := (&Calculator{newSession("test")}).checkAgent(); err != ErrUnauthenticated {
+		t.Errorf("anonymous should be unauthenticated, got %v", err)
+	}
+}
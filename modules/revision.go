@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"jcron/modules/api"
+	"jcron/modules/cron"
+	"jcron/modules/handle"
+	"log"
+	"reflect"
+	"strconv"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// 版本号冲突时重新读取最新版本号的最大次数
+const maxRevisionRetry = 5
+
+/**
+ * 获取job的最新版本，没有版本时返回nil
+ */
+var latestRevision = func(name string) (*api.JobRevision, error) {
+	revision := &api.JobRevision{}
+	find := func(c *mgo.Collection) error {
+		return c.Find(bson.M{"name": name}).Sort("-version").One(revision)
+	}
+	err := handle.WitchCollection(handle.Config().JobDb, handle.Config().JobRevisionCollection, find)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return revision, nil
+}
+
+/**
+ * 保存job配置版本，修改前的配置和最新版本不一致时（如网站、数据库直接修改的），先把修改前的配置保存为import版本
+ * 同时修改导致版本号冲突时重新读取最新版本号
+ */
+func saveRevision(action, user string, old, jobData *cron.JobCollection) error {
+	for retry := 0; ; retry++ {
+		latest, err := latestRevision(jobData.Name)
+		if err != nil {
+			return err
+		}
+		version := 0
+		if latest != nil {
+			version = latest.Version
+		}
+		revisions := []interface{}{}
+		if old != nil && (latest == nil || !sameRevision(&latest.Job, old)) {
+			version++
+			//接口之外的修改不知道修改人
+			revisions = append(revisions, &api.JobRevision{Name: old.Name, Version: version, Action: "import", Job: *old, Time: time.Now()})
+		}
+		version++
+		revisions = append(revisions, &api.JobRevision{Name: jobData.Name, Version: version, Action: action, Job: *jobData, User: user, Time: time.Now()})
+		err = insertRevisions(revisions...)
+		if mgo.IsDup(err) && retry < maxRevisionRetry {
+			continue
+		}
+		return err
+	}
+}
+
+// 两个版本的配置是否一致，运行状态由启动、停止修改，不算配置修改
+func sameRevision(a, b *cron.JobCollection) bool {
+	for _, diff := range diffJob(a, b) {
+		if diff.Field != "Status" {
+			return false
+		}
+	}
+	return true
+}
+
+// 写入job配置版本，同一个job的版本号不能重复
+var insertRevisions = func(revisions ...interface{}) error {
+	insert := func(c *mgo.Collection) error {
+		index := mgo.Index{Key: []string{"name", "version"}, Unique: true}
+		if err := c.EnsureIndex(index); err != nil {
+			log.Printf("EnsureIndex %s error: %s\n", handle.Config().JobRevisionCollection, err)
+		}
+		return c.Insert(revisions...)
+	}
+	return handle.WitchCollection(handle.Config().JobDb, handle.Config().JobRevisionCollection, insert)
+}
+
+/**
+ * 获取指定版本的job配置，版本号为0时返回当前配置
+ */
+func findRevision(name string, version int) (*cron.JobCollection, error) {
+	if version == 0 {
+		return findJob(name)
+	}
+	revision := api.JobRevision{}
+	find := func(c *mgo.Collection) error {
+		return c.Find(bson.M{"name": name, "version": version}).One(&revision)
+	}
+	err := handle.WitchCollection(handle.Config().JobDb, handle.Config().JobRevisionCollection, find)
+	if err != nil {
+		return nil, errors.New("revision " + strconv.Itoa(version) + " not exist")
+	}
+	return &revision.Job, nil
+}
+
+/**
+ * 逐个字段对比两个job配置
+ */
+func diffJob(from, to *cron.JobCollection) []*api.FieldDiff {
+	diffs := []*api.FieldDiff{}
+	fromValue := reflect.ValueOf(from).Elem()
+	toValue := reflect.ValueOf(to).Elem()
+	for i := 0; i < fromValue.NumField(); i++ {
+		a := fromValue.Field(i).Interface()
+		b := toValue.Field(i).Interface()
+		if !reflect.DeepEqual(a, b) {
+			diffs = append(diffs, &api.FieldDiff{Field: fromValue.Type().Field(i).Name, From: a, To: b})
+		}
+	}
+	return diffs
+}
+
+/**
+ * jsonrpc接口，获取job的版本列表，按版本号倒序
+ */
+func (t *Calculator) GetJobRevision(name string, reply *[]*api.JobRevision) error {
+	*reply = []*api.JobRevision{}
+	if err := t.session.Check(name, permView); err != nil {
+		return err
+	}
+	find := func(c *mgo.Collection) error {
+		return c.Find(bson.M{"name": name}).Sort("-version").All(reply)
+	}
+	return handle.WitchCollection(handle.Config().JobDb, handle.Config().JobRevisionCollection, find)
+}
+
+/**
+ * jsonrpc接口，对比两个版本的差异
+ */
+func (t *Calculator) DiffJobRevision(args *api.RevisionDiffArgs, reply *[]*api.FieldDiff) error {
+	*reply = []*api.FieldDiff{}
+	if err := t.session.Check(args.Name, permView); err != nil {
+		return err
+	}
+	from, err := findRevision(args.Name, args.From)
+	if err != nil {
+		return err
+	}
+	to, err := findRevision(args.Name, args.To)
+	if err != nil {
+		return err
+	}
+	*reply = diffJob(from, to)
+	return nil
+}
+
+/**
+ * jsonrpc接口，回滚到指定版本，正在调度的job立即生效
+ */
+func (t *Calculator) RollbackJob(args *api.RollbackArgs, reply *int) (err error) {
+	log.Printf("RollbackJob Name : %s, Version : %d\n", args.Name, args.Version)
+	*reply = -1
+	var old *cron.JobCollection
+	var newData cron.JobCollection
+	defer func() {
+		operate := &api.OperateLog{Method: "RollbackJob", JobName: args.Name, Params: args}
+		if old != nil {
+			operate.Before = old
+			operate.After = &newData
+		}
+		t.session.audit(operate, err)
+	}()
+	if err = t.session.Check(args.Name, permEdit); err != nil {
+		return err
+	}
+	if args.Version < 1 {
+		return errors.New("Version must greater than zero")
+	}
+	jobStateLock.Lock()
+	defer jobStateLock.Unlock()
+	current, err := findJob(args.Name)
+	if err != nil {
+		return errors.New("job not exist")
+	}
+	if err = checkEditable(current); err != nil {
+		return err
+	}
+	revision, err := findRevision(args.Name, args.Version)
+	if err != nil {
+		return err
+	}
+	err = validateJob(revision)
+	if err != nil {
+		return err
+	}
+
+	//运行状态、添加信息和编辑人保持不变，操作人记录在版本和操作日志中
+	newData = *revision
+	newData.Status = current.Status
+	newData.Source = current.Source
+	newData.AddPerson = current.AddPerson
+	newData.AddTime = current.AddTime
+	newData.EditPerson = current.EditPerson
+	newData.EditTime = strconv.FormatInt(time.Now().Unix(), 10)
+	err = saveJob(current, &newData)
+	if err != nil {
+		return err
+	}
+	old = current
+	if err = saveRevision("rollback", t.session.User, old, &newData); err != nil {
+		return revisionError(err)
+	}
+	*reply = 0
+	return nil
+}
+
+// 配置已保存、版本写入失败时返回的错误
+func revisionError(err error) error {
+	return errors.New("job is saved, but save revision error: " + err.Error())
+}
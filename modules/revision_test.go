@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"jcron/modules/api"
+	"jcron/modules/cron"
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2"
+)
+
+func TestDiffJob(t *testing.T) {
+	from := &cron.JobCollection{Name: "php1", Cron: "0 * * * * *", Channel: 1, Content: []string{"a.php"}, Labels: map[string]string{"zone": "a"}}
+	to := &cron.JobCollection{Name: "php1", Cron: "0 0 * * * *", Channel: 1, Content: []string{"a.php", "x"}, Labels: map[string]string{"zone": "a"}}
+	diffs := diffJob(from, to)
+	expected := []*api.FieldDiff{
+		{Field: "Cron", From: "0 * * * * *", To: "0 0 * * * *"},
+		{Field: "Content", From: []string{"a.php"}, To: []string{"a.php", "x"}},
+	}
+	if !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("unexpected diff %v", diffs)
+	}
+	if diffs := diffJob(from, from); len(diffs) != 0 {
+		t.Errorf("expected no diff, got %v", diffs)
+	}
+}
+
+func TestSaveRevision(t *testing.T) {
+	stubJobWrites(t)
+	var latest *api.JobRevision
+	latestRevision = func(name string) (*api.JobRevision, error) {
+		return latest, nil
+	}
+	var inserted []*api.JobRevision
+	dups := 0
+	insertRevisions = func(revisions ...interface{}) error {
+		if dups > 0 {
+			dups--
+			latest.Version++
+			return &mgo.LastError{Code: 11000}
+		}
+		inserted = inserted[:0]
+		for _, revision := range revisions {
+			inserted = append(inserted, revision.(*api.JobRevision))
+		}
+		return nil
+	}
+	actions := func() []string {
+		list := []string{}
+		for _, revision := range inserted {
+			list = append(list, revision.Action+":"+revision.User)
+		}
+		return list
+	}
+	old := &cron.JobCollection{Name: "php1", Cron: "0 * * * * *", Status: cron.StatusRunning}
+	edited := &cron.JobCollection{Name: "php1", Cron: "0 0 * * * *", Status: cron.StatusRunning}
+
+	// 没有版本时先导入修改前的配置
+	if err := saveRevision("update", "alice", old, edited); err != nil {
+		t.Fatal(err)
+	}
+	if a := actions(); !reflect.DeepEqual(a, []string{"import:", "update:alice"}) || inserted[0].Version != 1 || inserted[1].Version != 2 {
+		t.Errorf("unexpected revisions %v", a)
+	}
+
+	// 和最新版本一致时不导入，只有运行状态不同也算一致
+	latest = &api.JobRevision{Name: "php1", Version: 2, Job: *old}
+	latest.Job.Status = cron.StatusStopped
+	if err := saveRevision("update", "alice", old, edited); err != nil {
+		t.Fatal(err)
+	}
+	if a := actions(); !reflect.DeepEqual(a, []string{"update:alice"}) || inserted[0].Version != 3 {
+		t.Errorf("unexpected revisions %v", a)
+	}
+
+	// 接口之外修改过的配置先导入
+	latest = &api.JobRevision{Name: "php1", Version: 3, Job: *edited}
+	if err := saveRevision("rollback", "bob", old, edited); err != nil {
+		t.Fatal(err)
+	}
+	if a := actions(); !reflect.DeepEqual(a, []string{"import:", "rollback:bob"}) || inserted[0].Version != 4 {
+		t.Errorf("unexpected revisions %v", a)
+	}
+
+	// 版本号冲突时重新读取最新版本
+	latest = &api.JobRevision{Name: "php1", Version: 5, Job: *old}
+	dups = 2
+	if err := saveRevision("update", "alice", old, edited); err != nil {
+		t.Fatal(err)
+	}
+	if a := actions(); !reflect.DeepEqual(a, []string{"update:alice"}) || inserted[0].Version != 8 {
+		t.Errorf("unexpected revisions %v version %d", a, inserted[0].Version)
+	}
+
+	// 一直冲突或其他错误返回给调用方
+	dups = maxRevisionRetry + 1
+	if err := saveRevision("update", "alice", old, edited); !mgo.IsDup(err) {
+		t.Errorf("expected duplicate key error, got %v", err)
+	}
+	dups = 0
+	insertRevisions = func(revisions ...interface{}) error {
+		return errors.New("no reachable servers")
+	}
+	if err := saveRevision("update", "alice", old, edited); err == nil {
+		t.Error("expected insert error")
+	}
+}
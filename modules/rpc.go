@@ -1,54 +1,58 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"jcron/modules/api"
 	"jcron/modules/cron"
 	"jcron/modules/handle"
-	"jcron/modules/job/cmd"
-	"jcron/modules/job/web"
 
 	"errors"
+	"fmt"
 	"log"
 	"net"
 	"net/rpc"
 	"net/rpc/jsonrpc"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
-//jsonrpc对象
-type Calculator struct{}
+//jsonrpc对象，每个连接一个，绑定连接的会话
+type Calculator struct {
+	session *Session
+}
 
 func add(name string) error {
+	if err := checkLeader(); err != nil {
+		return err
+	}
+	jobStateLock.Lock()
+	defer jobStateLock.Unlock()
 	jobData := &cron.JobCollection{}
 	find := func(c *mgo.Collection) error {
 		return c.Find(bson.M{"name": name, "status": 0}).One(jobData)
 	}
-	err := handle.WitchCollection(handle.Conf.JobDb, handle.Conf.JobCollection, find)
+	err := handle.WitchCollection(handle.Config().JobDb, handle.Config().JobCollection, find)
 	if err == nil {
-		var jobObj cron.Job
-		objHandle := handle.NewMongoC(jobData.Name)
-		if jobData.ExecType == "php" {
-			jobObj, err = cmd.NewPHPJob(cmd.DefaultPHP(jobData.ExecEnv), objHandle, jobData.Channel, jobData.Content...)
-			if err != nil {
-				return err
-			}
-		} else if jobData.ExecType == "http" {
-			jobObj, err = web.NewWebJob(objHandle, jobData.Channel, jobData.Content[0])
-			if err != nil {
-				return err
-			}
-		} else {
-			return errors.New("job not support")
+		jobObj, err := newJob(jobData)
+		if err != nil {
+			return err
 		}
 		ret, err := c.AddJob(jobData.Name, jobData.Desc, jobData.Cron, jobObj)
 		if err == nil {
 			if ret == 0 {
 				update := func(c *mgo.Collection) error {
-					return c.Update(bson.M{"name": jobData.Name}, bson.M{"$set": bson.M{"status": 1}})
+					set := bson.M{"status": 1}
+					err := c.Update(fence(bson.M{"name": jobData.Name}, set), bson.M{"$set": set})
+					return fenceError(c, bson.M{"name": jobData.Name}, err)
 				}
-				err = handle.WitchCollection(handle.Conf.JobDb, handle.Conf.JobCollection, update)
+				err = handle.WitchCollection(handle.Config().JobDb, handle.Config().JobCollection, update)
 				if err != nil {
 					return err
 				}
@@ -60,13 +64,38 @@ func add(name string) error {
 	}
 }
 
+/**
+ * jsonrpc接口，登录，开启认证时其他接口需要先登录
+ */
+func (t *Calculator) Login(args *api.LoginArgs, reply *api.Session) error {
+	err := t.session.Login(args)
+	if err != nil {
+		log.Printf("Login failed User : %s, Addr : %s\n", args.User, t.session.Addr)
+		return err
+	}
+	*reply = t.session.Session
+	return nil
+}
+
 /**
  * 手动运行一次正在调度的任务
  */
-func (t *Calculator) RunOnceJob(testJob *cron.TestJob, reply *int) error {
+func (t *Calculator) RunOnceJob(testJob *cron.TestJob, reply *int) (err error) {
+	defer func() {
+		t.session.audit(&api.OperateLog{Method: "RunOnceJob", JobName: testJob.Name, Params: testJob.Param}, err)
+	}()
+	if err = t.session.Check(testJob.Name, permEdit); err != nil {
+		*reply = -1
+		return err
+	}
+	//备用节点不运行任务
+	if err = checkLeader(); err != nil {
+		*reply = -1
+		return err
+	}
 	for _, entry := range c.Entries() {
 		if testJob.Name == entry.Name {
-			entry.Job.Run(testJob.Param)
+			entry.Job.RunOnce(testJob.Param)
 			*reply = 0
 			return nil
 		}
@@ -78,10 +107,17 @@ func (t *Calculator) RunOnceJob(testJob *cron.TestJob, reply *int) error {
 /**
  * jsonrpc接口，启动job
  */
-func (t *Calculator) StartJob(name string, reply *int) error {
+func (t *Calculator) StartJob(name string, reply *int) (err error) {
 	log.Printf("StartJob Name : %s\n", name)
+	defer func() {
+		t.session.audit(&api.OperateLog{Method: "StartJob", JobName: name}, err)
+	}()
+	if err = t.session.Check(name, permEdit); err != nil {
+		*reply = -1
+		return err
+	}
 
-	err := add(name)
+	err = add(name)
 	if err != nil {
 		*reply = -1
 		return err
@@ -92,29 +128,119 @@ func (t *Calculator) StartJob(name string, reply *int) error {
 }
 
 /**
- * jsonrpc接口，停止job
+ * jsonrpc接口，停止job，正在运行的实例继续运行
  */
-func (t *Calculator) StopJob(name string, reply *int) error {
+func (t *Calculator) StopJob(name string, reply *int) (err error) {
 	log.Printf("StopJob Name : %s\n", name)
-	c.RemoveFunc(name)
-	//更新运行状态
-	// 获取正在正常进行调度的任务
-	jobData := cron.JobCollection{}
-	find := func(c *mgo.Collection) error {
-		return c.Find(bson.M{"name": name, "status": 1}).One(&jobData)
+	defer func() {
+		t.session.audit(&api.OperateLog{Method: "StopJob", JobName: name}, err)
+	}()
+	if err = t.session.Check(name, permEdit); err != nil {
+		*reply = -1
+		return err
 	}
-	err := handle.WitchCollection(handle.Conf.JobDb, handle.Conf.JobCollection, find)
-	if err == nil {
-		update := func(c *mgo.Collection) error {
-			return c.Update(bson.M{"name": name}, bson.M{"$set": bson.M{"status": 0}})
-		}
-		handle.WitchCollection(handle.Conf.JobDb, handle.Conf.JobCollection, update)
-		*reply = 0
-		return nil
-	} else {
+	if err = stopJob(name, api.StopDetach, 0); err != nil {
 		*reply = -1
-		return errors.New("job not exist, or job is stoped")
+		return err
+	}
+	*reply = 0
+	return nil
+}
+
+/**
+ * jsonrpc接口，停止job并指定正在运行实例的处理方式
+ */
+func (t *Calculator) StopJobWithMode(args *api.StopJobArgs, reply *int) (err error) {
+	log.Printf("StopJobWithMode Name : %s, Mode : %s\n", args.Name, args.Mode)
+	defer func() {
+		t.session.audit(&api.OperateLog{Method: "StopJobWithMode", JobName: args.Name, Params: args}, err)
+	}()
+	*reply = -1
+	if err = t.session.Check(args.Name, permEdit); err != nil {
+		return err
+	}
+	mode := args.Mode
+	if mode == "" {
+		mode = api.StopDetach
+	}
+	if mode != api.StopDetach && mode != api.StopDrain && mode != api.StopKill {
+		return errors.New("Mode must be detach, drain or kill")
+	}
+	if args.Timeout < 0 {
+		return errors.New("Timeout must not be negative")
+	}
+	timeout := time.Duration(args.Timeout) * time.Second
+	if timeout == 0 {
+		timeout = defaultDrainTimeout
+	}
+	if err = stopJob(args.Name, mode, timeout); err != nil {
+		return err
+	}
+	*reply = 0
+	return nil
+}
+
+// drain默认等待时间
+const defaultDrainTimeout = time.Minute
+
+/**
+ * 停止调度并把状态改为停止，暂停的job也可以停止，按mode处理正在运行的实例，实例列表在全部结束前仍可查看和杀死
+ */
+func stopJob(name, mode string, timeout time.Duration) error {
+	if err := checkLeader(); err != nil {
+		return err
+	}
+	job, err := unschedule(name)
+	if err != nil || job == nil {
+		return err
+	}
+
+	switch mode {
+	case api.StopKill:
+		// 复制一份，杀死实例时会修改列表
+		runs := append([]*cron.RunInfo{}, job.List()...)
+		for _, run := range runs {
+			if err := job.Kill(run.ObjectId); err != nil {
+				log.Printf("StopJob kill %s error: %s\n", run.ObjectId, err)
+			}
+		}
+	case api.StopDrain:
+		deadline := time.Now().Add(timeout)
+		for len(job.List()) > 0 {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("job is stopped, but %d instances are still running after %s", len(job.List()), timeout)
+			}
+			time.Sleep(500 * time.Millisecond)
+		}
+	}
+	return nil
+}
+
+// 把运行中或暂停的job状态改为停止，没有时返回mgo.ErrNotFound，其他节点已成为领导者并修改过时返回lease.ErrFenced
+var setStopped = func(name string) error {
+	update := func(c *mgo.Collection) error {
+		set := bson.M{"status": cron.StatusStopped}
+		err := c.Update(fence(bson.M{"name": name, "status": bson.M{"$in": []int{cron.StatusRunning, cron.StatusPaused}}}, set), bson.M{"$set": set})
+		return fenceError(c, bson.M{"name": name}, err)
+	}
+	return handle.WitchCollection(handle.Config().JobDb, handle.Config().JobCollection, update)
+}
+
+// 停止调度并把状态改为停止，返回停止前的job对象，没有在调度时为nil
+func unschedule(name string) (cron.Job, error) {
+	jobStateLock.Lock()
+	defer jobStateLock.Unlock()
+	//先更新运行状态，写入失败时继续调度
+	err := setStopped(name)
+	if err == mgo.ErrNotFound {
+		return nil, errors.New("job not exist, or job is stoped")
+	}
+	if err != nil {
+		return nil, err
 	}
+	job := c.Lookup(name)
+	c.RemoveFunc(name)
+	return job, nil
 }
 
 /**
@@ -124,15 +250,14 @@ func (t *Calculator) GetJobInstance(name string, reply *[]*cron.RunInfo) error {
 	log.Printf("GetJobInstance name : %s\n", name)
 	//*reply要赋值，不然接收端会产生invalid error <nil>
 	*reply = []*cron.RunInfo{}
-	entries := c.Entries()
-	if len(entries) > 0 {
-		for _, entry := range entries {
-			if entry.Name == name {
-				*reply = entry.Job.List()
-				for _, runInfo := range *reply {
-					log.Printf("ObjectId : %s, Date : %s\n", runInfo.ObjectId, runInfo.Date)
-				}
-			}
+	if err := t.session.Check(name, permView); err != nil {
+		return err
+	}
+	// 已停止的job在实例全部结束前仍可查看
+	if job := c.Lookup(name); job != nil {
+		*reply = job.List()
+		for _, runInfo := range *reply {
+			log.Printf("ObjectId : %s, Date : %s\n", runInfo.ObjectId, runInfo.Date)
 		}
 	}
 	return nil
@@ -141,55 +266,458 @@ func (t *Calculator) GetJobInstance(name string, reply *[]*cron.RunInfo) error {
 /**
  * jsonrpc接口，杀死job实例
  */
-func (t *Calculator) KillJobInstance(jobInstance *cron.JobInstance, reply *int) error {
+func (t *Calculator) KillJobInstance(jobInstance *cron.JobInstance, reply *int) (err error) {
 	log.Printf("KillJobInstance name : %s, objectid : %s\n", jobInstance.JobName, jobInstance.ObjectId)
-	entries := c.Entries()
-	for _, entry := range entries {
-		if entry.Name == jobInstance.JobName {
-			err := entry.Job.Kill(jobInstance.ObjectId)
-			if err != nil {
-				*reply = -1
-				return err
-			} else {
-				*reply = 0
-			}
+	defer func() {
+		t.session.audit(&api.OperateLog{Method: "KillJobInstance", JobName: jobInstance.JobName, ObjectId: jobInstance.ObjectId}, err)
+	}()
+	if err = t.session.Check(jobInstance.JobName, permEdit); err != nil {
+		*reply = -1
+		return err
+	}
+	// 已停止的job在实例全部结束前仍可杀死
+	if job := c.Lookup(jobInstance.JobName); job != nil {
+		err = job.Kill(jobInstance.ObjectId)
+		if err != nil {
+			*reply = -1
 			return err
+		} else {
+			*reply = 0
 		}
+		return err
 	}
 	return nil
 }
 
+/**
+ * jsonrpc接口，获取job列表，只返回有查看权限的job
+ */
 func (t *Calculator) GetJobList(flag bool, reply *[]*cron.JobList) error {
 	*reply = []*cron.JobList{}
+	if !t.session.login {
+		return ErrUnauthenticated
+	}
+	allow := map[string]bool{}
+	if !t.session.Admin {
+		jobList, err := t.session.viewableJobs()
+		if err != nil {
+			return err
+		}
+		for _, jobData := range jobList {
+			allow[jobData.Name] = true
+		}
+	}
 	for _, entry := range c.Entries() {
-		*reply = append(*reply, &cron.JobList{entry.Name, entry.Job.List()})
+		if !t.session.Admin && !allow[entry.Name] {
+			continue
+		}
+		*reply = append(*reply, &cron.JobList{
+			Name:        entry.Name,
+			RunInstance: entry.Job.List(),
+			Cron:        entry.Cron,
+			Next:        entry.Next,
+			Prev:        entry.Prev,
+			Paused:      entry.Paused,
+		})
+	}
+	return nil
+}
+
+/**
+ * jsonrpc接口，获取所有有查看权限的job配置，包括未运行的job，category不为空时按类别过滤
+ */
+func (t *Calculator) GetJobs(category string, reply *[]*cron.JobCollection) error {
+	*reply = []*cron.JobCollection{}
+	jobList, err := t.session.viewableJobs()
+	if err != nil {
+		return err
+	}
+	for _, jobData := range jobList {
+		if category == "" || jobData.Category == category {
+			*reply = append(*reply, jobData)
+		}
+	}
+	return nil
+}
+
+/**
+ * jsonrpc接口，获取job配置
+ */
+func (t *Calculator) GetJob(name string, reply *cron.JobCollection) error {
+	if err := t.session.Check(name, permView); err != nil {
+		return err
+	}
+	jobData, err := findJob(name)
+	if err != nil {
+		return errors.New("job not exist")
 	}
+	*reply = *jobData
 	return nil
 }
 
+/**
+ * jsonrpc接口，校验cron表达式，返回之后的执行时间
+ */
+func (t *Calculator) ParseCron(args *api.CronArgs, reply *[]time.Time) error {
+	*reply = []time.Time{}
+	schedule, err := cron.Parse(args.Cron)
+	if err != nil {
+		return err
+	}
+	count := args.Count
+	if count <= 0 || count > 100 {
+		count = 5
+	}
+	next := time.Now()
+	for i := 0; i < count; i++ {
+		next = schedule.Next(next)
+		if next.IsZero() {
+			break
+		}
+		*reply = append(*reply, next)
+	}
+	return nil
+}
+
+/**
+ * jsonrpc接口，新建job，Status为1时创建后立即启动
+ */
+func (t *Calculator) CreateJob(jobData *cron.JobCollection, reply *int) (err error) {
+	log.Printf("CreateJob Name : %s\n", jobData.Name)
+	*reply = -1
+	var newData cron.JobCollection
+	defer func() {
+		operate := &api.OperateLog{Method: "CreateJob", JobName: jobData.Name, Params: jobData}
+		if err == nil {
+			operate.After = &newData
+		}
+		t.session.audit(operate, err)
+	}()
+	if !t.session.login {
+		return ErrUnauthenticated
+	}
+	//执行环境和内容决定运行的程序，只有管理员可以创建
+	if !t.session.Admin {
+		return ErrPermissionDenied
+	}
+	err = validateJob(jobData)
+	if err != nil {
+		return err
+	}
+	//创建后启动的只能由领导者创建，避免创建后启动失败
+	if jobData.Status == cron.StatusRunning {
+		if err = checkLeader(); err != nil {
+			return err
+		}
+	}
+	count := 0
+	find := func(c *mgo.Collection) error {
+		count, err = c.Find(bson.M{"name": jobData.Name}).Count()
+		return err
+	}
+	err = handle.WitchCollection(handle.Config().JobDb, handle.Config().JobCollection, find)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errors.New("job name already exist")
+	}
+
+	newData = *jobData
+	if newData.AddPerson == "" {
+		newData.AddPerson = t.session.User
+	}
+	newData.AddTime = strconv.FormatInt(time.Now().Unix(), 10)
+	newData.EditPerson = ""
+	newData.EditTime = ""
+	newData.Status = 0
+	newData.Source = ""
+	insert := func(c *mgo.Collection) error {
+		return c.Insert(&newData)
+	}
+	err = handle.WitchCollection(handle.Config().JobDb, handle.Config().JobCollection, insert)
+	if err != nil {
+		return err
+	}
+	if err = saveRevision("create", t.session.User, nil, &newData); err != nil {
+		return revisionError(err)
+	}
+	if jobData.Status == 1 {
+		err = add(jobData.Name)
+		if err != nil {
+			return err
+		}
+	}
+	*reply = 0
+	return nil
+}
+
+/**
+ * jsonrpc接口，修改job，正在调度的job立即生效，正在运行的实例不受影响
+ */
+func (t *Calculator) UpdateJob(jobData *cron.JobCollection, reply *int) (err error) {
+	log.Printf("UpdateJob Name : %s\n", jobData.Name)
+	*reply = -1
+	var old *cron.JobCollection
+	var newData cron.JobCollection
+	defer func() {
+		operate := &api.OperateLog{Method: "UpdateJob", JobName: jobData.Name, Params: jobData}
+		if old != nil {
+			operate.Before = old
+			operate.After = &newData
+		}
+		t.session.audit(operate, err)
+	}()
+	if err = t.session.Check(jobData.Name, permEdit); err != nil {
+		return err
+	}
+	//和启动、停止、暂停互斥，避免修改期间状态变化
+	jobStateLock.Lock()
+	defer jobStateLock.Unlock()
+	old, err = findJob(jobData.Name)
+	if err != nil {
+		return errors.New("job not exist")
+	}
+	if err = checkEditable(old); err != nil {
+		return err
+	}
+	//执行环境决定运行的程序，只有管理员可以修改
+	if !t.session.Admin && jobData.ExecEnv != old.ExecEnv {
+		return ErrPermissionDenied
+	}
+	err = validateJob(jobData)
+	if err != nil {
+		return err
+	}
+
+	newData = *jobData
+	newData.Status = old.Status
+	newData.Source = old.Source
+	newData.AddTime = old.AddTime
+	//编辑人是有修改权限的人员列表，只有管理员可以修改，操作人记录在版本和操作日志中
+	if !t.session.Admin || newData.AddPerson == "" {
+		newData.AddPerson = old.AddPerson
+	}
+	if !t.session.Admin {
+		newData.EditPerson = old.EditPerson
+	}
+	newData.EditTime = strconv.FormatInt(time.Now().Unix(), 10)
+
+	err = saveJob(old, &newData)
+	if err != nil {
+		return err
+	}
+	if err = saveRevision("update", t.session.User, old, &newData); err != nil {
+		return revisionError(err)
+	}
+	*reply = 0
+	return nil
+}
+
+/**
+ * jsonrpc接口，删除job，正在调度的job需要先停止
+ */
+func (t *Calculator) DeleteJob(name string, reply *int) (err error) {
+	log.Printf("DeleteJob Name : %s\n", name)
+	*reply = -1
+	var old *cron.JobCollection
+	defer func() {
+		operate := &api.OperateLog{Method: "DeleteJob", JobName: name}
+		if old != nil {
+			operate.Before = old
+		}
+		t.session.audit(operate, err)
+	}()
+	if err = t.session.Check(name, permEdit); err != nil {
+		return err
+	}
+	jobStateLock.Lock()
+	defer jobStateLock.Unlock()
+	if findEntry(name) != nil {
+		return errors.New("job is running, stop it first")
+	}
+	old, _ = findJob(name)
+	if old != nil {
+		if err = checkEditable(old); err != nil {
+			return err
+		}
+	}
+	err = removeStoppedJob(name)
+	if err == mgo.ErrNotFound {
+		return errors.New("job not exist, or job is running")
+	}
+	if err != nil {
+		return err
+	}
+	if old != nil {
+		if err = saveRevision("delete", t.session.User, old, old); err != nil {
+			return revisionError(err)
+		}
+	}
+	*reply = 0
+	return nil
+}
+
+// 配置了证书时返回tls配置，否则返回nil
+func tlsConfig() (*tls.Config, error) {
+	if handle.Config().TlsCertFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(handle.Config().TlsCertFile, handle.Config().TlsKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if handle.Config().TlsClientCaFile != "" {
+		ca, err := ioutil.ReadFile(handle.Config().TlsClientCaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no certificate found in " + handle.Config().TlsClientCaFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// 创建监听，配置了证书时开启tls
+func newListener(port string) (net.Listener, error) {
+	config, err := tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	listener, err := listenTCP(port)
+	if err != nil || config == nil {
+		return listener, err
+	}
+	return tls.NewListener(listener, config), nil
+}
+
+// 客户端证书的CN和接口用户名一致时自动登录
+func certLogin(session *Session, state *tls.ConnectionState) {
+	if state != nil && len(state.PeerCertificates) > 0 && authEnabled() {
+		if user := findApiUser(state.PeerCertificates[0].Subject.CommonName); user != nil {
+			session.bind(user)
+		}
+	}
+}
+
+// 处理一个rpc连接
+// tls握手的超时，连接后不发送数据的客户端不能一直占用连接，测试时修改
+var handshakeTimeout = 10 * time.Second
+
+func serveConn(conn net.Conn) {
+	if !trackConn(conn) {
+		conn.Close()
+		return
+	}
+	defer untrackConn(conn)
+	session := newSession(conn.RemoteAddr().String())
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf("tls handshake error: %s\n", err)
+			conn.Close()
+			return
+		}
+		//握手期间开始平滑关闭时保留关闭设置的读取超时
+		rpcConns.Lock()
+		conn.SetWriteDeadline(time.Time{})
+		if !rpcConns.closing {
+			conn.SetReadDeadline(time.Time{})
+		}
+		rpcConns.Unlock()
+		state := tlsConn.ConnectionState()
+		certLogin(session, &state)
+	}
+	server := rpc.NewServer()
+	server.Register(&Calculator{session})
+	server.ServeCodec(jsonrpc.NewServerCodec(conn))
+}
+
+// 正在服务的rpc连接，平滑重启时关闭
+var rpcConns = struct {
+	sync.Mutex
+	conns   map[net.Conn]bool
+	closing bool // 开始关闭后不再接受新连接
+	wg      sync.WaitGroup
+}{conns: map[net.Conn]bool{}}
+
+// 记录正在服务的连接，平滑重启开始关闭连接后返回false
+func trackConn(conn net.Conn) bool {
+	rpcConns.Lock()
+	defer rpcConns.Unlock()
+	if rpcConns.closing {
+		return false
+	}
+	rpcConns.conns[conn] = true
+	rpcConns.wg.Add(1)
+	return true
+}
+
+func untrackConn(conn net.Conn) {
+	rpcConns.Lock()
+	delete(rpcConns.conns, conn)
+	rpcConns.Unlock()
+	rpcConns.wg.Done()
+}
+
+/**
+ * 平滑关闭rpc连接：不再读取新的请求，等待处理中的请求返回后由rpc服务关闭连接，超时后返回
+ */
+func closeRPCConns(timeout time.Duration) {
+	rpcConns.Lock()
+	rpcConns.closing = true
+	for conn := range rpcConns.conns {
+		//读取超时后ServeCodec等待处理中的请求返回，再关闭连接
+		conn.SetReadDeadline(time.Now())
+	}
+	rpcConns.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		rpcConns.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("Handover: rpc requests still running after %s\n", timeout)
+	}
+}
+
 // 注册RPC服务
 func registerRPC() {
-	cal := new(Calculator)
-	server := rpc.NewServer()
-	server.Register(cal)
-	server.HandleHTTP(rpc.DefaultRPCPath, rpc.DefaultDebugPath)
+	if !authEnabled() {
+		log.Printf("ApiUsers is empty, rpc authentication is disabled\n")
+	}
 
-	//启动tcp前先延时1s，防止旧程序关闭时端口没有及时释放
-	<-time.After(1 * time.Second)
+	//启动tcp前先延时1s，防止旧程序关闭时端口没有及时释放，继承监听时不需要
+	if !hasInherited(handle.Config().JsonRpcPort) {
+		<-time.After(1 * time.Second)
+	}
 	//启动tcp端口监控
-	listener, e := net.Listen("tcp", ":"+handle.Conf.JsonRpcPort)
+	listener, e := newListener(handle.Config().JsonRpcPort)
 	if e != nil {
-		log.Printf("listen error:", e)
+		log.Fatal("listen error:", e)
 	}
+	markReady()
 
 	for {
 		//log.Printf("start listen\n")
 		if conn, err := listener.Accept(); err != nil {
+			//监听已交给新进程，等待交接完成后退出
+			if atomic.LoadInt32(&handedOver) == 1 {
+				select {}
+			}
 			log.Printf("accept error: " + err.Error())
 		} else {
 			//log.Printf("new connection established\n")
 			//异步处理rpc请求
-			go server.ServeCodec(jsonrpc.NewServerCodec(conn))
+			go serveConn(conn)
 		}
 	}
 }
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"crypto/tls"
+	"jcron/modules/api"
+	"jcron/modules/cron"
+	"jcron/modules/handle"
+	"jcron/modules/job/cmd"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// 替换job修改、删除、版本和操作日志的写入，返回写入的操作日志
+func stubJobWrites(t *testing.T) (updates map[string]bson.M, removed *[]string, audits *[]*api.OperateLog) {
+	update, remove, latest, insert, operate := updateJob, removeStoppedJob, latestRevision, insertRevisions, insertOperateLog
+	t.Cleanup(func() {
+		updateJob, removeStoppedJob, latestRevision, insertRevisions, insertOperateLog = update, remove, latest, insert, operate
+	})
+	updates = map[string]bson.M{}
+	removed = &[]string{}
+	audits = &[]*api.OperateLog{}
+	updateJob = func(name string, fields bson.M) error {
+		updates[name] = fields
+		return nil
+	}
+	removeStoppedJob = func(name string) error {
+		if name == "running" {
+			return mgo.ErrNotFound
+		}
+		*removed = append(*removed, name)
+		return nil
+	}
+	latestRevision = func(name string) (*api.JobRevision, error) {
+		return nil, nil
+	}
+	insertRevisions = func(revisions ...interface{}) error {
+		return nil
+	}
+	insertOperateLog = func(operate *api.OperateLog) error {
+		*audits = append(*audits, operate)
+		return nil
+	}
+	return
+}
+
+// 登录指定用户的rpc对象
+func loginAs(user string, admin bool) *Calculator {
+	s := newSession("test")
+	s.bind(&handle.ApiUser{Name: user, Admin: admin})
+	return &Calculator{s}
+}
+
+// 测试只有管理员可以创建job
+func TestCreateJobPermission(t *testing.T) {
+	stubApiUsers(t, []handle.ApiUser{{Name: "root", Token: "root-token", Admin: true}})
+	_, _, audits := stubJobWrites(t)
+	jobData := &cron.JobCollection{Name: "php1", Cron: "0 * * * * *", Channel: 1, Content: []string{"-r", "system('id');"}, ExecType: "php", ExecEnv: `{"path" : "/", "ini" : "/", "pwd" : "/"}`}
+	tests := []struct {
+		desc string
+		calc *Calculator
+		err  error
+	}{
+		{"normal user", loginAs("alice", false), ErrPermissionDenied},
+		{"anonymous", &Calculator{newSession("test")}, ErrUnauthenticated},
+	}
+	for _, test := range tests {
+		var reply int
+		if err := test.calc.CreateJob(jobData, &reply); err != test.err || reply != -1 {
+			t.Errorf("%s: expected %v, got %v reply %d", test.desc, test.err, err, reply)
+		}
+	}
+	if len(*audits) != 2 {
+		t.Errorf("denied creations should be audited, got %v", *audits)
+	}
+}
+
+func TestUpdateJob(t *testing.T) {
+	env := `{"path" : "/", "ini" : "/", "pwd" : "/"}`
+	stored := &cron.JobCollection{Name: "php1", Cron: "0 * * * * *", Channel: 1, Content: []string{"/tmp/a.php"}, ExecType: "php", ExecEnv: env,
+		Status: cron.StatusPaused, AddPerson: "alice", AddTime: "1500000000", EditPerson: "bob,carol"}
+	stubJobs(t, stored, &cron.JobCollection{Name: "file1", AddPerson: "alice", Source: "file:jobs.yaml"})
+	updates, _, audits := stubJobWrites(t)
+
+	tests := []struct {
+		desc       string
+		calc       *Calculator
+		edit       cron.JobCollection
+		err        string
+		editPerson string
+		addPerson  string
+	}{
+		{"editor", loginAs("carol", false), cron.JobCollection{Name: "php1", Cron: "0 0 * * * *", Channel: 2, Content: []string{"/tmp/b.php"}, ExecType: "php", ExecEnv: env, Status: cron.StatusStopped, AddPerson: "carol", EditPerson: "carol"}, "", "bob,carol", "alice"},
+		{"admin", loginAs("root", true), cron.JobCollection{Name: "php1", Cron: "0 0 * * * *", Channel: 2, Content: []string{"/tmp/b.php"}, ExecType: "php", ExecEnv: env, AddPerson: "dave", EditPerson: "bob"}, "", "bob", "dave"},
+		{"viewer", loginAs("eve", false), cron.JobCollection{Name: "php1"}, "permission denied", "", ""},
+		{"editor changes env", loginAs("carol", false), cron.JobCollection{Name: "php1", Cron: "0 0 * * * *", Channel: 1, Content: []string{"/tmp/b.php"}, ExecType: "php", ExecEnv: `{"path" : "/bin/sh", "ini" : "/", "pwd" : "/"}`}, "permission denied", "", ""},
+		{"invalid", loginAs("root", true), cron.JobCollection{Name: "php1", Cron: "0 * * * * *", Channel: 0}, "Channel must greater than zero", "", ""},
+		{"file managed", loginAs("alice", false), cron.JobCollection{Name: "file1"}, "job is managed by jobs.yaml", "", ""},
+		{"not exist", loginAs("root", true), cron.JobCollection{Name: "missing"}, "job not exist", "", ""},
+	}
+	for _, test := range tests {
+		delete(updates, test.edit.Name)
+		*audits = (*audits)[:0]
+		var reply int
+		err := test.calc.UpdateJob(&test.edit, &reply)
+		if len(*audits) != 1 || (*audits)[0].User != test.calc.session.User {
+			t.Errorf("%s: expected one audit by %s, got %v", test.desc, test.calc.session.User, *audits)
+		}
+		if test.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) || reply != -1 {
+				t.Errorf("%s: expected %q, got %v reply %d", test.desc, test.err, err, reply)
+			}
+			if _, ok := updates[test.edit.Name]; ok {
+				t.Errorf("%s: job should not be written", test.desc)
+			}
+			continue
+		}
+		if err != nil || reply != 0 {
+			t.Errorf("%s: unexpected error %v reply %d", test.desc, err, reply)
+			continue
+		}
+		fields := updates["php1"]
+		if _, ok := fields["status"]; ok {
+			t.Errorf("%s: status should not be written", test.desc)
+		}
+		if fields["editperson"] != test.editPerson || fields["addperson"] != test.addPerson || fields["addtime"] != "1500000000" || fields["channel"] != 2 {
+			t.Errorf("%s: unexpected fields %v", test.desc, fields)
+		}
+	}
+}
+
+func TestDeleteJob(t *testing.T) {
+	stubJobs(t,
+		&cron.JobCollection{Name: "stopped", AddPerson: "alice"},
+		&cron.JobCollection{Name: "running", AddPerson: "alice", Status: cron.StatusRunning},
+		&cron.JobCollection{Name: "scheduled", AddPerson: "alice", Status: cron.StatusRunning},
+		&cron.JobCollection{Name: "file1", AddPerson: "alice", Source: "file:jobs.yaml"},
+	)
+	_, removed, audits := stubJobWrites(t)
+	c.AddFunc("scheduled", "", "0 0 * * * *", func() {})
+	defer c.RemoveFunc("scheduled")
+
+	tests := []struct {
+		desc string
+		calc *Calculator
+		name string
+		err  string
+	}{
+		{"viewer", loginAs("eve", false), "stopped", "permission denied"},
+		{"scheduled", loginAs("alice", false), "scheduled", "job is running, stop it first"},
+		{"status running", loginAs("alice", false), "running", "job not exist, or job is running"},
+		{"file managed", loginAs("alice", false), "file1", "job is managed by jobs.yaml"},
+		{"owner", loginAs("alice", false), "stopped", ""},
+	}
+	for _, test := range tests {
+		*removed = (*removed)[:0]
+		*audits = (*audits)[:0]
+		var reply int
+		err := test.calc.DeleteJob(test.name, &reply)
+		if len(*audits) != 1 || (*audits)[0].Method != "DeleteJob" {
+			t.Errorf("%s: expected one DeleteJob audit, got %v", test.desc, *audits)
+		}
+		if test.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) || reply != -1 {
+				t.Errorf("%s: expected %q, got %v reply %d", test.desc, test.err, err, reply)
+			}
+			if len(*removed) > 0 {
+				t.Errorf("%s: job should not be removed", test.desc)
+			}
+			continue
+		}
+		if err != nil || reply != 0 || len(*removed) != 1 || (*removed)[0] != test.name {
+			t.Errorf("%s: expected %s removed, got %v %v", test.desc, test.name, err, *removed)
+		}
+	}
+}
+
+func TestStopJobWithMode(t *testing.T) {
+	stubJobs(t,
+		&cron.JobCollection{Name: "stop1", AddPerson: "alice", EditPerson: "bob", ViewPerson: "dave"},
+		&cron.JobCollection{Name: "stop2", AddPerson: "alice"},
+	)
+	_, _, audits := stubJobWrites(t)
+	defer func(set func(string) error) { setStopped = set }(setStopped)
+	stopped := []string{}
+	setStopped = func(name string) error {
+		if name == "stop2" {
+			return mgo.ErrNotFound
+		}
+		stopped = append(stopped, name)
+		return nil
+	}
+
+	tests := []struct {
+		user  string
+		admin bool
+		args  api.StopJobArgs
+		err   string
+	}{
+		{"dave", false, api.StopJobArgs{Name: "stop1"}, ErrPermissionDenied.Error()},
+		{"eve", false, api.StopJobArgs{Name: "stop1"}, ErrPermissionDenied.Error()},
+		{"bob", false, api.StopJobArgs{Name: "stop1", Mode: "pause"}, "Mode must be detach, drain or kill"},
+		{"bob", false, api.StopJobArgs{Name: "stop1", Mode: api.StopDrain, Timeout: -1}, "Timeout must not be negative"},
+		{"bob", false, api.StopJobArgs{Name: "stop1"}, ""},
+		{"alice", false, api.StopJobArgs{Name: "stop1", Mode: api.StopKill}, ""},
+		{"root", true, api.StopJobArgs{Name: "stop2"}, "job not exist, or job is stoped"},
+	}
+	for _, test := range tests {
+		var reply int
+		err := loginAs(test.user, test.admin).StopJobWithMode(&test.args, &reply)
+		if test.err == "" {
+			if err != nil || reply != 0 {
+				t.Errorf("%s stop %+v: %v, reply %d", test.user, test.args, err, reply)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.err || reply != -1 {
+			t.Errorf("%s stop %+v: %v, want %s", test.user, test.args, err, test.err)
+		}
+	}
+	if want := []string{"stop1", "stop1"}; !reflect.DeepEqual(stopped, want) {
+		t.Errorf("stopped %v, want %v", stopped, want)
+	}
+	if len(*audits) != len(tests) {
+		t.Errorf("expected %d audit logs, got %d", len(tests), len(*audits))
+	}
+}
+
+// 测试停止后重新启动的job接管agent上的实例，agent发回结果后从新的job中移除
+func TestAdoptRemoteRun(t *testing.T) {
+	stubJournal(t)
+	defer func(set func(string) error) { setStopped = set }(setStopped)
+	setStopped = func(name string) error { return nil }
+	defer func() {
+		remoteRuns.Lock()
+		remoteRuns.runs = map[string]*remoteRun{}
+		remoteRuns.Unlock()
+	}()
+
+	old, _ := cmd.NewPHPJob(&cmd.PHPEnv{}, handle.Console, 1)
+	if _, err := c.AddJob("adopt1", "", "0 0 0 1 1 ?", old); err != nil {
+		t.Fatal(err)
+	}
+	defer c.RemoveFunc("adopt1")
+	objectId := bson.NewObjectId().Hex()
+	old.Add(&cron.RunInfo{Date: time.Now(), ObjectId: objectId, Agent: "agent1"})
+	done := false
+	remoteRuns.Lock()
+	remoteRuns.runs[objectId] = &remoteRun{"adopt1", "agent1", &bufferLoger{data: map[string]interface{}{}}, func(bool) {
+		old.Remove(objectId)
+		done = true
+	}}
+	remoteRuns.Unlock()
+
+	if err := stopJob("adopt1", api.StopDetach, 0); err != nil {
+		t.Fatal(err)
+	}
+	job, _ := cmd.NewPHPJob(&cmd.PHPEnv{}, handle.Console, 1)
+	if _, err := c.AddJob("adopt1", "", "0 0 0 1 1 ?", job); err != nil {
+		t.Fatal(err)
+	}
+	if list := job.List(); len(list) != 1 || list[0].ObjectId != objectId {
+		t.Fatalf("restarted job should adopt the agent instance, got %v", list)
+	}
+
+	if !finishRemoteRun(objectId, handle.ResultSuccess, "") || !done {
+		t.Fatal("agent run should be finished")
+	}
+	if len(job.List()) != 0 {
+		t.Error("finished agent run should be removed from the restarted job")
+	}
+}
+
+// 测试暂停job，调度列表中没有的job暂停失败时恢复状态并返回错误
+func TestPauseJob(t *testing.T) {
+	stubJobs(t,
+		&cron.JobCollection{Name: "pause1", AddPerson: "alice"},
+		&cron.JobCollection{Name: "pause2", AddPerson: "alice"},
+	)
+	stubJobWrites(t)
+	defer func(set func(string, int, int) error) { setStatus = set }(setStatus)
+	status := map[string]int{"pause1": cron.StatusRunning, "pause2": cron.StatusRunning}
+	setStatus = func(name string, from, to int) error {
+		if status[name] != from {
+			return mgo.ErrNotFound
+		}
+		status[name] = to
+		return nil
+	}
+
+	job, _ := cmd.NewPHPJob(&cmd.PHPEnv{}, handle.Console, 1)
+	if _, err := c.AddJob("pause1", "", "0 0 0 1 1 ?", job); err != nil {
+		t.Fatal(err)
+	}
+	defer c.RemoveFunc("pause1")
+
+	var reply int
+	if err := loginAs("alice", false).PauseJob("pause1", &reply); err != nil || reply != 0 {
+		t.Fatalf("pause scheduled job: %v, reply %d", err, reply)
+	}
+	if status["pause1"] != cron.StatusPaused {
+		t.Errorf("expected pause1 paused, got status %d", status["pause1"])
+	}
+	for _, entry := range c.Entries() {
+		if entry.Name == "pause1" && !entry.Paused {
+			t.Error("expected pause1 entry paused")
+		}
+	}
+
+	err := loginAs("alice", false).PauseJob("pause2", &reply)
+	if err == nil || !strings.Contains(err.Error(), "not scheduled") || reply != -1 {
+		t.Errorf("pause unscheduled job: %v, reply %d", err, reply)
+	}
+	if status["pause2"] != cron.StatusRunning {
+		t.Errorf("expected pause2 status rolled back, got %d", status["pause2"])
+	}
+
+	// 调度列表中没有的job恢复失败时恢复为暂停状态
+	status["pause2"] = cron.StatusPaused
+	err = loginAs("alice", false).ResumeJob(&api.ResumeJobArgs{Name: "pause2"}, &reply)
+	if err == nil || !strings.Contains(err.Error(), "not scheduled") || reply != -1 {
+		t.Errorf("resume unscheduled job: %v, reply %d", err, reply)
+	}
+	if status["pause2"] != cron.StatusPaused {
+		t.Errorf("expected pause2 status rolled back, got %d", status["pause2"])
+	}
+	if err := loginAs("alice", false).ResumeJob(&api.ResumeJobArgs{Name: "pause1"}, &reply); err != nil || reply != 0 {
+		t.Fatalf("resume scheduled job: %v, reply %d", err, reply)
+	}
+	if status["pause1"] != cron.StatusRunning {
+		t.Errorf("expected pause1 running, got status %d", status["pause1"])
+	}
+}
+
+// 测试连接后不发送数据的tls客户端在握手超时后被关闭
+func TestServeConnHandshakeTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { handshakeTimeout = timeout }(handshakeTimeout)
+	handshakeTimeout = 50 * time.Millisecond
+
+	server, client := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		serveConn(tls.Server(server, &tls.Config{}))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("serveConn still waiting for the handshake")
+	}
+}
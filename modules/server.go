@@ -1,22 +1,27 @@
 // server.go
 /**
- 1、StopJob接口会将job从job列表移除，此时job的并发数无法控制。调用StartJob会重新添加job，
-	也会重新控制并发数，此时job的并发数会大于设定值，直到StopJob停止的job实例运行完才会恢复正常
- 2、加载job和快照时，因为无法添加不运行的job。如果先加载快照，会运行job，然后再加载快照实例，这时再加载job，又会运行job。
-	目前流程为先加载job，这时运行job，然后再加载快照实例，此时job并发数会大于设定值，直到快照实例运行完才会恢复正常
+ 1、StopJob接口会将job从job列表移除，正在运行的实例继续运行。调用StartJob重新添加job时，
+	还在运行的命令行实例转入新的job，占用新job的并发数，进程结束后释放
+ 2、加载job和快照时，因为无法添加不运行的job，先加载job，再加载实例日志中的实例。
+	加载的实例占用job的并发数，进程结束后释放，并发数不会超过设定值
 */
 package main
 
 import (
 	"encoding/json"
+	"flag"
+	"fmt"
+	"jcron/modules/config"
 	"jcron/modules/cron"
 	"jcron/modules/handle"
 	"jcron/modules/job/cmd"
-	"jcron/modules/job/web"
 	"jcron/modules/proc"
+	"jcron/modules/shim"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -27,12 +32,23 @@ import (
 //定时任务对象
 var c = cron.New()
 
-//job实例快照
+var (
+	//配置文件路径
+	configPath = flag.String("config", configEnv("JCRON_CONFIG", "conf.json"), "config file, json or yaml (.yaml/.yml), env JCRON_CONFIG")
+	//输出配置后退出
+	printConfig = flag.Bool("print-config", false, "print the effective config with secrets redacted and exit")
+)
+
+//job实例快照，旧版本在退出时保存，现在只用于升级后加载
 type JobInstanceSnapshot struct {
 	//进程id
 	Pid int
 	//进程启动时间
 	Date time.Time
+	//进程所在主机，开启选举时只加载本机的实例
+	Host string
+	//实例日志id，shim启动的实例通过它找到spool目录重新接管
+	ObjectId string
 }
 
 //jobSnapshot集合
@@ -51,122 +67,137 @@ type CurProcess struct {
 }
 
 /**
- * 保存job快照
+ * 保存job快照：把正在运行的实例重新写入实例日志，实例开始和结束时已经写入，这里只更新进程id等信息
+ * 每个实例单独写入，写入失败不影响其他实例，其他节点已成为领导者并写入过的实例日志不会被覆盖
  */
 func SaveJobSnapshot() {
 	log.Printf("SaveJobSnapshot\n")
 
-	// 获取当前正在调度的计划任务
-	entries := c.Entries()
-	if len(entries) > 0 {
-		//保存快照前先清理已有数据，保证每次读取的都是最近一次的有效快照
-		remove := func(c *mgo.Collection) error {
-			_, err := c.RemoveAll(nil)
-			return err
+	// 获取每一个正在调度的计划任务正在运行的实例
+	for _, entry := range c.Entries() {
+		for _, instance := range entry.Job.List() {
+			cron.JournalStart(entry.Name, instance)
+			log.Printf("SaveJobSnapshot Name : %s, ObjectId : %s, Date : %s\n", entry.Name, instance.ObjectId, instance.Date)
 		}
-		err := handle.WitchCollection(handle.Conf.JobDb, handle.Conf.JobSnapshotCollection, remove)
+	}
+}
 
-		for _, entry := range entries {
-			jobSnapshot := &JobSnapshot{}
-			jobSnapshot.Name = entry.Name
+/**
+ * 加载旧版本保存的job快照，并把之前正在运行的实例加入对应的计划任务中进行管理，加载后删除快照
+ */
+func loadLegacySnapshot(entries []*cron.Entry) {
+	var jobSnapshotList []JobSnapshot
+	find := func(c *mgo.Collection) error {
+		return c.Find(bson.M{"instance": bson.M{"$exists": true}}).All(&jobSnapshotList)
+	}
+	err := handle.WitchCollection(handle.Config().JobDb, handle.Config().JobSnapshotCollection, find)
+	if err != nil {
+		log.Printf("Load jobSnapshot Find error: %s\n", err)
+		return
+	}
+	if len(jobSnapshotList) == 0 {
+		return
+	}
 
-			// 获取每一个正在运行的计划任务的实例
-			for _, instance := range entry.Job.List() {
-				//有进程id的实例保存到快照，http请求因为找不到进程id，所以不保存到快照
-				if instance.Proc != nil {
-					err := proc.Exist(instance.Proc.Pid)
+	host, _ := os.Hostname()
+	for _, jobSnapshot := range jobSnapshotList {
+		for _, jobInstanceSnapshot := range jobSnapshot.Instance {
+			for _, entry := range entries {
+				//其他主机上的进程无法管理，旧版本快照没有主机名
+				if jobInstanceSnapshot.Host != "" && jobInstanceSnapshot.Host != host {
+					continue
+				}
+				if jobSnapshot.Name == entry.Name {
+					//shim启动的实例重新读取输出和结果，没有spool目录时按进程id管理
+					if reattach, ok := entry.Job.(reattacher); ok && jobInstanceSnapshot.ObjectId != "" {
+						err := reattach.Reattach(jobInstanceSnapshot.ObjectId, jobInstanceSnapshot.Date)
+						if err == nil {
+							log.Printf("Reattach Name : %s, ObjectId : %s\n", entry.Name, jobInstanceSnapshot.ObjectId)
+							continue
+						}
+						log.Printf("Reattach %s error: %s\n", jobInstanceSnapshot.ObjectId, err)
+					}
+					//_, err := os.FindProcess(jobInstanceSnapshot.Pid)
+					err := proc.Exist(jobInstanceSnapshot.Pid)
 					if err == nil {
-						//正在运行的实例加入到快照中
-						jobSnapshot.Instance = append(jobSnapshot.Instance, JobInstanceSnapshot{instance.Proc.Pid, instance.Date})
-						log.Printf("SaveJobSnapshot Name : %s, ObjectId : %s, Date : %s\n", jobSnapshot.Name, instance.ObjectId, instance.Date)
+						// 获取当前正在执行的任务进程句柄
+						process, _ := os.FindProcess(jobInstanceSnapshot.Pid)
+						runInfo := &cron.RunInfo{
+							Date:     jobInstanceSnapshot.Date,
+							Proc:     process,
+							ObjectId: jobInstanceSnapshot.ObjectId,
+							ExecType: "php",
+						}
+
+						//加载成功后，正在运行的实例加到job的实例列表，并写入实例日志
+						entry.Job.Add(runInfo)
+						cron.JournalStart(entry.Name, runInfo)
 					}
 				}
 			}
-
-			// 将快照插入mongo
-			insert := func(c *mgo.Collection) error {
-				return c.Insert(jobSnapshot)
-			}
-			err = handle.WitchCollection(handle.Conf.JobDb, handle.Conf.JobSnapshotCollection, insert)
-			if err != nil {
-				log.Fatal("SaveJobSnapshot Insert error:", err)
-			}
 		}
 	}
+
+	remove := func(c *mgo.Collection) error {
+		_, err := c.RemoveAll(bson.M{"instance": bson.M{"$exists": true}})
+		return err
+	}
+	if err := handle.WitchCollection(handle.Config().JobDb, handle.Config().JobSnapshotCollection, remove); err != nil {
+		log.Printf("Remove jobSnapshot error: %s\n", err)
+	}
+}
+
+// 能重新接管上一个进程启动的实例的job
+type reattacher interface {
+	Reattach(objectId string, date time.Time) error
 }
 
 /**
- * 加载job和job快照
+ * 加载job和job快照，读取job失败时返回错误
  */
-func LoadJobAndSnapshot() {
+func LoadJobAndSnapshot() error {
 	log.Printf("LoadJobAndSnapshot\n")
+	since := time.Now()
 
 	//加载job
 	var jobList []cron.JobCollection
-	// 获取正在正常进行调度的任务
+	// 获取正在调度的任务，包括暂停的
 	find := func(c *mgo.Collection) error {
-		return c.Find(bson.M{"status": 1}).All(&jobList)
+		return c.Find(bson.M{"status": bson.M{"$in": []int{cron.StatusRunning, cron.StatusPaused}}}).All(&jobList)
 	}
-	err := handle.WitchCollection(handle.Conf.JobDb, handle.Conf.JobCollection, find)
+	err := handle.WitchCollection(handle.Config().JobDb, handle.Config().JobCollection, find)
 	if err != nil {
-		log.Fatal("Load job Find error:", err)
+		return err
 	}
-	var jobObj cron.Job
-	for _, jobData := range jobList {
-		objHandle := handle.NewMongoC(jobData.Name)
-		if jobData.ExecType == "php" {
-			jobObj, err = cmd.NewPHPJob(cmd.DefaultPHP(jobData.ExecEnv), objHandle, jobData.Channel, jobData.Content...)
-			if err != nil {
-				log.Printf("Load job %s error", jobData.Name)
-			}
-		} else if jobData.ExecType == "http" {
-			jobObj, err = web.NewWebJob(objHandle, jobData.Channel, jobData.Content[0])
-			if err != nil {
-				log.Printf("Load job %s error", jobData.Name)
-			}
+	for i := range jobList {
+		jobData := &jobList[i]
+		jobObj, err := newJob(jobData)
+		if err != nil {
+			log.Printf("Load job %s error: %s\n", jobData.Name, err)
+			continue
 		}
-		_, err := c.AddJob(jobData.Name, jobData.Desc, jobData.Cron, jobObj)
+		_, err = c.AddJob(jobData.Name, jobData.Desc, jobData.Cron, jobObj)
 		if err != nil {
 			log.Printf("AddJob %s error", jobData.Name)
+			continue
+		}
+		if err = applyPaused(jobData); err != nil {
+			log.Printf("Pause %s error: %s\n", jobData.Name, err)
 		}
 	}
 
-	//延时一秒读取， 上一个进程关闭调用SaveJobSnapshot需要时间
-	<-time.After(1 * time.Second)
+	//同步job定义文件
+	syncJobFileOnStart()
 
-	//加载jobSnapshot，并把之前正在运行的实例加入当对应的计划任务中进行管理
-	var jobSnapshotList []JobSnapshot
-	find = func(c *mgo.Collection) error {
-		return c.Find(nil).All(&jobSnapshotList)
-	}
-	err = handle.WitchCollection(handle.Conf.JobDb, handle.Conf.JobSnapshotCollection, find)
-	if err != nil {
-		log.Fatal("Load jobSnapshot Find error:", err)
+	//延时一秒读取， 上一个进程关闭调用SaveJobSnapshot需要时间，平滑重启时旧进程已经保存
+	if !handedFrom {
+		<-time.After(1 * time.Second)
 	}
 
-	// 加载当前调度任务快照
+	//按实例日志恢复之前正在运行的实例，旧版本的快照加载后删除
 	entries := c.Entries()
-	for _, jobSnapshot := range jobSnapshotList {
-		for _, jobInstanceSnapshot := range jobSnapshot.Instance {
-			for _, entry := range entries {
-				if jobSnapshot.Name == entry.Name {
-					//_, err := os.FindProcess(jobInstanceSnapshot.Pid)
-					err := proc.Exist(jobInstanceSnapshot.Pid)
-					if err == nil {
-						// 获取当前正在执行的任务进程句柄
-						process, _ := os.FindProcess(jobInstanceSnapshot.Pid)
-						runInfo := &cron.RunInfo{
-							Date: jobInstanceSnapshot.Date,
-							Proc: process,
-						}
-
-						//加载成功后，正在运行的实例加到job的实例列表
-						entry.Job.Add(runInfo)
-					}
-				}
-			}
-		}
-	}
+	loadLegacySnapshot(entries)
+	stopped := loadJournal(entries)
 
 	//输出日志
 	for _, entry := range entries {
@@ -175,35 +206,100 @@ func LoadJobAndSnapshot() {
 			log.Printf("LoadJobAndSnapshot Name : %s, Pid : %d, Date : %s\n", entry.Name, pid, run.Date)
 		}
 	}
+	//没有恢复的运行记录标记为遗弃，已恢复的实例在开始调度前读取，检查运行记录较慢，在后台执行
+	adopted, pids := adoptedRuns(append(entries, stopped...))
+	go recoverRecords(since, adopted, pids)
+	atomic.StoreInt32(&jobsLoaded, 1)
+	return nil
+}
+
+// 读取环境变量，为空时使用默认值
+func configEnv(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+/**
+ * 加载配置，-print-config时输出配置后退出
+ */
+func loadConfig() {
+	conf, err := config.Load(*configPath, os.LookupEnv)
+	if *printConfig {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "\t")
+		encoder.Encode(config.Redact(conf))
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatal("load config error: ", err)
+	}
+	handle.SetConfig(conf)
+}
+
+/**
+ * 设置shim和spool目录，命令行任务通过shim启动，调度程序重启后可以重新接管
+ */
+func setupSpool() {
+	if handle.Config().SpoolPath == "" {
+		return
+	}
+	path, err := os.Executable()
+	if err != nil {
+		log.Printf("shim disabled: %s\n", err)
+		return
+	}
+	spool, err := filepath.Abs(handle.Config().SpoolPath)
+	if err == nil {
+		err = os.MkdirAll(spool, 0755)
+	}
+	if err != nil {
+		log.Fatal("SpoolPath error: ", err)
+	}
+	cmd.ShimPath = path
+	cmd.SpoolPath = spool
 }
 
 /**
  * 初始化
  */
-func init() {
+func setup() {
+	setupSpool()
+	//平滑重启时等待旧进程停止调度并交接
+	handedFrom = waitHandover()
+
+	//加载维护暂停，开始调度前生效，开启选举时成为领导者后再重新加载一次
+	if err := loadMaintenance(); err != nil {
+		log.Printf("Load maintenance error: %s\n", err)
+	}
+
+	//开启选举时由租约保证只有一个节点调度，不再按进程id关闭其他进程
+	if handle.Config().LeaderLease > 0 {
+		startElection()
+		return
+	}
+
 	// 获取当前程序的pid
 	curPid := os.Getpid()
 	log.Printf("Init cur Process %d \n", curPid)
 
-	//加载配置文件
-	file, _ := os.Open("conf.json")
-	decoder := json.NewDecoder(file)
-	err := decoder.Decode(&handle.Conf)
-	if err != nil {
-		log.Fatal("load conf.json error:", err)
-	}
-
 	//关闭正在执行的进程
 	var cur CurProcess
 	find := func(c *mgo.Collection) error {
 		return c.Find(nil).One(&cur)
 	}
-	err = handle.WitchCollection(handle.Conf.JobDb, handle.Conf.CurProcessCollection, find)
+	handle.WitchCollection(handle.Config().JobDb, handle.Config().CurProcessCollection, find)
 
 	pid := cur.Pid
 	if pid > 0 {
+		//平滑重启时旧进程交接后自己退出
 		err := proc.Exist(pid)
-		if err == nil {
+		if err == nil && !handedFrom {
 			proc.Kill(pid)
 		}
 
@@ -211,7 +307,7 @@ func init() {
 		update := func(c *mgo.Collection) error {
 			return c.Update(bson.M{"pid": pid}, bson.M{"$set": bson.M{"pid": curPid, "date": time.Now()}})
 		}
-		err = handle.WitchCollection(handle.Conf.JobDb, handle.Conf.CurProcessCollection, update)
+		err = handle.WitchCollection(handle.Config().JobDb, handle.Config().CurProcessCollection, update)
 		if err != nil {
 			panic(err)
 		}
@@ -221,28 +317,46 @@ func init() {
 		insert := func(c *mgo.Collection) error {
 			return c.Insert(&CurProcess{curPid, time.Now()})
 		}
-		err = handle.WitchCollection(handle.Conf.JobDb, handle.Conf.CurProcessCollection, insert)
+		handle.WitchCollection(handle.Config().JobDb, handle.Config().CurProcessCollection, insert)
 	}
 
 	//加载任务和快照
-	LoadJobAndSnapshot()
+	if err := LoadJobAndSnapshot(); err != nil {
+		log.Fatal("Load job Find error:", err)
+	}
 }
 
 /**
- * 进程接收到SIGTERM信号时，先停止任务，保存job快照，再退出当前进程
+ * 进程接收到SIGTERM信号时，先停止任务，保存job快照，再退出当前进程；接收到SIGHUP信号时热加载
  */
 func HookSignal() {
 	log.Printf("HookSignal\n")
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	//SIGHUP重新加载配置和job
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	go func() {
+		for range hups {
+			reload()
+		}
+	}()
+	//SIGUSR2平滑重启
+	hookHandover()
 	go func() {
 		//等待SIGTERM关闭信号
 		<-sigs
 		//1、停止计划任务
-		c.Stop()
+		stopScheduler()
 		//2、保存job快照
 		SaveJobSnapshot()
-		//3、退出当前进程
+		//3、释放租约，其他节点立即接管
+		if elector != nil {
+			if err := elector.Resign(); err != nil {
+				log.Printf("Resign error: %s\n", err)
+			}
+		}
+		//4、退出当前进程
 		os.Exit(1)
 	}()
 }
@@ -253,8 +367,25 @@ func main() {
 			log.Println(err)
 		}
 	}()
+	//作为shim运行命令行任务
+	if len(os.Args) > 1 && os.Args[1] == shim.Arg {
+		os.Exit(shim.Main(os.Args[2:]))
+	}
+	inheritListeners()
+	flag.Parse()
+	loadConfig()
+	setup()
 	HookSignal()
 	log.Printf("StartServer\n")
-	c.Start()
+	//开启选举时成为领导者后才开始调度
+	if elector == nil {
+		startScheduler()
+	}
+	go watchdog()
+	go journalHeartbeat()
+	go reconciler()
+	go maintenanceMonitor()
+	go agentMonitor()
+	go registerHTTP()
 	registerRPC()
 }
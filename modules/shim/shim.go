@@ -0,0 +1,265 @@
+// 命令行任务的shim进程：启动并等待子进程，把输出写入spool目录、退出状态写入状态文件，
+// 调度程序通过读取spool目录获取输出和结果，重启后可以重新接管
+package shim
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"jcron/modules/api"
+	"jcron/modules/proc"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 调度程序以该参数重新执行自身时作为shim运行
+const Arg = "shim"
+
+// spool目录中的文件
+const (
+	StateFile  = "state.json" // 进程和退出状态
+	OutputFile = "output"     // 输出，每行一个json格式的api.LogItem
+	OffsetFile = "offset"     // 调度程序已读取的输出位置
+)
+
+// 读取输出的间隔
+const watchInterval = 200 * time.Millisecond
+
+// 状态文件内容
+type State struct {
+	//shim进程id和启动时间
+	ShimPid   int
+	ShimStart uint64
+	//子进程id和启动时间，启动失败时为0
+	Pid      int
+	PidStart uint64
+	//子进程启动时间
+	StartTime time.Time
+	//子进程是否已退出
+	Exited bool
+	//退出码，启动失败或被信号杀死时为-1
+	ExitCode int
+	//失败原因，正常退出时为空
+	Error string
+	//退出时间
+	EndTime time.Time
+}
+
+/**
+ * 生成以shim方式运行命令的进程，shimPath为调度程序路径
+ */
+func Command(shimPath, dir, path string, args ...string) *exec.Cmd {
+	return exec.Command(shimPath, append([]string{Arg, dir, path}, args...)...)
+}
+
+/**
+ * 读取状态文件，shim还没有写入时返回nil
+ */
+func ReadState(dir string) (*State, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, StateFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &State{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// 先写临时文件再重命名，读取方不会读到写了一半的状态
+func writeState(dir string, state *State) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, StateFile+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, StateFile))
+}
+
+/**
+ * 进程是否还在运行，进程id和启动时间都一致才认为是同一个进程
+ */
+func Alive(pid int, start uint64) bool {
+	if pid <= 0 || start == 0 {
+		return false
+	}
+	now, err := proc.StartTime(pid)
+	return err == nil && now == start
+}
+
+// 输出文件，标准输出和错误输出并发写入
+type spool struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+// 一种输出的管道
+type spoolPipe struct {
+	spool    *spool
+	fromType int
+}
+
+func (p *spoolPipe) Write(b []byte) (int, error) {
+	data, err := json.Marshal(&api.LogItem{Time: time.Now(), FromType: p.fromType, Content: string(b)})
+	if err != nil {
+		return 0, err
+	}
+	p.spool.lock.Lock()
+	defer p.spool.lock.Unlock()
+	if _, err := p.spool.file.Write(append(data, '\n')); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+/**
+ * shim进程入口，参数为spool目录、执行文件和参数，返回进程退出码
+ */
+func Main(args []string) int {
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: shim <dir> <path> [args...]")
+		return 2
+	}
+	dir := args[0]
+	// 调度程序退出或重启时不影响正在运行的任务
+	signal.Ignore(syscall.SIGHUP, syscall.SIGINT)
+
+	state := &State{ShimPid: os.Getpid(), StartTime: time.Now()}
+	state.ShimStart, _ = proc.StartTime(state.ShimPid)
+	file, err := os.OpenFile(filepath.Join(dir, OutputFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		state.Exited, state.ExitCode, state.Error, state.EndTime = true, -1, err.Error(), time.Now()
+		writeState(dir, state)
+		return 1
+	}
+	defer file.Close()
+	out := &spool{file: file}
+
+	cmd := exec.Command(args[1], args[2:]...)
+	cmd.Stdout = &spoolPipe{out, 0}
+	cmd.Stderr = &spoolPipe{out, 1}
+	if err := cmd.Start(); err != nil {
+		state.Exited, state.ExitCode, state.Error, state.EndTime = true, -1, err.Error(), time.Now()
+		writeState(dir, state)
+		return 1
+	}
+	state.Pid = cmd.Process.Pid
+	state.PidStart, _ = proc.StartTime(state.Pid)
+	writeState(dir, state)
+
+	err = cmd.Wait()
+	state.Exited, state.EndTime = true, time.Now()
+	if err != nil {
+		state.Error = err.Error()
+		state.ExitCode = -1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Exited() {
+				state.ExitCode = status.ExitStatus()
+			}
+		}
+	}
+	if err := writeState(dir, state); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// 增量读取输出文件，记录读取位置
+type reader struct {
+	dir    string
+	offset int64
+}
+
+// 读取保存的读取位置，重新接管时不重复输出
+func newReader(dir string) *reader {
+	r := &reader{dir: dir}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, OffsetFile)); err == nil {
+		r.offset, _ = strconv.ParseInt(string(bytes.TrimSpace(data)), 10, 64)
+	}
+	return r
+}
+
+// 读取新的完整行，写了一半的行下次再读
+func (r *reader) drain(write func(item *api.LogItem)) error {
+	file, err := os.Open(filepath.Join(r.dir, OutputFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Seek(r.offset, io.SeekStart); err != nil {
+		return err
+	}
+	offset := r.offset
+	buf := bufio.NewReader(file)
+	for {
+		line, err := buf.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		offset += int64(len(line))
+		item := &api.LogItem{}
+		if json.Unmarshal(line, item) == nil {
+			write(item)
+		}
+	}
+	if offset == r.offset {
+		return nil
+	}
+	r.offset = offset
+	return ioutil.WriteFile(filepath.Join(r.dir, OffsetFile), []byte(strconv.FormatInt(offset, 10)), 0644)
+}
+
+/**
+ * 持续读取输出直到子进程退出，alive返回shim是否还在运行
+ * 返回最终状态，shim没有记录退出状态就结束时Exited为false。
+ * stop关闭时保存读取位置后返回nil，由其他进程从该位置继续读取
+ */
+func Watch(dir string, alive func() bool, stop <-chan struct{}, write func(item *api.LogItem)) *State {
+	r := newReader(dir)
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		// 先判断是否在运行再读取，保证退出前的输出都被读取
+		running := alive()
+		r.drain(write)
+		state, _ := ReadState(dir)
+		if state != nil && state.Exited {
+			r.drain(write)
+			return state
+		}
+		if !running {
+			if state == nil {
+				state = &State{}
+			}
+			return state
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(watchInterval):
+		}
+	}
+}
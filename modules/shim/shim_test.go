@@ -0,0 +1,109 @@
+package shim
+
+import (
+	"io/ioutil"
+	"jcron/modules/api"
+	"jcron/modules/proc"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestShim(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	code := Main([]string{dir, "/bin/sh", "-c", "echo out; echo err >&2; exit 3"})
+	if code != 0 {
+		t.Fatalf("Main returned %d", code)
+	}
+
+	items := []*api.LogItem{}
+	collect := func(item *api.LogItem) { items = append(items, item) }
+	state := Watch(dir, func() bool { return false }, nil, collect)
+	if !state.Exited || state.ExitCode != 3 || state.Error == "" || state.Pid == 0 {
+		t.Errorf("unexpected state %+v", state)
+	}
+	stdout, stderr := "", ""
+	for _, item := range items {
+		if item.FromType == 0 {
+			stdout += item.Content
+		} else {
+			stderr += item.Content
+		}
+	}
+	if stdout != "out\n" || stderr != "err\n" {
+		t.Errorf("stdout %q, stderr %q", stdout, stderr)
+	}
+
+	// 重新接管时从保存的位置继续读取，不重复输出
+	items = items[:0]
+	Watch(dir, func() bool { return false }, nil, collect)
+	if len(items) != 0 {
+		t.Errorf("output read twice: %v", items)
+	}
+}
+
+// 测试停止读取后返回nil，其他进程从保存的位置继续读取
+func TestWatchStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, OutputFile), []byte(`{"FromType":0,"Content":"a"}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	items := []*api.LogItem{}
+	collect := func(item *api.LogItem) { items = append(items, item) }
+	stop := make(chan struct{})
+	time.AfterFunc(50*time.Millisecond, func() { close(stop) })
+	if state := Watch(dir, func() bool { return true }, stop, collect); state != nil {
+		t.Fatalf("stopped watch should return nil, got %+v", state)
+	}
+	if len(items) != 1 {
+		t.Fatalf("expected 1 item before stop, got %v", items)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, OutputFile), []byte(`{"FromType":0,"Content":"a"}`+"\n"+`{"FromType":1,"Content":"b"}`+"\n"), 0644)
+	items = items[:0]
+	Watch(dir, func() bool { return false }, nil, collect)
+	if len(items) != 1 || items[0].Content != "b" {
+		t.Errorf("watch after stop should continue from the saved offset, got %v", items)
+	}
+}
+
+func TestStartFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if code := Main([]string{dir, "/not/exist"}); code != 1 {
+		t.Errorf("Main returned %d, want 1", code)
+	}
+	state, err := ReadState(dir)
+	if err != nil || state == nil || !state.Exited || state.ExitCode != -1 || state.Error == "" {
+		t.Errorf("unexpected state %+v, %v", state, err)
+	}
+}
+
+func TestAlive(t *testing.T) {
+	pid := os.Getpid()
+	start, err := proc.StartTime(pid)
+	if err != nil {
+		t.Skip(err)
+	}
+	if !Alive(pid, start) {
+		t.Error("current process should be alive")
+	}
+	if Alive(pid, start+1) {
+		t.Error("mismatched start time should not be alive")
+	}
+}
@@ -0,0 +1,4 @@
+package main
+
+// windows没有SIGUSR2，不支持平滑重启
+func hookHandover() {}
@@ -0,0 +1,175 @@
+// 运行中实例的输出广播，写入方不会被读取方阻塞
+package stream
+
+import (
+	"context"
+	"jcron/modules/api"
+	"sync"
+	"time"
+)
+
+// 每个实例在内存中保留的最大日志条数，跟不上的读取方会跳过最早的日志
+const maxItems = 10000
+
+// 实例结束后在内存中保留的时间，之后从数据库回放
+const retention = time.Minute
+
+// 超过该时间没有写入的输出流从内存中删除，避免没有正常结束的实例一直占用内存，读取方转为从数据库轮询
+const idleTimeout = time.Hour
+
+// 检查空闲输出流的间隔
+const sweepInterval = time.Minute
+
+// 一个实例的输出
+type Stream struct {
+	key      string // 在hub中的键，由job名称和实例id组成
+	lock     sync.Mutex
+	items    []api.LogItem
+	offset   int           // items[0]的绝对序号
+	base     int           // 创建时的序号，之前的输出只在数据库中
+	last     time.Time     // 最后写入时间
+	notify   chan struct{} // 有新输出或结束时关闭
+	finished bool
+}
+
+var (
+	hubLock   sync.Mutex
+	hub       = map[string]*Stream{} // 按job名称和实例id保存，只能通过实例所属的job读取
+	sweepOnce sync.Once
+)
+
+// hub中的键，job名称不能包含\x00
+func hubKey(name, objectId string) string {
+	return name + "\x00" + objectId
+}
+
+// 实例启动时创建输出流，name为实例所属的job名称
+func Open(name, objectId string) *Stream {
+	return Attach(name, objectId, 0)
+}
+
+/**
+ * 获取实例的输出流，已存在时复用，否则创建从offset序号开始的输出流，
+ * 重新接管的实例以数据库中已有的日志条数作为offset
+ */
+func Attach(name, objectId string, offset int) *Stream {
+	sweepOnce.Do(func() {
+		go func() {
+			for range time.Tick(sweepInterval) {
+				sweep(time.Now())
+			}
+		}()
+	})
+	hubLock.Lock()
+	defer hubLock.Unlock()
+	key := hubKey(name, objectId)
+	if s := hub[key]; s != nil {
+		return s
+	}
+	s := &Stream{key: key, notify: make(chan struct{}), offset: offset, base: offset, last: time.Now()}
+	hub[key] = s
+	return s
+}
+
+// 删除超过idleTimeout没有写入且没有结束的输出流
+func sweep(now time.Time) {
+	hubLock.Lock()
+	defer hubLock.Unlock()
+	for key, s := range hub {
+		s.lock.Lock()
+		idle := !s.finished && now.Sub(s.last) > idleTimeout
+		s.lock.Unlock()
+		if idle {
+			delete(hub, key)
+		}
+	}
+}
+
+// 获取job的实例的输出流，实例不在内存中或不属于该job时返回nil
+func Get(name, objectId string) *Stream {
+	hubLock.Lock()
+	defer hubLock.Unlock()
+	return hub[hubKey(name, objectId)]
+}
+
+// 写入一条输出，通知所有读取方
+func (s *Stream) Write(fromType int, p []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.finished {
+		return
+	}
+	s.last = time.Now()
+	s.items = append(s.items, api.LogItem{Time: s.last, FromType: fromType, Content: string(p)})
+	if len(s.items) > maxItems {
+		drop := len(s.items) - maxItems
+		s.items = append([]api.LogItem{}, s.items[drop:]...)
+		s.offset += drop
+	}
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+// 实例结束，保留一段时间后从内存中删除
+func (s *Stream) Close() {
+	s.lock.Lock()
+	if !s.finished {
+		s.finished = true
+		close(s.notify)
+	}
+	s.lock.Unlock()
+	time.AfterFunc(retention, func() {
+		hubLock.Lock()
+		if hub[s.key] == s {
+			delete(hub, s.key)
+		}
+		hubLock.Unlock()
+	})
+}
+
+// 创建时的序号，小于该序号的输出需要从数据库读取
+func (s *Stream) Base() int {
+	return s.base
+}
+
+// 当前输出的结束序号
+func (s *Stream) Tail() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.offset + len(s.items)
+}
+
+/**
+ * 读取from序号之后的输出，没有新输出时最多等待wait，ctx结束时（如客户端断开）立即返回，
+ * 返回输出、下次读取的序号和实例是否已结束
+ */
+func (s *Stream) Read(ctx context.Context, from int, wait time.Duration) ([]api.LogItem, int, bool) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		s.lock.Lock()
+		if from < s.offset {
+			from = s.offset
+		}
+		end := s.offset + len(s.items)
+		if from < end || s.finished {
+			items := []api.LogItem{}
+			if from < end {
+				items = append(items, s.items[from-s.offset:]...)
+			}
+			finished := s.finished
+			s.lock.Unlock()
+			return items, end, finished
+		}
+		notify := s.notify
+		s.lock.Unlock()
+
+		select {
+		case <-notify:
+		case <-timer.C:
+			return []api.LogItem{}, from, false
+		case <-ctx.Done():
+			return []api.LogItem{}, from, false
+		}
+	}
+}
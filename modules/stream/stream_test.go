@@ -0,0 +1,144 @@
+package stream
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 测试多个读取方同时读取，结束后返回finished
+func TestFollow(t *testing.T) {
+	s := Open("job", "TestFollow")
+	s.Write(0, []byte("a"))
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			content := ""
+			from := 0
+			for {
+				items, next, finished := s.Read(context.Background(), from, time.Second)
+				for _, item := range items {
+					content += item.Content
+				}
+				from = next
+				if finished {
+					break
+				}
+			}
+			if content != "abc" {
+				t.Errorf("expected abc, got %q", content)
+			}
+		}()
+	}
+
+	<-time.After(10 * time.Millisecond)
+	s.Write(0, []byte("b"))
+	s.Write(1, []byte("c"))
+	s.Close()
+	wg.Wait()
+
+	if Get("job", "TestFollow") != s {
+		t.Fatal("finished stream should be kept for a while")
+	}
+}
+
+// 测试从当前位置开始读取、超时和取消
+func TestReadTail(t *testing.T) {
+	s := Open("job", "TestReadTail")
+	s.Write(0, []byte("old"))
+	items, next, finished := s.Read(context.Background(), s.Tail(), 10*time.Millisecond)
+	if len(items) != 0 || next != 1 || finished {
+		t.Fatalf("unexpected read %v %d %v", items, next, finished)
+	}
+	s.Write(0, []byte("new"))
+	items, _, _ = s.Read(context.Background(), next, time.Second)
+	if len(items) != 1 || items[0].Content != "new" {
+		t.Fatalf("unexpected items %v", items)
+	}
+
+	// 读取方断开时不等到超时
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	items, next, _ = s.Read(ctx, s.Tail(), time.Minute)
+	if len(items) != 0 || next != 2 || time.Since(start) > time.Second {
+		t.Fatalf("read not cancelled: %v %d after %s", items, next, time.Since(start))
+	}
+}
+
+// 测试超出最大条数时丢弃最早的输出
+func TestReadOverflow(t *testing.T) {
+	s := Open("job", "TestReadOverflow")
+	for i := 0; i < maxItems+10; i++ {
+		s.Write(0, []byte("x"))
+	}
+	items, next, _ := s.Read(context.Background(), 0, time.Millisecond)
+	if len(items) != maxItems || next != maxItems+10 {
+		t.Fatalf("unexpected read %d %d", len(items), next)
+	}
+}
+
+// 测试重新接管时复用已有的输出流，新建的输出流从已保存的条数开始编号
+func TestAttach(t *testing.T) {
+	s := Open("job", "TestAttach")
+	s.Write(0, []byte("a"))
+	if Attach("job", "TestAttach", 5) != s {
+		t.Fatal("existing stream should be reused")
+	}
+	if s.Tail() != 1 {
+		t.Fatalf("existing stream offset changed, tail is %d", s.Tail())
+	}
+
+	s = Attach("job", "TestAttachNew", 3)
+	if s.Base() != 3 || s.Tail() != 3 {
+		t.Fatalf("unexpected base %d tail %d", s.Base(), s.Tail())
+	}
+	s.Write(0, []byte("d"))
+	items, next, _ := s.Read(context.Background(), 0, time.Millisecond)
+	if len(items) != 1 || items[0].Content != "d" || next != 4 {
+		t.Fatalf("unexpected read %v %d", items, next)
+	}
+}
+
+// 测试长时间没有写入且没有结束的输出流被删除，已结束的按保留时间删除
+func TestSweep(t *testing.T) {
+	idle := Open("job", "TestSweepIdle")
+	finished := Open("job", "TestSweepFinished")
+	finished.Close()
+	active := Open("job", "TestSweepActive")
+
+	later := time.Now().Add(idleTimeout + time.Second)
+	active.lock.Lock()
+	active.last = later
+	active.lock.Unlock()
+	sweep(later)
+	if Get("job", "TestSweepIdle") != nil {
+		t.Error("idle stream should be removed")
+	}
+	if Get("job", "TestSweepFinished") != finished {
+		t.Error("finished stream should be kept until retention")
+	}
+	if Get("job", "TestSweepActive") != active {
+		t.Error("active stream should be kept")
+	}
+	idle.Write(0, []byte("x"))
+}
+
+// 测试输出流只能通过实例所属的job获取
+func TestGetOtherJob(t *testing.T) {
+	s := Open("jobB", "TestGetOtherJob")
+	defer s.Close()
+	if Get("jobB", "TestGetOtherJob") != s {
+		t.Fatal("stream should be found by its own job")
+	}
+	if Get("jobA", "TestGetOtherJob") != nil {
+		t.Error("stream should not be found by another job")
+	}
+	if Attach("jobA", "TestGetOtherJob", 0) == s {
+		t.Error("another job should not reuse the stream")
+	}
+}
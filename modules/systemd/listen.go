@@ -0,0 +1,52 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+)
+
+// socket激活传入的第一个文件描述符
+const ListenFdsStart = 3
+
+// 解析LISTEN_PID和LISTEN_FDS，LISTEN_PID不是当前进程时返回0
+func listenFds(pid, fds string, self int) int {
+	if pid == "" || pid != strconv.Itoa(self) {
+		return 0
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+/**
+ * 返回systemd socket激活传入的监听，没有通过socket激活启动时返回空
+ * 读取后清除环境变量，子进程不会重复使用
+ */
+func Listeners() ([]net.Listener, error) {
+	n := listenFds(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getpid())
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	return FileListeners(ListenFdsStart, n)
+}
+
+/**
+ * 把从start开始的n个继承的文件描述符转换为监听
+ */
+func FileListeners(start, n int) ([]net.Listener, error) {
+	listeners := []net.Listener{}
+	for fd := start; fd < start+n; fd++ {
+		file := os.NewFile(uintptr(fd), "listener"+strconv.Itoa(fd))
+		listener, err := net.FileListener(file)
+		// FileListener复制了文件描述符，原来的可以关闭
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
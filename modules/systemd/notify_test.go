@@ -0,0 +1,81 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 测试向NOTIFY_SOCKET发送状态
+func TestNotify(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	if sent, err := Notify(Ready); sent || err != nil {
+		t.Fatalf("expected not sent without NOTIFY_SOCKET, got %v %v", sent, err)
+	}
+
+	dir, err := ioutil.TempDir("", "notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", path)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	if sent, err := Notify(Ready); !sent || err != nil {
+		t.Fatalf("expected sent, got %v %v", sent, err)
+	}
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != Ready {
+		t.Fatalf("expected %q, got %q", Ready, buf[:n])
+	}
+}
+
+// 测试看门狗超时时间
+func TestWatchdogTimeout(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if d := WatchdogTimeout(); d != 30*time.Second {
+		t.Fatalf("expected 30s, got %s", d)
+	}
+	os.Setenv("WATCHDOG_PID", "1")
+	if d := WatchdogTimeout(); d != 0 {
+		t.Fatalf("expected 0 for other pid, got %s", d)
+	}
+}
+
+// 测试解析socket激活的环境变量
+func TestListenFds(t *testing.T) {
+	cases := []struct {
+		pid, fds string
+		want     int
+	}{
+		{"", "2", 0},
+		{"100", "2", 2},
+		{"101", "2", 0},
+		{"100", "x", 0},
+		{"100", "-1", 0},
+	}
+	for _, c := range cases {
+		if got := listenFds(c.pid, c.fds, 100); got != c.want {
+			t.Errorf("listenFds(%q, %q) = %d, want %d", c.pid, c.fds, got, c.want)
+		}
+	}
+}